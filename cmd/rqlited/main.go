@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 
@@ -236,8 +237,12 @@ func main() {
 		apiProto = "https"
 	}
 	meta := map[string]string{
-		"api_addr":  apiAdv,
-		"api_proto": apiProto,
+		"api_addr":             apiAdv,
+		"api_proto":            apiProto,
+		store.FormatVersionKey: strconv.Itoa(str.FormatVersion()),
+	}
+	if str.Learner() {
+		meta[store.LearnerKey] = "true"
 	}
 
 	// Execute any requested join operation.
@@ -3,11 +3,18 @@
 package db
 
 import (
+	"context"
 	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
 	"io"
+	"math"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mattn/go-sqlite3"
@@ -15,10 +22,21 @@ import (
 
 const bkDelay = 250
 
+// bkStepPages is the number of pages copied in each step of a backup which
+// reports its progress.
+const bkStepPages = 1024
+
 const (
-	fkChecks         = "PRAGMA foreign_keys"
-	fkChecksEnabled  = "PRAGMA foreign_keys=ON"
-	fkChecksDisabled = "PRAGMA foreign_keys=OFF"
+	fkChecks          = "PRAGMA foreign_keys"
+	fkChecksEnabled   = "PRAGMA foreign_keys=ON"
+	fkChecksDisabled  = "PRAGMA foreign_keys=OFF"
+	busyTimeout       = "PRAGMA busy_timeout"
+	journalMode       = "PRAGMA journal_mode"
+	pageCount         = "PRAGMA page_count"
+	pageSize          = "PRAGMA page_size"
+	walCheckpoint     = "PRAGMA wal_checkpoint(TRUNCATE)"
+	queryOnlyEnabled  = "PRAGMA query_only=ON"
+	queryOnlyDisabled = "PRAGMA query_only=OFF"
 
 	numExecutions      = "executions"
 	numExecutionErrors = "execution_errors"
@@ -27,6 +45,23 @@ const (
 	numQTx             = "query_transactions"
 )
 
+// ErrStatementTimeout is set as the error of any statement which does not
+// complete within its allowed time.
+var ErrStatementTimeout = errors.New("statement timed out")
+
+// ErrDryRunTransactionControl is returned when a dry run includes a
+// statement which would begin or end a transaction, as any statement after it
+// would then change the database.
+var ErrDryRunTransactionControl = errors.New("transaction control statement not allowed in dry run")
+
+// ErrDryRunTransactionEnded is returned when the transaction of a dry run
+// ends before all its statements are executed.
+var ErrDryRunTransactionEnded = errors.New("dry run transaction ended")
+
+// ErrTransactionActive is returned when an operation which cannot run
+// inside a transaction is attempted while one is active.
+var ErrTransactionActive = errors.New("transaction is active")
+
 // DBVersion is the SQLite version.
 var DBVersion string
 
@@ -44,29 +79,113 @@ func init() {
 
 }
 
+// contextExecer is implemented by connections which can execute statements
+// that modify the database, honoring a context.
+type contextExecer interface {
+	ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error)
+}
+
 // DB is the SQL database.
 type DB struct {
 	sqlite3conn *sqlite3.SQLiteConn // Driver connection to database.
 	path        string              // Path to database file.
 	dsn         string              // DSN, if any.
 	memory      bool                // In-memory only.
+
+	// mu is held for reading by queries, which run with query_only set on
+	// the connection, and for writing by every operation which may change
+	// the database. query_only is left set once the queries finish, and
+	// only cleared by the next change, as setting it expires every prepared
+	// statement. queryOnly records whether it is set, and readersMu guards
+	// it while queries run.
+	mu        sync.RWMutex
+	readersMu sync.Mutex
+	queryOnly bool
+
+	coerceIntegers bool // Whether integral float64 parameters are bound as int64.
+
+	stmts *stmtCache // Prepared statements of queries, nil if not cached.
+
+	rowCounts *rowCounter // Rows in each table, nil until first requested.
 }
 
-// Result represents the outcome of an operation that changes rows.
+// Result represents the outcome of an operation that changes rows. Each
+// statement executed has its own Result, so every INSERT in a request reports
+// the ID of the row it inserted in LastInsertID. If the operation failed,
+// ErrorCode carries the SQLite extended result code, if any. If the operation
+// was made through a replicated log, RaftIndex is the index of the log entry
+// which carried it. For a CREATE, DROP or ALTER statement, Changed is set if
+// the statement changed the schema, so that, for example, a CREATE TABLE IF
+// NOT EXISTS reports whether it created the table. None of ErrorCode,
+// RaftIndex and Changed are included in the JSON encoding, so that encoding
+// is unchanged for existing clients. A PRAGMA
+// statement may return rows, such as the outcome of integrity_check, so if a
+// statement is a single PRAGMA, the columns and rows it returns are set in
+// Columns and Values.
 type Result struct {
-	LastInsertID int64   `json:"last_insert_id,omitempty"`
-	RowsAffected int64   `json:"rows_affected,omitempty"`
-	Error        string  `json:"error,omitempty"`
-	Time         float64 `json:"time,omitempty"`
+	LastInsertID int64           `json:"last_insert_id,omitempty"`
+	RowsAffected int64           `json:"rows_affected,omitempty"`
+	Columns      []string        `json:"columns,omitempty"`
+	Values       [][]interface{} `json:"values,omitempty"`
+	ChangedRows  []ChangedRow    `json:"changed_rows,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	ErrorCode    int             `json:"-"`
+	RaftIndex    uint64          `json:"-"`
+	Changed      bool            `json:"-"`
+	Time         float64         `json:"time,omitempty"`
 }
 
-// Rows represents the outcome of an operation that returns query data.
+// ChangedRow identifies a row updated or deleted by a statement, including
+// by any trigger the statement fired. Op is "update" or "delete".
+type ChangedRow struct {
+	Op    string `json:"op"`
+	Table string `json:"table"`
+	RowID int64  `json:"rowid"`
+}
+
+// Rows represents the outcome of an operation that returns query data. Types
+// holds the declared type of each column, in lower case, so that clients can
+// tell, for example, INTEGER from TEXT or BLOB columns. Columns without a
+// declared type, such as expressions and NULL literals, have a blank type. As
+// with Result, any SQLite extended result code is set in ErrorCode. If the
+// query was limited to a maximum number of rows, and returned more, Truncated
+// is set and only the first rows are included. StaleFor is set by the layer
+// above to how stale the database read may have been, ServedByLeader to
+// whether the rows were read on the leader, Checksum, if requested, to a
+// checksum of the columns and values, and Total to the number of rows
+// without any LIMIT. None of ErrorCode, StaleFor and ServedByLeader are
+// included in the JSON encoding. A NULL value is nil in Values, and so
+// encoded as JSON null, distinct from an empty string or blob.
 type Rows struct {
-	Columns []string        `json:"columns,omitempty"`
-	Types   []string        `json:"types,omitempty"`
-	Values  [][]interface{} `json:"values,omitempty"`
-	Error   string          `json:"error,omitempty"`
-	Time    float64         `json:"time,omitempty"`
+	Columns        []string                 `json:"columns,omitempty"`
+	Types          []string                 `json:"types,omitempty"`
+	Values         [][]interface{}          `json:"values,omitempty"`
+	Maps           []map[string]interface{} `json:"rows,omitempty"`
+	Truncated      bool                     `json:"truncated,omitempty"`
+	Error          string                   `json:"error,omitempty"`
+	ErrorCode      int                      `json:"-"`
+	StaleFor       time.Duration            `json:"-"`
+	ServedByLeader bool                     `json:"-"`
+	Time           float64                  `json:"time,omitempty"`
+	Checksum       string                   `json:"checksum,omitempty"`
+	Total          *int64                   `json:"total,omitempty"`
+}
+
+// MakeAssociative converts the rows to associative form, replacing Values
+// with Maps, where each row is keyed by column name. Duplicate column names,
+// as may result from a join, are made unique by appending a suffix of the
+// form ":N" to all but the first occurrence.
+func (r *Rows) MakeAssociative() {
+	keys := uniqueColumnNames(r.Columns)
+	r.Maps = make([]map[string]interface{}, len(r.Values))
+	for i, v := range r.Values {
+		m := make(map[string]interface{}, len(keys))
+		for j := range keys {
+			m[keys[j]] = v[j]
+		}
+		r.Maps[i] = m
+	}
+	r.Values = nil
 }
 
 // Statement represents a single parameterized statement for processing
@@ -122,6 +241,7 @@ func LoadInMemoryWithDSN(dbPath, dsn string) (*DB, error) {
 
 // Close closes the underlying database connection.
 func (db *DB) Close() error {
+	db.stmts.clear()
 	return db.sqlite3conn.Close()
 }
 
@@ -144,6 +264,8 @@ func (db *DB) EnableFKConstraints(e bool) error {
 	if !e {
 		q = fkChecksDisabled
 	}
+	db.lock()
+	defer db.mu.Unlock()
 	_, err := db.sqlite3conn.Exec(q, nil)
 	return err
 }
@@ -168,6 +290,105 @@ func (db *DB) FKConstraints() (bool, error) {
 	return false, nil
 }
 
+// SetBusyTimeout sets the busy timeout, in milliseconds, of the database
+// connection.
+func (db *DB) SetBusyTimeout(ms int) error {
+	db.lock()
+	defer db.mu.Unlock()
+	_, err := db.sqlite3conn.Exec(fmt.Sprintf("%s=%d", busyTimeout, ms), nil)
+	return err
+}
+
+// BusyTimeout returns the busy timeout, in milliseconds, of the database
+// connection.
+func (db *DB) BusyTimeout() (int, error) {
+	r, err := db.QueryStringStmt(busyTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if len(r) != 1 || len(r[0].Values) != 1 {
+		return 0, fmt.Errorf("unexpected busy timeout result")
+	}
+	return int(r[0].Values[0][0].(int64)), nil
+}
+
+// SetPragma sets the named pragma to value on the database connection.
+func (db *DB) SetPragma(name, value string) error {
+	db.lock()
+	defer db.mu.Unlock()
+	_, err := db.sqlite3conn.Exec(fmt.Sprintf("PRAGMA %s=%s", name, value), nil)
+	return err
+}
+
+// SetJournalMode sets the journal mode, such as "DELETE" or "WAL", of the
+// database. An error is returned if SQLite does not switch to the requested
+// mode.
+func (db *DB) SetJournalMode(mode string) error {
+	db.lock()
+	_, err := db.sqlite3conn.Exec(fmt.Sprintf("%s=%s", journalMode, mode), nil)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m, err := db.JournalMode()
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(m, mode) {
+		return fmt.Errorf("failed to set journal mode to %s, mode is %s", mode, m)
+	}
+	return nil
+}
+
+// JournalMode returns the journal mode of the database, in lower case.
+func (db *DB) JournalMode() (string, error) {
+	r, err := db.QueryStringStmt(journalMode)
+	if err != nil {
+		return "", err
+	}
+	if len(r) != 1 || len(r[0].Values) != 1 {
+		return "", fmt.Errorf("unexpected journal mode result")
+	}
+	m, ok := r[0].Values[0][0].(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected journal mode result")
+	}
+	return m, nil
+}
+
+// Pages returns the number of pages in the database, and the size of each
+// page in bytes. Their product is the size of the database, whether it is
+// in memory or on disk, including any pages still in the write-ahead log.
+func (db *DB) Pages() (count int64, size int64, err error) {
+	r, err := db.Query([]Statement{{pageCount, nil}, {pageSize, nil}}, false, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(r) != 2 || len(r[0].Values) != 1 || len(r[1].Values) != 1 {
+		return 0, 0, fmt.Errorf("unexpected page stats result")
+	}
+	count, ok := r[0].Values[0][0].(int64)
+	if !ok {
+		return 0, 0, fmt.Errorf("unexpected page count result")
+	}
+	size, ok = r[1].Values[0][0].(int64)
+	if !ok {
+		return 0, 0, fmt.Errorf("unexpected page size result")
+	}
+	return count, size, nil
+}
+
+// Checkpoint copies all content of the write-ahead log into the database
+// file, and truncates the log. It is a no-op unless the database is in WAL
+// journal mode.
+func (db *DB) Checkpoint() error {
+	db.lock()
+	defer db.mu.Unlock()
+	_, err := db.sqlite3conn.Exec(walCheckpoint, nil)
+	return err
+}
+
 // TransactionActive returns whether a transaction is currently active
 // i.e. if the database is NOT in autocommit mode.
 func (db *DB) TransactionActive() bool {
@@ -191,26 +412,126 @@ func (db *DB) ExecuteStringStmt(query string) ([]*Result, error) {
 
 // Execute executes queries that modify the database.
 func (db *DB) Execute(stmts []Statement, tx, xTime bool) ([]*Result, error) {
+	return db.ExecuteWithContext(context.Background(), stmts, tx, xTime)
+}
+
+// ExecuteWithContext executes queries that modify the database. If ctx is
+// done before all statements are processed, processing stops, any transaction
+// is rolled back, and ctx.Err() is returned.
+func (db *DB) ExecuteWithContext(ctx context.Context, stmts []Statement, tx, xTime bool) ([]*Result, error) {
+	return db.execute(ctx, stmts, tx, xTime, 0, 0, false, false)
+}
+
+// ExecuteWithTimeout executes queries that modify the database. Any single
+// statement which runs for longer than timeout is interrupted, and its result
+// carries ErrStatementTimeout as the error. As with any other statement error,
+// subsequent statements are still executed, unless tx is set, in which case
+// the entire transaction is rolled back. A zero timeout means no timeout.
+func (db *DB) ExecuteWithTimeout(stmts []Statement, tx, xTime bool, timeout time.Duration) ([]*Result, error) {
+	return db.execute(context.Background(), stmts, tx, xTime, timeout, 0, false, false)
+}
+
+// ExecuteWithStepLimit executes queries that modify the database. Any single
+// statement which executes more than about steps SQLite virtual machine
+// instructions is interrupted, and its result carries ErrStatementTimeout as
+// the error. Unlike a timeout, the limit interrupts a statement at the same
+// point whenever it is executed on the same database, however fast the
+// machine, so it may be applied to statements which must have the same
+// outcome on every copy of a database. As with any other statement error,
+// subsequent statements are still executed, unless tx is set, in which case
+// the entire transaction is rolled back. A zero limit means no limit.
+func (db *DB) ExecuteWithStepLimit(stmts []Statement, tx, xTime bool, steps int64) ([]*Result, error) {
+	return db.execute(context.Background(), stmts, tx, xTime, 0, steps, false, false)
+}
+
+// ExecuteReturningChanges executes queries as ExecuteWithStepLimit does, but
+// also sets ChangedRows on the result of each statement to the rows it
+// updated or deleted. The rows are reported by SQLite as they change, so no
+// RETURNING clause, and no particular SQLite version, is required. SQLite
+// does not report rows of WITHOUT ROWID tables, rows deleted by a DELETE
+// without a WHERE clause, which are truncated instead, or rows replaced
+// because of a conflict.
+func (db *DB) ExecuteReturningChanges(stmts []Statement, tx, xTime bool, steps int64) ([]*Result, error) {
+	return db.execute(context.Background(), stmts, tx, xTime, 0, steps, false, true)
+}
+
+// ExecuteDryRun executes queries inside a transaction which is always rolled
+// back, so the database is never modified. The results are those the
+// statements would have returned if executed within a transaction. Should
+// SQLite end the transaction itself, as it does when a change is interrupted,
+// processing stops, and ErrDryRunTransactionEnded is returned with the
+// results so far. Statements which begin or end a
+// transaction are refused, with ErrDryRunTransactionControl, before any
+// statement is executed. SAVEPOINT, RELEASE and ROLLBACK TO statements are
+// allowed, as they nest within the transaction.
+func (db *DB) ExecuteDryRun(stmts []Statement, xTime bool, timeout time.Duration) ([]*Result, error) {
+	for _, stmt := range stmts {
+		if txControlStmt(stmt.Query) {
+			return nil, ErrDryRunTransactionControl
+		}
+	}
+	return db.execute(context.Background(), stmts, true, xTime, timeout, 0, true, false)
+}
+
+// execute executes stmts, each limited to timeout and to steps, if non-zero.
+// If dryRun is set, tx must also be set, and the transaction is rolled back
+// once all statements are processed. If changes is set, the rows changed by
+// each statement are set on its result.
+func (db *DB) execute(ctx context.Context, stmts []Statement, tx, xTime bool, timeout time.Duration, steps int64, dryRun, changes bool) ([]*Result, error) {
+	db.lock()
+	defer db.mu.Unlock()
+
+	// Rows counted before a rollback to a savepoint are not discounted by
+	// SQLite, so every table is counted again.
+	altered, recount := false, false
+	for _, stmt := range stmts {
+		if altersSchema(stmt.Query) {
+			db.stmts.clear()
+			altered = true
+			recount = recount || strings.Contains(strings.ToUpper(stmt.Query), "DROP")
+		}
+		if _, rollback := savepointStmt(stmt.Query); rollback {
+			altered, recount = true, true
+		}
+	}
+
+	var changed []ChangedRow
+	if changes {
+		db.sqlite3conn.RegisterUpdateHook(func(op int, dbName string, table string, rowid int64) {
+			if db.rowCounts != nil {
+				db.rowCounts.update(op, dbName, table, rowid)
+			}
+			switch op {
+			case sqlite3.SQLITE_UPDATE:
+				changed = append(changed, ChangedRow{Op: "update", Table: table, RowID: rowid})
+			case sqlite3.SQLITE_DELETE:
+				changed = append(changed, ChangedRow{Op: "delete", Table: table, RowID: rowid})
+			}
+		})
+		defer db.registerUpdateHook()
+	}
+
 	stats.Add(numExecutions, int64(len(stmts)))
 	if tx {
 		stats.Add(numETx, 1)
 	}
 
-	type Execer interface {
-		Exec(query string, args []driver.Value) (driver.Result, error)
-	}
-
 	var allResults []*Result
 	err := func() error {
-		var execer Execer
+		var execer contextExecer
 		var rollback bool
 		var t driver.Tx
 		var err error
 
+		// The limit is removed before the transaction ends, so that it
+		// cannot interrupt the commit.
+		limit := newStepLimit(db.sqlite3conn, steps)
+
 		// Check for the err, if set rollback.
 		defer func() {
+			limit.close()
 			if t != nil {
-				if rollback {
+				if rollback || dryRun {
 					t.Rollback()
 					return
 				}
@@ -224,6 +545,7 @@ func (db *DB) Execute(stmts []Statement, tx, xTime bool) ([]*Result, error) {
 			stats.Add(numExecutionErrors, 1)
 
 			result.Error = err.Error()
+			result.ErrorCode = errorCode(err)
 			allResults = append(allResults, result)
 			if tx {
 				rollback = true // Will trigger the rollback.
@@ -243,8 +565,16 @@ func (db *DB) Execute(stmts []Statement, tx, xTime bool) ([]*Result, error) {
 			}
 		}
 
-		// Execute each query.
+		// Execute each query. A dry run must not outlive its transaction,
+		// as statements after it would change the database.
 		for _, stmt := range stmts {
+			if dryRun && !db.TransactionActive() {
+				return ErrDryRunTransactionEnded
+			}
+			if err := ctx.Err(); err != nil {
+				rollback = true
+				return err
+			}
 			if stmt.Query == "" {
 				continue
 			}
@@ -252,16 +582,65 @@ func (db *DB) Execute(stmts []Statement, tx, xTime bool) ([]*Result, error) {
 			result := &Result{}
 			start := time.Now()
 
-			r, err := execer.Exec(stmt.Query, stmt.Parameters)
+			changed = nil
+			limit.reset()
+			stmt.Parameters = db.coerceParameters(stmt.Parameters)
+			if isPragma(stmt.Query) {
+				if err := db.queryPragma(ctx, stmt, timeout, result); err != nil {
+					if ctx.Err() != nil {
+						rollback = true
+						return ctx.Err()
+					}
+					if limit.exceeded() {
+						err = ErrStatementTimeout
+					}
+					if handleError(result, err) {
+						continue
+					}
+					break
+				}
+				if xTime {
+					result.Time = time.Now().Sub(start).Seconds()
+				}
+				allResults = append(allResults, result)
+				continue
+			}
+
+			ddl := isDDL(stmt.Query)
+			var version int64
+			if ddl {
+				version = db.schemaVersion()
+			}
+			r, err := execStatement(ctx, execer, stmt, timeout)
 			if err != nil {
+				if ctx.Err() != nil {
+					rollback = true
+					return ctx.Err()
+				}
+				if limit.exceeded() {
+					err = ErrStatementTimeout
+				}
 				if handleError(result, err) {
 					continue
 				}
 				break
 			}
+			if ddl {
+				result.Changed = db.schemaVersion() != version
+			}
+			result.ChangedRows = changed
 			if r == nil {
 				continue
 			}
+			if ok, _ := savepointStmt(stmt.Query); ok {
+				// SQLite leaves the last insert ID and rows changed as set
+				// by the statement before, so neither is reported.
+				if xTime {
+					result.Time = time.Now().Sub(start).Seconds()
+				}
+				allResults = append(allResults, result)
+				continue
+			}
 
 			lid, err := r.LastInsertId()
 			if err != nil {
@@ -286,31 +665,310 @@ func (db *DB) Execute(stmts []Statement, tx, xTime bool) ([]*Result, error) {
 			allResults = append(allResults, result)
 		}
 
+		if dryRun && !db.TransactionActive() {
+			return ErrDryRunTransactionEnded
+		}
 		return nil
 	}()
 
+	if altered {
+		db.syncRowCounts(recount)
+	}
 	return allResults, err
 }
 
+// ExecuteBatch executes the single query once for each set of parameters in
+// params, as a prepared statement within one transaction. The returned result
+// aggregates the rows affected by every execution, and carries the ID of the
+// last row inserted. If any execution fails, the transaction is rolled back,
+// and the error, identifying the failed parameter set, is set on the result.
+func (db *DB) ExecuteBatch(query string, params [][]driver.Value, xTime bool) (*Result, error) {
+	db.lock()
+	defer db.mu.Unlock()
+
+	stats.Add(numExecutions, int64(len(params)))
+	stats.Add(numETx, 1)
+
+	result := &Result{}
+	start := time.Now()
+
+	t, err := db.sqlite3conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	err = func() error {
+		ps, err := db.sqlite3conn.Prepare(query)
+		if err != nil {
+			return err
+		}
+		defer ps.Close()
+
+		ec := ps.(driver.StmtExecContext)
+		for i, p := range params {
+			r, err := ec.ExecContext(context.Background(), namedValues(db.coerceParameters(p)))
+			if err != nil {
+				return fmt.Errorf("parameter set %d: %w", i, err)
+			}
+			lid, err := r.LastInsertId()
+			if err != nil {
+				return err
+			}
+			ra, err := r.RowsAffected()
+			if err != nil {
+				return err
+			}
+			result.LastInsertID = lid
+			result.RowsAffected += ra
+		}
+		return nil
+	}()
+	if err != nil {
+		stats.Add(numExecutionErrors, 1)
+		t.Rollback()
+		return &Result{Error: err.Error(), ErrorCode: errorCode(err)}, nil
+	}
+	if err := t.Commit(); err != nil {
+		return nil, err
+	}
+
+	if xTime {
+		result.Time = time.Now().Sub(start).Seconds()
+	}
+	return result, nil
+}
+
+// execStatement executes stmt using execer. If timeout is non-zero and the
+// statement does not complete within that time, it is interrupted and
+// ErrStatementTimeout is returned.
+func execStatement(ctx context.Context, execer contextExecer, stmt Statement, timeout time.Duration) (driver.Result, error) {
+	if timeout <= 0 {
+		return execer.ExecContext(ctx, stmt.Query, namedValues(stmt.Parameters))
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	r, err := execer.ExecContext(sctx, stmt.Query, namedValues(stmt.Parameters))
+	if err != nil && ctx.Err() == nil && sctx.Err() == context.DeadlineExceeded {
+		return nil, ErrStatementTimeout
+	}
+	return r, err
+}
+
+// queryPragma executes stmt, a PRAGMA statement, setting the columns and rows
+// it returns, if any, on result. As with execStatement, if timeout is non-zero
+// and the statement does not complete within that time, it is interrupted and
+// ErrStatementTimeout is returned.
+func (db *DB) queryPragma(ctx context.Context, stmt Statement, timeout time.Duration, result *Result) error {
+	sctx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		sctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := func() error {
+		rs, err := db.sqlite3conn.QueryContext(sctx, stmt.Query, namedValues(stmt.Parameters))
+		if err != nil {
+			return err
+		}
+		defer rs.Close()
+
+		result.Columns = rs.Columns()
+		types := rs.(*sqlite3.SQLiteRows).DeclTypes()
+		dest := make([]driver.Value, len(result.Columns))
+		for {
+			if err := rs.Next(dest); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			result.Values = append(result.Values, normalizeRowValues(dest, types))
+		}
+	}()
+	if err != nil && ctx.Err() == nil && sctx.Err() == context.DeadlineExceeded {
+		return ErrStatementTimeout
+	}
+	return err
+}
+
+// declTyper is implemented by the rows of a query, whether or not they were
+// returned by a cached statement.
+type declTyper interface {
+	DeclTypes() []string
+}
+
+// queryContext runs query, reusing the statement prepared for it by an
+// earlier run, if statements are cached and query is a single statement.
+func (db *DB) queryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if db.stmts == nil || !singleStatement(query) {
+		return db.sqlite3conn.QueryContext(ctx, query, args)
+	}
+
+	stmt := db.stmts.take(query)
+	if stmt == nil {
+		var err error
+		if stmt, err = db.sqlite3conn.Prepare(query); err != nil {
+			return nil, err
+		}
+	}
+	if len(args) < stmt.NumInput() {
+		// Let the connection report the missing parameters.
+		db.stmts.put(query, stmt)
+		return db.sqlite3conn.QueryContext(ctx, query, args)
+	}
+	rs, err := stmt.(driver.StmtQueryContext).QueryContext(ctx, args[:stmt.NumInput()])
+	if err != nil {
+		stmt.Close()
+		return nil, err
+	}
+	return &cachedRows{SQLiteRows: rs.(*sqlite3.SQLiteRows), cache: db.stmts, query: query, stmt: stmt}, nil
+}
+
+// singleStatement returns whether query holds a single statement. A query
+// with a semicolon anywhere but at its end, even within a string, is treated
+// as several statements.
+func singleStatement(query string) bool {
+	return !strings.Contains(strings.TrimRight(strings.TrimSpace(query), "; \t\r\n"), ";")
+}
+
+// altersSchema returns whether query may change the schema, and so leave
+// cached statements prepared for an earlier schema. It errs towards true, as
+// the only cost is statements being prepared again.
+func altersSchema(query string) bool {
+	q := strings.ToUpper(query)
+	return strings.Contains(q, "CREATE") || strings.Contains(q, "DROP") || strings.Contains(q, "ALTER")
+}
+
+// isDDL returns whether query starts with a CREATE, DROP or ALTER statement.
+func isDDL(query string) bool {
+	q := strings.TrimLeft(query, " \t\r\n")
+	for _, kw := range []string{"CREATE", "DROP", "ALTER"} {
+		if len(q) > len(kw) && strings.EqualFold(q[:len(kw)], kw) && strings.IndexByte(" \t\r\n", q[len(kw)]) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaVersion returns the schema version of the main database, which
+// SQLite increments whenever the schema changes, or -1 if it cannot be read.
+func (db *DB) schemaVersion() int64 {
+	v, err := db.queryColumn("PRAGMA schema_version")
+	if err != nil || len(v) != 1 {
+		return -1
+	}
+	n, _ := v[0].(int64)
+	return n
+}
+
+// savepointStmt returns whether query is a single SAVEPOINT, RELEASE or
+// ROLLBACK TO statement, and if so, whether it is a ROLLBACK TO. Unlike
+// BEGIN, these nest within any transaction already open.
+func savepointStmt(query string) (ok, rollback bool) {
+	if !singleStatement(query) {
+		return false, false
+	}
+	words := strings.Fields(strings.ToUpper(strings.TrimRight(query, "; \t\r\n")))
+	if len(words) < 2 {
+		return false, false
+	}
+	switch words[0] {
+	case "SAVEPOINT", "RELEASE":
+		return true, false
+	case "ROLLBACK":
+		if words[1] == "TRANSACTION" && len(words) > 2 {
+			words = words[1:]
+		}
+		if words[1] == "TO" {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// txControlStmt returns whether any statement of query begins or ends a
+// transaction, rather than a savepoint within it. Statements are split at
+// every ";", even within strings, so it may wrongly return true, but never
+// wrongly returns false.
+func txControlStmt(query string) bool {
+	for _, q := range strings.Split(query, ";") {
+		words := strings.Fields(strings.ToUpper(q))
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "BEGIN", "COMMIT", "END":
+			return true
+		case "ROLLBACK":
+			if len(words) > 1 && words[1] == "TRANSACTION" {
+				words = words[1:]
+			}
+			if len(words) < 2 || words[1] != "TO" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isPragma returns whether query is a single PRAGMA statement. Queries of
+// several statements are executed as usual, so the rows of any PRAGMA among
+// them are not returned.
+func isPragma(query string) bool {
+	q := strings.TrimRight(strings.TrimSpace(query), "; \t\r\n")
+	return len(q) >= len("PRAGMA") && strings.EqualFold(q[:len("PRAGMA")], "PRAGMA") &&
+		!strings.Contains(q, ";")
+}
+
 // QueryStringStmt executes a single query that return rows, but don't modify database.
 func (db *DB) QueryStringStmt(query string) ([]*Rows, error) {
 	return db.Query([]Statement{{query, nil}}, false, false)
 }
 
 // Query executes queries that return rows, but don't modify the database.
+// The queries run with query_only set on the connection, so any statement
+// attempting to modify the database fails.
 func (db *DB) Query(stmts []Statement, tx, xTime bool) ([]*Rows, error) {
+	return db.QueryWithContext(context.Background(), stmts, tx, xTime)
+}
+
+// QueryWithContext executes queries that return rows, but don't modify the
+// database. If ctx is done before all statements are processed, processing
+// stops, any transaction is rolled back, and ctx.Err() is returned.
+func (db *DB) QueryWithContext(ctx context.Context, stmts []Statement, tx, xTime bool) ([]*Rows, error) {
+	return db.QueryWithLimit(ctx, stmts, tx, xTime, 0)
+}
+
+// QueryWithLimit executes queries as QueryWithContext does, but reads at
+// most maxRows rows for each statement, marking the rows of any statement
+// which returned more as truncated. If maxRows is zero, there is no limit.
+func (db *DB) QueryWithLimit(ctx context.Context, stmts []Statement, tx, xTime bool, maxRows int) ([]*Rows, error) {
+	return db.query(ctx, stmts, tx, xTime, maxRows, false)
+}
+
+// Describe returns the columns, and their declared types, of the rows each
+// statement would return, without reading any rows. The statements are
+// prepared, but never stepped, so no table is scanned.
+func (db *DB) Describe(ctx context.Context, stmts []Statement) ([]*Rows, error) {
+	return db.query(ctx, stmts, false, false, 0, true)
+}
+
+// query executes queries as QueryWithLimit does. If describe is set, the
+// columns of each statement are returned, but no rows are read.
+func (db *DB) query(ctx context.Context, stmts []Statement, tx, xTime bool, maxRows int, describe bool) ([]*Rows, error) {
 	stats.Add(numQueries, int64(len(stmts)))
 	if tx {
 		stats.Add(numQTx, 1)
 	}
 
-	type Queryer interface {
-		Query(query string, args []driver.Value) (driver.Rows, error)
+	if err := db.beginQueryOnly(); err != nil {
+		return nil, err
 	}
+	defer db.endQueryOnly()
 
 	var allRows []*Rows
 	err := func() (err error) {
-		var queryer Queryer
 		var t driver.Tx
 		defer func() {
 			// XXX THIS DOESN'T ACTUALLY WORK! Might as WELL JUST COMMIT?
@@ -323,8 +981,6 @@ func (db *DB) Query(stmts []Statement, tx, xTime bool) ([]*Rows, error) {
 			}
 		}()
 
-		queryer = db.sqlite3conn
-
 		// Create the correct query object, depending on whether a
 		// transaction was requested.
 		if tx {
@@ -335,6 +991,9 @@ func (db *DB) Query(stmts []Statement, tx, xTime bool) ([]*Rows, error) {
 		}
 
 		for _, stmt := range stmts {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
 			if stmt.Query == "" {
 				continue
 			}
@@ -342,9 +1001,13 @@ func (db *DB) Query(stmts []Statement, tx, xTime bool) ([]*Rows, error) {
 			rows := &Rows{}
 			start := time.Now()
 
-			rs, err := queryer.Query(stmt.Query, stmt.Parameters)
+			rs, err := db.queryContext(ctx, stmt.Query, namedValues(db.coerceParameters(stmt.Parameters)))
 			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
 				rows.Error = err.Error()
+				rows.ErrorCode = errorCode(err)
 				allRows = append(allRows, rows)
 				continue
 			}
@@ -352,20 +1015,32 @@ func (db *DB) Query(stmts []Statement, tx, xTime bool) ([]*Rows, error) {
 			columns := rs.Columns()
 
 			rows.Columns = columns
-			rows.Types = rs.(*sqlite3.SQLiteRows).DeclTypes()
+			rows.Types = rs.(declTyper).DeclTypes()
+			if describe {
+				allRows = append(allRows, rows)
+				continue
+			}
 			dest := make([]driver.Value, len(rows.Columns))
 			for {
 				err := rs.Next(dest)
 				if err != nil {
 					if err != io.EOF {
 						rows.Error = err.Error()
+						rows.ErrorCode = errorCode(err)
 					}
 					break
 				}
+				if maxRows > 0 && len(rows.Values) == maxRows {
+					rows.Truncated = true
+					break
+				}
 
 				values := normalizeRowValues(dest, rows.Types)
 				rows.Values = append(rows.Values, values)
 			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if xTime {
 				rows.Time = time.Now().Sub(start).Seconds()
 			}
@@ -378,8 +1053,199 @@ func (db *DB) Query(stmts []Statement, tx, xTime bool) ([]*Rows, error) {
 	return allRows, err
 }
 
+// QueryStream executes queries that return rows, but don't modify the
+// database, calling fn for each row as it is read from the database. Unlike
+// Query, the rows are never all held in memory at once. Processing stops at
+// the first error, whether returned by a statement or by fn, and that error
+// is returned.
+func (db *DB) QueryStream(ctx context.Context, stmts []Statement, tx bool, fn func(row []interface{}) error) (err error) {
+	stats.Add(numQueries, int64(len(stmts)))
+	if tx {
+		stats.Add(numQTx, 1)
+	}
+
+	if err := db.beginQueryOnly(); err != nil {
+		return err
+	}
+	defer db.endQueryOnly()
+
+	var t driver.Tx
+	defer func() {
+		if t != nil {
+			if err != nil {
+				t.Rollback()
+				return
+			}
+			t.Commit()
+		}
+	}()
+
+	if tx {
+		t, err = db.sqlite3conn.Begin()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range stmts {
+		if stmt.Query == "" {
+			continue
+		}
+		if err = db.queryStream(ctx, stmt, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// beginQueryOnly prevents any change to the database until the matching
+// call to endQueryOnly, setting query_only on the connection if it is not
+// already set.
+func (db *DB) beginQueryOnly() error {
+	db.mu.RLock()
+	db.readersMu.Lock()
+	defer db.readersMu.Unlock()
+	if !db.queryOnly {
+		if _, err := db.sqlite3conn.Exec(queryOnlyEnabled, nil); err != nil {
+			db.mu.RUnlock()
+			return err
+		}
+		db.queryOnly = true
+	}
+	return nil
+}
+
+// endQueryOnly ends a query started by beginQueryOnly.
+func (db *DB) endQueryOnly() {
+	db.mu.RUnlock()
+}
+
+// lock locks the database for an operation which may change it, clearing
+// query_only on the connection if set.
+func (db *DB) lock() {
+	db.mu.Lock()
+	if db.queryOnly {
+		db.sqlite3conn.Exec(queryOnlyDisabled, nil)
+		db.queryOnly = false
+	}
+}
+
+// queryStream executes a single statement, calling fn for each row.
+func (db *DB) queryStream(ctx context.Context, stmt Statement, fn func(row []interface{}) error) error {
+	rs, err := db.queryContext(ctx, stmt.Query, namedValues(db.coerceParameters(stmt.Parameters)))
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+
+	types := rs.(declTyper).DeclTypes()
+	dest := make([]driver.Value, len(rs.Columns()))
+	for {
+		if err := rs.Next(dest); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(normalizeRowValues(dest, types)); err != nil {
+			return err
+		}
+	}
+}
+
+// RegisterFunc registers impl as an SQL scalar function named name, on the
+// connection. The arity of the function is that of impl, which may be
+// variadic. If deterministic is set, SQLite may assume the function always
+// returns the same result for the same arguments.
+func (db *DB) RegisterFunc(name string, impl interface{}, deterministic bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.sqlite3conn.RegisterFunc(name, impl, deterministic)
+}
+
+// SetCoerceIntegerParams sets whether float64 parameters with no fractional
+// part are bound as int64. Parameters decoded from JSON numbers are float64,
+// even when the client sent an integer, so this binds them as the integer
+// sent. The parameter a value is bound to does not identify a column, so
+// every integral value is coerced: SQLite converts it back to REAL when it is
+// stored in a column with REAL affinity, but it is stored as an integer in a
+// column with no affinity, and as "1" rather than "1.0" in a TEXT column.
+// Values whose magnitude exceeds 2^53 are never coerced, as float64 cannot
+// hold every such integer exactly, so they may already have lost precision.
+func (db *DB) SetCoerceIntegerParams(b bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.coerceIntegers = b
+}
+
+// SetPreparedCacheSize sets the number of prepared statements kept for reuse
+// by queries, keyed by their SQL text, so that a query run repeatedly is only
+// parsed and planned once. Only queries of a single statement are cached.
+// The cache is cleared whenever an Execute may change the schema. A size of
+// zero disables the cache.
+func (db *DB) SetPreparedCacheSize(n int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.stmts.clear()
+	db.stmts = nil
+	if n > 0 {
+		db.stmts = newStmtCache(n)
+	}
+}
+
+// PreparedCacheStats returns statistics about the prepared statement cache,
+// or nil if it is disabled.
+func (db *DB) PreparedCacheStats() map[string]interface{} {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.stmts == nil {
+		return nil
+	}
+	return db.stmts.Stats()
+}
+
+// Vacuum rebuilds the database file, reclaiming unused space. It returns
+// ErrTransactionActive if a transaction is active.
+func (db *DB) Vacuum() error {
+	db.lock()
+	defer db.mu.Unlock()
+	if db.TransactionActive() {
+		return ErrTransactionActive
+	}
+	db.stmts.clear()
+	_, err := db.sqlite3conn.Exec("VACUUM", nil)
+	return err
+}
+
+// Reindex rebuilds the indexes of the table or index with the given name, or
+// every index of the database if name is blank. A name may also be that of
+// a collation, in which case every index using the collation is rebuilt.
+func (db *DB) Reindex(name string) error {
+	db.lock()
+	defer db.mu.Unlock()
+	db.stmts.clear()
+	_, err := db.sqlite3conn.Exec(reindexStatement(name), nil)
+	return err
+}
+
+// reindexStatement returns the REINDEX statement for name.
+func reindexStatement(name string) string {
+	if name == "" {
+		return "REINDEX"
+	}
+	return fmt.Sprintf(`REINDEX "%s"`, strings.Replace(name, `"`, `""`, -1))
+}
+
 // Backup writes a consistent snapshot of the database to the given file.
 func (db *DB) Backup(path string) error {
+	return db.BackupWithProgress(path, nil)
+}
+
+// BackupWithProgress writes a consistent snapshot of the database to the
+// given file, as Backup does. If progress is non-nil, the database is copied
+// a number of pages at a time, and progress is called after each step with
+// the number of pages still to be copied, and the total number of pages.
+func (db *DB) BackupWithProgress(path string, progress func(remaining, total int)) error {
 	dstDB, err := Open(path)
 	if err != nil {
 		return err
@@ -392,15 +1258,72 @@ func (db *DB) Backup(path string) error {
 		}
 	}(dstDB, &err)
 
-	if err := copyDatabase(dstDB.sqlite3conn, db.sqlite3conn); err != nil {
+	if err := copyNamedDatabase(dstDB.sqlite3conn, "main", db.sqlite3conn, "main", progress); err != nil {
 		return err
 	}
 
 	return err
 }
 
+// Attach attaches the database at path to the connection under name, so its
+// tables may be referenced as name.table. A path of ":memory:" attaches a
+// new, empty, in-memory database.
+func (db *DB) Attach(name, path string) error {
+	db.lock()
+	defer db.mu.Unlock()
+	db.stmts.clear()
+	_, err := db.sqlite3conn.Exec(fmt.Sprintf(`ATTACH DATABASE ? AS "%s"`, strings.Replace(name, `"`, `""`, -1)),
+		[]driver.Value{path})
+	return err
+}
+
+// BackupAttached writes a consistent snapshot of the attached database name
+// to the given file.
+func (db *DB) BackupAttached(name, path string) error {
+	dstDB, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer dstDB.Close()
+
+	return copyNamedDatabase(dstDB.sqlite3conn, "main", db.sqlite3conn, name, nil)
+}
+
+// RestoreAttached replaces the contents of the attached database name with
+// the database in the given file.
+func (db *DB) RestoreAttached(name, path string) error {
+	srcDB, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+
+	db.lock()
+	defer db.mu.Unlock()
+	db.stmts.clear()
+	return copyNamedDatabase(db.sqlite3conn, name, srcDB.sqlite3conn, "main", nil)
+}
+
 // Dump writes a consistent snapshot of the database in SQL text format.
 func (db *DB) Dump(w io.Writer) error {
+	return db.DumpFiltered(w, nil, "")
+}
+
+// DumpFiltered writes a consistent snapshot of the database in SQL text
+// format, including only the tables for which filter returns true. Indexes
+// and triggers are included along with their table. Views are included only
+// if filter returns true for the view name. A nil filter includes everything.
+// Rows are written as statements starting with insert, such as "INSERT OR
+// REPLACE", so that the dump can be loaded into a database which already
+// holds some of the rows. If insert is blank, plain INSERT is used.
+func (db *DB) DumpFiltered(w io.Writer, filter func(name string) bool, insert string) error {
+	if filter == nil {
+		filter = func(string) bool { return true }
+	}
+	if insert == "" {
+		insert = "INSERT"
+	}
+
 	if _, err := w.Write([]byte("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")); err != nil {
 		return err
 	}
@@ -439,6 +1362,8 @@ func (db *DB) Dump(w io.Writer) error {
 			stmt = `ANALYZE "sqlite_master";`
 		} else if strings.HasPrefix(table, "sqlite_") {
 			continue
+		} else if !filter(table) {
+			continue
 		} else {
 			stmt = v[2].(string)
 		}
@@ -457,7 +1382,8 @@ func (db *DB) Dump(w io.Writer) error {
 			columnNames = append(columnNames, fmt.Sprintf(`'||quote("%s")||'`, w[1].(string)))
 		}
 
-		query = fmt.Sprintf(`SELECT 'INSERT INTO "%s" VALUES(%s)' FROM "%s";`,
+		query = fmt.Sprintf(`SELECT '%s INTO "%s" VALUES(%s)' FROM "%s";`,
+			insert,
 			tableIndent,
 			strings.Join(columnNames, ","),
 			tableIndent)
@@ -474,7 +1400,7 @@ func (db *DB) Dump(w io.Writer) error {
 	}
 
 	// Do indexes, triggers, and views.
-	query = `SELECT "name", "type", "sql" FROM "sqlite_master"
+	query = `SELECT "name", "type", "sql", "tbl_name" FROM "sqlite_master"
 			  WHERE "sql" NOT NULL AND "type" IN ('index', 'trigger', 'view')`
 	rows, err = db.QueryStringStmt(query)
 	if err != nil {
@@ -482,6 +1408,9 @@ func (db *DB) Dump(w io.Writer) error {
 	}
 	row = rows[0]
 	for _, v := range row.Values {
+		if !filter(v[3].(string)) {
+			continue
+		}
 		if _, err := w.Write([]byte(fmt.Sprintf("%s;\n", v[2]))); err != nil {
 			return err
 		}
@@ -494,22 +1423,200 @@ func (db *DB) Dump(w io.Writer) error {
 	return nil
 }
 
+// jsonlTableHeader is the record which precedes the rows of each table
+// written by DumpJSONL.
+type jsonlTableHeader struct {
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+	Types   []string `json:"types"`
+}
+
+// DumpJSONL writes a consistent snapshot of the contents of every table in
+// the database as newline-delimited JSON. Each table starts with a header
+// record naming the table, its columns, and their declared types, followed
+// by one JSON object per row, keyed by column name. Rows are streamed to w
+// as they are read, so no table is ever held in full as a Go result set.
+// Only the tables for which filter returns true are written. A nil filter
+// includes every table.
+func (db *DB) DumpJSONL(w io.Writer, filter func(table string) bool) error {
+	// Get a new connection, so the dump creation is isolated from other activity.
+	dstDB, err := OpenInMemory()
+	if err != nil {
+		return err
+	}
+	defer func(db *DB, err *error) {
+		cerr := db.Close()
+		if *err == nil {
+			*err = cerr
+		}
+	}(dstDB, &err)
+
+	if err := copyDatabase(dstDB.sqlite3conn, db.sqlite3conn); err != nil {
+		return err
+	}
+
+	query := `SELECT "name" FROM "sqlite_master"
+              WHERE "type" == 'table' AND "name" NOT LIKE 'sqlite_%' ORDER BY "name"`
+	rows, err := dstDB.QueryStringStmt(query)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for _, v := range rows[0].Values {
+		table := v[0].(string)
+		if filter != nil && !filter(table) {
+			continue
+		}
+		tableIndent := strings.Replace(table, `"`, `""`, -1)
+
+		r, err := dstDB.QueryStringStmt(fmt.Sprintf(`PRAGMA table_info("%s")`, tableIndent))
+		if err != nil {
+			return err
+		}
+		hdr := jsonlTableHeader{
+			Table:   table,
+			Columns: make([]string, 0, len(r[0].Values)),
+			Types:   make([]string, 0, len(r[0].Values)),
+		}
+		for _, c := range r[0].Values {
+			hdr.Columns = append(hdr.Columns, c[1].(string))
+			hdr.Types = append(hdr.Types, strings.ToLower(c[2].(string)))
+		}
+		if err := enc.Encode(hdr); err != nil {
+			return err
+		}
+
+		stmt := Statement{Query: fmt.Sprintf(`SELECT * FROM "%s"`, tableIndent)}
+		m := make(map[string]interface{}, len(hdr.Columns))
+		err = dstDB.queryStream(context.Background(), stmt, func(row []interface{}) error {
+			for i, c := range hdr.Columns {
+				m[c] = row[i]
+			}
+			return enc.Encode(m)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DumpCSV writes a consistent snapshot of the contents of table as CSV. The
+// first record is a header of the column names, followed by one record per
+// row. CSV has no representation of NULL, so NULL is written as the field
+// null, such as \N, which should differ from any text in the table, and from
+// empty text, which is written as an empty field. BLOBs are written as their
+// raw bytes.
+func (db *DB) DumpCSV(w io.Writer, table, null string) error {
+	// Get a new connection, so the dump creation is isolated from other activity.
+	dstDB, err := OpenInMemory()
+	if err != nil {
+		return err
+	}
+	defer func(db *DB, err *error) {
+		cerr := db.Close()
+		if *err == nil {
+			*err = cerr
+		}
+	}(dstDB, &err)
+
+	if err := copyDatabase(dstDB.sqlite3conn, db.sqlite3conn); err != nil {
+		return err
+	}
+
+	tableIndent := strings.Replace(table, `"`, `""`, -1)
+	r, err := dstDB.QueryStringStmt(fmt.Sprintf(`PRAGMA table_info("%s")`, tableIndent))
+	if err != nil {
+		return err
+	}
+	if len(r[0].Values) == 0 {
+		return fmt.Errorf("no such table: %s", table)
+	}
+	header := make([]string, 0, len(r[0].Values))
+	for _, c := range r[0].Values {
+		header = append(header, c[1].(string))
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	record := make([]string, len(header))
+	stmt := Statement{Query: fmt.Sprintf(`SELECT * FROM "%s"`, tableIndent)}
+	err = dstDB.queryStream(context.Background(), stmt, func(row []interface{}) error {
+		for i, v := range row {
+			record[i] = csvField(v, null)
+		}
+		return cw.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvField returns the CSV encoding of the column value v, or null if v
+// is NULL.
+func csvField(v interface{}, null string) string {
+	switch val := v.(type) {
+	case nil:
+		return null
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	case time.Time:
+		return val.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
 func copyDatabase(dst *sqlite3.SQLiteConn, src *sqlite3.SQLiteConn) error {
-	bk, err := dst.Backup("main", src, "main")
+	return copyNamedDatabase(dst, "main", src, "main", nil)
+}
+
+// copyNamedDatabase copies the database srcName of src over the database
+// dstName of dst. If progress is non-nil, the database is copied in steps,
+// calling progress after each with the pages remaining and the total pages.
+func copyNamedDatabase(dst *sqlite3.SQLiteConn, dstName string, src *sqlite3.SQLiteConn, srcName string, progress func(remaining, total int)) error {
+	bk, err := dst.Backup(dstName, src, srcName)
 	if err != nil {
 		return err
 	}
 
+	pages := -1
+	if progress != nil {
+		pages = bkStepPages
+	}
+	remaining := -1
 	for {
-		done, err := bk.Step(-1)
+		done, err := bk.Step(pages)
 		if err != nil {
 			bk.Finish()
 			return err
 		}
+		if progress != nil {
+			progress(bk.Remaining(), bk.PageCount())
+		}
 		if done {
 			break
 		}
-		time.Sleep(bkDelay * time.Millisecond)
+
+		// Only wait if no pages were copied, as the source was busy.
+		if bk.Remaining() == remaining || pages < 0 {
+			time.Sleep(bkDelay * time.Millisecond)
+		}
+		remaining = bk.Remaining()
 	}
 
 	if err := bk.Finish(); err != nil {
@@ -519,6 +1626,42 @@ func copyDatabase(dst *sqlite3.SQLiteConn, src *sqlite3.SQLiteConn) error {
 	return nil
 }
 
+// errorCode returns the SQLite extended result code carried by err, or
+// zero if err did not originate in SQLite. See
+// https://www.sqlite.org/rescode.html for the list of codes.
+func errorCode(err error) int {
+	var e sqlite3.Error
+	if errors.As(err, &e) {
+		return int(e.ExtendedCode)
+	}
+	return 0
+}
+
+// uniqueColumnNames returns the column names with any duplicates made unique
+// by appending a numeric suffix, skipping any suffixed name which is already
+// in use by another column.
+func uniqueColumnNames(columns []string) []string {
+	used := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		used[c] = true
+	}
+
+	seen := make(map[string]bool, len(columns))
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		name := c
+		for n := 1; seen[name]; n++ {
+			name = fmt.Sprintf("%s:%d", c, n)
+			if used[name] {
+				name = c
+			}
+		}
+		seen[name] = true
+		names[i] = name
+	}
+	return names
+}
+
 // normalizeRowValues performs some normalization of values in the returned rows.
 // Text values come over (from sqlite-go) as []byte instead of strings
 // for some reason, so we have explicitly convert (but only when type
@@ -554,6 +1697,47 @@ func isTextType(t string) bool {
 		strings.HasPrefix(t, "clob")
 }
 
+// maxExactFloatInt is the largest magnitude below which float64 holds every
+// integer exactly.
+const maxExactFloatInt = 1 << 53
+
+// coerceParameters returns args with any float64 with no fractional part,
+// within the range float64 holds integers exactly, converted to int64, if
+// the database coerces integer parameters. args itself is not modified.
+func (db *DB) coerceParameters(args []driver.Value) []driver.Value {
+	if !db.coerceIntegers {
+		return args
+	}
+	var coerced []driver.Value
+	for i, v := range args {
+		f, ok := v.(float64)
+		if !ok || f != math.Trunc(f) || math.Abs(f) > maxExactFloatInt {
+			continue
+		}
+		if coerced == nil {
+			coerced = append([]driver.Value{}, args...)
+		}
+		coerced[i] = int64(f)
+	}
+	if coerced == nil {
+		return args
+	}
+	return coerced
+}
+
+// namedValues converts positional parameters into the form expected by the
+// context-aware driver methods.
+func namedValues(args []driver.Value) []driver.NamedValue {
+	nv := make([]driver.NamedValue, len(args))
+	for i := range args {
+		nv[i] = driver.NamedValue{
+			Ordinal: i + 1,
+			Value:   args[i],
+		}
+	}
+	return nv
+}
+
 // fqdsn returns the fully-qualified datasource name.
 func fqdsn(path, dsn string) string {
 	if dsn != "" {
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
@@ -9,7 +10,9 @@ import (
 	"path"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/mattn/go-sqlite3"
 	"github.com/rqlite/rqlite/testdata/chinook"
 )
 
@@ -205,6 +208,382 @@ func Test_SimpleSingleJSONStatements(t *testing.T) {
 	}
 }
 
+func Test_ColumnTypes(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	_, err := db.ExecuteStringStmt("CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT, score REAL, data BLOB)")
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	_, err = db.ExecuteStringStmt(`INSERT INTO foo(id, name, score, data) VALUES(1, "fiona", 2.5, x'0102')`)
+	if err != nil {
+		t.Fatalf("failed to insert record: %s", err.Error())
+	}
+
+	r, err := db.QueryStringStmt("SELECT id, name, score, data, NULL, id + 1 FROM foo")
+	if err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+	if exp, got := `["integer","text","real","blob","",""]`, asJSON(r[0].Types); exp != got {
+		t.Fatalf("unexpected column types, expected %s, got %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona",2.5,"AQI=",null,2]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+}
+
+func Test_Describe(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	_, err := db.ExecuteStringStmt("CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)")
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	_, err = db.ExecuteStringStmt(`INSERT INTO foo(id, name) VALUES(1, "fiona")`)
+	if err != nil {
+		t.Fatalf("failed to insert record: %s", err.Error())
+	}
+
+	r, err := db.Describe(context.Background(), []Statement{
+		{Query: "SELECT * FROM foo"},
+		{Query: "SELECT name, COUNT(*) FROM foo WHERE id > ?", Parameters: []driver.Value{0}},
+		{Query: "SELECT * FROM bar"},
+	})
+	if err != nil {
+		t.Fatalf("failed to describe queries: %s", err.Error())
+	}
+	if exp, got := `[{"columns":["id","name"],"types":["integer","text"]},{"columns":["name","COUNT(*)"],"types":["text",""]},{"error":"no such table: bar"}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for describe, expected %s, got %s", exp, got)
+	}
+}
+
+func Test_ExecutePragma(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	r, err := db.Execute([]Statement{
+		{Query: "CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)"},
+		{Query: " pragma integrity_check; "},
+		{Query: "PRAGMA foreign_keys=ON"},
+		{Query: "PRAGMA nonsense("},
+	}, false, false)
+	if err != nil {
+		t.Fatalf("failed to execute statements: %s", err.Error())
+	}
+	if exp, got := `[{},{"columns":["integrity_check"],"values":[["ok"]]},{},{"error":"incomplete input"}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for execute, expected %s, got %s", exp, got)
+	}
+	fk, err := db.FKConstraints()
+	if err != nil {
+		t.Fatalf("failed to check foreign key constraints: %s", err.Error())
+	}
+	if !fk {
+		t.Fatal("foreign key constraints not enabled by PRAGMA")
+	}
+}
+
+func Test_CoerceIntegerParams(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	_, err := db.ExecuteStringStmt("CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, v)")
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	insert := Statement{
+		Query:      "INSERT INTO foo(id, v) VALUES(?, ?)",
+		Parameters: []driver.Value{float64(1), float64(1)},
+	}
+	query := Statement{
+		Query:      "SELECT id, v, typeof(v), typeof(?), typeof(?), typeof(?) FROM foo WHERE v = ?",
+		Parameters: []driver.Value{float64(1.5), float64(1 << 54), float64(-1), float64(1)},
+	}
+
+	// Without coercion, the value is stored as REAL.
+	if _, err := db.Execute([]Statement{insert}, false, false); err != nil {
+		t.Fatalf("failed to insert record: %s", err.Error())
+	}
+	r, err := db.Query([]Statement{query}, false, false)
+	if err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+	if exp, got := `[[1,1,"real","real","real","real"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+
+	db.SetCoerceIntegerParams(true)
+	if _, err := db.ExecuteStringStmt("DELETE FROM foo"); err != nil {
+		t.Fatalf("failed to delete records: %s", err.Error())
+	}
+	if _, err := db.Execute([]Statement{insert}, false, false); err != nil {
+		t.Fatalf("failed to insert record: %s", err.Error())
+	}
+	r, err = db.Query([]Statement{query}, false, false)
+	if err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+	if exp, got := `[[1,1,"integer","real","real","integer"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+	if _, ok := insert.Parameters[0].(float64); !ok {
+		t.Fatalf("parameters of statement modified")
+	}
+}
+
+func Test_PreparedCache(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+	db.SetPreparedCacheSize(2)
+
+	if _, err := db.ExecuteStringStmt(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	if _, err := db.ExecuteStringStmt(`INSERT INTO foo(id, name) VALUES(1, "fiona")`); err != nil {
+		t.Fatalf("failed to insert record: %s", err.Error())
+	}
+
+	query := func(q string, params ...driver.Value) string {
+		r, err := db.Query([]Statement{{q, params}}, false, false)
+		if err != nil {
+			t.Fatalf("failed to query table: %s", err.Error())
+		}
+		return asJSON(r)
+	}
+	for i := 0; i < 3; i++ {
+		if exp, got := `[{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"]]}]`,
+			query("SELECT * FROM foo WHERE id = ?", int64(1)); exp != got {
+			t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+		}
+	}
+	stats := db.PreparedCacheStats()
+	if stats["hits"] != uint64(2) || stats["misses"] != uint64(1) || stats["entries"] != 1 {
+		t.Fatalf("unexpected cache stats: %v", stats)
+	}
+
+	// Missing parameters are reported as without the cache.
+	if exp, got := `[{"error":"not enough args to execute query: want 1 got 0"}]`,
+		query("SELECT * FROM foo WHERE id = ?"); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+
+	// Changing the schema clears the cache, so the new column is returned.
+	if _, err := db.ExecuteStringStmt(`ALTER TABLE foo ADD COLUMN age INTEGER`); err != nil {
+		t.Fatalf("failed to alter table: %s", err.Error())
+	}
+	if n := db.PreparedCacheStats()["entries"]; n != 0 {
+		t.Fatalf("cache not cleared by schema change, %v entries", n)
+	}
+	if exp, got := `[{"columns":["id","name","age"],"types":["integer","text","integer"],"values":[[1,"fiona",null]]}]`,
+		query("SELECT * FROM foo WHERE id = ?", int64(1)); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+	if _, err := db.Execute([]Statement{{`DROP TABLE foo`, nil}, {`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, v REAL)`, nil}}, false, false); err != nil {
+		t.Fatalf("failed to recreate table: %s", err.Error())
+	}
+	if exp, got := `[{"columns":["id","v"],"types":["integer","real"]}]`,
+		query("SELECT * FROM foo WHERE id = ?", int64(1)); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+
+	// The least recently used statements are evicted.
+	query("SELECT 1")
+	query("SELECT 2")
+	if n := db.PreparedCacheStats()["entries"]; n != 2 {
+		t.Fatalf("unexpected number of cache entries, expected 2, got %v", n)
+	}
+
+	// Queries of several statements are not cached.
+	misses := db.PreparedCacheStats()["misses"]
+	query("SELECT 1; SELECT 2")
+	if m := db.PreparedCacheStats()["misses"]; m != misses {
+		t.Fatalf("query of several statements looked up in cache")
+	}
+
+	db.SetPreparedCacheSize(0)
+	if db.PreparedCacheStats() != nil {
+		t.Fatalf("cache not disabled")
+	}
+}
+
+func Test_ExecuteDryRunTransactionControl(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	mustExecute(db, `CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)
+	count := func() string {
+		t.Helper()
+		rows, err := db.QueryStringStmt(`SELECT COUNT(*) FROM foo`)
+		if err != nil {
+			t.Fatalf("failed to count rows: %s", err.Error())
+		}
+		return asJSON(rows[0].Values)
+	}
+
+	for _, q := range []string{
+		`COMMIT`,
+		`END TRANSACTION`,
+		`ROLLBACK`,
+		`BEGIN`,
+		`INSERT INTO foo(name) VALUES("fiona"); commit; INSERT INTO foo(name) VALUES("declan")`,
+	} {
+		_, err := db.ExecuteDryRun([]Statement{
+			{`INSERT INTO foo(name) VALUES("fiona")`, nil},
+			{q, nil},
+			{`INSERT INTO foo(name) VALUES("declan")`, nil},
+		}, false, 0)
+		if err != ErrDryRunTransactionControl {
+			t.Fatalf("wrong error for dry run including %q: %v", q, err)
+		}
+		if exp, got := `[[0]]`, count(); exp != got {
+			t.Fatalf("dry run including %q changed database, exp %s, got %s", q, exp, got)
+		}
+	}
+
+	// Savepoints nest within the dry run.
+	if _, err := db.ExecuteDryRun([]Statement{
+		{`SAVEPOINT sp`, nil},
+		{`INSERT INTO foo(name) VALUES("fiona")`, nil},
+		{`ROLLBACK TO sp`, nil},
+		{`RELEASE sp`, nil},
+	}, false, 0); err != nil {
+		t.Fatalf("failed to execute dry run with savepoint: %s", err.Error())
+	}
+
+	// Should the transaction end nonetheless, the dry run stops.
+	_, err := db.execute(context.Background(), []Statement{
+		{`INSERT INTO foo(name) VALUES("fiona")`, nil},
+		{`COMMIT`, nil},
+		{`INSERT INTO foo(name) VALUES("declan")`, nil},
+	}, true, false, 0, 0, true, false)
+	if err != ErrDryRunTransactionEnded {
+		t.Fatalf("wrong error for dry run whose transaction ended: %v", err)
+	}
+	if exp, got := `[[1]]`, count(); exp != got {
+		t.Fatalf("statement after end of dry run executed, exp %s, got %s", exp, got)
+	}
+	if db.TransactionActive() {
+		t.Fatalf("transaction left active")
+	}
+}
+
+func Test_TableRowCounts(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	mustExecute := func(stmts []Statement, tx bool) {
+		if _, err := db.Execute(stmts, tx, false); err != nil {
+			t.Fatalf("failed to execute: %s", err.Error())
+		}
+	}
+	checkCounts := func(exp string) {
+		t.Helper()
+		counts, err := db.TableRowCounts()
+		if err != nil {
+			t.Fatalf("failed to get table row counts: %s", err.Error())
+		}
+		if got := asJSON(counts); exp != got {
+			t.Fatalf("unexpected table row counts, expected %s, got %s", exp, got)
+		}
+	}
+
+	mustExecute([]Statement{
+		{`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`, nil},
+		{`INSERT INTO foo(name) VALUES("fiona")`, nil},
+		{`INSERT INTO foo(name) VALUES("declan")`, nil},
+	}, false)
+	checkCounts(`{"foo":2}`)
+
+	mustExecute([]Statement{
+		{`INSERT INTO foo(name) VALUES("aoife")`, nil},
+		{`INSERT INTO foo(name) VALUES("dana")`, nil},
+		{`DELETE FROM foo WHERE name = "fiona"`, nil},
+	}, true)
+	checkCounts(`{"foo":3}`)
+
+	// Changes rolled back are not counted.
+	mustExecute([]Statement{
+		{`INSERT INTO foo(name) VALUES("eve")`, nil},
+		{`INSERT INTO foo(id, name) VALUES(2, "declan")`, nil},
+	}, true)
+	if _, err := db.ExecuteDryRun([]Statement{{`INSERT INTO foo(name) VALUES("eve")`, nil}}, false, 0); err != nil {
+		t.Fatalf("failed to execute dry run: %s", err.Error())
+	}
+	checkCounts(`{"foo":3}`)
+
+	// Changes rolled back to a savepoint are not counted.
+	mustExecute([]Statement{
+		{`INSERT INTO foo(name) VALUES("eve")`, nil},
+		{`SAVEPOINT sp`, nil},
+		{`INSERT INTO foo(name) VALUES("mary")`, nil},
+		{`ROLLBACK TO sp`, nil},
+		{`RELEASE sp`, nil},
+	}, true)
+	checkCounts(`{"foo":4}`)
+	mustExecute([]Statement{{`DELETE FROM foo WHERE name = "eve"`, nil}}, false)
+	checkCounts(`{"foo":3}`)
+
+	// Tables created are counted, and tables dropped are not.
+	mustExecute([]Statement{
+		{`CREATE TABLE bar AS SELECT * FROM foo`, nil},
+		{`INSERT INTO bar(name) VALUES("eve")`, nil},
+	}, false)
+	checkCounts(`{"bar":4,"foo":3}`)
+	mustExecute([]Statement{
+		{`DROP TABLE foo`, nil},
+		{`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`, nil},
+		{`INSERT INTO foo(name) VALUES("fiona")`, nil},
+		{`DROP TABLE bar`, nil},
+	}, true)
+	checkCounts(`{"foo":1}`)
+
+	r, err := db.QueryStringStmt(`SELECT COUNT(*) FROM foo`)
+	if err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+	if exp, got := `[[1]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+}
+
+func Benchmark_QueryPreparedCache(b *testing.B) {
+	for _, size := range []int{0, 10} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			db, path := mustCreateDatabase()
+			defer db.Close()
+			defer os.Remove(path)
+			db.SetPreparedCacheSize(size)
+
+			if _, err := db.ExecuteStringStmt(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT, age INTEGER)`); err != nil {
+				b.Fatalf("failed to create table: %s", err.Error())
+			}
+			if _, err := db.ExecuteStringStmt(`INSERT INTO foo(id, name, age) VALUES(1, "fiona", 20)`); err != nil {
+				b.Fatalf("failed to insert record: %s", err.Error())
+			}
+			stmts := []Statement{{
+				Query: `SELECT f1.name, f2.age, upper(f3.name), f1.age + f2.age + f3.age
+					FROM foo AS f1 JOIN foo AS f2 ON f1.id = f2.id JOIN foo AS f3 ON f2.id = f3.id
+					WHERE f1.id = ? AND f2.age > ? AND f3.name LIKE 'f%' ORDER BY f1.name, f2.age`,
+				Parameters: []driver.Value{int64(1), int64(10)},
+			}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Query(stmts, false, false); err != nil {
+					b.Fatalf("failed to query table: %s", err.Error())
+				}
+			}
+		})
+	}
+}
+
 func Test_SimpleJoinStatements(t *testing.T) {
 	db, path := mustCreateDatabase()
 	defer db.Close()
@@ -379,6 +758,55 @@ func Test_SimpleFailingStatements_Execute(t *testing.T) {
 	}
 }
 
+func Test_FailingStatementsErrorCode(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	r, err := db.ExecuteStringStmt(`INSERT INTO foo(name) VALUES("fiona")`)
+	if err != nil {
+		t.Fatalf("error executing insertion into non-existent table: %s", err.Error())
+	}
+	if exp, got := int(sqlite3.ErrError), r[0].ErrorCode; exp != got {
+		t.Fatalf("unexpected error code, exp %d, got %d", exp, got)
+	}
+
+	mustExecute(db, `CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT UNIQUE)`)
+	mustExecute(db, `INSERT INTO foo(id, name) VALUES(1, "fiona")`)
+	r, err = db.ExecuteStringStmt(`INSERT INTO foo(id, name) VALUES(1, "declan")`)
+	if err != nil {
+		t.Fatalf("failed to attempt duplicate record insertion: %s", err.Error())
+	}
+	if exp, got := int(sqlite3.ErrConstraintPrimaryKey), r[0].ErrorCode; exp != got {
+		t.Fatalf("unexpected error code, exp %d, got %d", exp, got)
+	}
+	if exp, got := "UNIQUE constraint failed: foo.id", r[0].Error; exp != got {
+		t.Fatalf("unexpected error message, exp %s, got %s", exp, got)
+	}
+	r, err = db.ExecuteStringStmt(`INSERT INTO foo(id, name) VALUES(2, "fiona")`)
+	if err != nil {
+		t.Fatalf("failed to attempt duplicate record insertion: %s", err.Error())
+	}
+	if exp, got := int(sqlite3.ErrConstraintUnique), r[0].ErrorCode; exp != got {
+		t.Fatalf("unexpected error code, exp %d, got %d", exp, got)
+	}
+
+	ro, err := db.QueryStringStmt(`SELECT * FROM bar`)
+	if err != nil {
+		t.Fatalf("failed to attempt query of non-existent table: %s", err.Error())
+	}
+	if exp, got := int(sqlite3.ErrError), ro[0].ErrorCode; exp != got {
+		t.Fatalf("unexpected error code, exp %d, got %d", exp, got)
+	}
+	ro, err = db.QueryStringStmt(`SELECT * FROM foo`)
+	if err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+	if exp, got := 0, ro[0].ErrorCode; exp != got {
+		t.Fatalf("unexpected error code for successful query, exp %d, got %d", exp, got)
+	}
+}
+
 func Test_SimpleFailingStatements_Query(t *testing.T) {
 	db, path := mustCreateDatabase()
 	defer db.Close()
@@ -609,6 +1037,92 @@ func Test_UniqueConstraints(t *testing.T) {
 	}
 }
 
+func Test_BusyTimeout(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	if err := db.SetBusyTimeout(1234); err != nil {
+		t.Fatalf("failed to set busy timeout: %s", err.Error())
+	}
+	ms, err := db.BusyTimeout()
+	if err != nil {
+		t.Fatalf("failed to get busy timeout: %s", err.Error())
+	}
+	if ms != 1234 {
+		t.Fatalf("wrong busy timeout, exp 1234, got %d", ms)
+	}
+}
+
+func Test_Pages(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	if _, err := db.ExecuteStringStmt("CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)"); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	count, size, err := db.Pages()
+	if err != nil {
+		t.Fatalf("failed to get page stats: %s", err.Error())
+	}
+	if count == 0 || size == 0 {
+		t.Fatalf("page stats not set, count %d, size %d", count, size)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat database file: %s", err.Error())
+	}
+	if count*size != fi.Size() {
+		t.Fatalf("page stats don't match file size, %d*%d != %d", count, size, fi.Size())
+	}
+}
+
+func Test_JournalModeWAL(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+	defer os.Remove(path + "-wal")
+	defer os.Remove(path + "-shm")
+
+	if err := db.SetJournalMode("WAL"); err != nil {
+		t.Fatalf("failed to set journal mode: %s", err.Error())
+	}
+	m, err := db.JournalMode()
+	if err != nil {
+		t.Fatalf("failed to get journal mode: %s", err.Error())
+	}
+	if m != "wal" {
+		t.Fatalf("wrong journal mode, exp wal, got %s", m)
+	}
+
+	if _, err := db.ExecuteStringStmt("CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)"); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %s", err.Error())
+	}
+	fi, err := os.Stat(path + "-wal")
+	if err != nil {
+		t.Fatalf("failed to stat WAL file: %s", err.Error())
+	}
+	if fi.Size() != 0 {
+		t.Fatalf("WAL file not truncated by checkpoint, size %d", fi.Size())
+	}
+}
+
+func Test_JournalModeInMemory(t *testing.T) {
+	db, err := OpenInMemory()
+	if err != nil {
+		t.Fatalf("failed to open in-memory database: %s", err.Error())
+	}
+	defer db.Close()
+
+	if err := db.SetJournalMode("WAL"); err == nil {
+		t.Fatal("set WAL journal mode on in-memory database")
+	}
+}
+
 func Test_ActiveTransaction(t *testing.T) {
 	db, path := mustCreateDatabase()
 	defer db.Close()
@@ -773,6 +1287,132 @@ func Test_PartialFailTransaction(t *testing.T) {
 	}
 }
 
+func Test_QueryWithContextCancel(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	mustExecute(db, "CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)")
+	mustExecute(db, `INSERT INTO foo(id, name) VALUES(1, "fiona")`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := db.QueryWithContext(ctx, []Statement{{"SELECT * FROM foo", nil}}, true, false)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if db.TransactionActive() {
+		t.Fatal("transaction still active after cancelled query")
+	}
+
+	_, err = db.ExecuteWithContext(ctx, []Statement{{`INSERT INTO foo(id, name) VALUES(2, "fiona")`, nil}}, true, false)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if db.TransactionActive() {
+		t.Fatal("transaction still active after cancelled execute")
+	}
+
+	r, err := db.QueryStringStmt("SELECT COUNT(*) FROM foo")
+	if err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+	if exp, got := `[{"columns":["COUNT(*)"],"types":[""],"values":[[1]]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+}
+
+func Test_ExecuteWithTimeout(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	mustExecute(db, "CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)")
+
+	stmts := []Statement{
+		{`INSERT INTO foo(id, name) VALUES(1, "fiona")`, nil},
+		{`WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c LIMIT 1000000000) SELECT count(*) FROM c`, nil},
+		{`INSERT INTO foo(id, name) VALUES(2, "fiona")`, nil},
+	}
+	r, err := db.ExecuteWithTimeout(stmts, false, false, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to execute: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":1,"rows_affected":1},{"error":"statement timed out"},{"last_insert_id":2,"rows_affected":1}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for execute, expected %s, got %s", exp, got)
+	}
+}
+
+func Test_ExecuteWithStepLimit(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	mustExecute(db, "CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)")
+
+	stmts := []Statement{
+		{`INSERT INTO foo(id, name) VALUES(1, "fiona")`, nil},
+		{`WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c LIMIT 1000000000) SELECT count(*) FROM c`, nil},
+		{`INSERT INTO foo(id, name) VALUES(2, "fiona")`, nil},
+	}
+
+	// Transactional batch should be entirely rolled back.
+	r, err := db.ExecuteWithStepLimit(stmts, true, false, 100000)
+	if err != nil {
+		t.Fatalf("failed to execute: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":1,"rows_affected":1},{"error":"statement timed out"}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for execute, expected %s, got %s", exp, got)
+	}
+	q, err := db.QueryStringStmt(`SELECT COUNT(*) FROM foo`)
+	if err != nil {
+		t.Fatalf("failed to query: %s", err.Error())
+	}
+	if exp, got := `[[0]]`, asJSON(q[0].Values); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+
+	// Non-transactional batch should continue past the interrupted statement.
+	r, err = db.ExecuteWithStepLimit(stmts, false, false, 100000)
+	if err != nil {
+		t.Fatalf("failed to execute: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":1,"rows_affected":1},{"error":"statement timed out"},{"last_insert_id":2,"rows_affected":1}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for execute, expected %s, got %s", exp, got)
+	}
+
+	// Statements within the limit are unaffected, and are committed.
+	r, err = db.ExecuteWithStepLimit([]Statement{
+		{`INSERT INTO foo(id, name) VALUES(3, "fiona")`, nil},
+		{`WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c LIMIT 10) SELECT count(*) FROM c`, nil},
+	}, true, false, 100000)
+	if err != nil {
+		t.Fatalf("failed to execute: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":3,"rows_affected":1},{"last_insert_id":3,"rows_affected":1}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for execute, expected %s, got %s", exp, got)
+	}
+	q, err = db.QueryStringStmt(`SELECT COUNT(*) FROM foo`)
+	if err != nil {
+		t.Fatalf("failed to query: %s", err.Error())
+	}
+	if exp, got := `[[3]]`, asJSON(q[0].Values); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+}
+
+func Test_RowsMakeAssociative(t *testing.T) {
+	r := &Rows{
+		Columns: []string{"id", "name", "id", "id:1", "id"},
+		Values:  [][]interface{}{{1, "fiona", 2, 3, 4}},
+	}
+	r.MakeAssociative()
+	if exp, got := `{"columns":["id","name","id","id:1","id"],"rows":[{"id":1,"id:1":3,"id:2":2,"id:3":4,"name":"fiona"}]}`, asJSON(r); exp != got {
+		t.Fatalf("unexpected associative rows, expected %s, got %s", exp, got)
+	}
+}
+
 func Test_Backup(t *testing.T) {
 	db, path := mustCreateDatabase()
 	defer db.Close()
@@ -870,6 +1510,60 @@ func Test_DumpMemory(t *testing.T) {
 	}
 }
 
+func Test_DumpJSONL(t *testing.T) {
+	t.Parallel()
+
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	_, err := db.ExecuteStringStmt(`
+CREATE TABLE foo (id integer not null primary key, name text);
+INSERT INTO foo(id, name) VALUES(1, "fiona");
+INSERT INTO foo(id, name) VALUES(2, "declan");
+CREATE TABLE bar (id integer not null primary key, age integer);
+INSERT INTO bar(id, age) VALUES(1, 20);
+`)
+	if err != nil {
+		t.Fatalf("failed to create tables: %s", err.Error())
+	}
+
+	var b strings.Builder
+	if err := db.DumpJSONL(&b, nil); err != nil {
+		t.Fatalf("failed to dump database: %s", err.Error())
+	}
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if exp, got := 5, len(lines); exp != got {
+		t.Fatalf("wrong number of lines, exp %d, got %d:\n%s", exp, got, b.String())
+	}
+
+	// Tables are dumped in name order, each starting with a header.
+	var hdr struct {
+		Table   string   `json:"table"`
+		Columns []string `json:"columns"`
+		Types   []string `json:"types"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &hdr); err != nil {
+		t.Fatalf("failed to parse header line: %s", err.Error())
+	}
+	if hdr.Table != "bar" || asJSON(hdr.Columns) != `["id","age"]` || asJSON(hdr.Types) != `["integer","integer"]` {
+		t.Fatalf("unexpected header: %s", lines[0])
+	}
+
+	var row map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[4]), &row); err != nil {
+		t.Fatalf("failed to parse row line: %s", err.Error())
+	}
+	if row["id"] != float64(2) || row["name"] != "declan" {
+		t.Fatalf("unexpected row: %s", lines[4])
+	}
+
+	if exp, got := `{"table":"foo","columns":["id","name"],"types":["integer","text"]}`, lines[2]; exp != got {
+		t.Fatalf("unexpected header\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
 func mustCreateDatabase() (*DB, string) {
 	var err error
 	f, err := ioutil.TempFile("", "rqlilte-test-")
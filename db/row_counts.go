@@ -0,0 +1,196 @@
+package db
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// rowCounter maintains the number of rows in each table of the main
+// database, from the rows SQLite reports as inserted and deleted. Changes
+// are held as pending until the transaction making them commits, and are
+// discarded if it rolls back. It is safe for concurrent use.
+type rowCounter struct {
+	mu      sync.Mutex
+	counts  map[string]int64
+	pending map[string]int64
+}
+
+// update records the insertion or deletion of a row of table.
+func (c *rowCounter) update(op int, dbName, table string, rowid int64) {
+	if dbName != "main" || strings.HasPrefix(table, "sqlite_") {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch op {
+	case sqlite3.SQLITE_INSERT:
+		c.pending[table]++
+	case sqlite3.SQLITE_DELETE:
+		c.pending[table]--
+	}
+}
+
+// commit applies the pending changes to the counts.
+func (c *rowCounter) commit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for t, n := range c.pending {
+		if _, ok := c.counts[t]; ok {
+			c.counts[t] += n
+		}
+	}
+	c.pending = make(map[string]int64)
+	return 0
+}
+
+// rollback discards the pending changes.
+func (c *rowCounter) rollback() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = make(map[string]int64)
+}
+
+// copy returns a copy of the counts.
+func (c *rowCounter) copy() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[string]int64, len(c.counts))
+	for t, n := range c.counts {
+		m[t] = n
+	}
+	return m
+}
+
+// TableRowCounts returns the approximate number of rows in each table of the
+// main database. The tables are counted on the first call, and from then on
+// the counts are maintained as rows are inserted and deleted, so later calls
+// do not scan any table. Tables created or dropped are counted, or removed,
+// by an Execute which may change the schema. The counts are approximate, as
+// SQLite does not report every change: a DELETE with no WHERE clause removes
+// all rows at once without reporting them, as does a REPLACE of a conflicting
+// row, and changes to WITHOUT ROWID tables are never reported. A statement
+// which fails part way may also leave the rows it changed before failing
+// counted.
+func (db *DB) TableRowCounts() (map[string]int64, error) {
+	db.mu.RLock()
+	c := db.rowCounts
+	db.mu.RUnlock()
+	if c != nil {
+		return c.copy(), nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.rowCounts == nil {
+		c := &rowCounter{
+			counts:  make(map[string]int64),
+			pending: make(map[string]int64),
+		}
+		if err := db.countTables(c); err != nil {
+			return nil, err
+		}
+		db.rowCounts = c
+		db.registerUpdateHook()
+		db.sqlite3conn.RegisterCommitHook(c.commit)
+		db.sqlite3conn.RegisterRollbackHook(c.rollback)
+	}
+	return db.rowCounts.copy(), nil
+}
+
+// registerUpdateHook registers the hook through which rows are counted, if
+// they are, in place of any other update hook.
+func (db *DB) registerUpdateHook() {
+	if db.rowCounts == nil {
+		db.sqlite3conn.RegisterUpdateHook(nil)
+		return
+	}
+	db.sqlite3conn.RegisterUpdateHook(db.rowCounts.update)
+}
+
+// syncRowCounts counts the rows of any table created since the tables were
+// last counted, and stops counting any dropped. If recount is set, every
+// table is counted again, as one may have been dropped and created anew. If
+// the tables cannot be counted, counting stops, so the next call to
+// TableRowCounts counts every table. It must be called with mu held for
+// writing.
+func (db *DB) syncRowCounts(recount bool) {
+	if db.rowCounts == nil {
+		return
+	}
+	if recount {
+		db.rowCounts.mu.Lock()
+		db.rowCounts.counts = make(map[string]int64)
+		db.rowCounts.mu.Unlock()
+	}
+	if err := db.countTables(db.rowCounts); err != nil {
+		db.rowCounts = nil
+		db.registerUpdateHook()
+		db.sqlite3conn.RegisterCommitHook(nil)
+		db.sqlite3conn.RegisterRollbackHook(nil)
+	}
+}
+
+// countTables counts the rows of each table of the main database not already
+// counted by c, and removes from c any table which no longer exists. The
+// tables are counted without c locked, as its hooks may run meanwhile.
+func (db *DB) countTables(c *rowCounter) error {
+	tables, err := db.queryColumn(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return err
+	}
+	counted := c.copy()
+
+	counts := make(map[string]int64, len(tables))
+	for _, v := range tables {
+		t := v.(string)
+		if n, ok := counted[t]; ok {
+			counts[t] = n
+			continue
+		}
+		n, err := db.queryColumn(fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, strings.Replace(t, `"`, `""`, -1)))
+		if err != nil {
+			return err
+		}
+		counts[t] = n[0].(int64)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for t := range c.counts {
+		if _, ok := counts[t]; !ok {
+			delete(c.counts, t)
+		}
+	}
+	for t, n := range counts {
+		if _, ok := c.counts[t]; !ok {
+			c.counts[t] = n
+		}
+	}
+	return nil
+}
+
+// queryColumn returns the first column of each row returned by query.
+func (db *DB) queryColumn(query string) ([]driver.Value, error) {
+	rs, err := db.sqlite3conn.Query(query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var values []driver.Value
+	dest := make([]driver.Value, len(rs.Columns()))
+	for {
+		if err := rs.Next(dest); err != nil {
+			if err == io.EOF {
+				return values, nil
+			}
+			return nil, err
+		}
+		values = append(values, dest[0])
+	}
+}
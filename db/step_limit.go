@@ -0,0 +1,88 @@
+package db
+
+/*
+#include <stdlib.h>
+
+typedef struct sqlite3 sqlite3;
+void sqlite3_progress_handler(sqlite3*, int, int(*)(void*), void*);
+
+// step_limit_progress counts down the callbacks remaining to the statement
+// being executed, interrupting it once none remain.
+static int step_limit_progress(void *p) {
+	long long *remaining = p;
+	return --*remaining < 0;
+}
+
+static void step_limit_set(void *db, int n, long long *remaining) {
+	sqlite3_progress_handler((sqlite3*)db, n, remaining ? step_limit_progress : 0, remaining);
+}
+*/
+import "C"
+
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// stepLimitInterval is the number of SQLite virtual machine instructions
+// between checks of a step limit, which is therefore counted in multiples
+// of it.
+const stepLimitInterval = 1000
+
+// stepLimit interrupts statements executed on a connection once each has
+// executed more than a given number of SQLite virtual machine instructions.
+// As the instructions executed by a statement depend only on the statement
+// and the database, a statement is interrupted at the same point wherever
+// it is executed, unlike with a timeout.
+type stepLimit struct {
+	conn      *sqlite3.SQLiteConn
+	steps     int64
+	remaining *C.longlong
+}
+
+// newStepLimit returns a stepLimit of steps instructions for each statement
+// executed on conn, or nil if steps is not positive. It must be closed once
+// the statements have been executed.
+func newStepLimit(conn *sqlite3.SQLiteConn, steps int64) *stepLimit {
+	if steps <= 0 {
+		return nil
+	}
+	l := &stepLimit{
+		conn:      conn,
+		steps:     steps,
+		remaining: (*C.longlong)(C.malloc(C.size_t(unsafe.Sizeof(C.longlong(0))))),
+	}
+	C.step_limit_set(sqliteHandle(conn), stepLimitInterval, l.remaining)
+	return l
+}
+
+// reset allows the next statement the full number of steps.
+func (l *stepLimit) reset() {
+	if l == nil {
+		return
+	}
+	*l.remaining = C.longlong((l.steps + stepLimitInterval - 1) / stepLimitInterval)
+}
+
+// exceeded returns whether the last statement executed ran out of steps.
+func (l *stepLimit) exceeded() bool {
+	return l != nil && *l.remaining < 0
+}
+
+// close removes the limit from the connection.
+func (l *stepLimit) close() {
+	if l == nil {
+		return
+	}
+	C.step_limit_set(sqliteHandle(l.conn), 0, nil)
+	C.free(unsafe.Pointer(l.remaining))
+}
+
+// sqliteHandle returns the sqlite3 handle of conn, which the driver does
+// not export.
+func sqliteHandle(conn *sqlite3.SQLiteConn) unsafe.Pointer {
+	f := reflect.ValueOf(conn).Elem().FieldByName("db")
+	return *(*unsafe.Pointer)(unsafe.Pointer(f.UnsafeAddr()))
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"container/list"
+	"database/sql/driver"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// stmtCache caches prepared statements, keyed by their SQL text, so queries
+// run repeatedly are not parsed and planned each time. The least recently
+// used statements are finalized once the cache holds size statements. A
+// statement is taken out of the cache while it is in use, as queries may
+// run concurrently, and returned once its rows are closed. It is safe for
+// concurrent use. All methods are no-ops on a nil stmtCache, so that it can
+// be left in place when caching is disabled.
+type stmtCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // Most recently used at the front.
+	hits    uint64
+	misses  uint64
+}
+
+type stmtCacheEntry struct {
+	query string
+	stmt  driver.Stmt
+}
+
+// newStmtCache returns an empty cache holding at most size statements.
+func newStmtCache(size int) *stmtCache {
+	return &stmtCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// take removes the statement prepared for query from the cache, and returns
+// it, or nil if there is none.
+func (c *stmtCache) take(query string) driver.Stmt {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[query]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.remove(e)
+	return e.Value.(*stmtCacheEntry).stmt
+}
+
+// put returns stmt, prepared for query, to the cache. It is finalized
+// instead if the cache already holds a statement for query, as happens when
+// the same query runs concurrently.
+func (c *stmtCache) put(query string, stmt driver.Stmt) {
+	if c == nil {
+		stmt.Close()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[query]; ok {
+		stmt.Close()
+		return
+	}
+	c.entries[query] = c.lru.PushFront(&stmtCacheEntry{query: query, stmt: stmt})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.remove(e)
+		e.Value.(*stmtCacheEntry).stmt.Close()
+	}
+}
+
+// clear finalizes every statement in the cache. It is called with the
+// database locked for writing, so no statement is in use.
+func (c *stmtCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		e.Value.(*stmtCacheEntry).stmt.Close()
+	}
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Stats returns statistics about the cache.
+func (c *stmtCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"hits":    c.hits,
+		"misses":  c.misses,
+		"entries": c.lru.Len(),
+		"size":    c.size,
+	}
+}
+
+func (c *stmtCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*stmtCacheEntry).query)
+}
+
+// cachedRows are the rows of a query run using a cached statement. Closing
+// them returns the statement to the cache.
+type cachedRows struct {
+	*sqlite3.SQLiteRows
+	cache  *stmtCache
+	query  string
+	stmt   driver.Stmt
+	closed bool
+}
+
+// Close closes the rows, and returns their statement to the cache.
+func (r *cachedRows) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.SQLiteRows.Close()
+	if err != nil {
+		r.stmt.Close()
+		return err
+	}
+	r.cache.put(r.query, r.stmt)
+	return nil
+}
@@ -325,7 +325,7 @@ func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := s.store.Join(remoteID.(string), remoteAddr.(string), voter.(bool), m); err != nil {
-		if err == store.ErrNotLeader {
+		if errors.Is(err, store.ErrNotLeader) {
 			leaderAPIAddr := s.LeaderAPIAddr()
 			leaderProto := s.LeaderAPIProto()
 			if leaderAPIAddr == "" {
@@ -380,7 +380,7 @@ func (s *Service) handleRemove(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := s.store.Remove(remoteID); err != nil {
-		if err == store.ErrNotLeader {
+		if errors.Is(err, store.ErrNotLeader) {
 			leaderAPIAddr := s.LeaderAPIAddr()
 			leaderProto := s.LeaderAPIProto()
 			if leaderAPIAddr == "" {
@@ -424,7 +424,7 @@ func (s *Service) handleBackup(w http.ResponseWriter, r *http.Request) {
 
 	err = s.store.Backup(!noLeader, bf, w)
 	if err != nil {
-		if err == store.ErrNotLeader {
+		if errors.Is(err, store.ErrNotLeader) {
 			leaderAPIAddr := s.LeaderAPIAddr()
 			leaderProto := s.LeaderAPIProto()
 			if leaderAPIAddr == "" {
@@ -478,9 +478,9 @@ func (s *Service) handleLoad(w http.ResponseWriter, r *http.Request) {
 		stmts[i].Query = queries[i]
 	}
 
-	results, err := s.store.ExecuteOrAbort(&store.ExecuteRequest{stmts, timings, false})
+	results, err := s.store.ExecuteOrAbort(&store.ExecuteRequest{Stmts: stmts, Timings: timings, Tx: false})
 	if err != nil {
-		if err == store.ErrNotLeader {
+		if errors.Is(err, store.ErrNotLeader) {
 			leaderAPIAddr := s.LeaderAPIAddr()
 			leaderProto := s.LeaderAPIProto()
 			if leaderAPIAddr == "" {
@@ -626,9 +626,9 @@ func (s *Service) handleExecute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results, err := s.store.Execute(&store.ExecuteRequest{stmts, timings, isTx})
+	results, err := s.store.Execute(&store.ExecuteRequest{Stmts: stmts, Timings: timings, Tx: isTx})
 	if err != nil {
-		if err == store.ErrNotLeader {
+		if errors.Is(err, store.ErrNotLeader) {
 			leaderAPIAddr := s.LeaderAPIAddr()
 			leaderProto := s.LeaderAPIProto()
 			if leaderAPIAddr == "" {
@@ -695,9 +695,9 @@ func (s *Service) handleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results, err := s.store.Query(&store.QueryRequest{queries, timings, isTx, lvl, frsh})
+	results, err := s.store.Query(&store.QueryRequest{Stmts: queries, Timings: timings, Tx: isTx, Lvl: lvl, Freshness: frsh})
 	if err != nil {
-		if err == store.ErrNotLeader {
+		if errors.Is(err, store.ErrNotLeader) {
 			leaderAPIAddr := s.LeaderAPIAddr()
 			leaderProto := s.LeaderAPIProto()
 			if leaderAPIAddr == "" {
@@ -835,7 +835,7 @@ func requestQueries(r *http.Request) ([]store.Statement, error) {
 			return nil, errors.New("bad query GET request")
 		}
 		return []store.Statement{
-			{query, nil},
+			{Query: query},
 		}, nil
 	}
 
@@ -985,6 +985,10 @@ func backupFormat(w http.ResponseWriter, r *http.Request) (store.BackupFormat, e
 		w.Header().Set("Content-Type", "application/sql")
 		return store.BackupSQL, nil
 	}
+	if fmt == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		return store.BackupJSONL, nil
+	}
 	w.Header().Set("Content-Type", "application/octet-stream")
 	return store.BackupBinary, nil
 }
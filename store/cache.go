@@ -0,0 +1,166 @@
+package store
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	sql "github.com/rqlite/rqlite/db"
+)
+
+// defaultQueryCacheSize is the number of results cached if a TTL is set but
+// no size is given.
+const defaultQueryCacheSize = 100
+
+// queryCache caches the results of local queries, keyed by their statements,
+// for at most ttl. The least recently used results are evicted once the
+// cache holds size results. The whole cache is invalidated whenever the
+// database changes. It is safe for concurrent use. All methods are no-ops
+// on a nil queryCache, so that lookups can be left in place when caching
+// is disabled.
+type queryCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // Most recently used at the front.
+	gen     uint64     // Incremented by each invalidation.
+	hits    uint64
+	misses  uint64
+}
+
+type queryCacheEntry struct {
+	key     string
+	rows    []*sql.Rows
+	expires time.Time
+}
+
+// newQueryCache returns an empty cache.
+func newQueryCache(ttl time.Duration, size int) *queryCache {
+	if size <= 0 {
+		size = defaultQueryCacheSize
+	}
+	return &queryCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the cached results for key, if any, and the generation of the
+// cache. The generation must be passed to Put when caching the results of
+// a miss, so results read before an invalidation are not cached after it.
+func (c *queryCache) Get(key string) ([]*sql.Rows, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.Value.(*queryCacheEntry).expires) {
+		c.remove(e)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil, c.gen, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+
+	// The results are as stale as when read, plus the time since.
+	entry := e.Value.(*queryCacheEntry)
+	age := c.ttl - time.Until(entry.expires)
+	rows := copyRows(entry.rows)
+	for _, r := range rows {
+		r.StaleFor += age
+	}
+	return rows, c.gen, true
+}
+
+// Put caches rows for key, unless the cache has been invalidated since gen
+// was returned by Get.
+func (c *queryCache) Put(key string, gen uint64, rows []*sql.Rows) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&queryCacheEntry{
+		key:     key,
+		rows:    copyRows(rows),
+		expires: time.Now().Add(c.ttl),
+	})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Invalidate removes every cached result.
+func (c *queryCache) Invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Stats returns the hit and miss counts of the cache, and its size.
+func (c *queryCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"hits":    c.hits,
+		"misses":  c.misses,
+		"entries": c.lru.Len(),
+		"size":    c.size,
+		"ttl":     c.ttl.String(),
+	}
+}
+
+func (c *queryCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*queryCacheEntry).key)
+}
+
+// queryCacheKey returns the cache key of qr, or false if the results of qr
+// may not be cached. Only None reads without timings are cached.
+func queryCacheKey(qr *QueryRequest) (string, bool) {
+	if qr.Lvl != None || qr.Timings {
+		return "", false
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%t %d %t", qr.Tx, qr.MaxRows, qr.DescribeOnly)
+	for _, s := range qr.Stmts {
+		fmt.Fprintf(&b, "\x00%q", s.Query)
+		for _, v := range s.Parameters {
+			fmt.Fprintf(&b, " %T:%#v", v, v)
+		}
+	}
+	return b.String(), true
+}
+
+// copyRows returns a copy of rows, so that callers may convert the copy to
+// associative form without changing the original. The values are shared.
+func copyRows(rows []*sql.Rows) []*sql.Rows {
+	c := make([]*sql.Rows, len(rows))
+	for i, r := range rows {
+		rc := *r
+		c[i] = &rc
+	}
+	return c
+}
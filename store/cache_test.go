@@ -0,0 +1,65 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	sql "github.com/rqlite/rqlite/db"
+)
+
+func Test_QueryCacheEviction(t *testing.T) {
+	c := newQueryCache(time.Minute, 2)
+	for _, k := range []string{"a", "b"} {
+		_, gen, _ := c.Get(k)
+		c.Put(k, gen, []*sql.Rows{{Columns: []string{k}}})
+	}
+	c.Get("a") // Make "b" the least recently used.
+	_, gen, _ := c.Get("c")
+	c.Put("c", gen, nil)
+
+	if _, _, ok := c.Get("b"); ok {
+		t.Fatalf("least recently used result not evicted")
+	}
+	if r, _, ok := c.Get("a"); !ok || r[0].Columns[0] != "a" {
+		t.Fatalf("recently used result evicted")
+	}
+}
+
+func Test_QueryCacheExpiry(t *testing.T) {
+	c := newQueryCache(10*time.Millisecond, 0)
+	_, gen, _ := c.Get("a")
+	c.Put("a", gen, nil)
+	if _, _, ok := c.Get("a"); !ok {
+		t.Fatalf("result not cached")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, _, ok := c.Get("a"); ok {
+		t.Fatalf("expired result returned")
+	}
+}
+
+func Test_QueryCacheInvalidate(t *testing.T) {
+	c := newQueryCache(time.Minute, 0)
+	_, gen, _ := c.Get("a")
+	c.Put("a", gen, nil)
+
+	// Results read before an invalidation are not cached after it.
+	_, gen, _ = c.Get("b")
+	c.Invalidate()
+	c.Put("b", gen, nil)
+	if _, _, ok := c.Get("a"); ok {
+		t.Fatalf("result cached after invalidation")
+	}
+	if _, _, ok := c.Get("b"); ok {
+		t.Fatalf("stale result cached after invalidation")
+	}
+}
+
+func Test_QueryCacheNil(t *testing.T) {
+	var c *queryCache
+	c.Put("a", 0, nil)
+	c.Invalidate()
+	if _, _, ok := c.Get("a"); ok {
+		t.Fatalf("nil cache returned result")
+	}
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"math"
+	"time"
+
+	sql "github.com/rqlite/rqlite/db"
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// checksumRows returns the CRC-64 (ECMA) checksum of the columns and values
+// of r, in order, as 16 hex digits. Each value is encoded with its type, so
+// that values which print alike, such as the integer 1 and the text "1",
+// are not confused. The declared types of the columns, and the time taken
+// by the query, are not covered.
+func checksumRows(r *sql.Rows) string {
+	h := crc64.New(crc64Table)
+	writeChecksumLen(h, len(r.Columns))
+	for _, c := range r.Columns {
+		writeChecksumBytes(h, 's', []byte(c))
+	}
+	writeChecksumLen(h, len(r.Values))
+	for _, row := range r.Values {
+		for _, v := range row {
+			writeChecksumValue(h, v)
+		}
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func writeChecksumValue(h hash.Hash64, v interface{}) {
+	var b [9]byte
+	switch v := v.(type) {
+	case nil:
+		h.Write([]byte{'n'})
+	case int64:
+		b[0] = 'i'
+		binary.BigEndian.PutUint64(b[1:], uint64(v))
+		h.Write(b[:])
+	case float64:
+		b[0] = 'f'
+		binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+		h.Write(b[:])
+	case bool:
+		b[0] = 'i'
+		if v {
+			b[8] = 1
+		}
+		h.Write(b[:])
+	case string:
+		writeChecksumBytes(h, 's', []byte(v))
+	case []byte:
+		writeChecksumBytes(h, 'b', v)
+	case time.Time:
+		writeChecksumBytes(h, 's', []byte(v.Format(time.RFC3339Nano)))
+	default:
+		writeChecksumBytes(h, 's', []byte(fmt.Sprint(v)))
+	}
+}
+
+// writeChecksumBytes writes b to h, preceded by its type and length.
+func writeChecksumBytes(h hash.Hash64, typ byte, b []byte) {
+	h.Write([]byte{typ})
+	writeChecksumLen(h, len(b))
+	h.Write(b)
+}
+
+func writeChecksumLen(h hash.Hash64, n int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	h.Write(b[:])
+}
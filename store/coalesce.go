@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hashicorp/raft"
+	sql "github.com/rqlite/rqlite/db"
+)
+
+// maxCoalescedExecutes is the most Executes written to a single Raft log
+// entry, so that entries stay a manageable size however busy the leader.
+const maxCoalescedExecutes = 256
+
+// pendingExecute is an Execute waiting to be written to the Raft log, along
+// with any others which arrive within the batch window.
+type pendingExecute struct {
+	d    *databaseSub
+	done chan executeResult // Buffered, so the result is never blocked on.
+}
+
+type executeResult struct {
+	results []*sql.Result
+	err     error
+}
+
+// executeCoalesced passes d to coalesceExecutes, and waits for the results of
+// applying it. As with any Execute, if ctx is done first, the change may
+// still be applied.
+func (s *Store) executeCoalesced(ctx context.Context, d *databaseSub) ([]*sql.Result, error) {
+	p := &pendingExecute{d: d, done: make(chan executeResult, 1)}
+	select {
+	case s.coalesceCh <- p:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, raft.ErrRaftShutdown
+	}
+
+	select {
+	case r := <-p.done:
+		return r.results, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// coalesceExecutes collects the Executes arriving within the batch window of
+// the first, and writes them to the Raft log as a single entry.
+func (s *Store) coalesceExecutes() {
+	for {
+		var batch []*pendingExecute
+		select {
+		case p := <-s.coalesceCh:
+			batch = append(batch, p)
+		case <-s.done:
+			return
+		}
+
+		tmr := time.NewTimer(s.batchWindow)
+	collect:
+		for len(batch) < maxCoalescedExecutes {
+			select {
+			case p := <-s.coalesceCh:
+				batch = append(batch, p)
+			case <-tmr.C:
+				break collect
+			case <-s.done:
+				tmr.Stop()
+				for _, p := range batch {
+					p.done <- executeResult{err: raft.ErrRaftShutdown}
+				}
+				return
+			}
+		}
+		tmr.Stop()
+		s.applyCoalesced(batch)
+	}
+}
+
+// applyCoalesced writes batch to the Raft log, as a single Execute if it
+// holds only one, and passes each Execute its own results once applied. The
+// entry is written before applyCoalesced returns, so batches are applied in
+// the order they are collected.
+func (s *Store) applyCoalesced(batch []*pendingExecute) {
+	fail := func(err error) {
+		for _, p := range batch {
+			p.done <- executeResult{err: err}
+		}
+	}
+
+	var c *command
+	var err error
+	if len(batch) == 1 {
+		c, err = newCommand(execute, batch[0].d)
+	} else {
+		subs := make([]*databaseSub, len(batch))
+		for i := range batch {
+			subs[i] = batch[i].d
+		}
+		c, err = newCommand(executeMulti, &multiExecuteSub{Subs: subs})
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	epoch, start := s.leaderEpoch(), time.Now()
+	f := s.raft.Apply(b, s.ApplyTimeout)
+	go func() {
+		if err := s.waitForApply(context.Background(), f); err != nil {
+			fail(err)
+			return
+		}
+		s.latency.executeApply.Since(start)
+		s.setLeaderConfirmed(epoch, start, true)
+
+		var responses []*fsmExecuteResponse
+		switch r := f.Response().(type) {
+		case *fsmExecuteResponse:
+			responses = []*fsmExecuteResponse{r}
+		case *fsmMultiExecuteResponse:
+			responses = r.responses
+		case *fsmGenericResponse:
+			fail(r.error)
+			return
+		}
+		for i, p := range batch {
+			r := responses[i]
+			if r.error == nil {
+				for _, res := range r.results {
+					res.RaftIndex = f.Index()
+				}
+			}
+			p.done <- executeResult{results: r.results, err: r.error}
+		}
+	}()
+}
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	sql "github.com/rqlite/rqlite/db"
+)
+
+// ColumnType is the type of the values held by a Column.
+type ColumnType int
+
+const (
+	// ColumnNull is the type of a column holding only NULLs.
+	ColumnNull ColumnType = iota
+
+	// ColumnInt64 is the type of a column holding integers. Booleans are
+	// held as 0 and 1.
+	ColumnInt64
+
+	// ColumnFloat64 is the type of a column holding reals, or a mix of
+	// reals and integers.
+	ColumnFloat64
+
+	// ColumnString is the type of a column holding text, or a mix of
+	// values of different types, each formatted as text. Times are
+	// formatted as RFC 3339, with nanoseconds.
+	ColumnString
+
+	// ColumnBytes is the type of a column holding blobs.
+	ColumnBytes
+)
+
+// String returns the name of the type.
+func (t ColumnType) String() string {
+	switch t {
+	case ColumnNull:
+		return "null"
+	case ColumnInt64:
+		return "int64"
+	case ColumnFloat64:
+		return "float64"
+	case ColumnString:
+		return "string"
+	case ColumnBytes:
+		return "bytes"
+	}
+	return fmt.Sprintf("ColumnType(%d)", int(t))
+}
+
+// Column holds every value of one column of a result. Only the slice for
+// Type is set, and it holds a value for every row, the zero value for a
+// NULL. Nulls is a bitmap, in which the bit for row i, bit i%8 of byte i/8,
+// is set if that row is NULL. It is nil if no row is NULL.
+type Column struct {
+	Name     string     `json:"name"`
+	DeclType string     `json:"decl_type,omitempty"`
+	Type     ColumnType `json:"type"`
+	Int64s   []int64    `json:"int64s,omitempty"`
+	Float64s []float64  `json:"float64s,omitempty"`
+	Strings  []string   `json:"strings,omitempty"`
+	Bytes    [][]byte   `json:"bytes,omitempty"`
+	Nulls    []byte     `json:"nulls,omitempty"`
+}
+
+// IsNull returns whether row i of the column is NULL.
+func (c *Column) IsNull(i int) bool {
+	return i/8 < len(c.Nulls) && c.Nulls[i/8]&(1<<uint(i%8)) != 0
+}
+
+// ColumnarRows is the result of a query, held column by column rather than
+// row by row.
+type ColumnarRows struct {
+	Columns []*Column `json:"columns,omitempty"`
+	NumRows int       `json:"num_rows"`
+	Error   string    `json:"error,omitempty"`
+	Time    float64   `json:"time,omitempty"`
+}
+
+// QueryColumnar executes queries as Query does, but returns the results
+// column by column, each column a slice of a single type. The type of each
+// column is chosen from the values it holds, as SQLite does not require
+// every value of a column to be of its declared type. qr.Associative is
+// ignored.
+func (s *Store) QueryColumnar(qr *QueryRequest) ([]*ColumnarRows, error) {
+	cqr := *qr
+	cqr.Associative = false
+	rows, err := s.Query(&cqr)
+	if err != nil {
+		return nil, err
+	}
+	crs := make([]*ColumnarRows, len(rows))
+	for i := range rows {
+		crs[i] = newColumnarRows(rows[i])
+	}
+	return crs, nil
+}
+
+// newColumnarRows returns r column by column.
+func newColumnarRows(r *sql.Rows) *ColumnarRows {
+	cr := &ColumnarRows{
+		Columns: make([]*Column, len(r.Columns)),
+		NumRows: len(r.Values),
+		Error:   r.Error,
+		Time:    r.Time,
+	}
+	for j := range r.Columns {
+		c := &Column{Name: r.Columns[j]}
+		if j < len(r.Types) {
+			c.DeclType = r.Types[j]
+		}
+		c.fill(r.Values, j)
+		cr.Columns[j] = c
+	}
+	return cr
+}
+
+// fill sets the column from column j of values.
+func (c *Column) fill(values [][]interface{}, j int) {
+	for i := range values {
+		v := columnValue(values[i][j])
+		if v == nil {
+			if c.Nulls == nil {
+				c.Nulls = make([]byte, (len(values)+7)/8)
+			}
+			c.Nulls[i/8] |= 1 << uint(i%8)
+			continue
+		}
+		c.Type = widenColumnType(c.Type, columnTypeOf(v))
+	}
+
+	n := len(values)
+	switch c.Type {
+	case ColumnInt64:
+		c.Int64s = make([]int64, n)
+	case ColumnFloat64:
+		c.Float64s = make([]float64, n)
+	case ColumnString:
+		c.Strings = make([]string, n)
+	case ColumnBytes:
+		c.Bytes = make([][]byte, n)
+	}
+	for i := range values {
+		if c.IsNull(i) {
+			continue
+		}
+		switch v := columnValue(values[i][j]); c.Type {
+		case ColumnInt64:
+			c.Int64s[i] = v.(int64)
+		case ColumnFloat64:
+			switch f := v.(type) {
+			case int64:
+				c.Float64s[i] = float64(f)
+			case float64:
+				c.Float64s[i] = f
+			}
+		case ColumnString:
+			c.Strings[i] = formatColumnValue(v)
+		case ColumnBytes:
+			c.Bytes[i] = v.([]byte)
+		}
+	}
+}
+
+// columnValue returns v as one of the types held by a Column, or nil if v is
+// NULL.
+func columnValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+func columnTypeOf(v interface{}) ColumnType {
+	switch v.(type) {
+	case int64:
+		return ColumnInt64
+	case float64:
+		return ColumnFloat64
+	case []byte:
+		return ColumnBytes
+	}
+	return ColumnString
+}
+
+// widenColumnType returns the type of a column holding values of both t
+// and u.
+func widenColumnType(t, u ColumnType) ColumnType {
+	switch {
+	case t == ColumnNull || t == u:
+		return u
+	case u == ColumnNull:
+		return t
+	case (t == ColumnInt64 || t == ColumnFloat64) && (u == ColumnInt64 || u == ColumnFloat64):
+		return ColumnFloat64
+	}
+	return ColumnString
+}
+
+func formatColumnValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
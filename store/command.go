@@ -12,6 +12,12 @@ const (
 	query                             // Commands which query the database.
 	metadataSet                       // Commands which sets Store metadata
 	metadataDelete                    // Commands which deletes Store metadata
+	load                              // Commands which replace the database.
+	vacuum                            // Commands which vacuum the database.
+	executeBatch                      // Commands which execute one statement many times.
+	executeMulti                      // Commands which carry several Executes.
+	reindex                           // Commands which rebuild indexes.
+	quiesce                           // Commands which stop or resume changes.
 )
 
 type command struct {
@@ -46,9 +52,48 @@ type databaseSub struct {
 	Queries    []string  `json:"queries,omitempty"`
 	Parameters [][]Value `json:"Parameters,omitempty`
 	Timings    bool      `json:"timings,omitempty"`
+	MaxRows    int       `json:"max_rows,omitempty"`
+
+	// StepLimit, if non-zero, is the number of SQLite virtual machine
+	// instructions any single statement may execute before it is
+	// interrupted, so that it is interrupted at the same point on every node.
+	StepLimit int64 `json:"step_limit,omitempty"`
+
+	// IdempotencyKey, if set, identifies a change which is applied at most
+	// once while its record is kept. Time is when the leader proposed the
+	// change, and Expires is when its record may be discarded, both as Unix
+	// times in nanoseconds.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	Time           int64  `json:"time,omitempty"`
+	Expires        int64  `json:"expires,omitempty"`
+
+	// ReturnChangedRows, if set, reports the rows changed by each statement.
+	ReturnChangedRows bool `json:"return_changed_rows,omitempty"`
+
+	// DescribeOnly, if set, returns the columns of each query, but no rows.
+	DescribeOnly bool `json:"describe_only,omitempty"`
+}
+
+// batchSub is a command sub which executes a single query once for each
+// set of parameters.
+type batchSub struct {
+	Query      string    `json:"query,omitempty"`
+	Parameters [][]Value `json:"parameters,omitempty"`
+	Timings    bool      `json:"timings,omitempty"`
+}
+
+// multiExecuteSub is a command sub which carries several Executes, written
+// to the log as one entry, and applied in order.
+type multiExecuteSub struct {
+	Subs []*databaseSub `json:"subs,omitempty"`
 }
 
 type metadataSetSub struct {
 	RaftID string            `json:"raft_id,omitempty"`
 	Data   map[string]string `json:"data,omitempty"`
 }
+
+// loadSub is a command sub which carries a complete SQLite database file.
+type loadSub struct {
+	DB []byte `json:"db,omitempty"`
+}
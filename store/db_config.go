@@ -1,9 +1,77 @@
 package store
 
+import (
+	"time"
+)
+
 // DBConfig represents the configuration of the underlying SQLite database.
+// It is applied each time the database is opened. Once the Store is open,
+// only BusyTimeout may be changed, by Store.SetBusyTimeout. DSN, Memory,
+// JournalMode, Pragmas, Attach and Functions are fixed for the life of the
+// Store.
 type DBConfig struct {
 	DSN    string // Any custom DSN
 	Memory bool   // Whether the database is in-memory only.
+
+	// BusyTimeout, if non-zero, sets the SQLite busy timeout. If zero, the
+	// driver's default is used.
+	BusyTimeout time.Duration
+
+	// JournalMode, if set, is the SQLite journal mode of the database, for
+	// example "DELETE" or "WAL". WAL is only supported for on-disk databases.
+	JournalMode string
+
+	// Pragmas are set on the database connection, in name order, every
+	// time the database is opened. Each node applies its own pragmas, so
+	// any pragma which changes the result of a statement, such as
+	// foreign_keys, must be set identically on every node, or nodes may
+	// diverge. Pragmas which set the on-disk format are rejected.
+	Pragmas map[string]string
+
+	// Attach lists additional databases, attached to the connection in name
+	// order, so statements may reference their tables as name.table. They
+	// are part of the replicated state: they are changed only through the
+	// Raft log, and are included in snapshots, after the main database. So
+	// every node must be configured with the same databases, from when the
+	// cluster is first created. Backups, and Reload, cover only the main
+	// database.
+	Attach []AttachedDB
+
+	// Functions are registered as SQL scalar functions every time the
+	// database is opened. Every node executes each statement itself, so a
+	// function must be deterministic, returning the same result for the same
+	// arguments on every node, at any time, or the nodes' databases may
+	// diverge. Every node must be configured with the same functions. They
+	// should not be referenced by the schema, such as by an index or a CHECK
+	// constraint, as snapshots are checked on a connection without them.
+	Functions []Function
+
+	// CoerceIntegerParams, if set, binds float64 parameters with no
+	// fractional part as integers. Numbers decoded from JSON, as sent by
+	// clients and as held in the Raft log, are float64, even when they are
+	// integers. Integers of magnitude above 2^53 cannot be carried exactly by
+	// float64, so are left unchanged, and should be sent as literals in the
+	// statement instead. It must be set identically on every node.
+	CoerceIntegerParams bool
+}
+
+// Function is a Go function registered as the SQL scalar function Name. Its
+// arity is that of Impl, which may be variadic, and its arguments and result
+// must be types supported by the SQLite driver, such as int64, float64,
+// string and []byte. Deterministic tells SQLite that the function has no
+// side effects, so that it may optimize calls to it. It does not relax the
+// requirement that every function be deterministic.
+type Function struct {
+	Name          string
+	Impl          interface{} `json:"-"`
+	Deterministic bool
+}
+
+// AttachedDB is an additional database attached under Name. It is kept in
+// memory if Memory is set, and otherwise in a file in the Store directory.
+type AttachedDB struct {
+	Name   string
+	Memory bool
 }
 
 // NewDBConfig returns a new DB config instance.
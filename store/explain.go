@@ -0,0 +1,47 @@
+package store
+
+import (
+	"errors"
+	"strings"
+)
+
+// PlanStep is one step of a query plan, as reported by EXPLAIN QUERY PLAN.
+// Steps form a tree, in which each step is a child of the step whose ID is
+// its Parent. Top-level steps have a Parent of zero.
+type PlanStep struct {
+	ID     int64  `json:"id"`
+	Parent int64  `json:"parent"`
+	Detail string `json:"detail"`
+}
+
+// ExplainQueryPlan returns the steps SQLite would take to run the statement
+// query, with the given parameters, in the order reported by SQLite. The
+// statement is not run. The plan is read from the local database, so no
+// leadership is required.
+func (s *Store) ExplainQueryPlan(query string, params []interface{}) ([]PlanStep, error) {
+	stmt := Statement{
+		Query:      "EXPLAIN QUERY PLAN " + strings.TrimSpace(query),
+		Parameters: make([]Value, len(params)),
+	}
+	for i := range params {
+		stmt.Parameters[i] = params[i]
+	}
+	rows, err := s.Query(&QueryRequest{Stmts: []Statement{stmt}, Lvl: None})
+	if err != nil {
+		return nil, err
+	}
+	if rows[0].Error != "" {
+		return nil, errors.New(rows[0].Error)
+	}
+
+	steps := make([]PlanStep, 0, len(rows[0].Values))
+	for _, v := range rows[0].Values {
+		if len(v) < 4 {
+			return nil, errors.New("unexpected query plan format")
+		}
+		id, _ := v[0].(int64)
+		parent, _ := v[1].(int64)
+		steps = append(steps, PlanStep{ID: id, Parent: parent, Detail: asString(v[3])})
+	}
+	return steps, nil
+}
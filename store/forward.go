@@ -0,0 +1,95 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// metadataRequest asks the leader to set metadata of the node with ID.
+type metadataRequest struct {
+	ID string            `json:"id"`
+	MD map[string]string `json:"md"`
+}
+
+// metadataResponse reports the outcome of a metadataRequest.
+type metadataResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// forwardMetadata adds the metadata md to any existing metadata for this
+// node, by asking the leader to set it, over the leader's Raft address. It
+// returns ErrNotLeader if there is no leader, or the node asked is no longer
+// the leader.
+func (s *Store) forwardMetadata(md map[string]string) error {
+	addr := s.LeaderAddr()
+	if addr == "" {
+		return ErrNotLeader
+	}
+	conn, err := s.ln.Dial(addr, connectionTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(connectionTimeout + s.ApplyTimeout))
+
+	if _, err := conn.Write([]byte{rpcSetMetadata}); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(conn).Encode(&metadataRequest{ID: s.raftID, MD: md}); err != nil {
+		return err
+	}
+	var resp metadataResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+	switch resp.Error {
+	case "":
+		return nil
+	case ErrNotLeader.Error():
+		return ErrNotLeader
+	}
+	return errors.New(resp.Error)
+}
+
+// serveMetadata sets the metadata requested by another node on conn, as
+// sent by forwardMetadata, if the node is a member of the cluster.
+func (s *Store) serveMetadata(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(connectionTimeout + s.ApplyTimeout))
+
+	var req metadataRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		s.logger.Warn("failed to read metadata request", "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+
+	var resp metadataResponse
+	if err := s.setMemberMetadata(req.ID, req.MD); err != nil {
+		resp.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		s.logger.Warn("failed to respond to metadata request", "remote", conn.RemoteAddr(), "error", err)
+	}
+}
+
+// setMemberMetadata sets the metadata md of the node with the given ID, if
+// it is a member of the cluster.
+func (s *Store) setMemberMetadata(id string, md map[string]string) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	cf := s.raft.GetConfiguration()
+	if err := cf.Error(); err != nil {
+		return err
+	}
+	for _, srv := range cf.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) {
+			return s.setMetadata(id, md)
+		}
+	}
+	return ErrNodeNotFound
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of each histogram.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// histogram counts durations in the buckets given by latencyBuckets, plus
+// a final bucket for all longer durations. It is safe for concurrent use.
+// All methods are no-ops on a nil histogram, so that recording can be left
+// in place when latency metrics are disabled.
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+// newHistogram returns an empty histogram.
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]uint64, len(latencyBuckets)+1),
+	}
+}
+
+// Observe records the duration d.
+func (h *histogram) Observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// Since records the time elapsed since t.
+func (h *histogram) Since(t time.Time) {
+	if h == nil {
+		return
+	}
+	h.Observe(time.Since(t))
+}
+
+// Stats returns the number of durations recorded, their sum, and the count
+// in each bucket, keyed by the upper bound of the bucket.
+func (h *histogram) Stats() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]uint64, len(h.counts))
+	for i, b := range latencyBuckets {
+		buckets[b.String()] = h.counts[i]
+	}
+	buckets["+Inf"] = h.counts[len(latencyBuckets)]
+
+	return map[string]interface{}{
+		"count":   h.count,
+		"sum":     h.sum.String(),
+		"buckets": buckets,
+	}
+}
+
+// latencyMetrics are the histograms recorded by a Store. The zero value
+// has nil histograms, and so records nothing.
+type latencyMetrics struct {
+	executeTotal  *histogram // Time taken by Execute, end to end.
+	executeApply  *histogram // Time waiting for changes to be committed and applied.
+	executeSQLite *histogram // Time taken by SQLite to apply changes, on this node.
+	queryTotal    *histogram // Time taken by Query, end to end.
+}
+
+// newLatencyMetrics returns a set of empty histograms.
+func newLatencyMetrics() latencyMetrics {
+	return latencyMetrics{
+		executeTotal:  newHistogram(),
+		executeApply:  newHistogram(),
+		executeSQLite: newHistogram(),
+		queryTotal:    newHistogram(),
+	}
+}
+
+// enabled returns whether l records anything.
+func (l *latencyMetrics) enabled() bool {
+	return l.executeTotal != nil
+}
+
+// Stats returns the stats of each histogram.
+func (l *latencyMetrics) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"execute_total":  l.executeTotal.Stats(),
+		"execute_apply":  l.executeApply.Stats(),
+		"execute_sqlite": l.executeSQLite.Stats(),
+		"query_total":    l.queryTotal.Stats(),
+	}
+}
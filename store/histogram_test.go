@@ -0,0 +1,36 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_HistogramObserve(t *testing.T) {
+	h := newHistogram()
+	h.Observe(500 * time.Microsecond)
+	h.Observe(time.Millisecond)
+	h.Observe(7 * time.Millisecond)
+	h.Observe(time.Minute)
+
+	st := h.Stats()
+	if exp, got := uint64(4), st["count"].(uint64); exp != got {
+		t.Fatalf("wrong count, exp %d, got %d", exp, got)
+	}
+	buckets := st["buckets"].(map[string]uint64)
+	for b, exp := range map[string]uint64{"1ms": 2, "5ms": 0, "10ms": 1, "+Inf": 1} {
+		if got := buckets[b]; exp != got {
+			t.Fatalf("wrong count for bucket %s, exp %d, got %d", b, exp, got)
+		}
+	}
+}
+
+func Test_HistogramNil(t *testing.T) {
+	var h *histogram
+	h.Observe(time.Second)
+	h.Since(time.Now())
+
+	var l latencyMetrics
+	if l.enabled() {
+		t.Fatal("zero latency metrics marked as enabled")
+	}
+}
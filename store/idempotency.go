@@ -0,0 +1,107 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	sql "github.com/rqlite/rqlite/db"
+)
+
+// defaultIdempotencyTTL is how long the results of an Execute carrying an
+// idempotency key are remembered, if no TTL is given.
+const defaultIdempotencyTTL = 10 * time.Minute
+
+// idempotentRecord holds the results of applying an Execute request carrying
+// an idempotency key. Records are replicated through the Raft log, and
+// included in snapshots, so every node holds the same records.
+type idempotentRecord struct {
+	Results []*sql.Result `json:"results,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Expires int64         `json:"expires"` // Unix time, in nanoseconds, as assigned by the leader.
+}
+
+// stampIdempotency sets the times on d needed to expire its idempotency
+// record, if d carries a key. The times are assigned by the leader, so every
+// node expires records at the same point in the log.
+func (s *Store) stampIdempotency(d *databaseSub) {
+	if d.IdempotencyKey == "" {
+		return
+	}
+	now := time.Now()
+	d.Time = now.UnixNano()
+	d.Expires = now.Add(s.idempotencyTTL).UnixNano()
+}
+
+// executeIdempotent calls fn to apply the changes in d, unless d carries an
+// idempotency key already applied, in which case the original results are
+// returned instead. It is only called by the FSM.
+func (s *Store) executeIdempotent(d *databaseSub, fn func() ([]*sql.Result, error)) ([]*sql.Result, error) {
+	if d.IdempotencyKey == "" {
+		return fn()
+	}
+
+	s.idempotencyMu.Lock()
+	for k, rec := range s.idempotency {
+		if rec.Expires <= d.Time {
+			delete(s.idempotency, k)
+		}
+	}
+	rec, ok := s.idempotency[d.IdempotencyKey]
+	s.idempotencyMu.Unlock()
+	if ok {
+		stats.Add(numIdempotentHits, 1)
+		return rec.results()
+	}
+
+	r, err := fn()
+	rec = &idempotentRecord{Results: r, Expires: d.Expires}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	s.idempotencyMu.Lock()
+	s.idempotency[d.IdempotencyKey] = rec
+	s.idempotencyMu.Unlock()
+	return r, err
+}
+
+// results returns a copy of the original results, and any error.
+func (r *idempotentRecord) results() ([]*sql.Result, error) {
+	res := make([]*sql.Result, len(r.Results))
+	for i := range r.Results {
+		rc := *r.Results[i]
+		res[i] = &rc
+	}
+	if r.Error != "" {
+		return res, errors.New(r.Error)
+	}
+	return res, nil
+}
+
+// idempotencySnapshot returns the encoded idempotency records, or nil if
+// there are none.
+func (s *Store) idempotencySnapshot() ([]byte, error) {
+	s.idempotencyMu.Lock()
+	defer s.idempotencyMu.Unlock()
+	if len(s.idempotency) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(s.idempotency)
+}
+
+// restoreIdempotency replaces the idempotency records with records.
+func (s *Store) restoreIdempotency(records map[string]*idempotentRecord) {
+	if records == nil {
+		records = make(map[string]*idempotentRecord)
+	}
+	s.idempotencyMu.Lock()
+	defer s.idempotencyMu.Unlock()
+	s.idempotency = records
+}
+
+// numIdempotencyKeys returns the number of idempotency records held.
+func (s *Store) numIdempotencyKeys() int {
+	s.idempotencyMu.Lock()
+	defer s.idempotencyMu.Unlock()
+	return len(s.idempotency)
+}
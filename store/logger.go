@@ -0,0 +1,58 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger is the interface through which the Store logs. Each method is passed
+// a message, followed by any number of alternating keys and values, such as
+// "node", id, which describe the event. A structured logger, such as zap or
+// logrus, can be plugged in through a small adapter.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// NewStdLogger returns a Logger which writes to l, one line per event, in the
+// form "[LEVEL] message key=value ...".
+func NewStdLogger(l *log.Logger) Logger {
+	return &stdLogger{l: l}
+}
+
+// stdLogger is a Logger which writes to a standard library logger.
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s *stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	s.log("DEBUG", msg, keysAndValues)
+}
+
+func (s *stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	s.log("INFO", msg, keysAndValues)
+}
+
+func (s *stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	s.log("WARN", msg, keysAndValues)
+}
+
+func (s *stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	s.log("ERROR", msg, keysAndValues)
+}
+
+func (s *stdLogger) log(level, msg string, keysAndValues []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", level, msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 == len(keysAndValues) {
+			fmt.Fprintf(&b, " %v", keysAndValues[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	s.l.Print(b.String())
+}
@@ -0,0 +1,27 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+)
+
+func Test_StdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "[store] ", 0))
+
+	l.Info("node joined successfully", "addr", "localhost:4002", "suffrage", "voter")
+	l.Error("failed to take snapshot", "error", errors.New("disk full"))
+	l.Warn("odd number of fields", "dangling")
+	l.Debug("no fields")
+
+	exp := `[store] [INFO] node joined successfully addr=localhost:4002 suffrage=voter
+[store] [ERROR] failed to take snapshot error=disk full
+[store] [WARN] odd number of fields dangling
+[store] [DEBUG] no fields
+`
+	if got := buf.String(); got != exp {
+		t.Fatalf("unexpected log output\nexp: %s\ngot: %s", exp, got)
+	}
+}
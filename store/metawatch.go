@@ -0,0 +1,99 @@
+package store
+
+// MetadataEventType is the kind of change to the metadata of a node.
+type MetadataEventType int
+
+const (
+	// MetadataNodeAdded is the type of the event emitted when metadata is
+	// first set for a node.
+	MetadataNodeAdded MetadataEventType = iota
+
+	// MetadataKeysSet is the type of the event emitted when keys are set,
+	// or changed, in the existing metadata of a node.
+	MetadataKeysSet
+
+	// MetadataNodeRemoved is the type of the event emitted when the
+	// metadata of a node is removed, as when the node leaves the cluster.
+	MetadataNodeRemoved
+)
+
+// String returns the name of the type.
+func (t MetadataEventType) String() string {
+	switch t {
+	case MetadataNodeAdded:
+		return "added"
+	case MetadataKeysSet:
+		return "set"
+	case MetadataNodeRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// MetadataEvent is a change to the replicated metadata of a node.
+type MetadataEvent struct {
+	Type MetadataEventType `json:"type"`
+	ID   string            `json:"id"`
+
+	// Data holds the keys set, and their values, or, for a removed node,
+	// the metadata it had.
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// WatchMetadata returns a channel which receives an event each time the
+// metadata of a node is changed, as log entries setting and removing it are
+// applied to this node. Each call returns a distinct, buffered, channel. If a
+// subscriber does not keep up with changes, events for that subscriber are
+// dropped, so that the Raft system is never blocked. Metadata restored from
+// a snapshot is not reported.
+//
+// The returned func cancels the subscription, and closes the channel. It may
+// be called more than once. The channel is also closed when the store is
+// closed.
+func (s *Store) WatchMetadata() (<-chan MetadataEvent, func()) {
+	ch := make(chan MetadataEvent, metadataChanSize)
+	s.metaObsMu.Lock()
+	defer s.metaObsMu.Unlock()
+	if s.metaObsClosed {
+		close(ch)
+		return ch, func() {}
+	}
+	if s.metaObs == nil {
+		s.metaObs = make(map[chan MetadataEvent]struct{})
+	}
+	s.metaObs[ch] = struct{}{}
+
+	return ch, func() {
+		s.metaObsMu.Lock()
+		defer s.metaObsMu.Unlock()
+		if _, ok := s.metaObs[ch]; ok {
+			delete(s.metaObs, ch)
+			close(ch)
+		}
+	}
+}
+
+// closeMetadataWatchers closes the channel of every subscriber to metadata
+// changes, and of any later subscriber.
+func (s *Store) closeMetadataWatchers() {
+	s.metaObsMu.Lock()
+	defer s.metaObsMu.Unlock()
+	for ch := range s.metaObs {
+		close(ch)
+	}
+	s.metaObs = nil
+	s.metaObsClosed = true
+}
+
+// notifyMetadataChange passes ev to every subscriber to metadata changes.
+func (s *Store) notifyMetadataChange(ev MetadataEvent) {
+	s.metaObsMu.Lock()
+	defer s.metaObsMu.Unlock()
+	for ch := range s.metaObs {
+		select {
+		case ch <- ev:
+		default:
+			s.logger.Warn("metadata subscriber not keeping up, dropping event", "node", ev.ID)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+	gosql "database/sql/driver"
+	"strings"
+
+	sql "github.com/rqlite/rqlite/db"
+)
+
+// unorderableKeywords are the keywords which, outside any parentheses, make
+// the order of the rows of a SELECT something other than that of a single
+// table, or mean the statement orders its rows itself.
+var unorderableKeywords = []string{
+	"ORDER", "GROUP", "DISTINCT", "UNION", "INTERSECT", "EXCEPT", "JOIN", "WINDOW", "VALUES",
+}
+
+// aggregateFunctions are the built-in aggregate functions, a call to any of
+// which, outside any parentheses, collapses the rows of a SELECT.
+var aggregateFunctions = []string{
+	"COUNT", "SUM", "TOTAL", "AVG", "MIN", "MAX", "GROUP_CONCAT",
+}
+
+// withStableOrder returns a copy of qr in which each statement which would
+// return the rows of a single rowid table in no particular order orders them
+// by rowid. It must be called with mu held for reading.
+func (s *Store) withStableOrder(qr *QueryRequest) *QueryRequest {
+	var sqr *QueryRequest
+	for i, stmt := range qr.Stmts {
+		q, table, ok := stableOrderQuery(stmt.Query)
+		if !ok || !s.hasRowid(table) {
+			continue
+		}
+		if sqr == nil {
+			c := *qr
+			c.Stmts = append([]Statement{}, qr.Stmts...)
+			sqr = &c
+		}
+		sqr.Stmts[i].Query = q
+	}
+	if sqr == nil {
+		return qr
+	}
+	return sqr
+}
+
+// hasRowid returns whether table is an ordinary table of the main database
+// with a rowid. Views, virtual tables and WITHOUT ROWID tables have none,
+// nor do tables which do not exist.
+func (s *Store) hasRowid(table string) bool {
+	rows, err := s.db.Query([]sql.Statement{{
+		Query:      `SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ? COLLATE NOCASE`,
+		Parameters: []gosql.Value{table},
+	}}, false, false)
+	if err != nil || rows[0].Error != "" || len(rows[0].Values) != 1 {
+		return false
+	}
+	ddl := strings.ToUpper(asString(rows[0].Values[0][0]))
+	return strings.HasPrefix(ddl, "CREATE TABLE") && !strings.Contains(ddl, "WITHOUT ROWID")
+}
+
+// stableOrderQuery returns query with an ORDER BY rowid added, along with
+// the name of the table whose rowid it orders by, if query is a single
+// SELECT of the rows of a single table, which neither orders its rows
+// itself, nor groups, aggregates or combines them. Otherwise it returns
+// false. The ORDER BY is added before any LIMIT, so that the rows limited
+// are also those ordered.
+func stableOrderQuery(query string) (string, string, bool) {
+	q := strings.TrimRight(strings.TrimSpace(query), "; \t\r\n")
+	if !isKeywordAt(q, 0, "SELECT") {
+		return "", "", false
+	}
+
+	from, limit := -1, -1
+	ok := true
+	scanSQL(q, func(i, depth int) bool {
+		if q[i] == ';' {
+			ok = false
+			return false
+		}
+		if depth != 0 || (i > 0 && isWordByte(q[i-1])) {
+			return true
+		}
+		for _, kw := range unorderableKeywords {
+			if isKeywordAt(q, i, kw) {
+				ok = false
+				return false
+			}
+		}
+		for _, fn := range aggregateFunctions {
+			if isKeywordAt(q, i, fn) && strings.HasPrefix(strings.TrimSpace(q[i+len(fn):]), "(") {
+				ok = false
+				return false
+			}
+		}
+		switch {
+		case q[i] == ',' && from >= 0:
+			ok = false // A comma join.
+			return false
+		case from < 0 && isKeywordAt(q, i, "FROM"):
+			from = i
+		case limit < 0 && isKeywordAt(q, i, "LIMIT"):
+			limit = i
+		}
+		return true
+	})
+	if !ok || from < 0 {
+		return "", "", false
+	}
+
+	table, ok := leadingIdentifier(strings.TrimSpace(q[from+len("FROM"):]))
+	if !ok {
+		return "", "", false
+	}
+	if limit < 0 {
+		return q + " ORDER BY rowid", table, true
+	}
+	return strings.TrimSpace(q[:limit]) + " ORDER BY rowid " + q[limit:], table, true
+}
+
+// leadingIdentifier returns the unquoted identifier at the start of s, if it
+// is a single identifier, rather than the name of a table in another schema,
+// a table-valued function, or a subquery.
+func leadingIdentifier(s string) (string, bool) {
+	if s == "" {
+		return "", false
+	}
+	var id string
+	var n int
+	switch s[0] {
+	case '"', '`':
+		n = skipQuoted(s, 0, s[0]) + 1
+		if n > len(s) {
+			return "", false
+		}
+		q := string(s[0])
+		id = strings.Replace(s[1:n-1], q+q, q, -1)
+	case '[':
+		n = skipQuoted(s, 0, ']') + 1
+		if n > len(s) {
+			return "", false
+		}
+		id = s[1 : n-1]
+	default:
+		for n < len(s) && isWordByte(s[n]) {
+			n++
+		}
+		id = s[:n]
+	}
+	if id == "" {
+		return "", false
+	}
+	if rest := strings.TrimSpace(s[n:]); strings.HasPrefix(rest, ".") || strings.HasPrefix(rest, "(") {
+		return "", false
+	}
+	return id, true
+}
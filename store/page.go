@@ -0,0 +1,151 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	sql "github.com/rqlite/rqlite/db"
+)
+
+var (
+	// ErrInvalidPageToken is returned when a page token was not returned
+	// by QueryPage, or has been altered.
+	ErrInvalidPageToken = errors.New("invalid page token")
+
+	// ErrInvalidPageQuery is returned when QueryPage is not given exactly
+	// one statement.
+	ErrInvalidPageQuery = errors.New("page query must be a single statement")
+)
+
+// QueryPage returns one page of the rows returned by the single statement
+// in qr, at the consistency level of qr. Rows are paged by keyset on the
+// first column of the result, which must be unique, such as a rowid or
+// primary key, and the rows of each page are returned in order of that
+// column. The statement is wrapped in a query which selects at most size
+// rows following the key in token, so the statement itself must not end
+// with a LIMIT or ORDER BY which assumes otherwise. A blank token returns
+// the first page. The token for the next page is returned along with the
+// rows, and is blank if there are no more rows.
+func (s *Store) QueryPage(qr *QueryRequest, token string, size int) (*sql.Rows, string, error) {
+	if len(qr.Stmts) != 1 {
+		return nil, "", ErrInvalidPageQuery
+	}
+	if size <= 0 {
+		return nil, "", fmt.Errorf("invalid page size %d", size)
+	}
+	var after interface{}
+	if token != "" {
+		var err error
+		if after, err = decodePageToken(token); err != nil {
+			return nil, "", err
+		}
+	}
+
+	inner := strings.TrimRight(strings.TrimSpace(qr.Stmts[0].Query), ";")
+	key, err := s.pageKey(qr, inner)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Read one row more than a page, to learn whether there is another page.
+	params := append([]Value{}, qr.Stmts[0].Parameters...)
+	query := fmt.Sprintf(`SELECT * FROM (%s) ORDER BY %s LIMIT ?`, inner, key)
+	if token != "" {
+		query = fmt.Sprintf(`SELECT * FROM (%s) WHERE %s > ? ORDER BY %s LIMIT ?`, inner, key, key)
+		params = append(params, after)
+	}
+	params = append(params, int64(size+1))
+
+	pqr := *qr
+	pqr.Stmts = []Statement{{Query: query, Parameters: params, Lvl: qr.Stmts[0].Lvl}}
+	pqr.Associative = false
+	pqr.MaxRows = 0
+	pqr.TotalCount = false
+	rows, err := s.Query(&pqr)
+	if err != nil {
+		return nil, "", err
+	}
+	r := rows[0]
+	if r.Error != "" || len(r.Values) <= size {
+		if qr.Associative {
+			r.MakeAssociative()
+		}
+		return r, "", nil
+	}
+
+	r.Values = r.Values[:size]
+	next, err := encodePageToken(r.Values[size-1][0])
+	if err != nil {
+		return nil, "", err
+	}
+	if qr.Associative {
+		r.MakeAssociative()
+	}
+	return r, next, nil
+}
+
+// pageKey returns the quoted name of the first column returned by query.
+func (s *Store) pageKey(qr *QueryRequest, query string) (string, error) {
+	pqr := *qr
+	pqr.Stmts = []Statement{{
+		Query:      fmt.Sprintf(`SELECT * FROM (%s) LIMIT 0`, query),
+		Parameters: qr.Stmts[0].Parameters,
+		Lvl:        qr.Stmts[0].Lvl,
+	}}
+	pqr.MaxRows = 0
+	pqr.TotalCount = false
+	rows, err := s.Query(&pqr)
+	if err != nil {
+		return "", err
+	}
+	if rows[0].Error != "" {
+		return "", errors.New(rows[0].Error)
+	}
+	if len(rows[0].Columns) == 0 {
+		return "", ErrInvalidPageQuery
+	}
+	return `"` + strings.Replace(rows[0].Columns[0], `"`, `""`, -1) + `"`, nil
+}
+
+// encodePageToken returns an opaque token carrying the key value v.
+func encodePageToken(v interface{}) (string, error) {
+	b, err := json.Marshal([]interface{}{v})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodePageToken returns the key value carried by token. Integer keys are
+// returned as int64, so they compare as integers in SQLite.
+func decodePageToken(token string) (interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v []interface{}
+	if err := dec.Decode(&v); err != nil || len(v) != 1 {
+		return nil, ErrInvalidPageToken
+	}
+
+	switch k := v[0].(type) {
+	case json.Number:
+		if i, err := k.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := k.Float64()
+		if err != nil {
+			return nil, ErrInvalidPageToken
+		}
+		return f, nil
+	case string:
+		return k, nil
+	}
+	return nil, ErrInvalidPageToken
+}
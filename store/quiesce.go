@@ -0,0 +1,84 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+
+	"github.com/hashicorp/raft"
+)
+
+// ErrQuiesced is returned when a change to the database is requested while
+// the cluster is quiesced.
+var ErrQuiesced = errors.New("cluster is quiesced")
+
+// Quiesce stops, if enable is set, or resumes, if not, the acceptance of
+// changes to the database by every node in the cluster, such as during
+// maintenance. While quiesced, Execute, ExecuteBatch, ExecuteOrAbort,
+// Reload, BootFromSQLiteFile, Vacuum and Reindex return ErrQuiesced on every
+// node, while queries are served as usual. The setting is written to the Raft
+// log, so it is applied by every node in order with all other changes, and
+// any change already written to the log is applied first. Any such change
+// written after it, but requested before the node making it learnt of it, is
+// refused by every node. It is kept in snapshots. This must be called on the
+// leader.
+func (s *Store) Quiesce(enable bool) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	c, err := newCommand(quiesce, enable)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	f := s.raft.Apply(b, s.ApplyTimeout)
+	if err := f.Error(); err != nil {
+		if err == raft.ErrNotLeader {
+			return ErrNotLeader
+		}
+		return err
+	}
+	if err := f.Response().(*fsmGenericResponse).error; err != nil {
+		return err
+	}
+	if enable {
+		s.logger.Info("cluster quiesced")
+	} else {
+		s.logger.Info("cluster no longer quiesced")
+	}
+	return nil
+}
+
+// Quiesced returns whether the cluster is quiesced, as last applied by this
+// node.
+func (s *Store) Quiesced() bool {
+	return atomic.LoadInt32(&s.quiesced) != 0
+}
+
+// setQuiesced sets whether the cluster is quiesced.
+func (s *Store) setQuiesced(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&s.quiesced, v)
+}
+
+// quiescedSnapshot returns the encoding of the quiesce setting for a
+// snapshot, which is written after the idempotency records only if the
+// cluster is quiesced, so that other snapshots are unchanged. Since the
+// records must then be present, idempotency is returned as null if empty.
+func (s *Store) quiescedSnapshot(idempotency []byte) ([]byte, []byte) {
+	if !s.Quiesced() {
+		return idempotency, nil
+	}
+	if idempotency == nil {
+		idempotency = []byte("null")
+	}
+	return idempotency, []byte("true")
+}
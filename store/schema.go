@@ -0,0 +1,208 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// SchemaHashKey is the metadata key under which each node publishes the hash
+// of its schema, as returned by SchemaHash.
+const SchemaHashKey = "schema_hash"
+
+// TableInfo describes a table in the database.
+type TableInfo struct {
+	Name    string       `json:"name"`
+	SQL     string       `json:"sql"`
+	Columns []ColumnInfo `json:"columns"`
+	Indexes []IndexInfo  `json:"indexes,omitempty"`
+}
+
+// ColumnInfo describes a column of a table, as reported by PRAGMA table_info.
+type ColumnInfo struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`
+	NotNull    bool        `json:"not_null,omitempty"`
+	Default    interface{} `json:"default,omitempty"`
+	PrimaryKey bool        `json:"primary_key,omitempty"`
+}
+
+// IndexInfo describes an index on a table. SQL is blank for indexes SQLite
+// creates automatically, such as for UNIQUE constraints.
+type IndexInfo struct {
+	Name string `json:"name"`
+	SQL  string `json:"sql,omitempty"`
+}
+
+const (
+	schemaTables = `SELECT name, sql FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`
+	schemaColumns = `SELECT m.name, p.name, p.type, p."notnull", p.dflt_value, p.pk
+		FROM sqlite_master AS m, pragma_table_info(m.name) AS p
+		WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite_%' ORDER BY m.name, p.cid`
+	schemaIndexes = `SELECT tbl_name, name, sql FROM sqlite_master
+		WHERE type = 'index' AND tbl_name NOT LIKE 'sqlite_%' ORDER BY tbl_name, name`
+	schemaObjects = `SELECT type, name, tbl_name, sql FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%' ORDER BY type, name`
+)
+
+// Schema returns the tables in the database, sorted by name, along with
+// their columns and indexes. The schema is read from the local database,
+// with the same guarantees as a query at the None consistency level.
+func (s *Store) Schema() ([]TableInfo, error) {
+	rows, err := s.Query(&QueryRequest{
+		Stmts: []Statement{{Query: schemaTables}, {Query: schemaColumns}, {Query: schemaIndexes}},
+		Tx:    true,
+		Lvl:   None,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if r.Error != "" {
+			return nil, errors.New(r.Error)
+		}
+	}
+
+	tables := make([]TableInfo, 0, len(rows[0].Values))
+	byName := make(map[string]*TableInfo, len(rows[0].Values))
+	for _, v := range rows[0].Values {
+		tables = append(tables, TableInfo{Name: asString(v[0]), SQL: asString(v[1])})
+	}
+	for i := range tables {
+		byName[tables[i].Name] = &tables[i]
+	}
+
+	for _, v := range rows[1].Values {
+		t, ok := byName[asString(v[0])]
+		if !ok {
+			continue
+		}
+		t.Columns = append(t.Columns, ColumnInfo{
+			Name:       asString(v[1]),
+			Type:       asString(v[2]),
+			NotNull:    v[3] == int64(1),
+			Default:    v[4],
+			PrimaryKey: v[5] != int64(0),
+		})
+	}
+
+	for _, v := range rows[2].Values {
+		t, ok := byName[asString(v[0])]
+		if !ok {
+			continue
+		}
+		t.Indexes = append(t.Indexes, IndexInfo{Name: asString(v[1]), SQL: asString(v[2])})
+	}
+
+	return tables, nil
+}
+
+// SchemaHash returns a hash of the schema of the local database, covering
+// every table, index, view and trigger, and the SQL which created each. Nodes
+// which have applied the same changes return the same hash, so a node whose
+// hash differs from that of others has diverged from them. It returns a
+// blank string if the schema cannot be read.
+func (s *Store) SchemaHash() string {
+	rows, err := s.Query(&QueryRequest{Stmts: []Statement{{Query: schemaObjects}}, Lvl: None})
+	if err == nil && rows[0].Error != "" {
+		err = errors.New(rows[0].Error)
+	}
+	if err != nil {
+		s.logger.Warn("failed to read schema", "error", err)
+		return ""
+	}
+
+	h := sha256.New()
+	for _, v := range rows[0].Values {
+		for _, c := range v {
+			str := asString(c)
+			fmt.Fprintf(h, "%d:%s", len(str), str)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// PublishSchemaHash sets the hash of the local schema in the metadata of
+// this node, under SchemaHashKey. On a follower, the hash is forwarded to the
+// leader, which sets it.
+func (s *Store) PublishSchemaHash() error {
+	h := s.SchemaHash()
+	if h == "" {
+		return errors.New("failed to hash schema")
+	}
+	md := map[string]string{SchemaHashKey: h}
+	if s.raft.State() != raft.Leader {
+		return s.forwardMetadata(md)
+	}
+	return s.SetMetadata(md)
+}
+
+// schemaChanged signals that a change which may alter the schema has been
+// applied, so that the schema hash is published, if configured.
+func (s *Store) schemaChanged() {
+	select {
+	case s.schemaChangedCh <- struct{}{}:
+	default:
+	}
+}
+
+// publishSchemaHashes publishes the hash of the local schema whenever the
+// schema may have changed, until the store is closed. A hash which cannot be
+// published, such as while there is no leader, is retried.
+func (s *Store) publishSchemaHashes() {
+	for {
+		select {
+		case <-s.schemaChangedCh:
+		case <-s.done:
+			return
+		}
+
+		for {
+			err := s.PublishSchemaHash()
+			if err == nil {
+				break
+			}
+			s.logger.Warn("failed to publish schema hash, retrying", "error", err)
+			select {
+			case <-time.After(schemaPublishRetryDelay):
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// SchemaConsistent returns whether every node which has published a schema
+// hash in its metadata published the same hash. Hashes are only as current
+// as when they were published, so nodes should publish them once the changes
+// to compare have been applied by every node.
+func (s *Store) SchemaConsistent() bool {
+	hash := ""
+	for _, md := range s.AllMetadata() {
+		h, ok := md[SchemaHashKey]
+		if !ok {
+			continue
+		}
+		if hash != "" && h != hash {
+			return false
+		}
+		hash = h
+	}
+	return true
+}
+
+// asString returns v as a string, or a blank string if it is not one.
+func asString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	}
+	return ""
+}
@@ -1,9 +1,28 @@
 package store
 
+import (
+	"time"
+)
+
 // Server represents another node in the cluster.
 type Server struct {
 	ID   string `json:"id,omitempty"`
 	Addr string `json:"addr,omitempty"`
+
+	// Suffrage is "Voter", "Nonvoter" or "Staging", as recorded in the
+	// Raft configuration. Only voters count towards a quorum.
+	Suffrage string `json:"suffrage,omitempty"`
+
+	// Status is only set when requested. See Store.Nodes.
+	Status *ServerStatus `json:"status,omitempty"`
+}
+
+// ServerStatus is the status of a node, as seen by the node reporting it.
+type ServerStatus struct {
+	Self        bool      `json:"self,omitempty"`         // Whether this is the reporting node.
+	Leader      bool      `json:"leader,omitempty"`       // Whether the node is the leader.
+	Reachable   bool      `json:"reachable"`              // Whether the node is known to be reachable.
+	LastContact time.Time `json:"last_contact,omitempty"` // Last contact with the node, if known.
 }
 
 // Servers is a set of Servers.
@@ -0,0 +1,72 @@
+package store
+
+import "strings"
+
+// scanSQL calls fn with the position of each character of q which is
+// outside any string, quoted identifier or comment, along with the depth of
+// parentheses at that position. Scanning stops if fn returns false.
+func scanSQL(q string, fn func(i, depth int) bool) {
+	depth := 0
+	for i := 0; i < len(q); i++ {
+		switch ch := q[i]; {
+		case ch == '\'' || ch == '"' || ch == '`':
+			i = skipQuoted(q, i, ch)
+			continue
+		case ch == '[':
+			i = skipQuoted(q, i, ']')
+			continue
+		case ch == '-' && strings.HasPrefix(q[i:], "--"):
+			if j := strings.IndexByte(q[i:], '\n'); j >= 0 {
+				i += j
+			} else {
+				i = len(q)
+			}
+			continue
+		case ch == '/' && strings.HasPrefix(q[i:], "/*"):
+			if j := strings.Index(q[i+2:], "*/"); j >= 0 {
+				i += j + 3
+			} else {
+				i = len(q)
+			}
+			continue
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+		}
+		if !fn(i, depth) {
+			return
+		}
+	}
+}
+
+// skipQuoted returns the position of the character closing the quoted string
+// opened at i, or the end of q if it is not closed.
+func skipQuoted(q string, i int, close byte) int {
+	for j := i + 1; j < len(q); j++ {
+		if q[j] == close {
+			if close != ']' && j+1 < len(q) && q[j+1] == close {
+				j++ // A doubled quote is an escaped quote.
+				continue
+			}
+			return j
+		}
+	}
+	return len(q)
+}
+
+// isKeywordAt returns whether the keyword kw, in any case, is at position i of
+// q, as a whole word.
+func isKeywordAt(q string, i int, kw string) bool {
+	if i+len(kw) > len(q) || !strings.EqualFold(q[i:i+len(kw)], kw) {
+		return false
+	}
+	if i > 0 && isWordByte(q[i-1]) {
+		return false
+	}
+	return i+len(kw) == len(q) || !isWordByte(q[i+len(kw)])
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
@@ -4,7 +4,11 @@
 package store
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	gosql "database/sql/driver"
 	"encoding/binary"
 	"encoding/json"
@@ -14,11 +18,15 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/raft"
@@ -42,24 +50,192 @@ var (
 	// ErrInvalidBackupFormat is returned when the requested backup format
 	// is not valid.
 	ErrInvalidBackupFormat = errors.New("invalid backup format")
+
+	// ErrReadOnlyNode is returned when a node configured as read-only is
+	// asked to modify the database.
+	ErrReadOnlyNode = errors.New("node is read-only")
+
+	// ErrLearner is returned when a learner is asked to be promoted to a
+	// voter.
+	ErrLearner = errors.New("node is a learner")
+
+	// ErrNodeNotFound is returned when a requested node is not part of the
+	// cluster configuration.
+	ErrNodeNotFound = errors.New("node not found")
+
+	// ErrWALInMemory is returned when WAL journal mode is requested for an
+	// in-memory database.
+	ErrWALInMemory = errors.New("WAL journal mode is not supported for in-memory databases")
+
+	// ErrApplyTimeout is returned when a change to the database is not
+	// applied within the Store's apply timeout. The change may still be
+	// applied later.
+	ErrApplyTimeout = errors.New("timeout waiting for change to be applied")
+
+	// ErrQueryTimeout is returned when a query does not complete within the
+	// timeout of its request.
+	ErrQueryTimeout = errors.New("timeout waiting for query")
+
+	// ErrIncompatibleVersion is returned when a node built with a different
+	// store format version attempts to join the cluster.
+	ErrIncompatibleVersion = errors.New("incompatible store format version")
+
+	// ErrBackupFilterUnsupported is returned when table filtering is
+	// requested for a backup format which does not support it.
+	ErrBackupFilterUnsupported = errors.New("table filtering is not supported for this backup format")
+
+	// ErrBackupTableRequired is returned when a BackupCSV backup is
+	// requested without naming the table to back up.
+	ErrBackupTableRequired = errors.New("backup format requires a table")
+
+	// ErrUnsupportedPragma is returned when DBConfig contains a pragma which
+	// may not be set, or is not well-formed.
+	ErrUnsupportedPragma = errors.New("unsupported pragma")
+
+	// ErrInvalidRaftTimeouts is returned by Open when the Raft leader lease
+	// timeout is greater than the heartbeat timeout.
+	ErrInvalidRaftTimeouts = errors.New("leader lease timeout must not exceed heartbeat timeout")
+
+	// ErrInvalidBootstrap is returned by Open when BootstrapExpect does not
+	// match the number of nodes given by BootstrapPeers, plus this node.
+	ErrInvalidBootstrap = errors.New("bootstrap peers do not match expected node count")
+
+	// ErrInvalidAttachment is returned when DBConfig names an attached
+	// database which is not a simple, unique, identifier, or is reserved.
+	ErrInvalidAttachment = errors.New("invalid attached database name")
+
+	// ErrSnapshotAttachments is returned by Restore when the databases
+	// attached in a snapshot do not match those configured on this node.
+	ErrSnapshotAttachments = errors.New("snapshot attached databases do not match configuration")
+
+	// ErrMixedLevelTx is returned when a query in a transaction overrides
+	// the consistency level of some of its statements, since they cannot
+	// all be read in one transaction.
+	ErrMixedLevelTx = errors.New("statements in a transaction must share a consistency level")
+
+	// ErrNoEligibleVoters is returned when leadership cannot be transferred
+	// because the cluster has no other voting node.
+	ErrNoEligibleVoters = errors.New("no other voting node to transfer leadership to")
+
+	// ErrSnapshotCancelled is returned by the persisting of a snapshot which
+	// was cancelled by CancelSnapshot.
+	ErrSnapshotCancelled = errors.New("snapshot cancelled")
 )
 
+// NotLeaderError is returned when a read which must be served by the leader
+// is attempted on another node. It carries the address of the leader, if
+// known, so the caller can redirect the read. It matches ErrNotLeader when
+// compared using errors.Is.
+type NotLeaderError struct {
+	LeaderAddr string
+}
+
+// Error returns the string representation of the error.
+func (e *NotLeaderError) Error() string {
+	if e.LeaderAddr == "" {
+		return ErrNotLeader.Error()
+	}
+	return fmt.Sprintf("%s, leader is at %s", ErrNotLeader.Error(), e.LeaderAddr)
+}
+
+// Is returns whether target is ErrNotLeader.
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+// ApplyError is an error encountered by the FSM applying a committed log
+// entry which modifies the database. Since every node applies the same
+// entry, an ApplyError on one node but not another means the nodes may have
+// diverged.
+type ApplyError struct {
+	// Statement is the SQL statement which failed, or blank if the error is
+	// not specific to any one statement.
+	Statement string
+	Err       error
+}
+
+// Error returns the string representation of the error.
+func (e *ApplyError) Error() string {
+	if e.Statement == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Statement, e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// FormatVersion is the version of the encoding of Raft log entries and
+// snapshots used by this build. It must be bumped whenever that encoding
+// changes in a way older builds can't read.
+//
+//	1: the original encoding.
+//	2: snapshots include attached databases.
+//	3: executes carry idempotency keys, and snapshots their records.
+//	4: the executeMulti command, for coalesced Executes.
+//	5: the reindex command.
+//	6: the quiesce command, and snapshots record whether quiesced.
+//	7: snapshots name their attached databases.
+//	8: followers forward their metadata to the leader.
+//	9: loads, vacuums and reindexes are refused while quiesced.
+//	10: executes carry a step limit for their statements.
+const FormatVersion = 10
+
+// FormatVersionKey is the metadata key under which a joining node reports
+// its store format version.
+const FormatVersionKey = "format_version"
+
+// removePendingKey is the metadata key which marks a node for removal by
+// the next leader, once it has transferred leadership away.
+const removePendingKey = "remove_pending"
+
+// statementStepsPerSecond is the number of SQLite virtual machine
+// instructions a statement may execute for each second of the Timeout of its
+// ExecuteRequest, roughly as many as a single core executes in a second.
+const statementStepsPerSecond = 100000000
+
+// LearnerKey is the metadata key under which a joining node reports that it
+// is a learner, with the value "true".
+const LearnerKey = "learner"
+
 const (
 	retainSnapshotCount = 2
 	applyTimeout        = 10 * time.Second
 	openTimeout         = 120 * time.Second
 	sqliteFile          = "db.sqlite"
+	restoreSuffix       = ".restore"
 	leaderWaitDelay     = 100 * time.Millisecond
 	appliedWaitDelay    = 100 * time.Millisecond
 	connectionPoolCount = 5
 	connectionTimeout   = 10 * time.Second
+	acceptRetryDelay    = 5 * time.Millisecond
 	raftLogCacheSize    = 512
+	leaderChanSize      = 16
+	metadataChanSize    = 16
+	stepdownTimeout     = 10 * time.Second
+	removeTimeout       = 10 * time.Second
+	snapshotChunkSize   = 1 << 20
+	promoteCheckDelay   = 100 * time.Millisecond
+	promoteTimeout      = 10 * time.Minute
+	bootstrapDialDelay  = 250 * time.Millisecond
+	applyRetryDelay     = 100 * time.Millisecond
+	maxApplyRetryDelay  = 5 * time.Second
+
+	schemaPublishRetryDelay = time.Second
 )
 
+// snapshotAttachedMarker precedes any attached databases in a snapshot. It
+// cannot begin the cluster meta which otherwise follows the database.
+const snapshotAttachedMarker byte = 0
+
 const (
 	numSnaphots = "num_snapshots"
 	numBackups  = "num_backups"
 	numRestores = "num_restores"
+
+	numIdempotentHits = "num_idempotent_hits"
 )
 
 // BackupFormat represents the format of database backup.
@@ -71,8 +247,23 @@ const (
 
 	// BackupBinary is a SQLite file backup format.
 	BackupBinary
+
+	// BackupBinaryGzip is a gzip-compressed SQLite file backup format.
+	BackupBinaryGzip
+
+	// BackupJSONL is a newline-delimited JSON format, with one record
+	// per table row.
+	BackupJSONL
+
+	// BackupCSV is a CSV format, with a header of column names followed by
+	// one record per row, of the single table named by BackupOptions.
+	BackupCSV
 )
 
+// DefaultCSVNull is the field written for NULL by a BackupCSV backup, unless
+// BackupOptions sets another.
+const DefaultCSVNull = `\N`
+
 // stats captures stats for the Store.
 var stats *expvar.Map
 
@@ -81,6 +272,7 @@ func init() {
 	stats.Add(numSnaphots, 0)
 	stats.Add(numBackups, 0)
 	stats.Add(numRestores, 0)
+	stats.Add(numIdempotentHits, 0)
 }
 
 // Value is the type for parameters passed to a parameterized SQL statement.
@@ -90,16 +282,93 @@ type Value interface{}
 type Statement struct {
 	Query      string
 	Parameters []Value
+
+	// Lvl, if set, overrides the consistency level of the QueryRequest for
+	// this statement. It is ignored by Execute.
+	Lvl *ConsistencyLevel
 }
 
 // QueryRequest represents a query that returns rows, and does not modify
 // the database.
 type QueryRequest struct {
-	Stmts     []Statement
-	Timings   bool
-	Tx        bool
-	Lvl       ConsistencyLevel
+	Stmts   []Statement
+	Timings bool
+	Tx      bool
+	Lvl     ConsistencyLevel
+
+	// Freshness, if non-zero, bounds how stale a local read may be. For None,
+	// it is the maximum time since this node was last contacted by the leader.
+	// For Weak, it is the maximum time since the leader's leadership was last
+	// confirmed by a quorum, which is verified again if needed. The StaleFor
+	// field of the rows of a local read reports how stale the read was, which
+	// for None reads on a follower also covers any committed changes it has
+	// yet to apply.
 	Freshness time.Duration
+
+	// Associative, if set, returns each row as a map keyed by column name,
+	// instead of as a slice of values.
+	Associative bool
+
+	// MaxRows, if non-zero, is the maximum number of rows read for each
+	// statement. The rows of any statement which returns more are marked as
+	// truncated. It is not applied by QueryStream.
+	MaxRows int
+
+	// DescribeOnly, if set, returns only the columns of each statement, and
+	// their declared types, without reading any rows, so that the shape of a
+	// result can be learnt without scanning the tables. It is not applied by
+	// QueryStream.
+	DescribeOnly bool
+
+	// Checksum, if set, sets the Checksum field of the rows of each statement
+	// to a CRC-64 checksum of its columns and values, in order, so that the
+	// results of the same query on different nodes may be compared cheaply.
+	// A statement should order its rows, as otherwise SQLite may return the
+	// same rows in a different order on each node. It is not applied by
+	// QueryStream.
+	Checksum bool
+
+	// TotalCount, if set, sets the Total field of the rows of each statement
+	// to the number of rows the statement would return without the LIMIT
+	// clause of its outermost SELECT, if any, so that a client showing one
+	// page of rows may also show how many there are in all. Each statement
+	// is followed by a second, wrapping it in a COUNT(*), read at the same
+	// level, and within the same transaction if Tx is set. The count must
+	// find every row, so the cost of each statement is that of reading all
+	// its rows without the LIMIT, however few are returned. Total is not
+	// set if the statement is not a single statement, or its LIMIT binds
+	// parameters other than by positional "?" placeholders. It is not
+	// applied by QueryStream or QueryPage, nor if DescribeOnly is set.
+	TotalCount bool
+
+	// StableOrder, if set, orders the rows of each statement by rowid, if the
+	// statement is a SELECT of the rows of a single table with a rowid, and
+	// does not order, group, aggregate or combine the rows itself. SQLite
+	// does not otherwise promise any order, so the same query may return its
+	// rows in a different order on different nodes, or as the query plan
+	// changes. Statements of any other kind are left as they are. It is not
+	// applied by QueryStream.
+	StableOrder bool
+
+	// Timeout, if non-zero, is the maximum time the query may take, including
+	// any time spent waiting for the database while it is being replaced, such
+	// as during a snapshot restore. ErrQueryTimeout is returned if it expires.
+	Timeout time.Duration
+
+	// Tag, if set, labels the request in the stats of this node, under
+	// "tags", so that the queries of each client, or tenant, may be counted
+	// and timed apart. Stats are kept for a bounded number of distinct tags,
+	// after which any new tag is counted as "_other".
+	Tag string
+}
+
+// context returns a context derived from ctx which expires after the
+// timeout of q, if any.
+func (q *QueryRequest) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if q.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, q.Timeout)
 }
 
 func (q *QueryRequest) statements() []sql.Statement {
@@ -114,12 +383,41 @@ func (q *QueryRequest) statements() []sql.Statement {
 	return stmts
 }
 
+// levelRuns splits q into requests for each run of consecutive statements
+// sharing a consistency level, after applying any statement overrides. The
+// statements of the returned requests have no overrides.
+func (q *QueryRequest) levelRuns() []*QueryRequest {
+	var runs []*QueryRequest
+	for _, stmt := range q.Stmts {
+		lvl := q.Lvl
+		if stmt.Lvl != nil {
+			lvl = *stmt.Lvl
+		}
+		stmt.Lvl = nil
+		if n := len(runs); n > 0 && runs[n-1].Lvl == lvl {
+			runs[n-1].Stmts = append(runs[n-1].Stmts, stmt)
+			continue
+		}
+		r := *q
+		r.Stmts = []Statement{stmt}
+		r.Lvl = lvl
+		runs = append(runs, &r)
+	}
+	if len(runs) == 0 {
+		return []*QueryRequest{q}
+	}
+	return runs
+}
+
 func (q *QueryRequest) command() *databaseSub {
 	c := databaseSub{
 		Tx:         q.Tx,
 		Queries:    make([]string, len(q.Stmts)),
 		Parameters: make([][]Value, len(q.Stmts)),
 		Timings:    q.Timings,
+		MaxRows:    q.MaxRows,
+
+		DescribeOnly: q.DescribeOnly,
 	}
 	for i, s := range q.Stmts {
 		c.Queries[i] = s.Query
@@ -129,11 +427,64 @@ func (q *QueryRequest) command() *databaseSub {
 }
 
 // ExecuteRequest represents a query that returns no rows, but does modify
-// the database.
+// the database. If Tx is set, the statements may include SAVEPOINT, RELEASE
+// and ROLLBACK TO statements, which nest within the transaction, so that
+// some of its changes may be rolled back while the rest are committed.
 type ExecuteRequest struct {
 	Stmts   []Statement
 	Timings bool
 	Tx      bool
+
+	// Timeout, if non-zero, limits the time any single statement may take
+	// to execute, as it is applied on each node. A statement interrupted on
+	// some nodes but not others would leave their databases different, so
+	// the limit is not measured by the clock, but in SQLite virtual machine
+	// instructions, at a fixed rate of statementStepsPerSecond, which stops
+	// a statement at the same point on every node, however fast. A statement
+	// which exceeds it is rolled back, and its result carries
+	// sql.ErrStatementTimeout as the error. Subsequent statements are still
+	// executed, unless Tx is set, in which case the entire transaction is
+	// rolled back. For a dry run, Timeout is measured by the clock.
+	Timeout time.Duration
+
+	// DryRun, if set, executes the statements on the leader only, within a
+	// transaction which is always rolled back. Nothing is written to the
+	// Raft log, and the database is left unchanged. Tx is implied, and
+	// statements which would begin or end a transaction are refused, with
+	// sql.ErrDryRunTransactionControl.
+	DryRun bool
+
+	// IdempotencyKey, if set, identifies the request, so that a client may
+	// safely retry it. If a request with the same key has already been
+	// applied, within the Store's idempotency TTL, the changes are not
+	// applied again, and the original results are returned instead.
+	IdempotencyKey string
+
+	// ReturnChangedRows, if set, sets ChangedRows on the result of each
+	// statement to the rows it updated or deleted, for change data capture.
+	// See sql.DB.ExecuteReturningChanges for the rows SQLite does not report.
+	// It is ignored for dry runs.
+	ReturnChangedRows bool
+
+	// Tag, if set, labels the request in the stats of this node, as
+	// QueryRequest.Tag does. It is not sent to other nodes.
+	Tag string
+}
+
+// BatchExecuteRequest represents a single query that returns no rows, but
+// does modify the database, executed once for each set of parameters.
+type BatchExecuteRequest struct {
+	Stmt       string
+	Parameters [][]Value
+	Timings    bool
+}
+
+func (b *BatchExecuteRequest) command() *batchSub {
+	return &batchSub{
+		Query:      b.Stmt,
+		Parameters: b.Parameters,
+		Timings:    b.Timings,
+	}
 }
 
 func (e *ExecuteRequest) command() *databaseSub {
@@ -142,6 +493,10 @@ func (e *ExecuteRequest) command() *databaseSub {
 		Queries:    make([]string, len(e.Stmts)),
 		Parameters: make([][]Value, len(e.Stmts)),
 		Timings:    e.Timings,
+		StepLimit:  int64(e.Timeout.Seconds() * statementStepsPerSecond),
+
+		IdempotencyKey:    e.IdempotencyKey,
+		ReturnChangedRows: e.ReturnChangedRows,
 	}
 	for i, s := range e.Stmts {
 		c.Queries[i] = s.Query
@@ -158,6 +513,18 @@ const (
 	None ConsistencyLevel = iota
 	Weak
 	Strong
+
+	// LinearizableLease reads are as consistent as Strong reads, but are
+	// served from the leader's local database while it holds a leader lease,
+	// that is, while its leadership was confirmed by a quorum within the
+	// leader lease timeout. Otherwise the read is made as a Strong read.
+	LinearizableLease
+
+	// Linearizable reads are as consistent as Strong reads, but the read is
+	// not itself written to the Raft log. Instead the leader commits a no-op
+	// barrier, so confirming its leadership, and waits for every change
+	// committed before it to be applied, before reading its local database.
+	Linearizable
 )
 
 // ClusterState defines the possible Raft states the current node can be in
@@ -178,30 +545,107 @@ type Store struct {
 
 	mu sync.RWMutex // Sync access between queries and snapshots.
 
-	raft   *raft.Raft // The consensus mechanism.
-	ln     Listener
-	raftTn *raft.NetworkTransport
-	raftID string    // Node ID.
-	dbConf *DBConfig // SQLite database config.
-	dbPath string    // Path to underlying SQLite file, if not in-memory.
-	db     *sql.DB   // The underlying SQLite store.
+	dbMu sync.Mutex // Serializes changes to the database by the FSM and dry runs.
+
+	raft     *raft.Raft // The consensus mechanism.
+	ln       Listener
+	raftTn   *raft.NetworkTransport
+	raftID   string    // Node ID.
+	dbConf   *DBConfig // SQLite database config. BusyTimeout is protected by mu once open.
+	readOnly bool      // Whether this node rejects changes to the database.
+	learner  bool      // Whether this node must never vote.
+	dbPath   string    // Path to underlying SQLite file, if not in-memory.
+	db       *sql.DB   // The underlying SQLite store.
 
-	raftLog    raft.LogStore         // Persistent log store.
-	raftStable raft.StableStore      // Persistent k-v store.
-	boltStore  *raftboltdb.BoltStore // Physical store.
+	contacts *contactTransport // Raft's transport, recording the responses of other nodes.
+
+	raftLog    raft.LogStore           // Persistent log store.
+	raftStable raft.StableStore        // Persistent k-v store.
+	boltStore  *raftboltdb.BoltStore   // Physical store.
+	snapshots  *raft.FileSnapshotStore // Persistent snapshot store.
 
 	metaMu sync.RWMutex
 	meta   map[string]map[string]string
 
-	logger *log.Logger
+	metaObsMu     sync.Mutex                      // Sync access to metaObs and metaObsClosed.
+	metaObs       map[chan MetadataEvent]struct{} // Subscribers to metadata changes.
+	metaObsClosed bool                            // Whether the store is closed to subscribers.
+
+	idempotencyMu  sync.Mutex                   // Sync access to idempotency.
+	idempotency    map[string]*idempotentRecord // Results of keyed changes, by key.
+	idempotencyTTL time.Duration                // How long keyed results are kept.
+
+	leaderNotifyCh chan bool     // Leadership changes, as reported by Raft.
+	leaderObsMu    sync.Mutex    // Sync access to leaderObs.
+	leaderObs      []chan bool   // Subscribers to leadership changes.
+	done           chan struct{} // Closed when the store is closed.
+
+	snapshotMu     sync.RWMutex  // Sync access to SnapshotThreshold and SnapshotInterval once open.
+	snapshotWakeCh chan struct{} // Signals that the snapshot interval has changed.
+
+	numSnapshots     int64 // Number of snapshots taken by this store. Access atomically.
+	quiesced         int32 // Non-zero while changes to the database are refused. Access atomically.
+	lastApplyLatency int64 // Duration, in nanoseconds, of the most recent FSM apply. Access atomically.
+
+	fsmIndex  uint64        // Index of the last log entry applied to the FSM. Access atomically.
+	fsmBusy   int32         // Non-zero while the FSM applies a log entry. Access atomically.
+	appliedMu sync.Mutex    // Sync access to appliedCh.
+	appliedCh chan struct{} // Closed, and replaced, each time a log entry is applied to the FSM.
+
+	latency latencyMetrics // Zero, and so disabled, unless requested.
+	tags    tagStats       // Stats of tagged requests.
+
+	formatVersion int // Store format version, reported to and required of other nodes.
+
+	readyMaxLag uint64 // Committed entries which may be unapplied while ready.
+
+	queryCache *queryCache // Nil, and so disabled, unless requested.
+
+	preparedCacheSize int // Prepared statements cached by the database, if non-zero.
+
+	snapshotTransferRate int64 // Bytes per second at which snapshots are sent, if limited.
+
+	bootstrapExpect int       // Nodes, including this one, forming a new cluster.
+	bootstrapPeers  []*Server // The other nodes forming a new cluster.
+
+	applyRetries int // Times Execute retries when this node is not the leader.
+
+	snapshotExclude []string // Prefixes of the names of tables left out of snapshots.
+
+	deadNodeTimeout time.Duration // Time after which an unreachable non-voter is removed, if non-zero.
 
-	ShutdownOnRemove  bool
-	SnapshotThreshold uint64
-	SnapshotInterval  time.Duration
-	HeartbeatTimeout  time.Duration
-	ElectionTimeout   time.Duration
-	ApplyTimeout      time.Duration
-	RaftLogLevel      string
+	batchWindow time.Duration        // Time within which Executes are coalesced, if non-zero.
+	coalesceCh  chan *pendingExecute // Executes waiting to be coalesced.
+
+	publishSchemaHash bool          // Whether the schema hash is published whenever the schema may change.
+	schemaChangedCh   chan struct{} // Signals that the schema may have changed.
+
+	leaseMu         sync.Mutex // Sync access to leaseEpoch, leaderConfirmed and leaderApplied.
+	leaseEpoch      uint64     // Incremented on every change of Raft state.
+	leaderConfirmed time.Time  // When leadership was last confirmed by a quorum, in this epoch.
+	leaderApplied   bool       // Whether an entry, or barrier, of this epoch has been applied.
+
+	caughtUpAt int64 // Unix time, in nanoseconds, as of which the database last held every committed change. Access atomically.
+
+	snapshotCanceller snapshotCanceller // Cancels the snapshot being persisted, if any.
+
+	logger Logger
+
+	ShutdownOnRemove   bool
+	SnapshotThreshold  uint64
+	SnapshotInterval   time.Duration
+	HeartbeatTimeout   time.Duration
+	ElectionTimeout    time.Duration
+	LeaderLeaseTimeout time.Duration
+	TrailingLogs       uint64
+	ApplyTimeout       time.Duration
+	RaftLogLevel       string
+
+	// OnApplyError, if set, is called with the log index and an *ApplyError
+	// whenever the FSM fails to apply a committed entry which modifies the
+	// database, once for each failed statement. It is called by the FSM, so
+	// it must not block, or call into the Store. It must be set before Open.
+	OnApplyError func(index uint64, err error)
 }
 
 // StoreConfig represents the configuration of the underlying Store.
@@ -211,37 +655,233 @@ type StoreConfig struct {
 	Tn     Transport   // The underlying Transport for raft.
 	ID     string      // Node ID.
 	Logger *log.Logger // The logger to use to log stuff.
+
+	// StructuredLogger, if set, is used for logging instead of Logger. If
+	// only Logger is set, it is wrapped by NewStdLogger, and if neither is
+	// set, logs go to stderr.
+	StructuredLogger Logger
+
+	// ReadOnly, if set, causes the Store to reject all Execute requests. It
+	// is intended for dedicated read replicas.
+	ReadOnly bool
+
+	// Learner, if set, marks the Store as a learner: a node which receives
+	// the log, but never votes. Unlike other non-voters, a learner is never
+	// promoted. It must report LearnerKey in the metadata of its join
+	// request, so that the leader adds it as a non-voter, and refuses to
+	// promote it.
+	Learner bool
+
+	// ApplyTimeout, if non-zero, is the maximum time an Execute waits for
+	// its changes to be committed and applied. If zero, a default is used.
+	ApplyTimeout time.Duration
+
+	// FormatVersion, if non-zero, overrides the store format version this
+	// Store reports, and requires of joining nodes. If zero, FormatVersion
+	// is used.
+	FormatVersion int
+
+	// LatencyMetrics, if set, records histograms of Execute and Query
+	// latencies, which are reported by Stats.
+	LatencyMetrics bool
+
+	// TLSConfig, if set, encrypts all Raft traffic between nodes by wrapping
+	// the Listener passed to New in a TLSListener.
+	TLSConfig *tls.Config
+
+	// SnapshotTransferRate, if non-zero, is the maximum rate, in bytes per
+	// second, at which this node sends snapshots to other nodes, such as
+	// one joining the cluster, so that the transfer does not saturate the
+	// network. Raft abandons a transfer which takes longer than 10 seconds,
+	// or 10 seconds for every 256KB of a larger snapshot, so a rate below
+	// about 26KB per second cannot send large snapshots.
+	SnapshotTransferRate int64
+
+	// ReadyMaxLag is the number of committed log entries this node may have
+	// yet to apply while Ready still reports it ready to serve.
+	ReadyMaxLag uint64
+
+	// QueryCacheTTL, if non-zero, caches the results of None reads for up
+	// to this long. The whole cache is invalidated whenever a change to the
+	// database is applied. QueryCacheSize is the maximum number of results
+	// cached, and if zero a default is used.
+	QueryCacheTTL  time.Duration
+	QueryCacheSize int
+
+	// PreparedCacheSize, if non-zero, is the number of prepared statements
+	// kept for reuse by queries, keyed by their SQL text, so that a query
+	// run repeatedly, with whatever parameters, is only parsed once. The
+	// cache is cleared by any change which may alter the schema.
+	PreparedCacheSize int
+
+	// BootstrapExpect, if non-zero, is the number of nodes, including this
+	// one, which together form a new cluster. Instead of bootstrapping a
+	// cluster of its own, or waiting to be joined, a new node waits until
+	// it can reach every node in BootstrapPeers, and then bootstraps a
+	// cluster of itself and those nodes. Every node must be given the same
+	// nodes, so they all bootstrap the same configuration, and so elect a
+	// single leader. It is ignored by a node which already has Raft state.
+	BootstrapExpect int
+
+	// BootstrapPeers are the other nodes which form the new cluster.
+	BootstrapPeers []*Server
+
+	// ApplyRetries is the number of times Execute retries, backing off
+	// exponentially, to at most 5 seconds between attempts, when it fails
+	// because this node is not the leader.
+	// Such changes are never written to the Raft log, so retrying cannot
+	// apply them twice. A node which becomes leader during the retries, for
+	// example by winning an election, then makes the change. Failures which
+	// may follow a change being written, such as lost leadership, and SQL
+	// errors, are not retried.
+	ApplyRetries int
+
+	// SnapshotExclude lists prefixes of the names of tables which are left
+	// out of snapshots, such as caches which the application can rebuild.
+	// This reduces the size of snapshots, and so the time taken to send
+	// them to joining nodes. Excluded tables, and their indexes and
+	// triggers, are absent from a database restored from a snapshot, and
+	// from any node brought up to date by one.
+	SnapshotExclude []string
+
+	// IdempotencyTTL, if non-zero, is how long the results of an Execute
+	// carrying an idempotency key are kept, during which a request with the
+	// same key is not applied again. If zero, a default is used.
+	IdempotencyTTL time.Duration
+
+	// HeartbeatTimeout, ElectionTimeout and LeaderLeaseTimeout, if non-zero,
+	// override the Raft defaults. Raising them avoids spurious elections on
+	// high-latency networks. LeaderLeaseTimeout may not exceed the effective
+	// HeartbeatTimeout.
+	HeartbeatTimeout   time.Duration
+	ElectionTimeout    time.Duration
+	LeaderLeaseTimeout time.Duration
+
+	// TrailingLogs, if non-zero, is the number of log entries Raft keeps
+	// after a snapshot, overriding the Raft default. A follower which falls
+	// no further behind than this catches up from the log, rather than by
+	// the transfer of a full snapshot.
+	TrailingLogs uint64
+
+	// DeadNodeTimeout, if non-zero, is the time after which the leader
+	// removes a non-voting node it has been unable to contact, so that read
+	// replicas which are gone for good do not accumulate in the cluster.
+	// The leader checks each non-voter regularly, and a node is only
+	// removed once the leader has seen it unreachable for the whole timeout.
+	// Voting nodes are never removed automatically.
+	DeadNodeTimeout time.Duration
+
+	// BatchWindow, if non-zero, coalesces the Executes made on the leader
+	// within this long of each other into a single Raft log entry, so that
+	// many concurrent small changes share the cost of consensus. Each
+	// Execute is applied as if written to the log alone, in its own
+	// transaction if it requests one, and receives its own results. Each
+	// Execute waits up to BatchWindow longer for its results.
+	BatchWindow time.Duration
+
+	// PublishSchemaHash, if set, publishes the hash of the local schema in
+	// the metadata of this node, as PublishSchemaHash does, whenever a
+	// change which may alter the schema is applied. A follower forwards it
+	// to the leader, so that SchemaConsistent can compare every node.
+	PublishSchemaHash bool
 }
 
 // New returns a new Store.
 func New(ln Listener, c *StoreConfig) *Store {
-	logger := c.Logger
+	logger := c.StructuredLogger
 	if logger == nil {
-		logger = log.New(os.Stderr, "[store] ", log.LstdFlags)
+		l := c.Logger
+		if l == nil {
+			l = log.New(os.Stderr, "[store] ", log.LstdFlags)
+		}
+		logger = NewStdLogger(l)
+	}
+
+	at := applyTimeout
+	if c.ApplyTimeout != 0 {
+		at = c.ApplyTimeout
+	}
+	var lm latencyMetrics
+	if c.LatencyMetrics {
+		lm = newLatencyMetrics()
+	}
+	fv := FormatVersion
+	if c.FormatVersion != 0 {
+		fv = c.FormatVersion
+	}
+	if c.TLSConfig != nil {
+		ln = NewTLSListener(ln, c.TLSConfig)
+	}
+	var qc *queryCache
+	if c.QueryCacheTTL > 0 {
+		qc = newQueryCache(c.QueryCacheTTL, c.QueryCacheSize)
+	}
+	it := defaultIdempotencyTTL
+	if c.IdempotencyTTL != 0 {
+		it = c.IdempotencyTTL
 	}
 
 	return &Store{
-		ln:           ln,
-		raftDir:      c.Dir,
-		raftID:       c.ID,
-		dbConf:       c.DBConf,
-		dbPath:       filepath.Join(c.Dir, sqliteFile),
-		meta:         make(map[string]map[string]string),
-		logger:       logger,
-		ApplyTimeout: applyTimeout,
+		ln:            ln,
+		raftDir:       c.Dir,
+		raftID:        c.ID,
+		dbConf:        c.DBConf,
+		readOnly:      c.ReadOnly,
+		learner:       c.Learner,
+		dbPath:        filepath.Join(c.Dir, sqliteFile),
+		meta:          make(map[string]map[string]string),
+		appliedCh:     make(chan struct{}),
+		latency:       lm,
+		formatVersion: fv,
+		readyMaxLag:   c.ReadyMaxLag,
+		queryCache:    qc,
+		logger:        logger,
+		ApplyTimeout:  at,
+
+		bootstrapExpect: c.BootstrapExpect,
+		bootstrapPeers:  c.BootstrapPeers,
+		applyRetries:    c.ApplyRetries,
+		snapshotExclude: c.SnapshotExclude,
+		deadNodeTimeout: c.DeadNodeTimeout,
+		batchWindow:     c.BatchWindow,
+		coalesceCh:      make(chan *pendingExecute),
+
+		publishSchemaHash: c.PublishSchemaHash,
+		schemaChangedCh:   make(chan struct{}, 1),
+
+		preparedCacheSize:    c.PreparedCacheSize,
+		snapshotTransferRate: c.SnapshotTransferRate,
+
+		idempotency:    make(map[string]*idempotentRecord),
+		idempotencyTTL: it,
+
+		HeartbeatTimeout:   c.HeartbeatTimeout,
+		ElectionTimeout:    c.ElectionTimeout,
+		LeaderLeaseTimeout: c.LeaderLeaseTimeout,
+		TrailingLogs:       c.TrailingLogs,
 	}
 }
 
 // Open opens the store. If enableSingle is set, and there are no existing peers,
 // then this node becomes the first node, and therefore leader, of the cluster.
 func (s *Store) Open(enableSingle bool) error {
-	s.logger.Printf("opening store with node ID %s", s.raftID)
+	s.logger.Info("opening store", "node", s.raftID)
 
-	s.logger.Printf("ensuring directory at %s exists", s.raftDir)
+	if s.leaderLeaseTimeout() > s.heartbeatTimeout() {
+		return ErrInvalidRaftTimeouts
+	}
+
+	s.logger.Debug("ensuring directory exists", "dir", s.raftDir)
 	if err := os.MkdirAll(s.raftDir, 0755); err != nil {
 		return err
 	}
 
+	// Is this a brand new node?
+	newNode := !pathExists(filepath.Join(s.raftDir, "raft.db"))
+	if newNode && s.bootstrapExpect > 0 && s.bootstrapExpect != len(s.bootstrapPeers)+1 {
+		return ErrInvalidBootstrap
+	}
+
 	// Open underlying database.
 	db, err := s.open()
 	if err != nil {
@@ -249,20 +889,25 @@ func (s *Store) Open(enableSingle bool) error {
 	}
 	s.db = db
 
-	// Is this a brand new node?
-	newNode := !pathExists(filepath.Join(s.raftDir, "raft.db"))
-
 	// Create Raft-compatible network layer.
-	s.raftTn = raft.NewNetworkTransport(NewTransport(s.ln), connectionPoolCount, connectionTimeout, nil)
+	s.raftTn = raft.NewNetworkTransport(NewTransport(newRPCListener(s.ln, s.serveMetadata)), connectionPoolCount, connectionTimeout, nil)
 
 	config := s.raftConfig()
 	config.LocalID = raft.ServerID(s.raftID)
 
+	// Raft blocks writing leadership changes to NotifyCh, so it's buffered,
+	// and consumed by a dedicated goroutine.
+	s.leaderNotifyCh = make(chan bool, leaderChanSize)
+	config.NotifyCh = s.leaderNotifyCh
+	s.done = make(chan struct{})
+	s.snapshotWakeCh = make(chan struct{}, 1)
+
 	// Create the snapshot store. This allows Raft to truncate the log.
 	snapshots, err := raft.NewFileSnapshotStore(s.raftDir, retainSnapshotCount, os.Stderr)
 	if err != nil {
 		return fmt.Errorf("file snapshot store: %s", err)
 	}
+	s.snapshots = snapshots
 
 	// Create the log store and stable store.
 	s.boltStore, err = raftboltdb.NewBoltStore(filepath.Join(s.raftDir, "raft.db"))
@@ -276,13 +921,22 @@ func (s *Store) Open(enableSingle bool) error {
 	}
 
 	// Instantiate the Raft system.
-	ra, err := raft.NewRaft(config, s, s.raftLog, s.raftStable, snapshots, s.raftTn)
+	var trans raft.Transport = s.raftTn
+	if s.snapshotTransferRate > 0 {
+		trans = &throttledTransport{NetworkTransport: s.raftTn, rate: s.snapshotTransferRate}
+	}
+	s.contacts = newContactTransport(trans)
+	ra, err := raft.NewRaft(config, s, s.raftLog, s.raftStable, snapshots, s.contacts)
 	if err != nil {
 		return fmt.Errorf("new raft: %s", err)
 	}
+	ra.RegisterObserver(raft.NewObserver(nil, false, s.observeState))
 
-	if enableSingle && newNode {
-		s.logger.Printf("bootstrap needed")
+	if s.bootstrapExpect > 0 && newNode {
+		s.logger.Info("bootstrap needed, waiting for peers", "peers", len(s.bootstrapPeers))
+		go s.bootstrapWhenReachable(ra, config.LocalID)
+	} else if enableSingle && newNode {
+		s.logger.Info("bootstrap needed")
 		configuration := raft.Configuration{
 			Servers: []raft.Server{
 				{
@@ -293,26 +947,283 @@ func (s *Store) Open(enableSingle bool) error {
 		}
 		ra.BootstrapCluster(configuration)
 	} else {
-		s.logger.Printf("no bootstrap needed")
+		s.logger.Info("no bootstrap needed")
 	}
 
 	s.raft = ra
+	go s.notifyLeaderChanges()
+	go s.monitorSnapshots()
+	if s.deadNodeTimeout > 0 {
+		go s.removeDeadNodes()
+	}
+	if s.batchWindow > 0 {
+		go s.coalesceExecutes()
+	}
+	if s.publishSchemaHash {
+		go s.publishSchemaHashes()
+	}
 
 	return nil
 }
 
+// bootstrapWhenReachable bootstraps ra with a configuration of this node and
+// every bootstrap peer, once each peer accepts a connection. It gives up if
+// the store is closed first.
+func (s *Store) bootstrapWhenReachable(ra *raft.Raft, id raft.ServerID) {
+	servers := []raft.Server{{ID: id, Address: s.raftTn.LocalAddr()}}
+	for _, p := range s.bootstrapPeers {
+		servers = append(servers, raft.Server{ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.Addr)})
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+
+	reached := make(map[string]bool, len(s.bootstrapPeers))
+	for {
+		for _, p := range s.bootstrapPeers {
+			if reached[p.ID] {
+				continue
+			}
+			if conn, err := s.ln.Dial(p.Addr, connectionTimeout); err == nil {
+				conn.Close()
+				reached[p.ID] = true
+			}
+		}
+		if len(reached) == len(s.bootstrapPeers) {
+			break
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(bootstrapDialDelay):
+		}
+	}
+
+	s.logger.Info("all bootstrap peers reachable, bootstrapping cluster", "peers", len(s.bootstrapPeers))
+	if err := ra.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+		s.logger.Error("failed to bootstrap cluster", "error", err)
+	}
+}
+
 // Close closes the store. If wait is true, waits for a graceful shutdown.
+// Raft is shut down before the database is closed, so no log entry is
+// applied to a closed database. If wait is false, the database and the Raft
+// log are closed in the background, once Raft has shut down.
 func (s *Store) Close(wait bool) error {
-	if err := s.db.Close(); err != nil {
+	f := s.raft.Shutdown()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.closeMetadataWatchers()
+	if !wait {
+		go func() {
+			if err := s.release(f); err != nil {
+				s.logger.Error("failed to release store after shutdown", "error", err)
+			}
+		}()
+		return nil
+	}
+	return s.release(f)
+}
+
+// release waits for Raft to shut down, with the future f, and then closes
+// the database and the Raft log. Raft no longer uses the log, so releasing it
+// allows the store to be reopened.
+func (s *Store) release(f raft.Future) error {
+	err := f.Error()
+	if e := s.db.Close(); err == nil {
+		err = e
+	}
+	if e := s.boltStore.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// CloseWithTimeout closes the store as Close does, but if wait is true, waits
+// at most timeout for a graceful shutdown, in which Raft finishes applying
+// any log entry in progress. It returns whether the shutdown was graceful.
+//
+// If it was not, the store is left half-closed. The Raft transport is
+// closed, so no more entries are sent or received, but the database and the
+// Raft log stay open, as the entry being applied may still be using them.
+// They are closed in the background once that entry has been applied and
+// Raft has shut down, and until then the store cannot be reopened, nor its
+// files removed.
+func (s *Store) CloseWithTimeout(wait bool, timeout time.Duration) (bool, error) {
+	if !wait {
+		return true, s.Close(false)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.Close(true)
+	}()
+
+	tmr := time.NewTimer(timeout)
+	defer tmr.Stop()
+	select {
+	case err := <-closed:
+		return true, err
+	case <-tmr.C:
+		s.logger.Warn("timed out waiting for graceful shutdown, forcing close", "timeout", timeout)
+		return false, s.raftTn.Close()
+	}
+}
+
+// SetSnapshotThreshold sets the number of outstanding log entries which
+// trigger a snapshot. Raft does not support changing its configuration while
+// running, so the new threshold is enforced by the Store, which polls the log
+// every snapshot interval. As a result, the threshold can only be effectively
+// lowered at runtime: Raft continues to also snapshot at the threshold in
+// place when the Store was opened. The new value is passed to Raft the next
+// time the Store is opened.
+func (s *Store) SetSnapshotThreshold(n uint64) {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	s.SnapshotThreshold = n
+}
+
+// SetSnapshotInterval sets how often the Store checks whether a snapshot
+// should be taken. As with SetSnapshotThreshold, Raft continues to also check
+// at the interval in place when the Store was opened, and the new value is
+// passed to Raft the next time the Store is opened.
+func (s *Store) SetSnapshotInterval(d time.Duration) {
+	s.snapshotMu.Lock()
+	s.SnapshotInterval = d
+	s.snapshotMu.Unlock()
+
+	select {
+	case s.snapshotWakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// TriggerSnapshot snapshots the database now, rather than waiting for the
+// snapshot threshold or interval to be reached, and truncates the Raft log,
+// less the trailing entries Raft retains for slow followers. It blocks until
+// the snapshot is complete. It may be called on any node, and
+// is a no-op if nothing has been written since the last snapshot.
+func (s *Store) TriggerSnapshot() error {
+	if err := s.raft.Snapshot().Error(); err != nil && err != raft.ErrNothingNewToSnapshot {
 		return err
 	}
-	f := s.raft.Shutdown()
-	if wait {
-		if e := f.(raft.Future); e.Error() != nil {
-			return e.Error()
+	return nil
+}
+
+// LastSnapshot returns the index and term of the last log entry included in
+// the latest snapshot held by this node, along with the size of the snapshot
+// and the time it was taken. All are zero if the node holds no snapshot. A
+// snapshot sent by the leader carries the time it was taken on the leader.
+func (s *Store) LastSnapshot() (index, term uint64, size int64, at time.Time, err error) {
+	metas, err := s.snapshots.List()
+	if err != nil || len(metas) == 0 {
+		return 0, 0, 0, time.Time{}, err
+	}
+	m := metas[0]
+	at, err = snapshotTime(m.ID)
+	if err != nil {
+		return 0, 0, 0, time.Time{}, err
+	}
+	return m.Index, m.Term, m.Size, at, nil
+}
+
+// snapshotTime returns the time a snapshot was taken, from its ID. Raft
+// names each snapshot "term-index-msec", where msec is the Unix time, in
+// milliseconds, at which it was created.
+func snapshotTime(id string) (time.Time, error) {
+	msec, err := strconv.ParseInt(id[strings.LastIndex(id, "-")+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid snapshot ID %s: %s", id, err)
+	}
+	return time.Unix(0, msec*int64(time.Millisecond)), nil
+}
+
+// snapshotConfig returns the snapshot threshold and interval currently in
+// effect, taking into account Raft defaults.
+func (s *Store) snapshotConfig() (uint64, time.Duration) {
+	s.snapshotMu.RLock()
+	defer s.snapshotMu.RUnlock()
+	def := raft.DefaultConfig()
+	threshold, interval := s.SnapshotThreshold, s.SnapshotInterval
+	if threshold == 0 {
+		threshold = def.SnapshotThreshold
+	}
+	if interval == 0 {
+		interval = def.SnapshotInterval
+	}
+	return threshold, interval
+}
+
+// monitorSnapshots periodically triggers a snapshot if the number of log
+// entries since the last snapshot has reached the snapshot threshold, until
+// the store is closed. This allows the threshold and interval to be changed
+// while the Store is open.
+func (s *Store) monitorSnapshots() {
+	for {
+		_, interval := s.snapshotConfig()
+		select {
+		case <-time.After(interval):
+			threshold, _ := s.snapshotConfig()
+			lastSnap, err := strconv.ParseUint(s.raft.Stats()["last_snapshot_index"], 10, 64)
+			if err != nil {
+				s.logger.Error("failed to determine last snapshot index", "error", err)
+				continue
+			}
+			if s.raft.LastIndex()-lastSnap < threshold {
+				continue
+			}
+			if err := s.raft.Snapshot().Error(); err != nil && err != raft.ErrNothingNewToSnapshot {
+				s.logger.Error("failed to take snapshot", "error", err)
+			}
+		case <-s.snapshotWakeCh:
+			// Interval changed, start waiting again using the new value.
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// RegisterLeaderChange returns a channel which receives true when this node
+// becomes the leader, and false when it stops being the leader. Each call
+// returns a distinct, buffered, channel. If a subscriber does not keep up
+// with changes, notifications for that subscriber are dropped, so that the
+// Raft system is never blocked.
+func (s *Store) RegisterLeaderChange() <-chan bool {
+	ch := make(chan bool, leaderChanSize)
+	s.leaderObsMu.Lock()
+	defer s.leaderObsMu.Unlock()
+	s.leaderObs = append(s.leaderObs, ch)
+	return ch
+}
+
+// notifyLeaderChanges passes leadership changes reported by Raft to every
+// subscriber, until the store is closed.
+func (s *Store) notifyLeaderChanges() {
+	for {
+		select {
+		case isLeader := <-s.leaderNotifyCh:
+			if isLeader {
+				s.logger.Info("leader elected", "node", s.raftID)
+				go s.removePendingNodes()
+			} else {
+				s.logger.Info("no longer leader", "node", s.raftID)
+			}
+
+			s.leaderObsMu.Lock()
+			for _, ch := range s.leaderObs {
+				select {
+				case ch <- isLeader:
+				default:
+					s.logger.Warn("leader change subscriber not keeping up, dropping notification")
+				}
+			}
+			s.leaderObsMu.Unlock()
+		case <-s.done:
+			return
 		}
 	}
-	return nil
 }
 
 // WaitForApplied waits for all Raft log entries to to be applied to the
@@ -321,7 +1232,7 @@ func (s *Store) WaitForApplied(timeout time.Duration) error {
 	if timeout == 0 {
 		return nil
 	}
-	s.logger.Printf("waiting for up to %s for application of initial logs", timeout)
+	s.logger.Info("waiting for application of initial logs", "timeout", timeout)
 	if err := s.WaitForAppliedIndex(s.raft.LastIndex(), timeout); err != nil {
 		return ErrOpenTimeout
 	}
@@ -374,23 +1285,45 @@ func (s *Store) LeaderAddr() string {
 // LeaderID returns the node ID of the Raft leader. Returns a
 // blank string if there is no leader, or an error.
 func (s *Store) LeaderID() (string, error) {
-	addr := s.LeaderAddr()
+	id, _, err := s.Leader()
+	return id, err
+}
+
+// Leader returns the node ID and address of the Raft leader. Both are
+// derived from a single read of the leader address, so they always refer
+// to the same node, even across a leadership change. Returns blank strings
+// if there is no leader. The ID is blank if the leader is not in the
+// cluster configuration known to this node.
+func (s *Store) Leader() (id string, addr string, err error) {
+	addr = s.LeaderAddr()
+	if addr == "" {
+		return "", "", nil
+	}
+
 	configFuture := s.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
-		s.logger.Printf("failed to get raft configuration: %v", err)
-		return "", err
+		s.logger.Error("failed to get raft configuration", "error", err)
+		return "", "", err
 	}
 
 	for _, srv := range configFuture.Configuration().Servers {
 		if srv.Address == raft.ServerAddress(addr) {
-			return string(srv.ID), nil
+			return string(srv.ID), addr, nil
 		}
 	}
-	return "", nil
+	return "", addr, nil
 }
 
-// Nodes returns the slice of nodes in the cluster, sorted by ID ascending.
-func (s *Store) Nodes() ([]*Server, error) {
+// Nodes returns the slice of nodes in the cluster, sorted by ID ascending,
+// each with its suffrage. If withStatus is true, each node also carries its
+// status as seen by this node. This node is always reachable. When this node
+// is the leader, every other node is reachable if it has responded to the
+// leader within the heartbeat timeout, and the time of its last response is
+// set. When this node is a follower, the leader is reachable if it has been
+// in contact within the heartbeat timeout, and the time of that contact is
+// set. A follower knows of no contact with other nodes, so they are never
+// reported as reachable.
+func (s *Store) Nodes(withStatus bool) ([]*Server, error) {
 	f := s.raft.GetConfiguration()
 	if f.Error() != nil {
 		return nil, f.Error()
@@ -400,8 +1333,33 @@ func (s *Store) Nodes() ([]*Server, error) {
 	servers := make([]*Server, len(rs))
 	for i := range rs {
 		servers[i] = &Server{
-			ID:   string(rs[i].ID),
-			Addr: string(rs[i].Address),
+			ID:       string(rs[i].ID),
+			Addr:     string(rs[i].Address),
+			Suffrage: rs[i].Suffrage.String(),
+		}
+	}
+
+	if withStatus {
+		leaderAddr := s.LeaderAddr()
+		lastContact := s.raft.LastContact()
+		isLeader := s.raft.State() == raft.Leader
+		for _, srv := range servers {
+			st := &ServerStatus{
+				Self:   srv.ID == s.raftID,
+				Leader: leaderAddr != "" && srv.Addr == leaderAddr,
+			}
+			if st.Self {
+				st.Reachable = true
+			} else if isLeader {
+				if c, ok := s.contacts.Contact(raft.ServerID(srv.ID)); ok {
+					st.LastContact = c.Time
+					st.Reachable = time.Since(c.Time) < s.heartbeatTimeout()
+				}
+			} else if st.Leader && !lastContact.IsZero() {
+				st.LastContact = lastContact
+				st.Reachable = time.Since(lastContact) < s.heartbeatTimeout()
+			}
+			srv.Status = st
 		}
 	}
 
@@ -409,6 +1367,57 @@ func (s *Store) Nodes() ([]*Server, error) {
 	return servers, nil
 }
 
+// raftConfiguration is the JSON form of a Raft configuration, as returned by
+// RaftConfiguration.
+type raftConfiguration struct {
+	Index   uint64       `json:"index"`
+	Servers []raftServer `json:"servers"`
+}
+
+type raftServer struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+}
+
+// RaftConfiguration returns the Raft configuration known to this node, as
+// JSON, listing each server, with its ID, address and suffrage, in the order
+// held by Raft, along with the index of the log entry which set it. Raft
+// uses a configuration as soon as it is written to the log, so a change may
+// be included before it is committed.
+func (s *Store) RaftConfiguration() ([]byte, error) {
+	f := s.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+
+	c := raftConfiguration{Index: f.Index(), Servers: []raftServer{}}
+	for _, srv := range f.Configuration().Servers {
+		c.Servers = append(c.Servers, raftServer{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+		})
+	}
+	return json.Marshal(c)
+}
+
+// heartbeatTimeout returns the effective Raft heartbeat timeout.
+func (s *Store) heartbeatTimeout() time.Duration {
+	if s.HeartbeatTimeout != 0 {
+		return s.HeartbeatTimeout
+	}
+	return raft.DefaultConfig().HeartbeatTimeout
+}
+
+// leaderLeaseTimeout returns the effective Raft leader lease timeout.
+func (s *Store) leaderLeaseTimeout() time.Duration {
+	if s.LeaderLeaseTimeout != 0 {
+		return s.LeaderLeaseTimeout
+	}
+	return raft.DefaultConfig().LeaderLeaseTimeout
+}
+
 // WaitForLeader blocks until a leader is detected, or the timeout expires.
 func (s *Store) WaitForLeader(timeout time.Duration) (string, error) {
 	tck := time.NewTicker(leaderWaitDelay)
@@ -429,6 +1438,80 @@ func (s *Store) WaitForLeader(timeout time.Duration) (string, error) {
 	}
 }
 
+// Live returns whether the Store is open, and so able to serve requests at
+// all. It is cheap enough to be called as often as needed.
+func (s *Store) Live() bool {
+	return s.raft != nil && s.raft.State() != raft.Shutdown
+}
+
+// Ready returns whether the Store is ready to serve requests. It is ready if
+// it is live, a leader is known, and it has applied all but at most the
+// configured ReadyMaxLag of the log entries it knows to be committed.
+func (s *Store) Ready() bool {
+	if !s.Live() || s.LeaderAddr() == "" {
+		return false
+	}
+	applied, ci, err := s.applyProgress()
+	if err != nil {
+		return false
+	}
+	return applied+s.readyMaxLag >= ci
+}
+
+// applyProgress returns the index of the last log entry applied by this
+// node, and of the last it knows to be committed.
+func (s *Store) applyProgress() (applied, committed uint64, err error) {
+	stats := s.raft.Stats()
+	committed, err = strconv.ParseUint(stats["commit_index"], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Raft counts entries as applied once handed to the FSM, and never hands
+	// it entries such as configuration changes. So unless the FSM is idle,
+	// and Raft's count therefore exact, use the last entry the FSM applied.
+	applied = s.raft.AppliedIndex()
+	if stats["fsm_pending"] != "0" || atomic.LoadInt32(&s.fsmBusy) != 0 {
+		applied = atomic.LoadUint64(&s.fsmIndex)
+	}
+	return applied, committed, nil
+}
+
+// staleness returns how stale a read of the local database may be. The
+// leader is never stale. A follower which has applied every change it knows
+// to be committed is as stale as the time since it last heard from the
+// leader. A follower yet to apply some such changes is as stale as the time
+// since it was last seen to have applied them all, or, if it never has been,
+// as stale as a time.Duration allows.
+func (s *Store) staleness() time.Duration {
+	if s.raft.State() == raft.Leader {
+		return 0
+	}
+
+	asOf := s.raft.LastContact()
+	applied, ci, err := s.applyProgress()
+	if err == nil && applied >= ci && !asOf.IsZero() {
+		atomic.StoreInt64(&s.caughtUpAt, asOf.UnixNano())
+	}
+	c := atomic.LoadInt64(&s.caughtUpAt)
+	if c == 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	if d := time.Since(time.Unix(0, c)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// AppliedIndex returns the index of the last Raft log entry applied by this
+// node. Raft counts an entry as applied once it is handed over to be applied
+// to the database, so a client reading its own writes from a follower should
+// instead pass the RaftIndex of an Execute result to WaitForBarrier or
+// WaitForAppliedIndexContext.
+func (s *Store) AppliedIndex() uint64 {
+	return s.raft.AppliedIndex()
+}
+
 // WaitForAppliedIndex blocks until a given log index has been applied,
 // or the timeout expires.
 func (s *Store) WaitForAppliedIndex(idx uint64, timeout time.Duration) error {
@@ -449,17 +1532,157 @@ func (s *Store) WaitForAppliedIndex(idx uint64, timeout time.Duration) error {
 	}
 }
 
-// Stats returns stats for the store.
-func (s *Store) Stats() (map[string]interface{}, error) {
-	fkEnabled, err := s.db.FKConstraints()
-	if err != nil {
-		return nil, err
+// Barrier returns an index such that every change committed before the call
+// is at or below it. It must be called on the leader, which writes a barrier
+// to the Raft log, so confirming its leadership, and waits for the barrier
+// to be applied. Passing the index to WaitForBarrier on any node then allows
+// that node to read everything committed as of the call to Barrier.
+func (s *Store) Barrier(timeout time.Duration) (uint64, error) {
+	if s.raft.State() != raft.Leader {
+		return 0, ErrNotLeader
 	}
-
-	dbStatus := map[string]interface{}{
-		"dsn":            s.dbConf.DSN,
-		"fk_constraints": enabledFromBool(fkEnabled),
-		"version":        sql.DBVersion,
+	if err := s.raft.Barrier(timeout).Error(); err != nil {
+		if err == raft.ErrNotLeader {
+			return 0, ErrNotLeader
+		}
+		return 0, err
+	}
+	return s.raft.AppliedIndex(), nil
+}
+
+// WaitForBarrier blocks until this node has applied every log entry up to
+// and including idx, as returned by Barrier, or the timeout expires. Unlike
+// WaitForAppliedIndex, it waits for entries handed to the FSM to be applied
+// to the database.
+func (s *Store) WaitForBarrier(idx uint64, timeout time.Duration) error {
+	tck := time.NewTicker(appliedWaitDelay)
+	defer tck.Stop()
+	tmr := time.NewTimer(timeout)
+	defer tmr.Stop()
+
+	for {
+		if applied, _, err := s.applyProgress(); err == nil && applied >= idx {
+			return nil
+		}
+		select {
+		case <-tck.C:
+		case <-tmr.C:
+			return fmt.Errorf("timeout waiting for barrier index %d", idx)
+		}
+	}
+}
+
+// CancelSnapshot cancels the snapshot being persisted, if any, so that it is
+// discarded rather than kept. It returns whether a snapshot was in progress.
+func (s *Store) CancelSnapshot() bool {
+	return s.snapshotCanceller.cancel()
+}
+
+// WaitForAppliedIndexContext blocks until a given log index has been applied,
+// or ctx is done, in which case ctx.Err() is returned. The store is woken as
+// soon as each log entry is applied to the FSM. Log entries which never reach
+// the FSM, such as configuration changes, are caught by a periodic check of
+// the applied index, as made by WaitForBarrier, and so this never returns
+// before the entry at idx is applied to the database.
+func (s *Store) WaitForAppliedIndexContext(ctx context.Context, idx uint64) error {
+	tck := time.NewTicker(appliedWaitDelay)
+	defer tck.Stop()
+
+	for {
+		// Fetch the channel before checking the index, so an entry
+		// applied in between is not missed.
+		s.appliedMu.Lock()
+		ch := s.appliedCh
+		s.appliedMu.Unlock()
+
+		if atomic.LoadUint64(&s.fsmIndex) >= idx {
+			return nil
+		}
+
+		select {
+		case <-ch:
+		case <-tck.C:
+			if applied, _, err := s.applyProgress(); err == nil && applied >= idx {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// setFSMIndex records that the log entry at idx has been applied to the FSM,
+// and wakes anyone waiting on an applied index.
+func (s *Store) setFSMIndex(idx uint64) {
+	atomic.StoreUint64(&s.fsmIndex, idx)
+
+	s.appliedMu.Lock()
+	defer s.appliedMu.Unlock()
+	close(s.appliedCh)
+	s.appliedCh = make(chan struct{})
+}
+
+// DBConfig returns a copy of the effective configuration of the database.
+func (s *Store) DBConfig() DBConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := *s.dbConf
+	if s.dbConf.Pragmas != nil {
+		c.Pragmas = make(map[string]string, len(s.dbConf.Pragmas))
+		for k, v := range s.dbConf.Pragmas {
+			c.Pragmas[k] = v
+		}
+	}
+	c.Attach = append([]AttachedDB(nil), s.dbConf.Attach...)
+	c.Functions = append([]Function(nil), s.dbConf.Functions...)
+	return c
+}
+
+// SetBusyTimeout sets the SQLite busy timeout of this node's database
+// connection, without reopening the database. The timeout is kept if the
+// database is later reopened, for example by a restore. It is not written
+// to the Raft log, so applies only to this node. d must be positive.
+func (s *Store) SetBusyTimeout(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid busy timeout %s", d)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.db.SetBusyTimeout(int(d / time.Millisecond)); err != nil {
+		return err
+	}
+	s.dbConf.BusyTimeout = d
+	return nil
+}
+
+// DBSize returns the size of the database in bytes, computed from its page
+// count and page size, whether it is in memory or on disk.
+func (s *Store) DBSize() (int64, error) {
+	count, size, err := s.dbPages()
+	if err != nil {
+		return 0, err
+	}
+	return count * size, nil
+}
+
+// dbPages returns the page count and page size of the database.
+func (s *Store) dbPages() (int64, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Pages()
+}
+
+// Stats returns stats for the store.
+func (s *Store) Stats() (map[string]interface{}, error) {
+	fkEnabled, err := s.db.FKConstraints()
+	if err != nil {
+		return nil, err
+	}
+
+	dbStatus := map[string]interface{}{
+		"dsn":            s.dbConf.DSN,
+		"fk_constraints": enabledFromBool(fkEnabled),
+		"version":        sql.DBVersion,
 	}
 	if !s.dbConf.Memory {
 		dbStatus["path"] = s.dbPath
@@ -471,77 +1694,832 @@ func (s *Store) Stats() (map[string]interface{}, error) {
 	} else {
 		dbStatus["path"] = ":memory:"
 	}
+	pageCount, pageSize, err := s.dbPages()
+	if err != nil {
+		return nil, err
+	}
+	dbStatus["page_count"] = pageCount
+	dbStatus["page_size"] = pageSize
+	if pc := s.db.PreparedCacheStats(); pc != nil {
+		dbStatus["prepared_cache"] = pc
+	}
+	dbSize := pageCount * pageSize
+
+	nodes, err := s.Nodes(false)
+	if err != nil {
+		return nil, err
+	}
+	leaderID, err := s.LeaderID()
+	if err != nil {
+		return nil, err
+	}
+
+	raftStats := s.raft.Stats()
+	ls, err := s.logSize()
+	if err != nil {
+		return nil, err
+	}
+	raftStats["log_size"] = strconv.FormatInt(ls, 10)
+
+	snapIndex, snapTerm, snapSize, snapTime, err := s.LastSnapshot()
+	if err != nil {
+		return nil, err
+	}
 
-	nodes, err := s.Nodes()
+	status := map[string]interface{}{
+		"node_id": s.raftID,
+		"raft":    raftStats,
+		"addr":    s.Addr(),
+		"leader": map[string]string{
+			"node_id": leaderID,
+			"addr":    s.LeaderAddr(),
+		},
+		"apply_timeout":        s.ApplyTimeout.String(),
+		"heartbeat_timeout":    s.HeartbeatTimeout.String(),
+		"election_timeout":     s.ElectionTimeout.String(),
+		"leader_lease_timeout": s.LeaderLeaseTimeout.String(),
+		"snapshot_threshold":   s.SnapshotThreshold,
+		"snapshot_interval":    s.SnapshotInterval,
+		"trailing_logs":        s.TrailingLogs,
+		"batch_window":         s.batchWindow.String(),
+		"quiesced":             s.Quiesced(),
+		"metadata":             s.meta,
+		"nodes":                nodes,
+		"dir":                  s.raftDir,
+		"sqlite3":              dbStatus,
+		"db_conf":              s.DBConfig(),
+		"db_size":              dbSize,
+		"num_nodes":            len(nodes),
+		"num_snapshots":        atomic.LoadInt64(&s.numSnapshots),
+		"applied_index":        s.raft.AppliedIndex(),
+		"last_log_index":       s.raft.LastIndex(),
+		"fsm_apply_duration":   time.Duration(atomic.LoadInt64(&s.lastApplyLatency)).String(),
+	}
+	if s.latency.enabled() {
+		status["latency"] = s.latency.Stats()
+	}
+	if s.queryCache != nil {
+		status["query_cache"] = s.queryCache.Stats()
+	}
+	if tags := s.tags.Stats(); tags != nil {
+		status["tags"] = tags
+	}
+	if snapIndex > 0 {
+		status["last_snapshot"] = map[string]interface{}{
+			"index": snapIndex,
+			"term":  snapTerm,
+			"size":  snapSize,
+			"time":  snapTime,
+		}
+	}
+	status["idempotency_keys"] = s.numIdempotencyKeys()
+	return status, nil
+}
+
+// TableRowCounts returns the approximate number of rows in each table of the
+// database, keyed by table name, without counting them each time. The tables
+// are counted on the first call, and from then on the counts are maintained
+// as each change is applied. The counts are approximate, as some changes are
+// not seen, such as a DELETE with no WHERE clause, which SQLite performs by
+// truncating the table. After a restore, the tables are counted again. It
+// returns nil if the tables cannot be counted.
+func (s *Store) TableRowCounts() map[string]int64 {
+	counts, err := s.db.TableRowCounts()
+	if err != nil {
+		s.logger.Warn("failed to count table rows", "error", err)
+		return nil
+	}
+	return counts
+}
+
+// Execute executes queries that return no rows, but do modify the database.
+func (s *Store) Execute(ex *ExecuteRequest) ([]*sql.Result, error) {
+	return s.ExecuteContext(context.Background(), ex)
+}
+
+// ExecuteContext executes queries that return no rows, but do modify the
+// database. If ctx is done before the Raft log entry is applied, ctx.Err()
+// is returned. Note that the entry may still be committed and applied by
+// the cluster after ctx is done. Each result carries the index of the Raft
+// log entry, which may be passed to WaitForBarrier, or
+// WaitForAppliedIndexContext, on another node to read the changes from it,
+// as both wait for the entry to be applied to the database. The index is zero
+// for dry runs.
+func (s *Store) ExecuteContext(ctx context.Context, ex *ExecuteRequest) (results []*sql.Result, retErr error) {
+	if s.latency.enabled() {
+		defer s.latency.executeTotal.Since(time.Now())
+	}
+	if ex.Tag != "" {
+		defer func(start time.Time) {
+			s.tags.observeExecute(ex.Tag, start, retErr)
+		}(time.Now())
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.readOnly {
+		return nil, ErrReadOnlyNode
+	}
+	if s.Quiesced() {
+		return nil, ErrQuiesced
+	}
+
+	delay := applyRetryDelay
+	for i := 0; ; i++ {
+		results, err := s.executeOnLeader(ctx, ex)
+		if i >= s.applyRetries || !retryableApplyError(err) {
+			return results, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxApplyRetryDelay {
+			delay = maxApplyRetryDelay
+		}
+	}
+}
+
+// executeOnLeader executes ex, if this node is the leader.
+func (s *Store) executeOnLeader(ctx context.Context, ex *ExecuteRequest) ([]*sql.Result, error) {
+	if s.raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+	return s.execute(ctx, ex)
+}
+
+// retryableApplyError returns whether err means a change was rejected
+// before being written to the Raft log, so may be safely retried.
+func retryableApplyError(err error) bool {
+	return err == ErrNotLeader || err == raft.ErrLeadershipTransferInProgress
+}
+
+// executeDryRun executes the statements in ex against the local database,
+// without going through the Raft log, and rolls back all changes.
+func (s *Store) executeDryRun(ex *ExecuteRequest) ([]*sql.Result, error) {
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	d := ex.command()
+	return s.db.ExecuteDryRun(subCommandToStatements(d), ex.Timings, ex.Timeout)
+}
+
+// ExecuteBatch executes the statement in br once for each set of parameters,
+// all within a single Raft log entry and a single transaction. The returned
+// result carries the total number of rows affected. If any execution fails
+// the entire batch is rolled back, and the error is set on the result.
+func (s *Store) ExecuteBatch(br *BatchExecuteRequest) (*sql.Result, error) {
+	if s.readOnly {
+		return nil, ErrReadOnlyNode
+	}
+	if s.Quiesced() {
+		return nil, ErrQuiesced
+	}
+	if s.raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+
+	c, err := newCommand(executeBatch, br.command())
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	f := s.raft.Apply(b, s.ApplyTimeout)
+	if err := s.waitForApply(context.Background(), f); err != nil {
+		return nil, err
+	}
+
+	r := f.Response().(*fsmExecuteResponse)
+	if r.error != nil {
+		return nil, r.error
+	}
+	r.results[0].RaftIndex = f.Index()
+	return r.results[0], nil
+}
+
+// ExecuteOrAbort executes the requests, but aborts any active transaction
+// on the underlying database in the case of any error.
+func (s *Store) ExecuteOrAbort(ex *ExecuteRequest) (results []*sql.Result, retErr error) {
+	if s.readOnly {
+		return nil, ErrReadOnlyNode
+	}
+	if s.Quiesced() {
+		return nil, ErrQuiesced
+	}
+
+	defer func() {
+		var errored bool
+		if results != nil {
+			for i := range results {
+				if results[i].Error != "" {
+					errored = true
+					break
+				}
+			}
+		}
+		if retErr != nil || errored {
+			if err := s.db.AbortTransaction(); err != nil {
+				s.logger.Warn("failed to abort transaction", "error", err)
+			}
+		}
+	}()
+	return s.execute(context.Background(), ex)
+}
+
+func (s *Store) execute(ctx context.Context, ex *ExecuteRequest) ([]*sql.Result, error) {
+	if ex.DryRun {
+		if s.raft.State() != raft.Leader {
+			return nil, ErrNotLeader
+		}
+		return s.executeDryRun(ex)
+	}
+
+	d := ex.command()
+	s.stampIdempotency(d)
+	if s.batchWindow > 0 {
+		return s.executeCoalesced(ctx, d)
+	}
+	c, err := newCommand(execute, d)
 	if err != nil {
 		return nil, err
 	}
-	leaderID, err := s.LeaderID()
-	if err != nil {
-		return nil, err
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	epoch, start := s.leaderEpoch(), time.Now()
+	f := s.raft.Apply(b, s.ApplyTimeout)
+	if err := s.waitForApply(ctx, f); err != nil {
+		return nil, err
+	}
+	s.latency.executeApply.Since(start)
+	s.setLeaderConfirmed(epoch, start, true)
+
+	r := f.Response().(*fsmExecuteResponse)
+	if r.error != nil {
+		return r.results, r.error
+	}
+	for _, res := range r.results {
+		res.RaftIndex = f.Index()
+	}
+	return r.results, nil
+}
+
+// Reload replaces the entire database with the SQLite database file read
+// from r. The file is checked locally before being written to the Raft log,
+// so every node in the cluster installs the same database through normal
+// replication. Any existing data is discarded. This must be called on the
+// leader.
+func (s *Store) Reload(r io.Reader) error {
+	if s.readOnly {
+		return ErrReadOnlyNode
+	}
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	if s.Quiesced() {
+		return ErrQuiesced
+	}
+
+	database, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := validateDatabase(database); err != nil {
+		return err
+	}
+
+	c, err := newCommand(load, &loadSub{DB: database})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	f := s.raft.Apply(b, s.ApplyTimeout)
+	if err := f.Error(); err != nil {
+		if err == raft.ErrNotLeader {
+			return ErrNotLeader
+		}
+		return err
+	}
+	return f.Response().(*fsmGenericResponse).error
+}
+
+// BootFromSQLiteFile replaces the entire database with the plain SQLite
+// database file at path, such as one created by another tool, so that a
+// new cluster may be bootstrapped from existing data. Unlike Restore, the
+// file is not expected to be a snapshot written by a Store. The file is
+// installed through the Raft log, as with Reload, so it is replicated to
+// every node. Any changes in a write-ahead log beside the file are not
+// included, so the file should be checkpointed first. This must be called
+// on the leader, once the Store is open.
+func (s *Store) BootFromSQLiteFile(path string) error {
+	if s.raft == nil {
+		return ErrNotLeader
+	}
+	if s.Quiesced() {
+		return ErrQuiesced
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Reload(f)
+}
+
+// Vacuum rebuilds the database, reclaiming the space left by deleted data.
+// The VACUUM is written to the Raft log, so it is performed by every node in
+// the cluster, in order with all other changes. It fails if a transaction is
+// active. This must be called on the leader.
+func (s *Store) Vacuum() error {
+	if s.readOnly {
+		return ErrReadOnlyNode
+	}
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	if s.Quiesced() {
+		return ErrQuiesced
+	}
+
+	c, err := newCommand(vacuum, nil)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	f := s.raft.Apply(b, s.ApplyTimeout)
+	if err := f.Error(); err != nil {
+		if err == raft.ErrNotLeader {
+			return ErrNotLeader
+		}
+		return err
+	}
+	return f.Response().(*fsmGenericResponse).error
+}
+
+// Reindex rebuilds the indexes of the given table, or every index of the
+// database if table is blank, such as after much churn of the data. As with
+// Vacuum, the REINDEX is written to the Raft log, so it is performed by every
+// node in the cluster, in order with all other changes. This must be called
+// on the leader.
+func (s *Store) Reindex(table string) error {
+	if s.readOnly {
+		return ErrReadOnlyNode
+	}
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	if s.Quiesced() {
+		return ErrQuiesced
+	}
+
+	c, err := newCommand(reindex, table)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	f := s.raft.Apply(b, s.ApplyTimeout)
+	if err := f.Error(); err != nil {
+		if err == raft.ErrNotLeader {
+			return ErrNotLeader
+		}
+		return err
+	}
+	return f.Response().(*fsmGenericResponse).error
+}
+
+// InsertMode is the form of the statements which insert rows in a
+// BackupSQL backup.
+type InsertMode int
+
+const (
+	// InsertPlain writes INSERT statements, so loading the backup fails if
+	// any row already exists.
+	InsertPlain InsertMode = iota
+
+	// InsertOrReplace writes INSERT OR REPLACE statements, so loading the
+	// backup overwrites any existing rows.
+	InsertOrReplace
+
+	// InsertOrIgnore writes INSERT OR IGNORE statements, so loading the
+	// backup leaves any existing rows unchanged.
+	InsertOrIgnore
+)
+
+// statement returns the start of the statements written for m.
+func (m InsertMode) statement() string {
+	switch m {
+	case InsertOrReplace:
+		return "INSERT OR REPLACE"
+	case InsertOrIgnore:
+		return "INSERT OR IGNORE"
+	default:
+		return "INSERT"
+	}
+}
+
+// BackupOptions restricts the tables included in a backup, and controls
+// how a BackupSQL backup inserts rows. Table selection is only supported by
+// the BackupSQL and BackupJSONL formats. A BackupCSV backup instead writes
+// the one table named by Table.
+type BackupOptions struct {
+	// IncludeTables, if non-empty, lists the only tables to back up.
+	IncludeTables []string
+
+	// ExcludeTables lists tables which are not backed up.
+	ExcludeTables []string
+
+	// Insert is the form of the statements which insert rows, for BackupSQL
+	// backups. It is ignored by all other formats.
+	Insert InsertMode
+
+	// Table is the table written by a BackupCSV backup, which is required.
+	// It is ignored by all other formats.
+	Table string
+
+	// CSVNull is the field written for NULL by a BackupCSV backup, as CSV
+	// has no representation of NULL. If blank, DefaultCSVNull is used. Empty
+	// text is written as an empty field. It is ignored by all other formats.
+	CSVNull string
+
+	// Progress, if set, is called periodically during a BackupBinary or
+	// BackupBinaryGzip backup, to report how far it has got. It is ignored
+	// by all other formats.
+	Progress func(p BackupProgress)
+}
+
+// BackupProgress reports how far a binary backup has got. The database is
+// first copied by the SQLite online backup API, during which PagesRemaining
+// and PagesTotal are set. The copy is then written to the destination, during
+// which BytesWritten and BytesTotal are set, and no pages remain. For a
+// BackupBinaryGzip backup, the bytes are counted before compression.
+type BackupProgress struct {
+	PagesRemaining int
+	PagesTotal     int
+	BytesWritten   int64
+	BytesTotal     int64
+}
+
+// progressWriter is a Writer which reports the bytes written through it.
+type progressWriter struct {
+	w        io.Writer
+	written  int64
+	total    int64
+	progress func(p BackupProgress)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	if n > 0 {
+		p.progress(BackupProgress{BytesWritten: p.written, BytesTotal: p.total})
+	}
+	return n, err
+}
+
+// filter returns a function which reports whether a table is selected by o.
+func (o *BackupOptions) filter() func(table string) bool {
+	return func(table string) bool {
+		if len(o.IncludeTables) > 0 && !contains(o.IncludeTables, table) {
+			return false
+		}
+		return !contains(o.ExcludeTables, table)
+	}
+}
+
+// Backup writes a snapshot of the underlying database to dst
+//
+// If leader is true, this operation is performed with a read consistency
+// level equivalent to "weak". Otherwise no guarantees are made about the
+// read consistency level.
+func (s *Store) Backup(leader bool, fmt BackupFormat, dst io.Writer) error {
+	return s.BackupWithOptions(leader, fmt, dst, nil)
+}
+
+// BackupWithOptions writes a snapshot of the underlying database to dst, as
+// Backup does, including only the tables selected by opts. A nil opts selects
+// every table. ErrBackupFilterUnsupported is returned if tables are selected
+// for a binary format.
+func (s *Store) BackupWithOptions(leader bool, fmt BackupFormat, dst io.Writer, opts *BackupOptions) error {
+	if leader && s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	var filter func(string) bool
+	if opts != nil && (len(opts.IncludeTables) > 0 || len(opts.ExcludeTables) > 0) {
+		if fmt != BackupSQL && fmt != BackupJSONL {
+			return ErrBackupFilterUnsupported
+		}
+		filter = opts.filter()
+	}
+	insert := InsertPlain
+	var progress func(BackupProgress)
+	if opts != nil {
+		insert = opts.Insert
+		progress = opts.Progress
+	}
+
+	if fmt == BackupBinary {
+		if err := s.database(leader, dst, progress); err != nil {
+			return err
+		}
+	} else if fmt == BackupBinaryGzip {
+		gw := gzip.NewWriter(dst)
+		if err := s.database(leader, gw, progress); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+	} else if fmt == BackupSQL {
+		if err := s.db.DumpFiltered(dst, filter, insert.statement()); err != nil {
+			return err
+		}
+	} else if fmt == BackupJSONL {
+		if err := s.db.DumpJSONL(dst, filter); err != nil {
+			return err
+		}
+	} else if fmt == BackupCSV {
+		if opts == nil || opts.Table == "" {
+			return ErrBackupTableRequired
+		}
+		null := opts.CSVNull
+		if null == "" {
+			null = DefaultCSVNull
+		}
+		if err := s.db.DumpCSV(dst, opts.Table, null); err != nil {
+			return err
+		}
+	} else {
+		return ErrInvalidBackupFormat
+	}
+
+	stats.Add(numBackups, 1)
+	return nil
+}
+
+// Query executes queries that return rows, and do not modify the database.
+// If a Weak or Strong query is made on a node which is not the leader, a
+// *NotLeaderError carrying the address of the leader is returned. The
+// ServedByLeader field of the rows reports whether they were read on the
+// leader, so a client making None reads of any node can tell when a read
+// happened to reflect the state of the leader, without paying for a Strong
+// read.
+func (s *Store) Query(qr *QueryRequest) ([]*sql.Rows, error) {
+	return s.QueryContext(context.Background(), qr)
+}
+
+// QueryContext executes queries that return rows, and do not modify the
+// database. If ctx is done before the query completes, ctx.Err() is returned
+// and any transaction opened for the query is rolled back.
+func (s *Store) QueryContext(ctx context.Context, qr *QueryRequest) (rows []*sql.Rows, retErr error) {
+	if s.latency.enabled() {
+		defer s.latency.queryTotal.Since(time.Now())
+	}
+	if qr.Tag != "" {
+		defer func(start time.Time) {
+			s.tags.observeQuery(qr.Tag, start, retErr)
+		}(time.Now())
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	qctx, cancel := qr.context(ctx)
+	defer cancel()
+	if qr.StableOrder {
+		if err := s.rlockContext(qctx); err != nil {
+			return nil, queryTimeoutError(ctx, err)
+		}
+		qr = s.withStableOrder(qr)
+		s.mu.RUnlock()
+	}
+	totals := qr.TotalCount && !qr.DescribeOnly
+	if totals {
+		qr = withTotals(qr)
+	}
+	rows, err := s.query(qctx, qr)
+	if err != nil {
+		return nil, queryTimeoutError(ctx, err)
+	}
+	if totals {
+		rows = foldTotals(rows)
+	}
+	if qr.Checksum {
+		for _, r := range rows {
+			r.Checksum = checksumRows(r)
+		}
+	}
+	if qr.Associative {
+		for _, r := range rows {
+			r.MakeAssociative()
+		}
+	}
+	return rows, nil
+}
+
+// query performs the query at the consistency level requested by qr, or by
+// any statement of qr which overrides it. Each run of consecutive statements
+// sharing a level is read separately, in order.
+func (s *Store) query(ctx context.Context, qr *QueryRequest) ([]*sql.Rows, error) {
+	runs := qr.levelRuns()
+	if len(runs) == 1 {
+		return s.queryLevel(ctx, runs[0])
+	}
+	if qr.Tx {
+		return nil, ErrMixedLevelTx
+	}
+
+	var rows []*sql.Rows
+	for _, r := range runs {
+		rs, err := s.queryLevel(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, rs...)
+	}
+	return rows, nil
+}
+
+// queryLevel performs the query at the single consistency level of qr.
+func (s *Store) queryLevel(ctx context.Context, qr *QueryRequest) ([]*sql.Rows, error) {
+	if s.readThroughLog(qr) {
+		rows, err := s.queryStrong(ctx, qr)
+		for _, r := range rows {
+			r.ServedByLeader = true
+		}
+		return rows, err
+	}
+
+	if err := s.checkLocalRead(qr); err != nil {
+		return nil, err
+	}
+	if qr.Lvl == Linearizable {
+		if err := s.readBarrier(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	key, cacheable := queryCacheKey(qr)
+	var gen uint64
+	if cacheable {
+		var rows []*sql.Rows
+		var ok bool
+		if rows, gen, ok = s.queryCache.Get(key); ok {
+			leader := s.raft.State() == raft.Leader
+			for _, r := range rows {
+				r.ServedByLeader = leader
+			}
+			return rows, nil
+		}
 	}
 
-	raftStats := s.raft.Stats()
-	ls, err := s.logSize()
-	if err != nil {
+	// Allow concurrent queries. Strong reads are not covered, as they are
+	// serialized with any change to the database by the Raft log.
+	if err := s.rlockContext(ctx); err != nil {
 		return nil, err
 	}
-	raftStats["log_size"] = strconv.FormatInt(ls, 10)
+	defer s.mu.RUnlock()
 
-	status := map[string]interface{}{
-		"node_id": s.raftID,
-		"raft":    raftStats,
-		"addr":    s.Addr(),
-		"leader": map[string]string{
-			"node_id": leaderID,
-			"addr":    s.LeaderAddr(),
-		},
-		"apply_timeout":      s.ApplyTimeout.String(),
-		"heartbeat_timeout":  s.HeartbeatTimeout.String(),
-		"election_timeout":   s.ElectionTimeout.String(),
-		"snapshot_threshold": s.SnapshotThreshold,
-		"snapshot_interval":  s.SnapshotInterval,
-		"metadata":           s.meta,
-		"nodes":              nodes,
-		"dir":                s.raftDir,
-		"sqlite3":            dbStatus,
-		"db_conf":            s.dbConf,
+	// Read straight from database.
+	stale := s.staleness()
+	leader := s.raft.State() == raft.Leader
+	var rows []*sql.Rows
+	var err error
+	if qr.DescribeOnly {
+		rows, err = s.db.Describe(ctx, qr.statements())
+	} else {
+		rows, err = s.db.QueryWithLimit(ctx, qr.statements(), qr.Tx, qr.Timings, qr.MaxRows)
 	}
-	return status, nil
+	for _, r := range rows {
+		r.StaleFor = stale
+		r.ServedByLeader = leader
+	}
+	if err == nil && cacheable {
+		s.queryCache.Put(key, gen, rows)
+	}
+	return rows, err
 }
 
-// Execute executes queries that return no rows, but do modify the database.
-func (s *Store) Execute(ex *ExecuteRequest) ([]*sql.Result, error) {
-	if s.raft.State() != raft.Leader {
-		return nil, ErrNotLeader
+// QueryStream executes queries that return rows, and do not modify the
+// database, calling fn for each row returned by each statement, in order.
+// For None and Weak consistency levels rows are read from the database
+// cursor and passed to fn one at a time, bypassing the allocation of the
+// entire result set. Strong reads, and LinearizableLease reads made without
+// a valid leader lease, must go through the Raft log, so their results are
+// buffered before being passed to fn. Processing stops if fn
+// returns an error, and that error is returned. An error returned by any
+// statement is also returned. As with Query, statements may override the
+// consistency level of qr.
+func (s *Store) QueryStream(qr *QueryRequest, fn func(row []interface{}) error) error {
+	runs := qr.levelRuns()
+	if len(runs) > 1 && qr.Tx {
+		return ErrMixedLevelTx
+	}
+
+	ctx, cancel := qr.context(context.Background())
+	defer cancel()
+	for _, r := range runs {
+		if err := s.queryStream(ctx, r, fn); err != nil {
+			return queryTimeoutError(context.Background(), err)
+		}
 	}
-	return s.execute(ex)
+	return nil
 }
 
-// ExecuteOrAbort executes the requests, but aborts any active transaction
-// on the underlying database in the case of any error.
-func (s *Store) ExecuteOrAbort(ex *ExecuteRequest) (results []*sql.Result, retErr error) {
-	defer func() {
-		var errored bool
-		if results != nil {
-			for i := range results {
-				if results[i].Error != "" {
-					errored = true
-					break
+// queryStream streams the query at the single consistency level of qr.
+func (s *Store) queryStream(ctx context.Context, qr *QueryRequest, fn func(row []interface{}) error) error {
+	if s.readThroughLog(qr) {
+		rows, err := s.queryStrong(ctx, qr)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if r.Error != "" {
+				return errors.New(r.Error)
+			}
+			for _, v := range r.Values {
+				if err := fn(v); err != nil {
+					return err
 				}
 			}
 		}
-		if retErr != nil || errored {
-			if err := s.db.AbortTransaction(); err != nil {
-				s.logger.Printf("WARNING: failed to abort transaction: %s", err.Error())
-			}
+		return nil
+	}
+
+	if err := s.checkLocalRead(qr); err != nil {
+		return err
+	}
+	if qr.Lvl == Linearizable {
+		if err := s.readBarrier(ctx); err != nil {
+			return err
 		}
+	}
+
+	if err := s.rlockContext(ctx); err != nil {
+		return err
+	}
+	defer s.mu.RUnlock()
+	return s.db.QueryStream(ctx, qr.statements(), qr.Tx, fn)
+}
+
+// rlockContext read-locks the database, unless ctx is done first, in which
+// case ctx.Err() is returned and the lock is not held.
+func (s *Store) rlockContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		s.mu.RLock()
+		return nil
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		s.mu.RLock()
+		close(locked)
 	}()
-	return s.execute(ex)
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// Release the lock once it is eventually acquired.
+		go func() {
+			<-locked
+			s.mu.RUnlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// queryTimeoutError returns ErrQueryTimeout if err is due to the timeout of
+// a request expiring, rather than to parent, and otherwise err.
+func queryTimeoutError(parent context.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+		return ErrQueryTimeout
+	}
+	return err
 }
 
-func (s *Store) execute(ex *ExecuteRequest) ([]*sql.Result, error) {
-	c, err := newCommand(execute, ex.command())
+// queryStrong performs the query through the Raft log.
+func (s *Store) queryStrong(ctx context.Context, qr *QueryRequest) ([]*sql.Rows, error) {
+	c, err := newCommand(query, qr.command())
 	if err != nil {
 		return nil, err
 	}
@@ -550,95 +2528,156 @@ func (s *Store) execute(ex *ExecuteRequest) ([]*sql.Result, error) {
 		return nil, err
 	}
 
+	epoch, start := s.leaderEpoch(), time.Now()
 	f := s.raft.Apply(b, s.ApplyTimeout)
-	if e := f.(raft.Future); e.Error() != nil {
-		if e.Error() == raft.ErrNotLeader {
-			return nil, ErrNotLeader
+	if err := waitForFuture(ctx, f); err != nil {
+		if err == raft.ErrNotLeader {
+			return nil, &NotLeaderError{LeaderAddr: s.LeaderAddr()}
 		}
-		return nil, e.Error()
+		return nil, err
 	}
+	s.setLeaderConfirmed(epoch, start, true)
 
-	r := f.Response().(*fsmExecuteResponse)
-	return r.results, r.error
+	r := f.Response().(*fsmQueryResponse)
+	return r.rows, r.error
 }
 
-// Backup writes a snapshot of the underlying database to dst
-//
-// If leader is true, this operation is performed with a read consistency
-// level equivalent to "weak". Otherwise no guarantees are made about the
-// read consistency level.
-func (s *Store) Backup(leader bool, fmt BackupFormat, dst io.Writer) error {
-	if leader && s.raft.State() != raft.Leader {
-		return ErrNotLeader
+// checkLocalRead returns an error if reading directly from the local
+// database would violate the consistency requirements of qr.
+func (s *Store) checkLocalRead(qr *QueryRequest) error {
+	if (qr.Lvl == Weak || qr.Lvl == LinearizableLease || qr.Lvl == Linearizable) && s.raft.State() != raft.Leader {
+		return &NotLeaderError{LeaderAddr: s.LeaderAddr()}
 	}
 
-	if fmt == BackupBinary {
-		if err := s.database(leader, dst); err != nil {
-			return err
-		}
-	} else if fmt == BackupSQL {
-		if err := s.db.Dump(dst); err != nil {
-			return err
-		}
-	} else {
-		return ErrInvalidBackupFormat
+	if qr.Lvl == Weak && qr.Freshness > 0 && !s.confirmLeadership(qr.Freshness) {
+		return ErrStaleRead
 	}
 
-	stats.Add(numBackups, 1)
+	if qr.Lvl == None && qr.Freshness > 0 && time.Since(s.raft.LastContact()) > qr.Freshness {
+		return ErrStaleRead
+	}
 	return nil
 }
 
-// Query executes queries that return rows, and do not modify the database.
-func (s *Store) Query(qr *QueryRequest) ([]*sql.Rows, error) {
-	// Allow concurrent queries.
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	if qr.Lvl == Strong {
-		c, err := newCommand(query, qr.command())
-		if err != nil {
-			return nil, err
-		}
-		b, err := json.Marshal(c)
-		if err != nil {
-			return nil, err
+// readBarrier commits a barrier to the Raft log, and waits for it to be
+// applied, so that a read of the local database which follows reflects
+// every change committed before the read was requested.
+func (s *Store) readBarrier(ctx context.Context) error {
+	epoch, start := s.leaderEpoch(), time.Now()
+	if err := waitForFuture(ctx, s.raft.Barrier(s.ApplyTimeout)); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return &NotLeaderError{LeaderAddr: s.LeaderAddr()}
 		}
+		return err
+	}
+	s.setLeaderConfirmed(epoch, start, true)
+	return nil
+}
 
-		f := s.raft.Apply(b, s.ApplyTimeout)
-		if e := f.(raft.Future); e.Error() != nil {
-			if e.Error() == raft.ErrNotLeader {
-				return nil, ErrNotLeader
-			}
-			return nil, e.Error()
-		}
+// readThroughLog returns whether qr must be read through the Raft log, which
+// is the case for Strong reads, and for LinearizableLease reads made on the
+// leader when it does not hold a valid lease. The read through the log then
+// gives the leader a lease, once per term, as once it is applied, so is every
+// entry committed in earlier terms.
+func (s *Store) readThroughLog(qr *QueryRequest) bool {
+	switch qr.Lvl {
+	case Strong:
+		return true
+	case LinearizableLease:
+		return s.raft.State() == raft.Leader && !s.leaseValid()
+	}
+	return false
+}
+
+// leaseValid returns whether this node's leadership was confirmed by a quorum
+// within the leader lease timeout, and an entry of its current term has been
+// applied, so that the database holds every change committed before the
+// term. Followers do not start an election until the longer heartbeat timeout
+// passes without contact from the leader, so no other node can have become
+// leader since.
+func (s *Store) leaseValid() bool {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	return s.leaderApplied && time.Since(s.leaderConfirmed) < s.leaderLeaseTimeout()
+}
 
-		r := f.Response().(*fsmQueryResponse)
-		return r.rows, r.error
+// confirmLeadership returns whether this node's leadership has been confirmed
+// by a quorum of the cluster within d. If it has not, leadership is verified
+// now, which blocks until a quorum responds, or until Raft gives up on
+// contacting one.
+func (s *Store) confirmLeadership(d time.Duration) bool {
+	s.leaseMu.Lock()
+	epoch, c := s.leaseEpoch, s.leaderConfirmed
+	s.leaseMu.Unlock()
+	if !c.IsZero() && time.Since(c) <= d {
+		return true
 	}
 
-	if qr.Lvl == Weak && s.raft.State() != raft.Leader {
-		return nil, ErrNotLeader
+	start := time.Now()
+	if err := s.raft.VerifyLeader().Error(); err != nil {
+		return false
 	}
+	s.setLeaderConfirmed(epoch, start, false)
+	return true
+}
 
-	if qr.Lvl == None && qr.Freshness > 0 && time.Since(s.raft.LastContact()) > qr.Freshness {
-		return nil, ErrStaleRead
+// leaderEpoch returns the current epoch, to be passed to setLeaderConfirmed
+// once whatever confirms leadership, begun after the call, completes.
+func (s *Store) leaderEpoch() uint64 {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	return s.leaseEpoch
+}
+
+// setLeaderConfirmed records that leadership was confirmed by a quorum of
+// the cluster at time t, and if applied is set, that an entry or barrier was
+// applied, unless the Raft state has changed since epoch, in which case the
+// confirmation may belong to an earlier term.
+func (s *Store) setLeaderConfirmed(epoch uint64, t time.Time, applied bool) {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	if epoch != s.leaseEpoch {
+		return
 	}
+	if t.After(s.leaderConfirmed) {
+		s.leaderConfirmed = t
+	}
+	s.leaderApplied = s.leaderApplied || applied
+}
 
-	// Read straight from database.
-	return s.db.Query(qr.statements(), qr.Tx, qr.Timings)
+// observeState is called by Raft, synchronously, on every observation. On
+// every change of Raft state it starts a new epoch, discarding any
+// confirmation of leadership, as it may belong to an earlier term. No
+// observation is ever passed on.
+func (s *Store) observeState(o *raft.Observation) bool {
+	if _, ok := o.Data.(raft.RaftState); ok {
+		s.leaseMu.Lock()
+		s.leaseEpoch++
+		s.leaderConfirmed = time.Time{}
+		s.leaderApplied = false
+		s.leaseMu.Unlock()
+	}
+	return false
 }
 
 // Join joins a node, identified by id and located at addr, to this store.
 // The node must be ready to respond to Raft communications at that address.
+// A learner, which reports LearnerKey in its metadata, is always joined as a
+// non-voter.
 func (s *Store) Join(id, addr string, voter bool, metadata map[string]string) error {
-	s.logger.Printf("received request to join node at %s", addr)
+	s.logger.Info("received request to join node", "addr", addr)
 	if s.raft.State() != raft.Leader {
 		return ErrNotLeader
 	}
 
+	if err := s.checkFormatVersion(metadata); err != nil {
+		s.logger.Warn("refusing join request", "addr", addr, "error", err)
+		return err
+	}
+
 	configFuture := s.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
-		s.logger.Printf("failed to get raft configuration: %v", err)
+		s.logger.Error("failed to get raft configuration", "error", err)
 		return err
 	}
 
@@ -649,22 +2688,26 @@ func (s *Store) Join(id, addr string, voter bool, metadata map[string]string) er
 			// However if *both* the ID and the address are the same, the no
 			// join is actually needed.
 			if srv.Address == raft.ServerAddress(addr) && srv.ID == raft.ServerID(id) {
-				s.logger.Printf("node %s at %s already member of cluster, ignoring join request", id, addr)
+				s.logger.Info("node already member of cluster, ignoring join request", "node", id, "addr", addr)
 				return nil
 			}
 
 			if err := s.remove(id); err != nil {
-				s.logger.Printf("failed to remove node: %v", err)
+				s.logger.Error("failed to remove node", "error", err)
 				return err
 			}
 		}
 	}
 
+	if voter && s.isLearner(id, metadata) {
+		s.logger.Info("node is a learner, joining as non-voter", "node", id)
+		voter = false
+	}
+
 	var f raft.IndexFuture
 	if voter {
 		f = s.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0)
 	} else {
-
 		f = s.raft.AddNonvoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0)
 	}
 	if e := f.(raft.Future); e.Error() != nil {
@@ -678,22 +2721,254 @@ func (s *Store) Join(id, addr string, voter bool, metadata map[string]string) er
 		return err
 	}
 
-	s.logger.Printf("node at %s joined successfully as %s", addr, prettyVoter(voter))
+	s.logger.Info("node joined successfully", "addr", addr, "suffrage", prettyVoter(voter))
+	return nil
+}
+
+// JoinWithPromotion joins the node as Join does, but as a non-voter, and then
+// promotes it to a voter once its log has caught up with the log of this node
+// at the time of the join. A non-voter does not count towards the quorum,
+// so a fresh node which must first receive a snapshot does not slow commits
+// down. The log of the node is known from its responses to the heartbeats
+// Raft sends it. Promotion is abandoned if this node loses leadership, or is
+// closed, or if the node has not caught up within ten minutes. A learner is
+// joined as a non-voter, and never promoted.
+func (s *Store) JoinWithPromotion(id, addr string, metadata map[string]string) error {
+	since := time.Now()
+	if err := s.Join(id, addr, false, metadata); err != nil {
+		return err
+	}
+	if s.isLearner(id, metadata) {
+		return nil
+	}
+	idx := s.raft.LastIndex()
+	go func() {
+		if err := s.promoteWhenCaughtUp(id, idx, since, promoteTimeout); err != nil {
+			s.logger.Error("failed to promote node", "node", id, "error", err)
+		}
+	}()
+	return nil
+}
+
+// promoteWhenCaughtUp promotes the node to a voter once it reports, after
+// since, that its last log index has reached idx. It gives up after timeout.
+func (s *Store) promoteWhenCaughtUp(id string, idx uint64, since time.Time, timeout time.Duration) error {
+	tck := time.NewTicker(promoteCheckDelay)
+	defer tck.Stop()
+	tmr := time.NewTimer(timeout)
+	defer tmr.Stop()
+	for {
+		select {
+		case <-tck.C:
+			if s.raft.State() != raft.Leader {
+				s.logger.Info("no longer leader, abandoning promotion of node", "node", id)
+				return nil
+			}
+			c, ok := s.contacts.Contact(raft.ServerID(id))
+			if !ok || c.Time.Before(since) || c.LastLog < idx {
+				continue
+			}
+			return s.Promote(id)
+		case <-tmr.C:
+			return fmt.Errorf("node did not catch up within %s", timeout)
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+// Promote makes the non-voting node with the given ID a voter. It does
+// nothing if the node is already a voter. A learner is never promoted, and
+// ErrLearner is returned instead. This must be called on the leader.
+func (s *Store) Promote(id string) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	if s.isLearner(id, nil) {
+		return ErrLearner
+	}
+
+	cf := s.raft.GetConfiguration()
+	if err := cf.Error(); err != nil {
+		return err
+	}
+	for _, srv := range cf.Configuration().Servers {
+		if srv.ID != raft.ServerID(id) {
+			continue
+		}
+		if srv.Suffrage == raft.Voter {
+			return nil
+		}
+		if err := s.raft.AddVoter(srv.ID, srv.Address, 0, 0).Error(); err != nil {
+			if err == raft.ErrNotLeader {
+				return ErrNotLeader
+			}
+			return err
+		}
+		s.logger.Info("node promoted to voter", "node", id)
+		return nil
+	}
+	return ErrNodeNotFound
+}
+
+// FormatVersion returns the store format version of this Store. A node
+// joining the cluster should report it in its metadata, under the key
+// FormatVersionKey.
+func (s *Store) FormatVersion() int {
+	return s.formatVersion
+}
+
+// Learner returns whether this Store is a learner. A learner joining the
+// cluster should report LearnerKey in its metadata.
+func (s *Store) Learner() bool {
+	return s.learner
+}
+
+// isLearner returns whether the node with the given ID, or the node joining
+// with the given metadata, is a learner.
+func (s *Store) isLearner(id string, md map[string]string) bool {
+	return md[LearnerKey] == "true" || s.Metadata(id, LearnerKey) == "true"
+}
+
+// checkFormatVersion returns ErrIncompatibleVersion if the join metadata md
+// reports a store format version different from this Store's. Nodes built
+// before format versions were introduced don't report one, and are allowed.
+func (s *Store) checkFormatVersion(md map[string]string) error {
+	v, ok := md[FormatVersionKey]
+	if !ok {
+		return nil
+	}
+	if v != strconv.Itoa(s.formatVersion) {
+		return fmt.Errorf("%w: node has %s, cluster has %d", ErrIncompatibleVersion, v, s.formatVersion)
+	}
 	return nil
 }
 
-// Remove removes a node from the store, specified by ID.
+// Stepdown transfers leadership of the cluster to another voting node. If
+// wait is set, it blocks until another node is leader, or returns an error if
+// that does not happen within a timeout. Otherwise it returns once the
+// transfer has been started.
+func (s *Store) Stepdown(wait bool) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	cf := s.raft.GetConfiguration()
+	if err := cf.Error(); err != nil {
+		return err
+	}
+	eligible := false
+	for _, srv := range cf.Configuration().Servers {
+		if srv.ID != raft.ServerID(s.raftID) && srv.Suffrage == raft.Voter {
+			eligible = true
+			break
+		}
+	}
+	if !eligible {
+		return ErrNoEligibleVoters
+	}
+
+	// Raft transfers leadership to the voter most up to date with the log.
+	s.logger.Info("transferring leadership")
+	if err := s.raft.LeadershipTransfer().Error(); err != nil {
+		if err == raft.ErrNotLeader {
+			return ErrNotLeader
+		}
+		return err
+	}
+	if !wait {
+		return nil
+	}
+
+	tck := time.NewTicker(leaderWaitDelay)
+	defer tck.Stop()
+	tmr := time.NewTimer(stepdownTimeout)
+	defer tmr.Stop()
+	for {
+		select {
+		case <-tck.C:
+			id, _, err := s.Leader()
+			if err == nil && id != "" && id != s.raftID {
+				return nil
+			}
+		case <-tmr.C:
+			return fmt.Errorf("timeout waiting for leadership to be transferred")
+		}
+	}
+}
+
+// Remove removes a node from the store, specified by ID. If the node is this
+// node, and it is the leader, leadership is first transferred to another
+// voting node, which then removes this node, so the cluster stays available.
+// In that case Remove blocks until this node has been removed, and returns
+// an error wrapping the reason if leadership could not be transferred.
 func (s *Store) Remove(id string) error {
-	s.logger.Printf("received request to remove node %s", id)
-	if err := s.remove(id); err != nil {
-		s.logger.Printf("failed to remove node %s: %s", id, err.Error())
+	s.logger.Info("received request to remove node", "node", id)
+	var err error
+	if id == s.raftID && s.raft.State() == raft.Leader {
+		err = s.removeSelf()
+	} else {
+		err = s.remove(id)
+	}
+	if err != nil {
+		s.logger.Error("failed to remove node", "node", id, "error", err)
 		return err
 	}
 
-	s.logger.Printf("node %s removed successfully", id)
+	s.logger.Info("node removed successfully", "node", id)
 	return nil
 }
 
+// RemoveByAddr removes a node from the store, specified by Raft address.
+func (s *Store) RemoveByAddr(addr string) error {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		s.logger.Error("failed to get raft configuration", "error", err)
+		return err
+	}
+
+	var ids []string
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.Address == raft.ServerAddress(addr) {
+			ids = append(ids, string(srv.ID))
+		}
+	}
+	if len(ids) == 0 {
+		return ErrNodeNotFound
+	}
+	if len(ids) > 1 {
+		return fmt.Errorf("multiple nodes found at address %s", addr)
+	}
+	return s.Remove(ids[0])
+}
+
+// WaitForRemoved blocks until the node with the given ID is no longer in the
+// cluster configuration known to this node, or the timeout expires. Once
+// removed, a node shuts down Raft, so when waiting for this node's own
+// removal, Raft having shut down also counts as removed.
+func (s *Store) WaitForRemoved(id string, timeout time.Duration) error {
+	tck := time.NewTicker(leaderWaitDelay)
+	defer tck.Stop()
+	tmr := time.NewTimer(timeout)
+	defer tmr.Stop()
+	for {
+		cf := s.raft.GetConfiguration()
+		if err := cf.Error(); err != nil {
+			if err == raft.ErrRaftShutdown && id == s.raftID {
+				return nil
+			}
+		} else if !hasServer(cf.Configuration(), id) {
+			return nil
+		}
+
+		select {
+		case <-tck.C:
+		case <-tmr.C:
+			return fmt.Errorf("timeout waiting for node %s to be removed", id)
+		}
+	}
+}
+
 // Metadata returns the value for a given key, for a given node ID.
 func (s *Store) Metadata(id, key string) string {
 	s.metaMu.RLock()
@@ -706,7 +2981,22 @@ func (s *Store) Metadata(id, key string) string {
 	if ok {
 		return v
 	}
-	return ""
+	return ""
+}
+
+// AllMetadata returns a copy of the metadata of every node, keyed by node ID.
+func (s *Store) AllMetadata() map[string]map[string]string {
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+
+	all := make(map[string]map[string]string, len(s.meta))
+	for id, md := range s.meta {
+		all[id] = make(map[string]string, len(md))
+		for k, v := range md {
+			all[id][k] = v
+		}
+	}
+	return all
 }
 
 // SetMetadata adds the metadata md to any existing metadata for
@@ -756,31 +3046,498 @@ func (s *Store) setMetadata(id string, md map[string]string) error {
 	return nil
 }
 
+// load replaces the underlying database with the SQLite database file
+// contained in b. All queries are blocked while the swap takes place.
+func (s *Store) load(b []byte) error {
+	return s.replaceDatabase(b, nil)
+}
+
+// replaceDatabase replaces the database with the SQLite database file
+// contained in b, and each attached database with the corresponding file
+// in attached. If attached is nil, the attached databases are kept. If the
+// new databases cannot be opened, the existing databases are put back in
+// place, and the error is returned.
+func (s *Store) replaceDatabase(b []byte, attached [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.queryCache.Invalidate()
+	defer s.schemaChanged()
+
+	// In-memory attached databases are lost when the connection is closed,
+	// so they are copied out first, to be kept or put back.
+	old, err := s.attachedDatabases(s.db)
+	if err != nil {
+		return err
+	}
+	if attached == nil {
+		attached = old
+	}
+
+	if s.dbConf.Memory {
+		db, err := s.openFromBytes(b)
+		if err != nil {
+			return err
+		}
+		if err := s.restoreAttached(db, attached); err != nil {
+			db.Close()
+			return err
+		}
+		if err := s.db.Close(); err != nil {
+			s.logger.Error("failed to close replaced database", "error", err)
+		}
+		s.db = db
+		return nil
+	}
+
+	// Move the existing database file aside, so it can be put back. Any
+	// write-ahead log is checkpointed first, so the file is complete.
+	if s.walEnabled() {
+		if err := s.db.Checkpoint(); err != nil {
+			return err
+		}
+	}
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	bakPath := s.dbPath + restoreSuffix
+	if err := os.Rename(s.dbPath, bakPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	db, err := s.openFromBytes(b)
+	if err == nil {
+		if err = s.restoreAttached(db, attached); err != nil {
+			db.Close()
+		}
+	}
+	if err != nil {
+		if rerr := s.rollbackDatabase(bakPath, old); rerr != nil {
+			return fmt.Errorf("%s, and failed to roll back: %s", err.Error(), rerr.Error())
+		}
+		return err
+	}
+	s.db = db
+	os.Remove(bakPath)
+	return nil
+}
+
+// rollbackDatabase puts the database file at bakPath back in place, and
+// reopens it, along with the attached databases in attached.
+func (s *Store) rollbackDatabase(bakPath string, attached [][]byte) error {
+	if err := s.removeDBFiles(); err != nil {
+		return err
+	}
+	if err := os.Rename(bakPath, s.dbPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := sql.OpenWithDSN(s.dbPath, s.dbConf.DSN)
+	if err != nil {
+		return err
+	}
+	if err := s.configureDB(db); err != nil {
+		db.Close()
+		return err
+	}
+	if err := s.restoreAttached(db, attached); err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// attachments returns the attached databases in the order they are attached.
+func (s *Store) attachments() []AttachedDB {
+	a := append([]AttachedDB(nil), s.dbConf.Attach...)
+	sort.Slice(a, func(i, j int) bool { return a[i].Name < a[j].Name })
+	return a
+}
+
+// attachedPath returns the path of the file of the attached database name.
+func (s *Store) attachedPath(name string) string {
+	return filepath.Join(s.raftDir, "attached-"+name+".sqlite")
+}
+
+// attachedDatabases returns a copy of each database attached to db, in the
+// order they are attached.
+func (s *Store) attachedDatabases(db *sql.DB) ([][]byte, error) {
+	var attached [][]byte
+	for _, a := range s.attachments() {
+		b, err := func() ([]byte, error) {
+			f, err := ioutil.TempFile("", "rqlilte-attached-")
+			if err != nil {
+				return nil, err
+			}
+			f.Close()
+			defer os.Remove(f.Name())
+
+			if err := db.BackupAttached(a.Name, f.Name()); err != nil {
+				return nil, err
+			}
+			return ioutil.ReadFile(f.Name())
+		}()
+		if err != nil {
+			return nil, err
+		}
+		attached = append(attached, b)
+	}
+	return attached, nil
+}
+
+// restoreAttached replaces the contents of each database attached to db with
+// the SQLite database file at the same position in attached.
+func (s *Store) restoreAttached(db *sql.DB, attached [][]byte) error {
+	for i, a := range s.attachments() {
+		if i >= len(attached) {
+			break
+		}
+		err := func() error {
+			f, err := ioutil.TempFile("", "rqlilte-attached-")
+			if err != nil {
+				return err
+			}
+			f.Close()
+			defer os.Remove(f.Name())
+
+			if err := ioutil.WriteFile(f.Name(), attached[i], 0660); err != nil {
+				return err
+			}
+			return db.RestoreAttached(a.Name, f.Name())
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openFromBytes writes the SQLite database file contained in b to the
+// configured location, and opens it.
+func (s *Store) openFromBytes(b []byte) (*sql.DB, error) {
+	var db *sql.DB
+	var err error
+	if !s.dbConf.Memory {
+		// Write database over any existing database file.
+		if err := s.removeDBFiles(); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(s.dbPath, b, 0660); err != nil {
+			return nil, err
+		}
+
+		// Re-open it.
+		db, err = sql.OpenWithDSN(s.dbPath, s.dbConf.DSN)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// In memory. Copy to temporary file, and then load memory from file.
+		f, err := ioutil.TempFile("", "rqlilte-snap-")
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+
+		if err := ioutil.WriteFile(f.Name(), b, 0660); err != nil {
+			return nil, err
+		}
+
+		// Load an in-memory database from the file now on disk.
+		db, err = sql.LoadInMemoryWithDSN(f.Name(), s.dbConf.DSN)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := s.configureDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
 // open opens the in-memory or file-based database.
 func (s *Store) open() (*sql.DB, error) {
 	var db *sql.DB
 	var err error
+
+	// Attached database files are rebuilt from the log along with the main
+	// database.
+	for _, a := range s.attachments() {
+		if !a.Memory {
+			for _, p := range []string{s.attachedPath(a.Name), s.attachedPath(a.Name) + "-journal"} {
+				if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+					return nil, err
+				}
+			}
+		}
+	}
 	if !s.dbConf.Memory {
 		// Explicitly remove any pre-existing SQLite database file as it will be
 		// completely rebuilt from committed log entries (and possibly a snapshot).
-		if err := os.Remove(s.dbPath); err != nil && !os.IsNotExist(err) {
+		if err := s.removeDBFiles(); err != nil {
 			return nil, err
 		}
 		db, err = sql.OpenWithDSN(s.dbPath, s.dbConf.DSN)
 		if err != nil {
 			return nil, err
 		}
-		s.logger.Println("SQLite database opened at", s.dbPath)
+		s.logger.Info("SQLite database opened", "path", s.dbPath)
 	} else {
 		db, err = sql.OpenInMemoryWithDSN(s.dbConf.DSN)
 		if err != nil {
 			return nil, err
 		}
-		s.logger.Println("SQLite in-memory database opened")
+		s.logger.Info("SQLite in-memory database opened")
+	}
+	if err := s.configureDB(db); err != nil {
+		db.Close()
+		return nil, err
 	}
 	return db, nil
 }
 
+// configureDB applies the connection-level settings in the store's DBConfig
+// to db. It must be called every time the underlying database is opened.
+func (s *Store) configureDB(db *sql.DB) error {
+	if s.dbConf.BusyTimeout > 0 {
+		if err := db.SetBusyTimeout(int(s.dbConf.BusyTimeout / time.Millisecond)); err != nil {
+			return err
+		}
+	}
+	if s.dbConf.JournalMode != "" {
+		if s.dbConf.Memory && s.walEnabled() {
+			return ErrWALInMemory
+		}
+		if err := db.SetJournalMode(s.dbConf.JournalMode); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(s.dbConf.Pragmas))
+	for k := range s.dbConf.Pragmas {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if err := checkPragma(k, s.dbConf.Pragmas[k]); err != nil {
+			return err
+		}
+		if err := db.SetPragma(k, s.dbConf.Pragmas[k]); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range s.attachments() {
+		name := strings.ToLower(a.Name)
+		if !attachNameRe.MatchString(a.Name) || name == "main" || name == "temp" || seen[name] {
+			return fmt.Errorf("%w: %s", ErrInvalidAttachment, a.Name)
+		}
+		seen[name] = true
+		path := ":memory:"
+		if !a.Memory {
+			path = s.attachedPath(a.Name)
+		}
+		if err := db.Attach(a.Name, path); err != nil {
+			return err
+		}
+	}
+	db.SetCoerceIntegerParams(s.dbConf.CoerceIntegerParams)
+	db.SetPreparedCacheSize(s.preparedCacheSize)
+	return s.registerFunctions(db)
+}
+
+// registerFunctions registers the functions in the store's DBConfig on db.
+func (s *Store) registerFunctions(db *sql.DB) error {
+	for _, f := range s.dbConf.Functions {
+		if err := db.RegisterFunc(f.Name, f.Impl, f.Deterministic); err != nil {
+			return fmt.Errorf("failed to register function %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+var (
+	pragmaNameRe  = regexp.MustCompile(`^[A-Za-z_]+$`)
+	pragmaValueRe = regexp.MustCompile(`^-?[A-Za-z0-9_]+$`)
+	attachNameRe  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// formatPragmas are pragmas which set the on-disk format of the database.
+// They can't be set through DBConfig, as the database file is shipped
+// between nodes in snapshots. journal_mode has its own DBConfig field.
+var formatPragmas = map[string]bool{
+	"auto_vacuum":  true,
+	"encoding":     true,
+	"journal_mode": true,
+	"page_size":    true,
+}
+
+// checkPragma returns an error if the pragma name and value are not allowed.
+// Both must be simple words or numbers, since they are not quoted.
+func checkPragma(name, value string) error {
+	if formatPragmas[strings.ToLower(name)] || !pragmaNameRe.MatchString(name) || !pragmaValueRe.MatchString(value) {
+		return fmt.Errorf("%w: %s=%s", ErrUnsupportedPragma, name, value)
+	}
+	return nil
+}
+
+// walEnabled returns whether the database is configured for WAL journal mode.
+func (s *Store) walEnabled() bool {
+	return strings.EqualFold(s.dbConf.JournalMode, "WAL")
+}
+
+// removeDBFiles removes the on-disk database file, and any write-ahead log
+// and shared-memory files which would otherwise be applied to a new
+// database created at the same path.
+func (s *Store) removeDBFiles() error {
+	for _, p := range []string{s.dbPath, s.dbPath + "-wal", s.dbPath + "-shm"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSelf removes this node, the leader, from the cluster. It marks this
+// node for removal, and transfers leadership, so that the new leader removes
+// it. It then waits until this node learns that it has been removed. If any
+// of this fails, the mark is withdrawn.
+func (s *Store) removeSelf() error {
+	if err := s.setMetadata(s.raftID, map[string]string{removePendingKey: "true"}); err != nil {
+		return err
+	}
+	if err := s.Stepdown(true); err != nil {
+		s.withdrawRemoval()
+		return fmt.Errorf("failed to transfer leadership before removal: %w", err)
+	}
+
+	if err := s.WaitForRemoved(s.raftID, removeTimeout); err != nil {
+		s.withdrawRemoval()
+		return err
+	}
+	return nil
+}
+
+// withdrawRemoval withdraws the mark for removal of this node, so another
+// leader does not act on it later. Once leadership has been transferred, the
+// mark is withdrawn through the new leader.
+func (s *Store) withdrawRemoval() {
+	md := map[string]string{removePendingKey: ""}
+	var err error
+	if s.raft.State() == raft.Leader {
+		err = s.setMetadata(s.raftID, md)
+	} else {
+		err = s.forwardMetadata(md)
+	}
+	if err != nil {
+		s.logger.Error("failed to withdraw removal of node", "node", s.raftID, "error", err)
+	}
+}
+
+// removePendingNodes removes every node marked for removal by a previous
+// leader. It is called when this node becomes the leader.
+func (s *Store) removePendingNodes() {
+	// The mark is written before leadership is transferred, but may not yet
+	// be applied here.
+	if err := s.WaitForAppliedIndex(s.raft.LastIndex(), s.ApplyTimeout); err != nil {
+		s.logger.Error("failed to apply log before removing pending nodes", "error", err)
+		return
+	}
+
+	var ids []string
+	s.metaMu.RLock()
+	for id, md := range s.meta {
+		if md[removePendingKey] == "true" && id != s.raftID {
+			ids = append(ids, id)
+		}
+	}
+	s.metaMu.RUnlock()
+
+	for _, id := range ids {
+		s.logger.Info("removing node, as requested by previous leader", "node", id)
+		if err := s.remove(id); err != nil {
+			s.logger.Error("failed to remove node", "node", id, "error", err)
+			continue
+		}
+		s.logger.Info("node removed successfully", "node", id)
+	}
+}
+
+// removeDeadNodes removes, while this node is the leader, every non-voter
+// which has not been reachable for the dead node timeout, until the store is
+// closed. A non-voter is reachable while it responds to the heartbeats Raft
+// sends it, each from its own goroutine, so one dead node delays no other.
+func (s *Store) removeDeadNodes() {
+	interval := s.deadNodeTimeout / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	tck := time.NewTicker(interval)
+	defer tck.Stop()
+
+	// Times each non-voter was first seen by this leader.
+	firstSeen := make(map[string]time.Time)
+	for {
+		select {
+		case <-tck.C:
+		case <-s.done:
+			return
+		}
+
+		if s.raft.State() != raft.Leader {
+			firstSeen = make(map[string]time.Time)
+			continue
+		}
+		cf := s.raft.GetConfiguration()
+		if err := cf.Error(); err != nil {
+			continue
+		}
+
+		nonVoters := make(map[string]bool)
+		for _, srv := range cf.Configuration().Servers {
+			id := string(srv.ID)
+			if srv.Suffrage != raft.Nonvoter || id == s.raftID {
+				continue
+			}
+			nonVoters[id] = true
+			if _, ok := firstSeen[id]; !ok {
+				firstSeen[id] = time.Now()
+			}
+			last := firstSeen[id]
+			if c, ok := s.contacts.Contact(srv.ID); ok && c.Time.After(last) {
+				last = c.Time
+			}
+			if time.Since(last) < s.deadNodeTimeout {
+				continue
+			}
+
+			s.logger.Info("removing unreachable non-voting node", "node", id, "last_contact", last)
+			if err := s.remove(id); err != nil {
+				s.logger.Error("failed to remove node", "node", id, "error", err)
+				continue
+			}
+			s.logger.Info("node removed successfully", "node", id)
+		}
+		for id := range firstSeen {
+			if !nonVoters[id] {
+				delete(firstSeen, id)
+			}
+		}
+	}
+}
+
+// hasServer returns whether the node with the given ID is in c.
+func hasServer(c raft.Configuration, id string) bool {
+	for _, srv := range c.Servers {
+		if srv.ID == raft.ServerID(id) {
+			return true
+		}
+	}
+	return false
+}
+
 // remove removes the node, with the given ID, from the cluster.
 func (s *Store) remove(id string) error {
 	if s.raft.State() != raft.Leader {
@@ -794,6 +3551,7 @@ func (s *Store) remove(id string) error {
 		}
 		return f.Error()
 	}
+	s.contacts.Forget(raft.ServerID(id))
 
 	c, err := newCommand(metadataDelete, id)
 	if err != nil {
@@ -831,6 +3589,12 @@ func (s *Store) raftConfig() *raft.Config {
 	if s.ElectionTimeout != 0 {
 		config.ElectionTimeout = s.ElectionTimeout
 	}
+	if s.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = s.LeaderLeaseTimeout
+	}
+	if s.TrailingLogs != 0 {
+		config.TrailingLogs = s.TrailingLogs
+	}
 	return config
 }
 
@@ -839,6 +3603,10 @@ type fsmExecuteResponse struct {
 	error   error
 }
 
+type fsmMultiExecuteResponse struct {
+	responses []*fsmExecuteResponse
+}
+
 type fsmQueryResponse struct {
 	rows  []*sql.Rows
 	error error
@@ -850,11 +3618,27 @@ type fsmGenericResponse struct {
 
 // Apply applies a Raft log entry to the database.
 func (s *Store) Apply(l *raft.Log) interface{} {
+	start := time.Now()
+	atomic.StoreInt32(&s.fsmBusy, 1)
+	defer func() {
+		atomic.StoreInt64(&s.lastApplyLatency, int64(time.Since(start)))
+		s.setFSMIndex(l.Index)
+		atomic.StoreInt32(&s.fsmBusy, 0)
+	}()
+
 	var c command
 	if err := json.Unmarshal(l.Data, &c); err != nil {
 		panic(fmt.Sprintf("failed to unmarshal cluster command: %s", err.Error()))
 	}
 
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	// Cached query results may be stale once the change is applied.
+	if c.Typ != query && c.Typ != metadataSet && c.Typ != metadataDelete {
+		defer s.queryCache.Invalidate()
+	}
+
 	switch c.Typ {
 	case execute, query:
 		var d databaseSub
@@ -864,43 +3648,171 @@ func (s *Store) Apply(l *raft.Log) interface{} {
 		stmts := subCommandToStatements(&d)
 
 		if c.Typ == execute {
-			r, err := s.db.Execute(stmts, d.Tx, d.Timings)
-			return &fsmExecuteResponse{results: r, error: err}
+			return s.applyExecute(l.Index, &d)
+		}
+		if d.DescribeOnly {
+			r, err := s.db.Describe(context.Background(), stmts)
+			return &fsmQueryResponse{rows: r, error: err}
 		}
-		r, err := s.db.Query(stmts, d.Tx, d.Timings)
+		r, err := s.db.QueryWithLimit(context.Background(), stmts, d.Tx, d.Timings, d.MaxRows)
 		return &fsmQueryResponse{rows: r, error: err}
+	case executeMulti:
+		var d multiExecuteSub
+		if err := json.Unmarshal(c.Sub, &d); err != nil {
+			return &fsmGenericResponse{error: err}
+		}
+		r := &fsmMultiExecuteResponse{responses: make([]*fsmExecuteResponse, len(d.Subs))}
+		for i := range d.Subs {
+			r.responses[i] = s.applyExecute(l.Index, d.Subs[i])
+		}
+		return r
 	case metadataSet:
 		var d metadataSetSub
 		if err := json.Unmarshal(c.Sub, &d); err != nil {
 			return &fsmGenericResponse{error: err}
 		}
-		func() {
+		ev := func() MetadataEvent {
 			s.metaMu.Lock()
 			defer s.metaMu.Unlock()
+			ev := MetadataEvent{Type: MetadataKeysSet, ID: d.RaftID, Data: make(map[string]string)}
 			if _, ok := s.meta[d.RaftID]; !ok {
 				s.meta[d.RaftID] = make(map[string]string)
+				ev.Type = MetadataNodeAdded
 			}
 			for k, v := range d.Data {
+				if old, ok := s.meta[d.RaftID][k]; !ok || old != v {
+					ev.Data[k] = v
+				}
 				s.meta[d.RaftID][k] = v
 			}
+			return ev
+		}()
+		if ev.Type == MetadataNodeAdded || len(ev.Data) > 0 {
+			s.notifyMetadataChange(ev)
+		}
+		return &fsmGenericResponse{}
+	case metadataDelete:
+		var d string
+		if err := json.Unmarshal(c.Sub, &d); err != nil {
+			return &fsmGenericResponse{error: err}
+		}
+		md, ok := func() (map[string]string, bool) {
+			s.metaMu.Lock()
+			defer s.metaMu.Unlock()
+			md, ok := s.meta[d]
+			delete(s.meta, d)
+			return md, ok
 		}()
+		if ok {
+			s.notifyMetadataChange(MetadataEvent{Type: MetadataNodeRemoved, ID: d, Data: md})
+		}
+		return &fsmGenericResponse{}
+	case load:
+		var d loadSub
+		if err := json.Unmarshal(c.Sub, &d); err != nil {
+			return &fsmGenericResponse{error: err}
+		}
+		if s.Quiesced() {
+			return &fsmGenericResponse{error: ErrQuiesced}
+		}
+		err := s.load(d.DB)
+		s.reportApplyErrors(l.Index, nil, nil, err)
+		return &fsmGenericResponse{error: err}
+	case vacuum:
+		if s.Quiesced() {
+			return &fsmGenericResponse{error: ErrQuiesced}
+		}
+		err := s.db.Vacuum()
+		s.reportApplyErrors(l.Index, []string{"VACUUM"}, nil, err)
+		return &fsmGenericResponse{error: err}
+	case reindex:
+		var table string
+		if err := json.Unmarshal(c.Sub, &table); err != nil {
+			return &fsmGenericResponse{error: err}
+		}
+		if s.Quiesced() {
+			return &fsmGenericResponse{error: ErrQuiesced}
+		}
+		err := s.db.Reindex(table)
+		s.reportApplyErrors(l.Index, []string{strings.TrimSpace("REINDEX " + table)}, nil, err)
+		return &fsmGenericResponse{error: err}
+	case quiesce:
+		var enable bool
+		if err := json.Unmarshal(c.Sub, &enable); err != nil {
+			return &fsmGenericResponse{error: err}
+		}
+		s.setQuiesced(enable)
 		return &fsmGenericResponse{}
-	case metadataDelete:
-		var d string
+	case executeBatch:
+		var d batchSub
 		if err := json.Unmarshal(c.Sub, &d); err != nil {
 			return &fsmGenericResponse{error: err}
 		}
-		func() {
-			s.metaMu.Lock()
-			defer s.metaMu.Unlock()
-			delete(s.meta, d)
-		}()
-		return &fsmGenericResponse{}
+		if s.Quiesced() {
+			return &fsmExecuteResponse{error: ErrQuiesced}
+		}
+		params := make([][]gosql.Value, len(d.Parameters))
+		for i := range d.Parameters {
+			params[i] = make([]gosql.Value, len(d.Parameters[i]))
+			for j := range d.Parameters[i] {
+				params[i][j] = d.Parameters[i][j]
+			}
+		}
+		r, err := s.db.ExecuteBatch(d.Query, params, d.Timings)
+		s.reportApplyErrors(l.Index, []string{d.Query}, []*sql.Result{r}, err)
+		return &fsmExecuteResponse{results: []*sql.Result{r}, error: err}
 	default:
 		return &fsmGenericResponse{error: fmt.Errorf("unknown command: %v", c.Typ)}
 	}
 }
 
+// applyExecute applies the changes in d, carried by the log entry at index.
+// Changes written to the log after the cluster was quiesced are refused.
+func (s *Store) applyExecute(index uint64, d *databaseSub) *fsmExecuteResponse {
+	if s.Quiesced() {
+		return &fsmExecuteResponse{error: ErrQuiesced}
+	}
+	r, err := s.executeIdempotent(d, func() ([]*sql.Result, error) {
+		defer s.latency.executeSQLite.Since(time.Now())
+		execute := s.db.ExecuteWithStepLimit
+		if d.ReturnChangedRows {
+			execute = s.db.ExecuteReturningChanges
+		}
+		r, err := execute(subCommandToStatements(d), d.Tx, d.Timings, d.StepLimit)
+		s.reportApplyErrors(index, d.Queries, r, err)
+		for _, res := range r {
+			if res != nil && res.Changed {
+				s.schemaChanged()
+				break
+			}
+		}
+		return r, err
+	})
+	return &fsmExecuteResponse{results: r, error: err}
+}
+
+// reportApplyErrors passes err, and the error of each of results, to any
+// OnApplyError callback. The results are those of queries, in order. If
+// there is a single query, err is attributed to it.
+func (s *Store) reportApplyErrors(index uint64, queries []string, results []*sql.Result, err error) {
+	if s.OnApplyError == nil {
+		return
+	}
+	for i, r := range results {
+		if r == nil || r.Error == "" || i >= len(queries) {
+			continue
+		}
+		s.OnApplyError(index, &ApplyError{Statement: queries[i], Err: errors.New(r.Error)})
+	}
+	if err != nil {
+		ae := &ApplyError{Err: err}
+		if len(queries) == 1 {
+			ae.Statement = queries[0]
+		}
+		s.OnApplyError(index, ae)
+	}
+}
+
 // Database returns a copy of the underlying database. The caller should
 // ensure that no transaction is taking place during this call, or an error may
 // be returned. If leader is true, this operation is performed with a read
@@ -932,6 +3844,89 @@ func (s *Store) Database(leader bool) ([]byte, error) {
 	return ioutil.ReadFile(f.Name())
 }
 
+// compactedDatabase returns a copy of the database, without the tables
+// excluded from snapshots.
+func (s *Store) compactedDatabase() ([]byte, error) {
+	f, err := ioutil.TempFile("", "rqlilte-snap-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.db.Backup(f.Name())
+	}(); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.registerFunctions(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.dropExcludedTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(f.Name())
+}
+
+// dropExcludedTables drops the tables of db excluded from snapshots, and
+// then vacuums db to reclaim their space.
+func (s *Store) dropExcludedTables(db *sql.DB) error {
+	rows, err := db.QueryStringStmt(`SELECT "name" FROM "sqlite_master" WHERE "type" = 'table'`)
+	if err != nil {
+		return err
+	}
+	if rows[0].Error != "" {
+		return errors.New(rows[0].Error)
+	}
+
+	var stmts []sql.Statement
+	for _, v := range rows[0].Values {
+		name := v[0].(string)
+		if strings.HasPrefix(name, "sqlite_") || !s.excludedFromSnapshot(name) {
+			continue
+		}
+		stmts = append(stmts, sql.Statement{
+			Query: fmt.Sprintf(`DROP TABLE "%s"`, strings.Replace(name, `"`, `""`, -1)),
+		})
+	}
+	if len(stmts) == 0 {
+		return nil
+	}
+	results, err := db.Execute(stmts, true, false)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			return errors.New(r.Error)
+		}
+	}
+	return db.Vacuum()
+}
+
+// excludedFromSnapshot returns whether the table named name is left out of
+// snapshots.
+func (s *Store) excludedFromSnapshot(name string) bool {
+	for _, p := range s.snapshotExclude {
+		if p != "" && strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
 // Snapshot returns a snapshot of the database. The caller must ensure that
 // no transaction is taking place during this call. Hashicorp Raft guarantees
 // that this function will not be called concurrently with Apply.
@@ -939,90 +3934,119 @@ func (s *Store) Database(leader bool) ([]byte, error) {
 // http://sqlite.org/howtocorrupt.html states it is safe to do this
 // as long as no transaction is in progress.
 func (s *Store) Snapshot() (raft.FSMSnapshot, error) {
-	fsm := &fsmSnapshot{}
+	fsm := &fsmSnapshot{canceller: &s.snapshotCanceller}
 	var err error
-	fsm.database, err = s.Database(false)
+	if len(s.snapshotExclude) > 0 {
+		fsm.database, err = s.compactedDatabase()
+	} else {
+		fsm.database, err = s.Database(false)
+	}
+	if err != nil {
+		s.logger.Error("failed to read database for snapshot", "error", err)
+		return nil, err
+	}
+
+	fsm.attached, err = func() ([][]byte, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.attachedDatabases(s.db)
+	}()
 	if err != nil {
-		s.logger.Printf("failed to read database for snapshot: %s", err.Error())
+		s.logger.Error("failed to read attached databases for snapshot", "error", err)
 		return nil, err
 	}
+	for _, a := range s.attachments() {
+		fsm.attachedNames = append(fsm.attachedNames, a.Name)
+	}
 
 	fsm.meta, err = json.Marshal(s.meta)
 	if err != nil {
-		s.logger.Printf("failed to encode meta for snapshot: %s", err.Error())
+		s.logger.Error("failed to encode meta for snapshot", "error", err)
+		return nil, err
+	}
+
+	fsm.idempotency, err = s.idempotencySnapshot()
+	if err != nil {
+		s.logger.Error("failed to encode idempotency records for snapshot", "error", err)
 		return nil, err
 	}
+	fsm.idempotency, fsm.quiesced = s.quiescedSnapshot(fsm.idempotency)
 
 	stats.Add(numSnaphots, 1)
+	atomic.AddInt64(&s.numSnapshots, 1)
 	return fsm, nil
 }
 
-// Restore restores the node to a previous state.
+// Restore restores the node to a previous state. The snapshot data may be
+// gzip-compressed, in which case it is transparently decompressed.
+//
+// The snapshot is read in full and its database validated before the
+// existing database is replaced. If any of this fails, the existing database
+// and cluster meta are left unchanged. The databases attached in the snapshot
+// must be those configured on this node, else ErrSnapshotAttachments is
+// returned.
 func (s *Store) Restore(rc io.ReadCloser) error {
-	if err := s.db.Close(); err != nil {
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	zr, err := gzipOrPlainReader(rc)
+	if err != nil {
 		return err
 	}
+	r := bufio.NewReader(zr)
 
-	// Get size of database.
-	var sz uint64
-	if err := binary.Read(rc, binary.LittleEndian, &sz); err != nil {
+	// Read in the database file data, preceded by its size.
+	database, err := readSized(r)
+	if err != nil {
 		return err
 	}
 
-	// Now read in the database file data and restore.
-	database := make([]byte, sz)
-	if _, err := io.ReadFull(rc, database); err != nil {
+	// Any attached databases follow, which must be those configured here.
+	names, attached, err := readAttached(r)
+	if err != nil {
 		return err
 	}
-
-	var db *sql.DB
-	var err error
-	if !s.dbConf.Memory {
-		// Write snapshot over any existing database file.
-		if err := ioutil.WriteFile(s.dbPath, database, 0660); err != nil {
-			return err
-		}
-
-		// Re-open it.
-		db, err = sql.OpenWithDSN(s.dbPath, s.dbConf.DSN)
-		if err != nil {
-			return err
-		}
-	} else {
-		// In memory. Copy to temporary file, and then load memory from file.
-		f, err := ioutil.TempFile("", "rqlilte-snap-")
-		if err != nil {
-			return err
-		}
-		f.Close()
-		defer os.Remove(f.Name())
-
-		if err := ioutil.WriteFile(f.Name(), database, 0660); err != nil {
-			return err
+	local := s.attachments()
+	if len(names) != len(local) {
+		return ErrSnapshotAttachments
+	}
+	for i, a := range local {
+		if names[i] != a.Name {
+			return ErrSnapshotAttachments
 		}
-
-		// Load an in-memory database from the snapshot now on disk.
-		db, err = sql.LoadInMemoryWithDSN(f.Name(), s.dbConf.DSN)
-		if err != nil {
+		if err := validateDatabase(attached[i]); err != nil {
 			return err
 		}
 	}
-	s.db = db
 
-	// Read remaining bytes, and set to cluster meta.
-	b, err := ioutil.ReadAll(rc)
-	if err != nil {
+	// Read remaining bytes, which are the cluster meta, followed by any
+	// idempotency records, and then whether the cluster is quiesced.
+	dec := json.NewDecoder(r)
+	meta := make(map[string]map[string]string)
+	if err := dec.Decode(&meta); err != nil {
+		return err
+	}
+	var records map[string]*idempotentRecord
+	if err := dec.Decode(&records); err != nil && err != io.EOF {
+		return err
+	}
+	var quiesced bool
+	if err := dec.Decode(&quiesced); err != nil && err != io.EOF {
 		return err
 	}
 
-	err = func() error {
-		s.metaMu.Lock()
-		defer s.metaMu.Unlock()
-		return json.Unmarshal(b, &s.meta)
-	}()
-	if err != nil {
+	if err := validateDatabase(database); err != nil {
+		return err
+	}
+	if err := s.replaceDatabase(database, attached); err != nil {
 		return err
 	}
+
+	s.metaMu.Lock()
+	s.meta = meta
+	s.metaMu.Unlock()
+	s.restoreIdempotency(records)
+	s.setQuiesced(quiesced)
 	stats.Add(numRestores, 1)
 	return nil
 }
@@ -1049,10 +4073,33 @@ func (s *Store) logSize() (int64, error) {
 type fsmSnapshot struct {
 	database []byte
 	meta     []byte
+
+	// attached holds each attached database, named by attachedNames, and
+	// is written after the database only if there are some.
+	attached      [][]byte
+	attachedNames []string
+
+	// idempotency holds any idempotency records, and is written after the
+	// meta only if there are some, so that other snapshots are unchanged.
+	idempotency []byte
+
+	// quiesced is written last, only if the cluster is quiesced.
+	quiesced []byte
+
+	canceller *snapshotCanceller // If set, allows Persist to be cancelled.
 }
 
-// Persist writes the snapshot to the given sink.
+// Persist writes the snapshot to the given sink. The databases are written
+// in chunks, and if the snapshot is cancelled between chunks, the sink is
+// cancelled, so no partial snapshot is kept, and ErrSnapshotCancelled is
+// returned.
 func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	var cancelled <-chan struct{}
+	if f.canceller != nil {
+		cancelled = f.canceller.start()
+		defer f.canceller.stop()
+	}
+
 	err := func() error {
 		// Start by writing size of database.
 		b := new(bytes.Buffer)
@@ -1066,15 +4113,51 @@ func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 		}
 
 		// Next write database to sink.
-		if _, err := sink.Write(f.database); err != nil {
+		if err := writeChunked(sink, f.database, cancelled); err != nil {
 			return err
 		}
 
-		// Finally write the meta.
+		// Then any attached databases, after a marker and their count, each
+		// preceded by its name and size.
+		if len(f.attached) > 0 {
+			if _, err := sink.Write([]byte{snapshotAttachedMarker}); err != nil {
+				return err
+			}
+			if err := binary.Write(sink, binary.LittleEndian, uint64(len(f.attached))); err != nil {
+				return err
+			}
+			for i, a := range f.attached {
+				name := f.attachedNames[i]
+				if err := binary.Write(sink, binary.LittleEndian, uint64(len(name))); err != nil {
+					return err
+				}
+				if _, err := io.WriteString(sink, name); err != nil {
+					return err
+				}
+				if err := binary.Write(sink, binary.LittleEndian, uint64(len(a))); err != nil {
+					return err
+				}
+				if err := writeChunked(sink, a, cancelled); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Then write the meta.
 		if _, err := sink.Write(f.meta); err != nil {
 			return err
 		}
 
+		// Then any idempotency records.
+		if _, err := sink.Write(f.idempotency); err != nil {
+			return err
+		}
+
+		// Finally whether the cluster is quiesced.
+		if _, err := sink.Write(f.quiesced); err != nil {
+			return err
+		}
+
 		// Close the sink.
 		return sink.Close()
 	}()
@@ -1088,11 +4171,19 @@ func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 }
 
 // Database copies contents of the underlying SQLite database to dst
-func (s *Store) database(leader bool, dst io.Writer) error {
+func (s *Store) database(leader bool, dst io.Writer, progress func(BackupProgress)) error {
 	if leader && s.raft.State() != raft.Leader {
 		return ErrNotLeader
 	}
 
+	// Move any content of the write-ahead log into the database file first,
+	// so the copy does not depend on the log.
+	if s.walEnabled() {
+		if err := s.db.Checkpoint(); err != nil {
+			return err
+		}
+	}
+
 	f, err := ioutil.TempFile("", "rqlilte-snap-")
 	if err != nil {
 		return err
@@ -1101,7 +4192,13 @@ func (s *Store) database(leader bool, dst io.Writer) error {
 		return err
 	}
 
-	if err := s.db.Backup(f.Name()); err != nil {
+	var pagesProgress func(remaining, total int)
+	if progress != nil {
+		pagesProgress = func(remaining, total int) {
+			progress(BackupProgress{PagesRemaining: remaining, PagesTotal: total})
+		}
+	}
+	if err := s.db.BackupWithProgress(f.Name(), pagesProgress); err != nil {
 		return err
 	}
 
@@ -1111,6 +4208,13 @@ func (s *Store) database(leader bool, dst io.Writer) error {
 	}
 	defer of.Close()
 
+	if progress != nil {
+		fi, err := of.Stat()
+		if err != nil {
+			return err
+		}
+		dst = &progressWriter{w: dst, total: fi.Size(), progress: progress}
+	}
 	_, err = io.Copy(dst, of)
 	return err
 }
@@ -1118,6 +4222,118 @@ func (s *Store) database(leader bool, dst io.Writer) error {
 // Release is a no-op.
 func (f *fsmSnapshot) Release() {}
 
+// writeChunked writes b to w in chunks, returning ErrSnapshotCancelled if
+// cancelled is closed before all chunks are written.
+func writeChunked(w io.Writer, b []byte, cancelled <-chan struct{}) error {
+	for len(b) > 0 {
+		select {
+		case <-cancelled:
+			return ErrSnapshotCancelled
+		default:
+		}
+		n := len(b)
+		if n > snapshotChunkSize {
+			n = snapshotChunkSize
+		}
+		if _, err := w.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// readSized reads from r a size, and then that many bytes. The bytes are
+// read as they arrive, so a corrupt size fails with io.ErrUnexpectedEOF
+// rather than allocating more than remains in r.
+func readSized(r io.Reader) ([]byte, error) {
+	var sz uint64
+	if err := binary.Read(r, binary.LittleEndian, &sz); err != nil {
+		return nil, err
+	}
+	if sz > math.MaxInt64 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, r, int64(sz)); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// readAttached reads from r any attached databases of a snapshot, returning
+// their names and contents. Neither is returned if r has no attachments.
+func readAttached(r *bufio.Reader) ([]string, [][]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if b[0] != snapshotAttachedMarker {
+		return nil, nil, nil
+	}
+	if _, err := r.Discard(1); err != nil {
+		return nil, nil, err
+	}
+
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	var attached [][]byte
+	for i := uint64(0); i < n; i++ {
+		name, err := readSized(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		a, err := readSized(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, string(name))
+		attached = append(attached, a)
+	}
+	return names, attached, nil
+}
+
+// snapshotCanceller allows the snapshot being persisted to be cancelled.
+type snapshotCanceller struct {
+	mu sync.Mutex
+	ch chan struct{} // Non-nil while a snapshot is persisted, and closed to cancel it.
+}
+
+// start returns a channel which is closed if the snapshot now being
+// persisted is cancelled.
+func (c *snapshotCanceller) start() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ch = make(chan struct{})
+	return c.ch
+}
+
+// stop marks the snapshot as no longer being persisted.
+func (c *snapshotCanceller) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ch = nil
+}
+
+// cancel cancels the snapshot being persisted, returning whether there was
+// one which had not already been cancelled.
+func (c *snapshotCanceller) cancel() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch == nil {
+		return false
+	}
+	close(c.ch)
+	c.ch = nil
+	return true
+}
+
 func subCommandToStatements(d *databaseSub) []sql.Statement {
 	stmts := make([]sql.Statement, len(d.Queries))
 	for i := range d.Queries {
@@ -1137,6 +4353,107 @@ func subCommandToStatements(d *databaseSub) []sql.Statement {
 	return stmts
 }
 
+// gzipOrPlainReader returns a reader of the data in r, decompressing it if
+// it starts with the gzip magic number. An uncompressed snapshot starts with
+// the little-endian size of a SQLite file, which is always a multiple of 512,
+// so cannot be mistaken for the gzip magic number.
+func gzipOrPlainReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// validateDatabase returns an error if b does not contain a usable SQLite
+// database file.
+func validateDatabase(b []byte) error {
+	f, err := ioutil.TempFile("", "rqlilte-load-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := ioutil.WriteFile(f.Name(), b, 0660); err != nil {
+		return err
+	}
+	db, err := sql.Open(f.Name())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Opening a database is lazy, so read the schema to check the file,
+	// and then check the integrity of the whole database.
+	rows, err := db.QueryStringStmt("SELECT COUNT(*) FROM sqlite_master")
+	if err != nil {
+		return err
+	}
+	if rows[0].Error != "" {
+		return errors.New(rows[0].Error)
+	}
+	rows, err = db.QueryStringStmt("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	if rows[0].Error != "" {
+		return errors.New(rows[0].Error)
+	}
+	if len(rows[0].Values) != 1 || asString(rows[0].Values[0][0]) != "ok" {
+		return fmt.Errorf("database failed integrity check: %v", rows[0].Values)
+	}
+	return nil
+}
+
+// waitForApply blocks until the Raft log entry of future f is applied, ctx is
+// done, or the Store's apply timeout expires, in which case ErrApplyTimeout
+// is returned.
+func (s *Store) waitForApply(ctx context.Context, f raft.Future) error {
+	wctx := ctx
+	if s.ApplyTimeout > 0 {
+		var cancel context.CancelFunc
+		wctx, cancel = context.WithTimeout(ctx, s.ApplyTimeout)
+		defer cancel()
+	}
+
+	err := waitForFuture(wctx, f)
+	switch {
+	case err == nil:
+		return nil
+	case err == raft.ErrNotLeader:
+		return ErrNotLeader
+	case err == raft.ErrEnqueueTimeout:
+		return ErrApplyTimeout
+	case err == context.DeadlineExceeded && ctx.Err() == nil:
+		return ErrApplyTimeout
+	}
+	return err
+}
+
+// waitForFuture blocks until the future f completes, or ctx is done. If ctx
+// is done first, ctx.Err() is returned.
+func waitForFuture(ctx context.Context, f raft.Future) error {
+	if ctx.Done() == nil {
+		return f.Error()
+	}
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- f.Error()
+	}()
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // enabledFromBool converts bool to "enabled" or "disabled".
 func enabledFromBool(b bool) string {
 	if b {
@@ -1160,3 +4477,13 @@ func pathExists(p string) bool {
 	}
 	return true
 }
+
+// contains returns true if s is in a.
+func contains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,15 +2,32 @@ package store
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/raft"
+	"github.com/mattn/go-sqlite3"
+	sql "github.com/rqlite/rqlite/db"
 	"github.com/rqlite/rqlite/testdata/chinook"
 )
 
@@ -35,6 +52,35 @@ func Test_OpenStoreSingleNode(t *testing.T) {
 	}
 }
 
+func Test_SingleNodeLeader(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	id, addr, err := s.Leader()
+	if err != nil {
+		t.Fatalf("failed to retrieve leader: %s", err.Error())
+	}
+	leaderID, err := s.LeaderID()
+	if err != nil {
+		t.Fatalf("failed to retrieve leader ID: %s", err.Error())
+	}
+	if exp, got := leaderID, id; exp != got {
+		t.Fatalf("wrong leader ID returned, got: %s, exp %s", got, exp)
+	}
+	if exp, got := s.LeaderAddr(), addr; exp != got {
+		t.Fatalf("wrong leader address returned, got: %s, exp %s", got, exp)
+	}
+	if id != s.ID() || addr != s.Addr() {
+		t.Fatalf("leader is not this node, got %s at %s", id, addr)
+	}
+}
+
 func Test_OpenStoreCloseSingleNode(t *testing.T) {
 	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
@@ -48,100 +94,146 @@ func Test_OpenStoreCloseSingleNode(t *testing.T) {
 	}
 }
 
-func Test_SingleNodeInMemExecuteQuery(t *testing.T) {
+// Test_SingleNodeCloseWithTimeout checks that a close which cannot shut down
+// gracefully, as an entry is stuck being applied, returns once the timeout
+// has passed, reporting that the close was not graceful.
+func Test_SingleNodeCloseWithTimeout(t *testing.T) {
 	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
 
 	if err := s.Open(true); err != nil {
 		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
-
-	queries := stmtsFromStrings([]string{
-		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
-		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
-	})
-	_, err := s.Execute(&ExecuteRequest{queries, false, false})
-	if err != nil {
-		t.Fatalf("failed to execute on single node: %s", err.Error())
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`})}); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
 	}
 
-	queries = stmtsFromString("SELECT * FROM foo")
-	r, err := s.Query(&QueryRequest{queries, false, false, None, 0})
+	// Stall the FSM, by holding the lock it takes to apply an entry.
+	s.dbMu.Lock()
+	executed := make(chan struct{})
+	go func() {
+		defer close(executed)
+		s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{`INSERT INTO foo(id, name) VALUES(1, "fiona")`})})
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	start := time.Now()
+	graceful, err := s.CloseWithTimeout(true, time.Second)
 	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
+		t.Fatalf("failed to close single-node store: %s", err.Error())
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if graceful {
+		t.Fatalf("close reported as graceful despite stalled FSM")
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if d := time.Since(start); d > 3*time.Second {
+		t.Fatalf("close took %s, longer than its timeout", d)
+	}
+
+	s.dbMu.Unlock()
+	select {
+	case <-executed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("stalled execute did not return")
 	}
 }
 
-// Test_SingleNodeInMemExecuteQueryFail ensures database level errors are presented by the store.
-func Test_SingleNodeInMemExecuteQueryFail(t *testing.T) {
+func Test_SingleNodeCloseWithTimeoutGraceful(t *testing.T) {
 	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
 
 	if err := s.Open(true); err != nil {
 		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
-
-	queries := stmtsFromStrings([]string{
-		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
-	})
-	r, err := s.Execute(&ExecuteRequest{queries, false, false})
+	graceful, err := s.CloseWithTimeout(true, 10*time.Second)
 	if err != nil {
-		t.Fatalf("failed to execute on single node: %s", err.Error())
+		t.Fatalf("failed to close single-node store: %s", err.Error())
 	}
-	if exp, got := "no such table: foo", r[0].Error; exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if !graceful {
+		t.Fatalf("close of idle store reported as not graceful")
 	}
 }
 
-func Test_SingleNodeFileExecuteQuery(t *testing.T) {
+// Test_SingleNodeReopenDatabaseBehindLog checks that a database left behind
+// the log, as by a crash between Raft committing an entry and the entry
+// being applied to the database, is brought up to date when reopened.
+func Test_SingleNodeReopenDatabaseBehindLog(t *testing.T) {
 	s := mustNewStore(false)
 	defer os.RemoveAll(s.Path())
-
 	if err := s.Open(true); err != nil {
 		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
 
 	queries := stmtsFromStrings([]string{
 		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
 		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+		`INSERT INTO foo(id, name) VALUES(2, "declan")`,
 	})
-	_, err := s.Execute(&ExecuteRequest{queries, false, false})
-	if err != nil {
+	if _, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false}); err != nil {
 		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
-	r, err := s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
-	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
+	if err := s.Close(true); err != nil {
+		t.Fatalf("failed to close single-node store: %s", err.Error())
 	}
-	r, err = s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
+
+	// Undo the last change to the database, but not to the log.
+	db, err := sql.Open(s.dbPath)
 	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
+		t.Fatalf("failed to open database: %s", err.Error())
+	}
+	if _, err := db.ExecuteStringStmt(`DELETE FROM foo WHERE id = 2`); err != nil {
+		t.Fatalf("failed to delete from database: %s", err.Error())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %s", err.Error())
+	}
+
+	s = New(mustMockLister("localhost:0"), &StoreConfig{
+		DBConf: NewDBConfig("", false),
+		Dir:    s.Path(),
+		ID:     s.ID(),
+	})
+	if err := s.Open(false); err != nil {
+		t.Fatalf("failed to reopen single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+	if err := s.WaitForBarrier(s.raft.LastIndex(), 5*time.Second); err != nil {
+		t.Fatalf("failed to apply log: %s", err.Error())
 	}
-	r, err = s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
+
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None})
 	if err != nil {
 		t.Fatalf("failed to query single node: %s", err.Error())
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if exp, got := `[[1,"fiona"],[2,"declan"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("database not brought up to date\nexp: %s\ngot: %s", exp, got)
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+}
+
+func Test_SingleNodeRaftConfiguration(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	b, err := s.RaftConfiguration()
+	if err != nil {
+		t.Fatalf("failed to get raft configuration: %s", err.Error())
+	}
+	exp := fmt.Sprintf(`{"index":1,"servers":[{"id":%q,"address":%q,"suffrage":"Voter"}]}`, s.ID(), s.Addr())
+	if got := string(b); exp != got {
+		t.Fatalf("unexpected raft configuration\nexp: %s\ngot: %s", exp, got)
 	}
 }
 
-func Test_SingleNodeExecuteQueryTx(t *testing.T) {
+func Test_SingleNodeInMemExecuteQuery(t *testing.T) {
 	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
 
@@ -155,19 +247,13 @@ func Test_SingleNodeExecuteQueryTx(t *testing.T) {
 		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
 		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
 	})
-	_, err := s.Execute(&ExecuteRequest{queries, false, true})
+	_, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false})
 	if err != nil {
 		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
-	r, err := s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, true, None, 0})
-	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
-	}
-	r, err = s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, true, Weak, 0})
-	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
-	}
-	r, err = s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, true, Strong, 0})
+
+	queries = stmtsFromString("SELECT * FROM foo")
+	r, err := s.Query(&QueryRequest{Stmts: queries, Timings: false, Tx: false, Lvl: None, Freshness: 0})
 	if err != nil {
 		t.Fatalf("failed to query single node: %s", err.Error())
 	}
@@ -177,16 +263,11 @@ func Test_SingleNodeExecuteQueryTx(t *testing.T) {
 	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
 		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
 	}
-	_, err = s.Execute(&ExecuteRequest{queries, false, true})
-	if err != nil {
-		t.Fatalf("failed to execute on single node: %s", err.Error())
-	}
 }
 
-func Test_SingleNodeBackupBinary(t *testing.T) {
-	t.Parallel()
-
-	s := mustNewStore(false)
+// Test_SingleNodeInMemExecuteQueryFail ensures database level errors are presented by the store.
+func Test_SingleNodeInMemExecuteQueryFail(t *testing.T) {
+	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
 
 	if err := s.Open(true); err != nil {
@@ -195,45 +276,49 @@ func Test_SingleNodeBackupBinary(t *testing.T) {
 	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
 
-	dump := `PRAGMA foreign_keys=OFF;
-BEGIN TRANSACTION;
-CREATE TABLE foo (id integer not null primary key, name text);
-INSERT INTO "foo" VALUES(1,'fiona');
-COMMIT;
-`
-	_, err := s.Execute(&ExecuteRequest{stmtsFromString(dump), false, false})
+	queries := stmtsFromStrings([]string{
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	r, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false})
 	if err != nil {
-		t.Fatalf("failed to load simple dump: %s", err.Error())
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if exp, got := "no such table: foo", r[0].Error; exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := int(sqlite3.ErrError), r[0].ErrorCode; exp != got {
+		t.Fatalf("unexpected error code for query\nexp: %d\ngot: %d", exp, got)
 	}
+}
 
-	f, err := ioutil.TempFile("", "rqlite-baktest-")
-	defer os.Remove(f.Name())
-	s.logger.Printf("backup file is %s", f.Name())
+func Test_SingleNodeWaitForAppliedIndexContext(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
 
-	if err := s.Backup(true, BackupBinary, f); err != nil {
-		t.Fatalf("Backup failed %s", err.Error())
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	// Check the backed up data by reading back up file, underlying SQLite file,
-	// and comparing the two.
-	bkp, err := ioutil.ReadFile(f.Name())
-	if err != nil {
-		t.Fatalf("Backup Failed: unable to read backup file, %s", err.Error())
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
-
-	dbFile, err := ioutil.ReadFile(filepath.Join(s.Path(), sqliteFile))
-	if err != nil {
-		t.Fatalf("Backup Failed: unable to read source SQLite file, %s", err.Error())
+	if err := s.WaitForAppliedIndexContext(context.Background(), s.raft.LastIndex()); err != nil {
+		t.Fatalf("failed to wait for applied index: %s", err.Error())
 	}
 
-	if ret := bytes.Compare(bkp, dbFile); ret != 0 {
-		t.Fatalf("Backup Failed: backup bytes are not same")
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if err := s.WaitForAppliedIndexContext(ctx, s.raft.LastIndex()+100); err != ctx.Err() || err == nil {
+		t.Fatalf("expected %v waiting for unreachable index, got %v", ctx.Err(), err)
 	}
 }
 
-func Test_SingleNodeBackupText(t *testing.T) {
-	t.Parallel()
-
+func Test_SingleNodeExecuteQueryContextCancel(t *testing.T) {
 	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
 
@@ -243,37 +328,41 @@ func Test_SingleNodeBackupText(t *testing.T) {
 	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
 
-	dump := `PRAGMA foreign_keys=OFF;
-BEGIN TRANSACTION;
-CREATE TABLE foo (id integer not null primary key, name text);
-INSERT INTO "foo" VALUES(1,'fiona');
-COMMIT;
-`
-	_, err := s.Execute(&ExecuteRequest{stmtsFromString(dump), false, false})
-	if err != nil {
-		t.Fatalf("failed to load simple dump: %s", err.Error())
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	if _, err := s.ExecuteContext(context.Background(), &ExecuteRequest{Stmts: queries, Timings: false, Tx: false}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
 
-	f, err := ioutil.TempFile("", "rqlite-baktest-")
-	defer os.Remove(f.Name())
-	s.logger.Printf("backup file is %s", f.Name())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
 
-	if err := s.Backup(true, BackupSQL, f); err != nil {
-		t.Fatalf("Backup failed %s", err.Error())
+	_, err := s.ExecuteContext(ctx, &ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO foo(id, name) VALUES(2, "fiona")`), Timings: false, Tx: false})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled for execute, got %v", err)
 	}
 
-	// Check the backed up data
-	bkp, err := ioutil.ReadFile(f.Name())
+	_, err = s.QueryContext(ctx, &QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: true, Lvl: None, Freshness: 0})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled for query, got %v", err)
+	}
+	if s.db.TransactionActive() {
+		t.Fatalf("transaction left active after cancelled query")
+	}
+
+	r, err := s.QueryContext(context.Background(), &QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: true, Lvl: None, Freshness: 0})
 	if err != nil {
-		t.Fatalf("Backup Failed: unable to read backup file, %s", err.Error())
+		t.Fatalf("failed to query single node: %s", err.Error())
 	}
-	if ret := bytes.Compare(bkp, []byte(dump)); ret != 0 {
-		t.Fatalf("Backup Failed: backup bytes are not same")
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
 	}
 }
 
-func Test_SingleNodeLoad(t *testing.T) {
-	s := mustNewStore(true)
+func Test_SingleNodeReadOnly(t *testing.T) {
+	s := mustNewStoreWithConfig(true, &StoreConfig{ReadOnly: true})
 	defer os.RemoveAll(s.Path())
 
 	if err := s.Open(true); err != nil {
@@ -282,31 +371,26 @@ func Test_SingleNodeLoad(t *testing.T) {
 	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
 
-	dump := `PRAGMA foreign_keys=OFF;
-BEGIN TRANSACTION;
-CREATE TABLE foo (id integer not null primary key, name text);
-INSERT INTO "foo" VALUES(1,'fiona');
-COMMIT;
-`
-	_, err := s.Execute(&ExecuteRequest{stmtsFromString(dump), false, false})
-	if err != nil {
-		t.Fatalf("failed to load simple dump: %s", err.Error())
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+	})
+	if _, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false}); err != ErrReadOnlyNode {
+		t.Fatalf("expected ErrReadOnlyNode for execute, got %v", err)
+	}
+	if _, err := s.ExecuteOrAbort(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false}); err != ErrReadOnlyNode {
+		t.Fatalf("expected ErrReadOnlyNode for execute-or-abort, got %v", err)
 	}
 
-	// Check that data were loaded correctly.
-	r, err := s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, true, Strong, 0})
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM sqlite_master"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
 	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
+		t.Fatalf("failed to query read-only node: %s", err.Error())
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
-	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+	if exp, got := `[{"columns":["type","name","tbl_name","rootpage","sql"],"types":["text","text","text","int","text"]}]`, asJSON(r); exp != got {
 		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
 	}
 }
 
-func Test_SingleNodeSingleCommandTrigger(t *testing.T) {
+func Test_SingleNodeQueryStream(t *testing.T) {
 	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
 
@@ -316,37 +400,63 @@ func Test_SingleNodeSingleCommandTrigger(t *testing.T) {
 	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
 
-	dump := `PRAGMA foreign_keys=OFF;
-BEGIN TRANSACTION;
-CREATE TABLE foo (id integer primary key asc, name text);
-INSERT INTO "foo" VALUES(1,'bob');
-INSERT INTO "foo" VALUES(2,'alice');
-INSERT INTO "foo" VALUES(3,'eve');
-CREATE TABLE bar (nameid integer, age integer);
-INSERT INTO "bar" VALUES(1,44);
-INSERT INTO "bar" VALUES(2,46);
-INSERT INTO "bar" VALUES(3,8);
-CREATE VIEW foobar as select name as Person, Age as age from foo inner join bar on foo.id == bar.nameid;
-CREATE TRIGGER new_foobar instead of insert on foobar begin insert into foo (name) values (new.Person); insert into bar (nameid, age) values ((select id from foo where name == new.Person), new.Age); end;
-COMMIT;
-`
-	_, err := s.Execute(&ExecuteRequest{stmtsFromString(dump), false, false})
+	const numRows = 100000
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		fmt.Sprintf(`WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c LIMIT %d) INSERT INTO foo(id, name) SELECT x, "fiona" FROM c`, numRows),
+	})
+	_, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false})
 	if err != nil {
-		t.Fatalf("failed to load dump with trigger: %s", err.Error())
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
 
-	// Check that the VIEW and TRIGGER are OK by using both.
-	r, err := s.Execute(&ExecuteRequest{stmtsFromString("INSERT INTO foobar VALUES('jason', 16)"), false, true})
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	n := 0
+	err = s.QueryStream(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0}, func(row []interface{}) error {
+		n++
+		if row[0].(int64) != int64(n) {
+			return fmt.Errorf("unexpected id, exp: %d, got %v", n, row[0])
+		}
+		if n == numRows {
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+		}
+		return nil
+	})
 	if err != nil {
-		t.Fatalf("failed to insert into view on single node: %s", err.Error())
+		t.Fatalf("failed to stream query: %s", err.Error())
 	}
-	if exp, got := int64(3), r[0].LastInsertID; exp != got {
-		t.Fatalf("unexpected results for query\nexp: %d\ngot: %d", exp, got)
+	if n != numRows {
+		t.Fatalf("wrong number of rows streamed, exp: %d, got %d", numRows, n)
+	}
+
+	// Buffering all rows would require many megabytes of live heap.
+	if after.HeapAlloc > before.HeapAlloc && after.HeapAlloc-before.HeapAlloc > 4*1024*1024 {
+		t.Fatalf("heap grew too much while streaming: %d bytes", after.HeapAlloc-before.HeapAlloc)
+	}
+
+	// Check streaming stops on callback error.
+	n = 0
+	stop := fmt.Errorf("stop")
+	err = s.QueryStream(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: true, Lvl: Strong, Freshness: 0}, func(row []interface{}) error {
+		n++
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("expected callback error, got %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("callback called after error, called %d times", n)
 	}
 }
 
-func Test_SingleNodeLoadNoStatements(t *testing.T) {
-	s := mustNewStore(true)
+func Test_SingleNodeBusyTimeout(t *testing.T) {
+	dbConf := NewDBConfig("", false)
+	dbConf.BusyTimeout = 2 * time.Second
+	s := mustNewStoreWithConfig(false, &StoreConfig{DBConf: dbConf})
 	defer os.RemoveAll(s.Path())
 
 	if err := s.Open(true); err != nil {
@@ -355,17 +465,16 @@ func Test_SingleNodeLoadNoStatements(t *testing.T) {
 	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
 
-	dump := `PRAGMA foreign_keys=OFF;
-BEGIN TRANSACTION;
-COMMIT;
-`
-	_, err := s.Execute(&ExecuteRequest{stmtsFromString(dump), false, false})
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("PRAGMA busy_timeout"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
 	if err != nil {
-		t.Fatalf("failed to load dump with no commands: %s", err.Error())
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[2000]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected busy timeout\nexp: %s\ngot: %s", exp, got)
 	}
 }
 
-func Test_SingleNodeLoadEmpty(t *testing.T) {
+func Test_SingleNodeQueryNullAndEmptyString(t *testing.T) {
 	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
 
@@ -375,16 +484,41 @@ func Test_SingleNodeLoadEmpty(t *testing.T) {
 	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
 
-	dump := ``
-	_, err := s.Execute(&ExecuteRequest{stmtsFromString(dump), false, false})
-	if err != nil {
-		t.Fatalf("failed to load empty dump: %s", err.Error())
+	er := &ExecuteRequest{Stmts: []Statement{
+		{Query: `CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT, data BLOB, v)`},
+		{Query: `INSERT INTO foo(id, name, data, v) VALUES(1, NULL, NULL, NULL)`},
+		{Query: `INSERT INTO foo(id, name, data, v) VALUES(2, '', x'', '')`},
+		{Query: `INSERT INTO foo(id, name, data, v) VALUES(?, ?, ?, ?)`, Parameters: []Value{3, nil, nil, nil}},
+		{Query: `INSERT INTO foo(id, name, data, v) VALUES(?, ?, ?, ?)`, Parameters: []Value{4, "", []byte{}, ""}},
+	}}
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
-}
 
-func Test_SingleNodeLoadAbortOnError(t *testing.T) {
-	t.Parallel()
+	exp := `[[1,null,null,null],[2,"","",""],[3,null,null,null],[4,"","",""]]`
+	for _, lvl := range []ConsistencyLevel{None, Strong} {
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: lvl})
+		if err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+		if got := asJSON(r[0].Values); exp != got {
+			t.Fatalf("unexpected results for query at level %d\nexp: %s\ngot: %s", lvl, exp, got)
+		}
+	}
+
+	var rows [][]interface{}
+	if err := s.QueryStream(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None}, func(row []interface{}) error {
+		rows = append(rows, row)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to stream query: %s", err.Error())
+	}
+	if got := asJSON(rows); exp != got {
+		t.Fatalf("unexpected results for streamed query\nexp: %s\ngot: %s", exp, got)
+	}
+}
 
+func Test_SingleNodeQueryDescribeOnly(t *testing.T) {
 	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
 
@@ -394,54 +528,85 @@ func Test_SingleNodeLoadAbortOnError(t *testing.T) {
 	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
 
-	dump := `PRAGMA foreign_keys=OFF;
-BEGIN TRANSACTION;
-CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT);
-COMMIT;
-`
-	r, err := s.Execute(&ExecuteRequest{stmtsFromString(dump), false, false})
-	if err != nil {
-		t.Fatalf("failed to load commands: %s", err.Error())
-	}
-	if r[0].Error != "" {
-		t.Fatalf("error received creating table: %s", r[0].Error)
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	if _, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
 
-	r, err = s.Execute(&ExecuteRequest{stmtsFromString(dump), false, false})
-	if err != nil {
-		t.Fatalf("failed to load commands: %s", err.Error())
+	for _, lvl := range []ConsistencyLevel{None, Weak, Strong} {
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: lvl, DescribeOnly: true})
+		if err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+		if exp, got := `[{"columns":["id","name"],"types":["integer","text"]}]`, asJSON(r); exp != got {
+			t.Fatalf("unexpected results for describe at level %d\nexp: %s\ngot: %s", lvl, exp, got)
+		}
 	}
-	if r[0].Error != "table foo already exists" {
-		t.Fatalf("received wrong error message: %s", r[0].Error)
+}
+
+func Test_SingleNodePragmaIntegrityCheck(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	r, err = s.Execute(&ExecuteRequest{stmtsFromString(dump), false, false})
+	re, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`PRAGMA integrity_check`)})
 	if err != nil {
-		t.Fatalf("failed to load commands: %s", err.Error())
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
-	if r[0].Error != "cannot start a transaction within a transaction" {
-		t.Fatalf("received wrong error message: %s", r[0].Error)
+	if exp, got := `[{"columns":["integrity_check"],"values":[["ok"]]}]`, asJSON(re); exp != got {
+		t.Fatalf("unexpected results for execute\nexp: %s\ngot: %s", exp, got)
 	}
 
-	r, err = s.ExecuteOrAbort(&ExecuteRequest{stmtsFromString(dump), false, false})
+	rq, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`PRAGMA integrity_check`), Lvl: None})
 	if err != nil {
-		t.Fatalf("failed to load commands: %s", err.Error())
+		t.Fatalf("failed to query single node: %s", err.Error())
 	}
-	if r[0].Error != "cannot start a transaction within a transaction" {
-		t.Fatalf("received wrong error message: %s", r[0].Error)
+	if exp, got := `[["ok"]]`, asJSON(rq[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeCoerceIntegerParams(t *testing.T) {
+	dbConf := NewDBConfig("", true)
+	dbConf.CoerceIntegerParams = true
+	s := mustNewStoreWithConfig(true, &StoreConfig{DBConf: dbConf})
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	r, err = s.Execute(&ExecuteRequest{stmtsFromString(dump), false, false})
+	er := &ExecuteRequest{Stmts: []Statement{
+		{Query: `CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, v)`},
+		{Query: `INSERT INTO foo(id, v) VALUES(?, ?)`, Parameters: []Value{float64(1), int64(2)}},
+	}}
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	qr := &QueryRequest{Stmts: []Statement{
+		{Query: `SELECT id, v, typeof(v) FROM foo WHERE id = ?`, Parameters: []Value{float64(1)}},
+	}, Lvl: None}
+	r, err := s.Query(qr)
 	if err != nil {
-		t.Fatalf("failed to load commands: %s", err.Error())
+		t.Fatalf("failed to query single node: %s", err.Error())
 	}
-	if r[0].Error != "table foo already exists" {
-		t.Fatalf("received wrong error message: %s", r[0].Error)
+	if exp, got := `[[1,2,"integer"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
 	}
 }
 
-func Test_SingleNodeLoadChinook(t *testing.T) {
-	s := mustNewStore(true)
+func Test_SingleNodePreparedCache(t *testing.T) {
+	s := mustNewStoreWithConfig(true, &StoreConfig{DBConf: NewDBConfig("", true), PreparedCacheSize: 10})
 	defer os.RemoveAll(s.Path())
 
 	if err := s.Open(true); err != nil {
@@ -450,465 +615,5724 @@ func Test_SingleNodeLoadChinook(t *testing.T) {
 	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
 
-	_, err := s.Execute(&ExecuteRequest{stmtsFromString(chinook.DB), false, false})
-	if err != nil {
-		t.Fatalf("failed to load chinook dump: %s", err.Error())
+	er := &ExecuteRequest{Stmts: []Statement{
+		{Query: `CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`},
+		{Query: `INSERT INTO foo(id, name) VALUES(?, ?)`, Parameters: []Value{int64(1), "fiona"}},
+	}}
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	qr := &QueryRequest{Stmts: []Statement{
+		{Query: `SELECT * FROM foo WHERE id = ?`, Parameters: []Value{int64(1)}},
+	}, Lvl: None}
+	for i := 0; i < 2; i++ {
+		r, err := s.Query(qr)
+		if err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+		if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+			t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+		}
 	}
 
-	// Check that data were loaded correctly.
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %s", err.Error())
+	}
+	pc := stats["sqlite3"].(map[string]interface{})["prepared_cache"].(map[string]interface{})
+	if pc["hits"] != uint64(1) || pc["size"] != 10 {
+		t.Fatalf("unexpected prepared cache stats: %v", pc)
+	}
 
-	r, err := s.Query(&QueryRequest{stmtsFromString("SELECT count(*) FROM track"), false, true, Strong, 0})
+	// A change to the schema is seen by the same query.
+	er = &ExecuteRequest{Stmts: []Statement{
+		{Query: `ALTER TABLE foo ADD COLUMN age INTEGER`},
+		{Query: `UPDATE foo SET age = ? WHERE id = ?`, Parameters: []Value{int64(20), int64(1)}},
+	}}
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	r, err := s.Query(qr)
 	if err != nil {
 		t.Fatalf("failed to query single node: %s", err.Error())
 	}
-	if exp, got := `["count(*)"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if exp, got := `["id","name","age"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected columns for query\nexp: %s\ngot: %s", exp, got)
 	}
-	if exp, got := `[[3503]]`, asJSON(r[0].Values); exp != got {
+	if exp, got := `[[1,"fiona",20]]`, asJSON(r[0].Values); exp != got {
 		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
 	}
+}
 
-	r, err = s.Query(&QueryRequest{stmtsFromString("SELECT count(*) FROM album"), false, true, Strong, 0})
-	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
+func Test_SingleNodeSetBusyTimeout(t *testing.T) {
+	dbConf := NewDBConfig("", true)
+	dbConf.BusyTimeout = 2 * time.Second
+	dbConf.Pragmas = map[string]string{"cache_size": "-4000"}
+	s := mustNewStoreWithConfig(true, &StoreConfig{DBConf: dbConf})
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	if exp, got := `["count(*)"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	c := s.DBConfig()
+	if !c.Memory || c.BusyTimeout != 2*time.Second || c.Pragmas["cache_size"] != "-4000" {
+		t.Fatalf("unexpected database config: %+v", c)
 	}
-	if exp, got := `[[347]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	c.Pragmas["cache_size"] = "-8000"
+	if got := s.DBConfig().Pragmas["cache_size"]; got != "-4000" {
+		t.Fatalf("database config not copied, cache_size is %s", got)
 	}
 
-	r, err = s.Query(&QueryRequest{stmtsFromString("SELECT count(*) FROM artist"), false, true, Strong, 0})
+	if err := s.SetBusyTimeout(-time.Second); err == nil {
+		t.Fatalf("expected error setting negative busy timeout")
+	}
+	if err := s.SetBusyTimeout(3 * time.Second); err != nil {
+		t.Fatalf("failed to set busy timeout: %s", err.Error())
+	}
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("PRAGMA busy_timeout"), Lvl: None})
 	if err != nil {
 		t.Fatalf("failed to query single node: %s", err.Error())
 	}
-	if exp, got := `["count(*)"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if exp, got := `[[3000]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected busy timeout\nexp: %s\ngot: %s", exp, got)
 	}
-	if exp, got := `[[275]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if got := s.DBConfig().BusyTimeout; got != 3*time.Second {
+		t.Fatalf("database config has wrong busy timeout: %s", got)
 	}
-
 }
 
-func Test_MultiNodeJoinRemove(t *testing.T) {
-	s0 := mustNewStore(true)
-	defer os.RemoveAll(s0.Path())
-	if err := s0.Open(true); err != nil {
-		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+func Test_SingleNodeQueryTimeout(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	defer s0.Close(true)
-	s0.WaitForLeader(10 * time.Second)
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	s1 := mustNewStore(true)
-	defer os.RemoveAll(s1.Path())
-	if err := s1.Open(false); err != nil {
-		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	qr := &QueryRequest{
+		Stmts:   stmtsFromString("SELECT 1"),
+		Lvl:     None,
+		Timeout: 100 * time.Millisecond,
 	}
-	defer s1.Close(true)
 
-	// Get sorted list of cluster nodes.
-	storeNodes := []string{s0.ID(), s1.ID()}
-	sort.StringSlice(storeNodes).Sort()
+	// Hold the database lock, as a snapshot restore does.
+	s.mu.Lock()
+	start := time.Now()
+	_, err := s.Query(qr)
+	if err != ErrQueryTimeout {
+		s.mu.Unlock()
+		t.Fatalf("expected query timeout, got: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		s.mu.Unlock()
+		t.Fatalf("query took %s to time out", d)
+	}
+	err = s.QueryStream(qr, func(row []interface{}) error { return nil })
+	s.mu.Unlock()
+	if err != ErrQueryTimeout {
+		t.Fatalf("expected stream query timeout, got: %v", err)
+	}
 
-	// Join the second node to the first.
-	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
-		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	r, err := s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
 	}
+	if exp, got := `[[1]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
 
-	s1.WaitForLeader(10 * time.Second)
+func Test_SingleNodeExecuteReturnChangedRows(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
 
-	// Check leader state on follower.
-	if got, exp := s1.LeaderAddr(), s0.Addr(); got != exp {
-		t.Fatalf("wrong leader address returned, got: %s, exp %s", got, exp)
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	id, err := s1.LeaderID()
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+		`INSERT INTO foo(id, name) VALUES(2, "fiona")`,
+		`INSERT INTO foo(id, name) VALUES(3, "declan")`,
+	})})
 	if err != nil {
-		t.Fatalf("failed to retrieve leader ID: %s", err.Error())
-	}
-	if got, exp := id, s0.raftID; got != exp {
-		t.Fatalf("wrong leader ID returned, got: %s, exp %s", got, exp)
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
 
-	nodes, err := s0.Nodes()
+	// Changed rows are reported only if requested.
+	er := &ExecuteRequest{Stmts: stmtsFromString(`UPDATE foo SET name = "aoife" WHERE name = "fiona"`)}
+	r, err := s.Execute(er)
 	if err != nil {
-		t.Fatalf("failed to get nodes: %s", err.Error())
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if r[0].ChangedRows != nil {
+		t.Fatalf("changed rows reported without being requested: %s", asJSON(r[0].ChangedRows))
 	}
 
-	if len(nodes) != len(storeNodes) {
-		t.Fatalf("size of cluster is not correct")
+	er = &ExecuteRequest{
+		Stmts: stmtsFromStrings([]string{
+			`UPDATE foo SET name = "fiona" WHERE name = "aoife"`,
+			`DELETE FROM foo WHERE id = 3`,
+			`INSERT INTO foo(id, name) VALUES(4, "dana")`,
+		}),
+		ReturnChangedRows: true,
 	}
-	if storeNodes[0] != nodes[0].ID || storeNodes[1] != nodes[1].ID {
-		t.Fatalf("cluster does not have correct nodes")
+	r, err = s.Execute(er)
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
+	if exp, got := `[{"op":"update","table":"foo","rowid":1},{"op":"update","table":"foo","rowid":2}]`, asJSON(r[0].ChangedRows); exp != got {
+		t.Fatalf("unexpected changed rows for update\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[{"op":"delete","table":"foo","rowid":3}]`, asJSON(r[1].ChangedRows); exp != got {
+		t.Fatalf("unexpected changed rows for delete\nexp: %s\ngot: %s", exp, got)
+	}
+	if r[2].ChangedRows != nil {
+		t.Fatalf("changed rows reported for insert: %s", asJSON(r[2].ChangedRows))
+	}
+}
 
-	// Remove a node.
-	if err := s0.Remove(s1.ID()); err != nil {
-		t.Fatalf("failed to remove %s from cluster: %s", s1.ID(), err.Error())
+func Test_SingleNodeLogger(t *testing.T) {
+	l := &mockLogger{}
+	s := mustNewStoreWithConfig(true, &StoreConfig{StructuredLogger: l})
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	nodes, err = s0.Nodes()
-	if err != nil {
-		t.Fatalf("failed to get nodes post remove: %s", err.Error())
+	// Leadership changes are logged after they are reported by Raft.
+	deadline := time.Now().Add(5 * time.Second)
+	for !l.logged("INFO", "leader elected", "node", s.ID()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("leader election not logged, got %q", l.events())
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	if len(nodes) != 1 {
-		t.Fatalf("size of cluster is not correct post remove")
+
+	// A standard library logger is wrapped.
+	var buf bytes.Buffer
+	s = mustNewStoreWithConfig(true, &StoreConfig{Logger: log.New(&buf, "[store] ", 0)})
+	defer os.RemoveAll(s.Path())
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	if s0.ID() != nodes[0].ID {
-		t.Fatalf("cluster does not have correct nodes post remove")
+	s.Close(true)
+	if exp := "[store] [INFO] opening store node=" + s.ID(); !strings.Contains(buf.String(), exp) {
+		t.Fatalf("expected %q in log output, got %s", exp, buf.String())
 	}
 }
 
-func Test_MultiNodeJoinNonVoterRemove(t *testing.T) {
-	s0 := mustNewStore(true)
-	defer os.RemoveAll(s0.Path())
-	if err := s0.Open(true); err != nil {
-		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+func Test_SingleNodePragmas(t *testing.T) {
+	dbConf := NewDBConfig("", true)
+	dbConf.Pragmas = map[string]string{
+		"cache_size":  "-4000",
+		"synchronous": "NORMAL",
 	}
-	defer s0.Close(true)
-	s0.WaitForLeader(10 * time.Second)
+	s := mustNewStoreWithConfig(true, &StoreConfig{DBConf: dbConf})
+	defer os.RemoveAll(s.Path())
 
-	s1 := mustNewStore(true)
-	defer os.RemoveAll(s1.Path())
-	if err := s1.Open(false); err != nil {
-		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	defer s1.Close(true)
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	// Get sorted list of cluster nodes.
-	storeNodes := []string{s0.ID(), s1.ID()}
-	sort.StringSlice(storeNodes).Sort()
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromStrings([]string{"PRAGMA cache_size", "PRAGMA synchronous"}), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[-4000]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected cache size\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1]]`, asJSON(r[1].Values); exp != got {
+		t.Fatalf("unexpected synchronous setting\nexp: %s\ngot: %s", exp, got)
+	}
+}
 
-	// Join the second node to the first.
-	if err := s0.Join(s1.ID(), s1.Addr(), false, nil); err != nil {
-		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+func Test_SingleNodePragmasUnsupported(t *testing.T) {
+	for _, p := range []map[string]string{
+		{"page_size": "8192"},
+		{"cache_size": "1; DROP TABLE foo"},
+	} {
+		dbConf := NewDBConfig("", true)
+		dbConf.Pragmas = p
+		s := mustNewStoreWithConfig(true, &StoreConfig{DBConf: dbConf})
+		err := s.Open(true)
+		if !errors.Is(err, ErrUnsupportedPragma) {
+			s.Close(true)
+			t.Fatalf("expected ErrUnsupportedPragma for %v, got %v", p, err)
+		}
+		os.RemoveAll(s.Path())
 	}
+}
 
-	s1.WaitForLeader(10 * time.Second)
+func Test_SingleNodeWALJournalMode(t *testing.T) {
+	dbConf := NewDBConfig("", false)
+	dbConf.JournalMode = "WAL"
+	s := mustNewStoreWithConfig(false, &StoreConfig{DBConf: dbConf})
+	defer os.RemoveAll(s.Path())
 
-	// Check leader state on follower.
-	if got, exp := s1.LeaderAddr(), s0.Addr(); got != exp {
-		t.Fatalf("wrong leader address returned, got: %s, exp %s", got, exp)
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	id, err := s1.LeaderID()
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("PRAGMA journal_mode"), Lvl: None})
 	if err != nil {
-		t.Fatalf("failed to retrieve leader ID: %s", err.Error())
+		t.Fatalf("failed to query single node: %s", err.Error())
 	}
-	if got, exp := id, s0.raftID; got != exp {
-		t.Fatalf("wrong leader ID returned, got: %s, exp %s", got, exp)
+	if exp, got := `[["wal"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected journal mode\nexp: %s\ngot: %s", exp, got)
 	}
 
-	nodes, err := s0.Nodes()
-	if err != nil {
-		t.Fatalf("failed to get nodes: %s", err.Error())
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	if _, err := s.Execute(&ExecuteRequest{Stmts: queries}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
 
-	if len(nodes) != len(storeNodes) {
-		t.Fatalf("size of cluster is not correct")
+	// The binary backup must be a complete database on its own.
+	var buf bytes.Buffer
+	if err := s.Backup(true, BackupBinary, &buf); err != nil {
+		t.Fatalf("Backup failed %s", err.Error())
 	}
-	if storeNodes[0] != nodes[0].ID || storeNodes[1] != nodes[1].ID {
-		t.Fatalf("cluster does not have correct nodes")
+	path := filepath.Join(mustTempDir(), "backup.db")
+	defer os.RemoveAll(filepath.Dir(path))
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0660); err != nil {
+		t.Fatalf("failed to write backup: %s", err.Error())
 	}
-
-	// Remove the non-voter.
-	if err := s0.Remove(s1.ID()); err != nil {
-		t.Fatalf("failed to remove %s from cluster: %s", s1.ID(), err.Error())
+	db, err := sql.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open backup: %s", err.Error())
 	}
-
-	nodes, err = s0.Nodes()
+	defer db.Close()
+	rows, err := db.QueryStringStmt("SELECT * FROM foo")
 	if err != nil {
-		t.Fatalf("failed to get nodes post remove: %s", err.Error())
+		t.Fatalf("failed to query backup: %s", err.Error())
 	}
-	if len(nodes) != 1 {
-		t.Fatalf("size of cluster is not correct post remove")
+	if exp, got := `[[1,"fiona"]]`, asJSON(rows[0].Values); exp != got {
+		t.Fatalf("unexpected results for backup query\nexp: %s\ngot: %s", exp, got)
 	}
-	if s0.ID() != nodes[0].ID {
-		t.Fatalf("cluster does not have correct nodes post remove")
+}
+
+func Test_SingleNodeInMemWALJournalMode(t *testing.T) {
+	dbConf := NewDBConfig("", true)
+	dbConf.JournalMode = "wal"
+	s := mustNewStoreWithConfig(true, &StoreConfig{DBConf: dbConf})
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != ErrWALInMemory {
+		s.Close(true)
+		t.Fatalf("expected ErrWALInMemory opening in-memory store, got %v", err)
 	}
 }
 
-func Test_MultiNodeExecuteQuery(t *testing.T) {
-	s0 := mustNewStore(true)
-	defer os.RemoveAll(s0.Path())
-	if err := s0.Open(true); err != nil {
-		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
-	}
-	defer s0.Close(true)
-	s0.WaitForLeader(10 * time.Second)
+func Test_SingleNodeVacuum(t *testing.T) {
+	s := mustNewStore(false)
+	defer os.RemoveAll(s.Path())
 
-	s1 := mustNewStore(true)
-	defer os.RemoveAll(s1.Path())
-	if err := s1.Open(false); err != nil {
-		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	defer s1.Close(true)
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	s2 := mustNewStore(true)
-	defer os.RemoveAll(s2.Path())
-	if err := s2.Open(false); err != nil {
-		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	stmts := []string{`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`}
+	for i := 0; i < 2000; i++ {
+		stmts = append(stmts, fmt.Sprintf(`INSERT INTO foo(name) VALUES("%s")`, strings.Repeat("x", 1000)))
+	}
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings(stmts), Tx: true}); err != nil {
+		t.Fatalf("failed to insert records: %s", err.Error())
+	}
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`DELETE FROM foo`)}); err != nil {
+		t.Fatalf("failed to delete records: %s", err.Error())
 	}
-	defer s2.Close(true)
 
-	// Join the second node to the first as a voting node.
-	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
-		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	before, err := os.Stat(filepath.Join(s.Path(), sqliteFile))
+	if err != nil {
+		t.Fatalf("failed to stat database file: %s", err.Error())
 	}
 
-	// Join the third node to the first as a non-voting node.
-	if err := s0.Join(s2.ID(), s2.Addr(), false, nil); err != nil {
-		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`BEGIN`)}); err != nil {
+		t.Fatalf("failed to begin transaction: %s", err.Error())
+	}
+	if err := s.Vacuum(); err != sql.ErrTransactionActive {
+		t.Fatalf("expected ErrTransactionActive vacuuming during transaction, got %v", err)
+	}
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`ROLLBACK`)}); err != nil {
+		t.Fatalf("failed to roll back transaction: %s", err.Error())
 	}
 
-	queries := stmtsFromStrings([]string{
-		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
-		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
-	})
-	_, err := s0.Execute(&ExecuteRequest{queries, false, false})
-	if err != nil {
-		t.Fatalf("failed to execute on single node: %s", err.Error())
+	if err := s.Vacuum(); err != nil {
+		t.Fatalf("failed to vacuum: %s", err.Error())
 	}
-	r, err := s0.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
+	after, err := os.Stat(filepath.Join(s.Path(), sqliteFile))
 	if err != nil {
-		t.Fatalf("failed to query leader node: %s", err.Error())
+		t.Fatalf("failed to stat database file: %s", err.Error())
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if after.Size() >= before.Size() {
+		t.Fatalf("database file did not shrink, before %d bytes, after %d bytes", before.Size(), after.Size())
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+}
+
+func Test_SingleNodeReindex(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	// Wait until the 3 log entries have been applied to the voting follower,
-	// and then query.
-	if err := s1.WaitForAppliedIndex(3, 5*time.Second); err != nil {
-		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+	stmts := []string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`CREATE INDEX foo_name ON foo(name)`,
 	}
-	r, err = s1.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, Weak, 0})
-	if err == nil {
-		t.Fatalf("successfully queried non-leader node")
+	for i := 0; i < 1000; i++ {
+		stmts = append(stmts, fmt.Sprintf(`INSERT INTO foo(name) VALUES("name%d")`, i%10))
 	}
-	r, err = s1.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, Strong, 0})
-	if err == nil {
-		t.Fatalf("successfully queried non-leader node")
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings(stmts), Tx: true}); err != nil {
+		t.Fatalf("failed to insert records: %s", err.Error())
+	}
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`DELETE FROM foo WHERE id % 3 = 0`,
+		`UPDATE foo SET name = "name10" WHERE id % 3 = 1 AND name = "name1"`,
+	}), Tx: true}); err != nil {
+		t.Fatalf("failed to churn records: %s", err.Error())
 	}
-	r, err = s1.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
+
+	qr := &QueryRequest{Stmts: stmtsFromString(`SELECT name, COUNT(*) FROM foo INDEXED BY foo_name WHERE name IN ("name1", "name10") GROUP BY name ORDER BY name`), Lvl: None}
+	before, err := s.Query(qr)
 	if err != nil {
-		t.Fatalf("failed to query follower node: %s", err.Error())
+		t.Fatalf("failed to query: %s", err.Error())
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if before[0].Error != "" {
+		t.Fatalf("query returned error: %s", before[0].Error)
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+
+	for _, name := range []string{"foo", "foo_name", ""} {
+		if err := s.Reindex(name); err != nil {
+			t.Fatalf("failed to reindex %q: %s", name, err.Error())
+		}
+	}
+	if err := s.Reindex("nonsense"); err == nil {
+		t.Fatalf("expected error reindexing nonexistent table")
 	}
 
-	// Wait until the 3 log entries have been applied to the non-voting follower,
-	// and then query.
-	if err := s2.WaitForAppliedIndex(3, 5*time.Second); err != nil {
-		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+	after, err := s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query: %s", err.Error())
 	}
-	r, err = s2.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, Weak, 0})
-	if err == nil {
-		t.Fatalf("successfully queried non-voting node with Weak")
+	if exp, got := `[["name1",34],["name10",33]]`, asJSON(after[0].Values); exp != got {
+		t.Fatalf("unexpected results after reindex\nexp: %s\ngot: %s", exp, got)
 	}
-	r, err = s2.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, Strong, 0})
-	if err == nil {
-		t.Fatalf("successfully queried non-voting node with Strong")
+	if exp, got := asJSON(before[0].Values), asJSON(after[0].Values); exp != got {
+		t.Fatalf("results changed by reindex\nexp: %s\ngot: %s", exp, got)
 	}
-	r, err = s2.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
+	scan, err := s.Query(&QueryRequest{Stmts: stmtsFromString(strings.Replace(qr.Stmts[0].Query, "INDEXED BY foo_name", "NOT INDEXED", 1)), Lvl: None})
 	if err != nil {
-		t.Fatalf("failed to query non-voting node: %s", err.Error())
-	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+		t.Fatalf("failed to query: %s", err.Error())
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if exp, got := asJSON(scan[0].Values), asJSON(after[0].Values); exp != got {
+		t.Fatalf("results using index differ from table scan\nexp: %s\ngot: %s", exp, got)
 	}
 }
 
-func Test_MultiNodeExecuteQueryFreshness(t *testing.T) {
-	s0 := mustNewStore(true)
-	defer os.RemoveAll(s0.Path())
-	if err := s0.Open(true); err != nil {
-		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+func Test_SingleNodeExecuteApplyTimeout(t *testing.T) {
+	s := mustNewStoreWithConfig(true, &StoreConfig{ApplyTimeout: time.Millisecond})
+	defer os.RemoveAll(s.Path())
+
+	if exp, got := time.Millisecond, s.ApplyTimeout; exp != got {
+		t.Fatalf("wrong apply timeout, exp %s, got %s", exp, got)
 	}
-	defer s0.Close(true)
-	s0.WaitForLeader(10 * time.Second)
 
-	s1 := mustNewStore(true)
-	defer os.RemoveAll(s1.Path())
-	if err := s1.Open(false); err != nil {
-		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	defer s1.Close(true)
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	// Join the second node to the first.
-	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
-		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	stmts := []string{`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`}
+	for i := 0; i < 20000; i++ {
+		stmts = append(stmts, `INSERT INTO foo(name) VALUES("fiona")`)
+	}
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings(stmts), Tx: true})
+	if err != ErrApplyTimeout {
+		t.Fatalf("expected ErrApplyTimeout for large batch, got %v", err)
 	}
+}
 
-	queries := stmtsFromStrings([]string{
-		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
-		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
-	})
-	_, err := s0.Execute(&ExecuteRequest{queries, false, false})
-	if err != nil {
-		t.Fatalf("failed to execute on single node: %s", err.Error())
+func Test_SingleNodeLatencyMetrics(t *testing.T) {
+	s := mustNewStoreWithConfig(true, &StoreConfig{LatencyMetrics: true})
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	r, err := s0.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
-	if err != nil {
-		t.Fatalf("failed to query leader node: %s", err.Error())
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	for i := 0; i < 9; i++ {
+		if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO foo(name) VALUES("fiona")`)}); err != nil {
+			t.Fatalf("failed to insert record: %s", err.Error())
+		}
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if _, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None}); err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
 	}
 
-	// Wait until the 3 log entries have been applied to the follower,
-	// and then query.
-	if err := s1.WaitForAppliedIndex(3, 5*time.Second); err != nil {
-		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %s", err.Error())
+	}
+	latency := st["latency"].(map[string]interface{})
+	for name, exp := range map[string]uint64{
+		"execute_total":  10,
+		"execute_apply":  10,
+		"execute_sqlite": 10,
+		"query_total":    1,
+	} {
+		if got := latency[name].(map[string]interface{})["count"].(uint64); exp != got {
+			t.Fatalf("wrong count for %s histogram, exp %d, got %d", name, exp, got)
+		}
 	}
+}
 
-	// "Weak" consistency queries with 1 nanosecond freshness should pass, because freshness
-	// is ignored in this case.
-	r, err = s0.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, Weak, mustParseDuration("1ns")})
-	if err != nil {
-		t.Fatalf("Failed to ignore freshness if level is Weak: %s", err.Error())
+func Test_SingleNodeLatencyMetricsDisabled(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	// "Strong" consistency queries with 1 nanosecond freshness should pass, because freshness
-	// is ignored in this case.
-	r, err = s0.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, Strong, mustParseDuration("1ns")})
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	st, err := s.Stats()
 	if err != nil {
-		t.Fatalf("Failed to ignore freshness if level is Strong: %s", err.Error())
+		t.Fatalf("failed to get stats: %s", err.Error())
 	}
+	if _, ok := st["latency"]; ok {
+		t.Fatalf("latency reported when disabled")
+	}
+}
 
-	// Kill leader.
-	s0.Close(true)
+func Test_SingleNodeTagStats(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
 
-	// "None" consistency queries should still work.
-	r, err = s1.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	st, err := s.Stats()
 	if err != nil {
-		t.Fatalf("failed to query follower node: %s", err.Error())
+		t.Fatalf("failed to get stats: %s", err.Error())
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if _, ok := st["tags"]; ok {
+		t.Fatalf("tags reported before any tagged request")
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`), Tag: "acme"}); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None, Tag: "acme"}); err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+	}
+	if _, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None, Tag: "globex"}); err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if _, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None}); err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if _, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None, Tag: "globex", Timeout: time.Nanosecond}); err == nil {
+		t.Fatalf("query with expired timeout succeeded")
 	}
 
-	// Wait for the freshness interval to pass.
-	time.Sleep(mustParseDuration("1s"))
+	// Tags beyond the bound are counted together.
+	for i := 0; i < maxStatsTags; i++ {
+		if _, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None, Tag: fmt.Sprintf("tenant%d", i)}); err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+	}
 
-	// "None" consistency queries with 1 nanosecond freshness should fail, because at least
-	// one nanosecond *should* have passed since leader died (surely!).
-	r, err = s1.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, mustParseDuration("1ns")})
-	if err == nil {
-		t.Fatalf("freshness violating query didn't return an error")
+	st, err = s.Stats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %s", err.Error())
+	}
+	tags := st["tags"].(map[string]interface{})
+	if exp, got := maxStatsTags+1, len(tags); exp != got {
+		t.Fatalf("wrong number of tags, exp %d, got %d", exp, got)
+	}
+	for _, tt := range []struct {
+		tag      string
+		queries  uint64
+		executes uint64
+		errors   uint64
+	}{
+		{tag: "acme", queries: 3, executes: 1},
+		{tag: "globex", queries: 2, errors: 1},
+		{tag: "tenant0", queries: 1},
+		{tag: otherStatsTag, queries: 2},
+	} {
+		ts, ok := tags[tt.tag].(map[string]interface{})
+		if !ok {
+			t.Fatalf("no stats for tag %s", tt.tag)
+		}
+		if got := ts["query"].(map[string]interface{})["count"].(uint64); got != tt.queries {
+			t.Fatalf("wrong query count for tag %s, exp %d, got %d", tt.tag, tt.queries, got)
+		}
+		if got := ts["execute"].(map[string]interface{})["count"].(uint64); got != tt.executes {
+			t.Fatalf("wrong execute count for tag %s, exp %d, got %d", tt.tag, tt.executes, got)
+		}
+		if got := ts["errors"].(uint64); got != tt.errors {
+			t.Fatalf("wrong error count for tag %s, exp %d, got %d", tt.tag, tt.errors, got)
+		}
 	}
-	if err != ErrStaleRead {
-		t.Fatalf("freshness violating query didn't returned wrong error: %s", err.Error())
+}
+
+func Test_SingleNodeQueryCache(t *testing.T) {
+	s := mustNewStoreWithConfig(true, &StoreConfig{QueryCacheTTL: time.Minute})
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	// Freshness of 0 is ignored.
-	r, err = s1.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
-	if err != nil {
-		t.Fatalf("failed to query follower node: %s", err.Error())
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+
+	cacheStats := func() (uint64, uint64) {
+		stats, err := s.Stats()
+		if err != nil {
+			t.Fatalf("failed to get stats: %s", err.Error())
+		}
+		qc := stats["query_cache"].(map[string]interface{})
+		return qc["hits"].(uint64), qc["misses"].(uint64)
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	query := func(exp string) {
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None})
+		if err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+		if got := asJSON(r); exp != got {
+			t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+		}
 	}
 
-	// "None" consistency queries with 1 hour freshness should pass, because it should
-	// not be that long since the leader died.
-	r, err = s1.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, mustParseDuration("1h")})
+	one := `[{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"]]}]`
+	query(one)
+	query(one)
+	if hits, misses := cacheStats(); hits != 1 || misses != 1 {
+		t.Fatalf("expected 1 hit and 1 miss, got %d hits and %d misses", hits, misses)
+	}
+
+	// Associative results are built from a copy of the cached rows.
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None, Associative: true})
 	if err != nil {
-		t.Fatalf("failed to query follower node: %s", err.Error())
+		t.Fatalf("failed to query single node: %s", err.Error())
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if exp, got := `[{"columns":["id","name"],"types":["integer","text"],"rows":[{"id":1,"name":"fiona"}]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected associative results\nexp: %s\ngot: %s", exp, got)
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	query(one)
+
+	// A write invalidates the cache.
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO foo(id, name) VALUES(2, "declan")`)}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	query(`[{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"],[2,"declan"]]}]`)
+	if hits, misses := cacheStats(); hits != 3 || misses != 2 {
+		t.Fatalf("expected 3 hits and 2 misses, got %d hits and %d misses", hits, misses)
 	}
 }
 
-func Test_StoreLogTruncationMultinode(t *testing.T) {
-	s0 := mustNewStore(true)
-	defer os.RemoveAll(s0.Path())
-	s0.SnapshotThreshold = 4
-	s0.SnapshotInterval = 100 * time.Millisecond
+func Test_SingleNodeQueryMaxRows(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
 
-	if err := s0.Open(true); err != nil {
+	if err := s.Open(true); err != nil {
 		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	defer s0.Close(true)
-	s0.WaitForLeader(10 * time.Second)
-	nSnaps := stats.Get(numSnaphots).String()
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	// Write more than s.SnapshotThreshold statements.
-	queries := []string{
-		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
-		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
-		`INSERT INTO foo(id, name) VALUES(2, "fiona")`,
-		`INSERT INTO foo(id, name) VALUES(3, "fiona")`,
-		`INSERT INTO foo(id, name) VALUES(4, "fiona")`,
-		`INSERT INTO foo(id, name) VALUES(5, "fiona")`,
+	queries := []string{`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`}
+	for i := 0; i < 10; i++ {
+		queries = append(queries, `INSERT INTO foo(name) VALUES("fiona")`)
 	}
-	for i := range queries {
-		_, err := s0.Execute(&ExecuteRequest{stmtsFromString(queries[i]), false, false})
-		if err != nil {
-			t.Fatalf("failed to execute on single node: %s", err.Error())
-		}
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings(queries)}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
 
-	// Wait for the snapshot to happen and log to be truncated.
+	for _, lvl := range []ConsistencyLevel{None, Weak, Strong} {
+		r, err := s.Query(&QueryRequest{
+			Stmts:   stmtsFromStrings([]string{`SELECT * FROM foo`, `SELECT * FROM foo WHERE id <= 3`}),
+			Lvl:     lvl,
+			MaxRows: 3,
+		})
+		if err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+		if !r[0].Truncated {
+			t.Fatalf("rows not marked truncated at level %d", lvl)
+		}
+		if exp, got := 3, len(r[0].Values); exp != got {
+			t.Fatalf("wrong number of rows at level %d, exp %d, got %d", lvl, exp, got)
+		}
+		if r[1].Truncated {
+			t.Fatalf("rows marked truncated at level %d with exactly MaxRows rows", lvl)
+		}
+		if exp, got := 3, len(r[1].Values); exp != got {
+			t.Fatalf("wrong number of rows at level %d, exp %d, got %d", lvl, exp, got)
+		}
+	}
+
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if r[0].Truncated || len(r[0].Values) != 10 {
+		t.Fatalf("unlimited query returned %d rows, truncated %v", len(r[0].Values), r[0].Truncated)
+	}
+}
+
+func Test_SingleNodeQueryPage(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	br := &BatchExecuteRequest{Stmt: `INSERT INTO foo(id, name) VALUES(?, ?)`}
+	for i := 1; i <= 250; i++ {
+		br.Parameters = append(br.Parameters, []Value{int64(i * 2), fmt.Sprintf("name%d", i)})
+	}
+	if _, err := s.ExecuteBatch(br); err != nil {
+		t.Fatalf("failed to insert rows: %s", err.Error())
+	}
+
+	qr := &QueryRequest{
+		Stmts: []Statement{{Query: `SELECT id, name FROM foo WHERE id > ?;`, Parameters: []Value{int64(0)}}},
+		Lvl:   None,
+	}
+	var ids []int64
+	var token string
+	var sizes []int
+	for {
+		r, next, err := s.QueryPage(qr, token, 100)
+		if err != nil {
+			t.Fatalf("failed to query page: %s", err.Error())
+		}
+		if r.Error != "" {
+			t.Fatalf("page query returned error: %s", r.Error)
+		}
+		sizes = append(sizes, len(r.Values))
+		for _, v := range r.Values {
+			ids = append(ids, v[0].(int64))
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if exp, got := "[100,100,50]", asJSON(sizes); exp != got {
+		t.Fatalf("unexpected page sizes, exp %s, got %s", exp, got)
+	}
+	for i, id := range ids {
+		if exp := int64((i + 1) * 2); id != exp {
+			t.Fatalf("row %d skipped or duplicated, exp id %d, got %d", i, exp, id)
+		}
+	}
+
+	if _, _, err := s.QueryPage(qr, "not a token", 100); err != ErrInvalidPageToken {
+		t.Fatalf("expected ErrInvalidPageToken, got %v", err)
+	}
+	if _, _, err := s.QueryPage(&QueryRequest{Stmts: stmtsFromStrings([]string{"SELECT 1", "SELECT 2"})}, "", 100); err != ErrInvalidPageQuery {
+		t.Fatalf("expected ErrInvalidPageQuery, got %v", err)
+	}
+}
+
+func Test_SingleNodeQueryTotalCount(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	br := &BatchExecuteRequest{Stmt: `INSERT INTO foo(id, name) VALUES(?, ?)`}
+	for i := 1; i <= 250; i++ {
+		br.Parameters = append(br.Parameters, []Value{int64(i), fmt.Sprintf("name%d", i)})
+	}
+	if _, err := s.ExecuteBatch(br); err != nil {
+		t.Fatalf("failed to insert rows: %s", err.Error())
+	}
+
+	for _, lvl := range []ConsistencyLevel{None, Strong} {
+		qr := &QueryRequest{
+			Stmts: []Statement{
+				{Query: `SELECT id FROM foo WHERE id > ? ORDER BY id LIMIT ? OFFSET ?;`, Parameters: []Value{int64(10), int64(100), int64(20)}},
+				{Query: `SELECT name FROM foo WHERE name LIKE 'name1%'`},
+				{Query: `SELECT * FROM (SELECT * FROM foo LIMIT 5) ORDER BY id limit 2`},
+				{Query: `SELECT * FROM nonsense LIMIT 1`},
+			},
+			Lvl:        lvl,
+			Tx:         true,
+			TotalCount: true,
+		}
+		r, err := s.Query(qr)
+		if err != nil {
+			t.Fatalf("failed to query: %s", err.Error())
+		}
+		if len(r) != 4 {
+			t.Fatalf("expected rows of 4 statements, got %s", asJSON(r))
+		}
+		if len(r[0].Values) != 100 || r[0].Values[0][0].(int64) != 31 {
+			t.Fatalf("LIMIT not applied to rows, got %d rows", len(r[0].Values))
+		}
+		for i, exp := range []int64{240, 111, 5} {
+			if r[i].Total == nil || *r[i].Total != exp {
+				t.Fatalf("unexpected total of statement %d, exp %d, got %s", i, exp, asJSON(r[i].Total))
+			}
+		}
+		if exp := len(r[1].Values); int64(exp) != *r[1].Total {
+			t.Fatalf("total of statement without LIMIT not its number of rows")
+		}
+		if r[3].Error == "" || r[3].Total != nil {
+			t.Fatalf("expected error and no total for failed statement, got %s", asJSON(r[3]))
+		}
+	}
+
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo LIMIT 1`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query: %s", err.Error())
+	}
+	if r[0].Total != nil {
+		t.Fatalf("total set without being requested")
+	}
+}
+
+func Test_SingleNodeQueryStableOrder(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	// Names sort in the reverse order of ids, so a read using the index on
+	// name returns the rows in the reverse order of a table scan.
+	stmts := []string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`CREATE INDEX foo_name ON foo(name)`,
+		`CREATE TABLE bar (name TEXT PRIMARY KEY) WITHOUT ROWID`,
+		`INSERT INTO bar(name) VALUES("fiona")`,
+	}
+	for i := 1; i <= 5; i++ {
+		stmts = append(stmts, fmt.Sprintf(`INSERT INTO foo(id, name) VALUES(%d, "name%d")`, i, 10-i))
+	}
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings(stmts)}); err != nil {
+		t.Fatalf("failed to insert records: %s", err.Error())
+	}
+
+	query := func(lvl ConsistencyLevel, stable bool, q string) string {
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(q), Lvl: lvl, StableOrder: stable})
+		if err != nil {
+			t.Fatalf("failed to query: %s", err.Error())
+		}
+		if r[0].Error != "" {
+			t.Fatalf("query %s returned error: %s", q, r[0].Error)
+		}
+		return asJSON(r[0].Values)
+	}
+	indexed := `SELECT id FROM foo INDEXED BY foo_name WHERE name > ''`
+	scan := `SELECT id FROM foo NOT INDEXED WHERE name > ''`
+	if query(None, false, indexed) == query(None, false, scan) {
+		t.Fatalf("rows in the same order without stable order, test is invalid")
+	}
+
+	for _, lvl := range []ConsistencyLevel{None, Strong} {
+		if exp, got := `[[1],[2],[3],[4],[5]]`, query(lvl, true, indexed); exp != got {
+			t.Fatalf("unexpected order of rows using index\nexp: %s\ngot: %s", exp, got)
+		}
+		if exp, got := `[[1],[2],[3],[4],[5]]`, query(lvl, true, scan); exp != got {
+			t.Fatalf("unexpected order of rows of table scan\nexp: %s\ngot: %s", exp, got)
+		}
+	}
+	if exp, got := `[[1],[2]]`, query(None, true, indexed+` LIMIT 2;`); exp != got {
+		t.Fatalf("unexpected rows of limited query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[["name9"],["name8"]]`, query(None, true, `SELECT name FROM foo INDEXED BY foo_name WHERE id IN (SELECT id FROM foo LIMIT 2)`); exp != got {
+		t.Fatalf("unexpected rows of query with limited subquery\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Statements which order, or aggregate, their rows, or read a table
+	// without a rowid, are left as they are.
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{`SELECT id FROM foo ORDER BY name`, `[[5],[4],[3],[2],[1]]`},
+		{`SELECT COUNT(*) FROM foo`, `[[5]]`},
+		{`SELECT name FROM bar`, `[["fiona"]]`},
+	} {
+		if got := query(None, true, tt.q); tt.exp != got {
+			t.Fatalf("unexpected rows for query %s\nexp: %s\ngot: %s", tt.q, tt.exp, got)
+		}
+	}
+}
+
+func Test_SingleNodeQueryColumnar(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, score REAL, name TEXT, data BLOB, mixed)`,
+		`INSERT INTO foo VALUES(1, 1.5, 'fiona', x'0102', 1)`,
+		`INSERT INTO foo VALUES(2, NULL, NULL, NULL, 2.5)`,
+		`INSERT INTO foo VALUES(3, 3, 'declan', x'', NULL)`,
+	})}); err != nil {
+		t.Fatalf("failed to insert rows: %s", err.Error())
+	}
+
+	crs, err := s.QueryColumnar(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo ORDER BY id`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query columnar: %s", err.Error())
+	}
+	if len(crs) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(crs))
+	}
+	cr := crs[0]
+	if cr.Error != "" {
+		t.Fatalf("columnar query returned error: %s", cr.Error)
+	}
+	if cr.NumRows != 3 || len(cr.Columns) != 5 {
+		t.Fatalf("unexpected shape of result: %s", asJSON(cr))
+	}
+
+	for _, tt := range []struct {
+		typ    ColumnType
+		values string
+		nulls  string
+	}{
+		{ColumnInt64, `[1,2,3]`, `[false,false,false]`},
+		{ColumnFloat64, `[1.5,0,3]`, `[false,true,false]`},
+		{ColumnString, `["fiona","","declan"]`, `[false,true,false]`},
+		{ColumnBytes, `["AQI=",null,""]`, `[false,true,false]`},
+		{ColumnFloat64, `[1,2.5,0]`, `[false,false,true]`},
+	} {
+		c := cr.Columns[0]
+		cr.Columns = cr.Columns[1:]
+		if c.Type != tt.typ {
+			t.Fatalf("unexpected type of column %s, exp %s, got %s", c.Name, tt.typ, c.Type)
+		}
+		var values interface{}
+		switch c.Type {
+		case ColumnInt64:
+			values = c.Int64s
+		case ColumnFloat64:
+			values = c.Float64s
+		case ColumnString:
+			values = c.Strings
+		case ColumnBytes:
+			values = c.Bytes
+		}
+		if got := asJSON(values); got != tt.values {
+			t.Fatalf("unexpected values of column %s, exp %s, got %s", c.Name, tt.values, got)
+		}
+		nulls := make([]bool, 3)
+		for i := range nulls {
+			nulls[i] = c.IsNull(i)
+		}
+		if got := asJSON(nulls); got != tt.nulls {
+			t.Fatalf("unexpected nulls of column %s, exp %s, got %s", c.Name, tt.nulls, got)
+		}
+	}
+
+	crs, err = s.QueryColumnar(&QueryRequest{Stmts: stmtsFromString(`SELECT name, 7 FROM foo WHERE id = 99`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query columnar: %s", err.Error())
+	}
+	if c := crs[0].Columns[0]; crs[0].NumRows != 0 || c.Type != ColumnNull || c.Nulls != nil {
+		t.Fatalf("unexpected result of empty query: %s", asJSON(crs[0]))
+	}
+}
+
+func Test_SingleNodeQueryReadOnly(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+
+	for _, q := range []string{
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+		`WITH x(id) AS (SELECT 1) INSERT INTO foo(id, name) SELECT id, "fiona" FROM x`,
+	} {
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(q), Lvl: None})
+		if err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+		if exp, got := `[{"error":"attempt to write a readonly database"}]`, asJSON(r); exp != got {
+			t.Fatalf("unexpected results for write through query\nexp: %s\ngot: %s", exp, got)
+		}
+	}
+
+	// Writes through Execute are unaffected.
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO foo(id, name) VALUES(2, "declan")`)}); err != nil {
+		t.Fatalf("failed to insert record: %s", err.Error())
+	}
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[2,"declan"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeExecuteDryRun(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	idx := s.raft.LastIndex()
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	r, err := s.Execute(&ExecuteRequest{Stmts: queries, DryRun: true})
+	if err != nil {
+		t.Fatalf("failed to dry run on single node: %s", err.Error())
+	}
+	if exp, got := `[{},{"last_insert_id":1,"rows_affected":1}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for dry run\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := idx, s.raft.LastIndex(); exp != got {
+		t.Fatalf("dry run written to Raft log, exp last index %d, got %d", exp, got)
+	}
+	for _, res := range r {
+		if res.RaftIndex != 0 {
+			t.Fatalf("dry run has non-zero raft index %d", res.RaftIndex)
+		}
+	}
+
+	rows, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT name FROM sqlite_master WHERE type="table"`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if rows[0].Values != nil {
+		t.Fatalf("table persisted after dry run: %s", asJSON(rows[0].Values))
+	}
+
+	r, err = s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO bar(id) VALUES(1)`), DryRun: true})
+	if err != nil {
+		t.Fatalf("failed to dry run on single node: %s", err.Error())
+	}
+	if exp, got := `[{"error":"no such table: bar"}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for failing dry run\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// A dry run cannot end its transaction, and so change the database.
+	queries = stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`COMMIT`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	if _, err := s.Execute(&ExecuteRequest{Stmts: queries, DryRun: true}); err != sql.ErrDryRunTransactionControl {
+		t.Fatalf("wrong error for dry run ending its transaction: %v", err)
+	}
+	rows, err = s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT name FROM sqlite_master WHERE type="table"`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if rows[0].Values != nil {
+		t.Fatalf("table persisted after dry run: %s", asJSON(rows[0].Values))
+	}
+}
+
+func Test_SingleNodeExecuteBatch(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+
+	br := &BatchExecuteRequest{Stmt: `INSERT INTO foo(id, name) VALUES(?, ?)`}
+	for i := 1; i <= 1000; i++ {
+		br.Parameters = append(br.Parameters, []Value{int64(i), fmt.Sprintf("name%d", i)})
+	}
+	idx := s.raft.LastIndex()
+	r, err := s.ExecuteBatch(br)
+	if err != nil {
+		t.Fatalf("failed to execute batch: %s", err.Error())
+	}
+	if r.Error != "" {
+		t.Fatalf("batch returned error: %s", r.Error)
+	}
+	if exp, got := int64(1000), r.RowsAffected; exp != got {
+		t.Fatalf("wrong rows affected, exp %d, got %d", exp, got)
+	}
+	if exp, got := idx+1, s.raft.LastIndex(); exp != got {
+		t.Fatalf("batch not written as single log entry, exp last index %d, got %d", exp, got)
+	}
+
+	rows, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM foo`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[1000]]`, asJSON(rows[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// A failure part way through rolls back the entire batch.
+	br = &BatchExecuteRequest{
+		Stmt:       `INSERT INTO foo(id, name) VALUES(?, ?)`,
+		Parameters: [][]Value{{int64(1001), "new"}, {int64(1), "duplicate"}},
+	}
+	r, err = s.ExecuteBatch(br)
+	if err != nil {
+		t.Fatalf("failed to execute batch: %s", err.Error())
+	}
+	if r.Error == "" {
+		t.Fatalf("expected error for batch with duplicate key")
+	}
+	if exp, got := int(sqlite3.ErrConstraintPrimaryKey), r.ErrorCode; exp != got {
+		t.Fatalf("wrong error code, exp %d, got %d", exp, got)
+	}
+	rows, err = s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM foo`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[1000]]`, asJSON(rows[0].Values); exp != got {
+		t.Fatalf("batch not rolled back\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeExecuteBatchWindow(t *testing.T) {
+	s := mustNewStoreWithConfig(true, &StoreConfig{BatchWindow: 100 * time.Millisecond})
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	first := s.raft.LastIndex()
+
+	// One Execute fails, and another fails within its transaction, without
+	// affecting any Execute coalesced with them.
+	const n = 20
+	requests := make([]*ExecuteRequest, n)
+	for i := range requests {
+		requests[i] = &ExecuteRequest{Stmts: []Statement{
+			{Query: `INSERT INTO foo(name) VALUES(?)`, Parameters: []Value{fmt.Sprintf("name%d", i)}},
+		}}
+	}
+	requests[7] = &ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO bar(name) VALUES("fiona")`)}
+	requests[9] = &ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`INSERT INTO foo(name) VALUES("declan")`,
+		`INSERT INTO bar(name) VALUES("declan")`,
+	}), Tx: true}
+
+	results := make([][]*sql.Result, n)
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := s.Execute(requests[i])
+			if err != nil {
+				t.Errorf("failed to execute request %d: %s", i, err.Error())
+			}
+			results[i] = r
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	if entries := s.raft.LastIndex() - first; entries >= n/2 {
+		t.Fatalf("%d Executes not coalesced, written in %d log entries", n, entries)
+	}
+	ids := make(map[int64]bool)
+	for i, r := range results {
+		switch i {
+		case 7:
+			if exp, got := `[{"error":"no such table: bar"}]`, asJSON(r); exp != got {
+				t.Fatalf("unexpected results for failed request\nexp: %s\ngot: %s", exp, got)
+			}
+		case 9:
+			if len(r) != 2 || r[1].Error != "no such table: bar" {
+				t.Fatalf("unexpected results for failed transaction: %s", asJSON(r))
+			}
+		default:
+			if len(r) != 1 || r[0].Error != "" || r[0].RowsAffected != 1 || r[0].RaftIndex <= first {
+				t.Fatalf("unexpected results for request %d: %s", i, asJSON(r))
+			}
+			if ids[r[0].LastInsertID] {
+				t.Fatalf("request %d shares last insert ID %d", i, r[0].LastInsertID)
+			}
+			ids[r[0].LastInsertID] = true
+		}
+	}
+
+	qr := &QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM foo`), Lvl: None}
+	r, err := s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := fmt.Sprintf(`[[%d]]`, n-2), asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeFileExecuteQuery(t *testing.T) {
+	s := mustNewStore(false)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	_, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	r, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	r, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeExecuteChanged(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	changed := func(stmts ...string) []bool {
+		re, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings(stmts)})
+		if err != nil {
+			t.Fatalf("failed to execute on single node: %s", err.Error())
+		}
+		c := make([]bool, len(re))
+		for i := range re {
+			if re[i].Error != "" {
+				t.Fatalf("statement %q returned error: %s", stmts[i], re[i].Error)
+			}
+			c[i] = re[i].Changed
+		}
+		return c
+	}
+
+	create := `CREATE TABLE IF NOT EXISTS foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`
+	if exp, got := `[true]`, asJSON(changed(create)); exp != got {
+		t.Fatalf("unexpected changed for first create, exp %s, got %s", exp, got)
+	}
+	if exp, got := `[false]`, asJSON(changed(create)); exp != got {
+		t.Fatalf("unexpected changed for second create, exp %s, got %s", exp, got)
+	}
+	if exp, got := `[false,true,false,false,true]`, asJSON(changed(
+		`INSERT INTO foo(name) VALUES("fiona")`,
+		`  create index IF NOT EXISTS foo_name ON foo(name)`,
+		`CREATE INDEX IF NOT EXISTS foo_name ON foo(name)`,
+		`DROP TABLE IF EXISTS bar`,
+		`ALTER TABLE foo ADD COLUMN age INTEGER`,
+	)); exp != got {
+		t.Fatalf("unexpected changed for statements, exp %s, got %s", exp, got)
+	}
+}
+
+func Test_SingleNodeExecuteLastInsertIDs(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE bar (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO bar(id, name) VALUES(10, "declan")`,
+	})}); err != nil {
+		t.Fatalf("failed to create tables: %s", err.Error())
+	}
+
+	for _, tt := range []struct {
+		tx  bool
+		exp []int64
+	}{
+		{false, []int64{1, 11, 2}},
+		{true, []int64{3, 12, 4}},
+	} {
+		r, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+			`INSERT INTO foo(name) VALUES("fiona")`,
+			`INSERT INTO bar(name) VALUES("fiona")`,
+			`INSERT INTO foo(name) VALUES("fiona")`,
+		}), Tx: tt.tx})
+		if err != nil {
+			t.Fatalf("failed to insert records: %s", err.Error())
+		}
+		if len(r) != 3 {
+			t.Fatalf("wrong number of results, exp 3, got %d", len(r))
+		}
+		for i, res := range r {
+			if res.Error != "" {
+				t.Fatalf("insert %d failed: %s", i, res.Error)
+			}
+			if res.RowsAffected != 1 {
+				t.Fatalf("wrong rows affected for insert %d, exp 1, got %d", i, res.RowsAffected)
+			}
+			if exp, got := tt.exp[i], res.LastInsertID; exp != got {
+				t.Fatalf("wrong last insert ID for insert %d (tx %v), exp %d, got %d", i, tt.tx, exp, got)
+			}
+		}
+	}
+}
+
+func Test_SingleNodeExecuteQueryTimings(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	results, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: true})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	for i, r := range results {
+		if r.Time <= 0 {
+			t.Fatalf("execute result %d has no time: %s", i, asJSON(r))
+		}
+	}
+
+	for _, lvl := range []ConsistencyLevel{None, Strong} {
+		rows, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Timings: true, Lvl: lvl})
+		if err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+		if rows[0].Time <= 0 {
+			t.Fatalf("query result at level %d has no time: %s", lvl, asJSON(rows[0]))
+		}
+	}
+
+	// Without timings, no time is set.
+	results, err = s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO foo(id, name) VALUES(2, "fiona")`)})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if results[0].Time != 0 {
+		t.Fatalf("execute result has time without timings: %s", asJSON(results[0]))
+	}
+	rows, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if rows[0].Time != 0 {
+		t.Fatalf("query result has time without timings: %s", asJSON(rows[0]))
+	}
+}
+
+func Test_SingleNodeExecuteQueryTx(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	_, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: true})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: true, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	r, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: true, Lvl: Weak, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	r, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: true, Lvl: Strong, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	_, err = s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: true})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+}
+
+func Test_SingleNodeExecuteSavepoint(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	re, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+		`SAVEPOINT step`,
+		`INSERT INTO foo(id, name) VALUES(2, "declan")`,
+		`SAVEPOINT inner`,
+		`UPDATE foo SET name = "aoife"`,
+		`RELEASE inner`,
+		`ROLLBACK TO step`,
+		`RELEASE step`,
+		`INSERT INTO foo(id, name) VALUES(3, "dana")`,
+	}), Tx: true})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if exp, got := `[{},{"last_insert_id":1,"rows_affected":1},{},{"last_insert_id":2,"rows_affected":1},{},{"last_insert_id":2,"rows_affected":2},{},{},{},{"last_insert_id":3,"rows_affected":1}]`, asJSON(re); exp != got {
+		t.Fatalf("unexpected results for execute\nexp: %s\ngot: %s", exp, got)
+	}
+
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo ORDER BY id"), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[1,"fiona"],[3,"dana"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if s.db.TransactionActive() {
+		t.Fatalf("transaction left active after execute")
+	}
+}
+
+func Test_SingleNodeExecuteStatementTimeout(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	slow := `WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c LIMIT 1000000000) SELECT count(*) FROM c`
+	queries := stmtsFromStrings([]string{
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+		slow,
+		`INSERT INTO foo(id, name) VALUES(2, "fiona")`,
+	})
+
+	// Transactional batch should be entirely rolled back.
+	r, err := s.Execute(&ExecuteRequest{Stmts: queries, Tx: true, Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":1,"rows_affected":1},{"error":"statement timed out"}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for execute\nexp: %s\ngot: %s", exp, got)
+	}
+	q, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT COUNT(*) FROM foo")})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[0]]`, asJSON(q[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Non-transactional batch should continue past the timed out statement.
+	r, err = s.Execute(&ExecuteRequest{Stmts: queries, Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":1,"rows_affected":1},{"error":"statement timed out"},{"last_insert_id":2,"rows_affected":1}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for execute\nexp: %s\ngot: %s", exp, got)
+	}
+	q, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT COUNT(*) FROM foo")})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[2]]`, asJSON(q[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// The limit is carried by the log entry, so that every node applies the
+	// same one.
+	var l raft.Log
+	if err := s.raftLog.GetLog(s.raft.LastIndex(), &l); err != nil {
+		t.Fatalf("failed to get last log entry: %s", err.Error())
+	}
+	var c command
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		t.Fatalf("failed to decode last log entry: %s", err.Error())
+	}
+	var d databaseSub
+	if err := json.Unmarshal(c.Sub, &d); err != nil {
+		t.Fatalf("failed to decode last log entry: %s", err.Error())
+	}
+	if exp, got := int64(statementStepsPerSecond/10), d.StepLimit; exp != got {
+		t.Fatalf("unexpected step limit in log entry, exp %d, got %d", exp, got)
+	}
+}
+
+func Test_SingleNodeBackupBinary(t *testing.T) {
+	t.Parallel()
+
+	s := mustNewStore(false)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	dump := `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE foo (id integer not null primary key, name text);
+INSERT INTO "foo" VALUES(1,'fiona');
+COMMIT;
+`
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load simple dump: %s", err.Error())
+	}
+
+	f, err := ioutil.TempFile("", "rqlite-baktest-")
+	defer os.Remove(f.Name())
+	s.logger.Debug("backup file created", "path", f.Name())
+
+	if err := s.Backup(true, BackupBinary, f); err != nil {
+		t.Fatalf("Backup failed %s", err.Error())
+	}
+
+	// Check the backed up data by reading back up file, underlying SQLite file,
+	// and comparing the two.
+	bkp, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("Backup Failed: unable to read backup file, %s", err.Error())
+	}
+
+	dbFile, err := ioutil.ReadFile(filepath.Join(s.Path(), sqliteFile))
+	if err != nil {
+		t.Fatalf("Backup Failed: unable to read source SQLite file, %s", err.Error())
+	}
+
+	if ret := bytes.Compare(bkp, dbFile); ret != 0 {
+		t.Fatalf("Backup Failed: backup bytes are not same")
+	}
+}
+
+func Test_SingleNodeBackupBinaryProgress(t *testing.T) {
+	s := mustNewStore(false)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	// Make the database span several steps of the SQLite backup.
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, data BLOB)`,
+		`WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c WHERE x < 4096) INSERT INTO foo(data) SELECT randomblob(1024) FROM c`,
+	})
+	if _, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	var progress []BackupProgress
+	var buf bytes.Buffer
+	opts := &BackupOptions{Progress: func(p BackupProgress) { progress = append(progress, p) }}
+	if err := s.BackupWithOptions(true, BackupBinary, &buf, opts); err != nil {
+		t.Fatalf("failed to backup single node: %s", err.Error())
+	}
+
+	var steps int
+	for _, p := range progress {
+		if p.PagesTotal > 0 {
+			steps++
+		}
+	}
+	if steps < 2 {
+		t.Fatalf("expected progress of several backup steps, got %d", steps)
+	}
+	if p := progress[0]; p.PagesRemaining == 0 || p.PagesRemaining >= p.PagesTotal {
+		t.Fatalf("unexpected progress of first backup step: %+v", p)
+	}
+	last := progress[len(progress)-1]
+	if last.BytesWritten != int64(buf.Len()) || last.BytesTotal != int64(buf.Len()) {
+		t.Fatalf("unexpected final progress %+v, backup is %d bytes", last, buf.Len())
+	}
+}
+
+func Test_SingleNodeBackupBinaryGzip(t *testing.T) {
+	t.Parallel()
+
+	s := mustNewStore(false)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	dump := `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE foo (id integer not null primary key, name text);
+INSERT INTO "foo" VALUES(1,'fiona');
+COMMIT;
+`
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load simple dump: %s", err.Error())
+	}
+
+	var buf bytes.Buffer
+	if err := s.Backup(true, BackupBinaryGzip, &buf); err != nil {
+		t.Fatalf("Backup failed %s", err.Error())
+	}
+
+	// Decompress the backup and compare it to the underlying SQLite file.
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Backup Failed: unable to create gzip reader, %s", err.Error())
+	}
+	bkp, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("Backup Failed: unable to decompress backup, %s", err.Error())
+	}
+	dbFile, err := ioutil.ReadFile(filepath.Join(s.Path(), sqliteFile))
+	if err != nil {
+		t.Fatalf("Backup Failed: unable to read source SQLite file, %s", err.Error())
+	}
+	if ret := bytes.Compare(bkp, dbFile); ret != 0 {
+		t.Fatalf("Backup Failed: backup bytes are not same")
+	}
+
+	// Wrap the backup in a gzip-compressed snapshot, and restore from it.
+	_, err = s.Execute(&ExecuteRequest{Stmts: stmtsFromString("DROP TABLE foo"), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to drop table: %s", err.Error())
+	}
+	var snap bytes.Buffer
+	gw := gzip.NewWriter(&snap)
+	if err := binary.Write(gw, binary.LittleEndian, uint64(len(bkp))); err != nil {
+		t.Fatalf("failed to write snapshot size: %s", err.Error())
+	}
+	gw.Write(bkp)
+	gw.Write([]byte("{}"))
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to close gzip writer: %s", err.Error())
+	}
+	if err := s.Restore(ioutil.NopCloser(&snap)); err != nil {
+		t.Fatalf("failed to restore gzipped snapshot: %s", err.Error())
+	}
+
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeBackupText(t *testing.T) {
+	t.Parallel()
+
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	dump := `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE foo (id integer not null primary key, name text);
+INSERT INTO "foo" VALUES(1,'fiona');
+COMMIT;
+`
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load simple dump: %s", err.Error())
+	}
+
+	f, err := ioutil.TempFile("", "rqlite-baktest-")
+	defer os.Remove(f.Name())
+	s.logger.Debug("backup file created", "path", f.Name())
+
+	if err := s.Backup(true, BackupSQL, f); err != nil {
+		t.Fatalf("Backup failed %s", err.Error())
+	}
+
+	// Check the backed up data
+	bkp, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("Backup Failed: unable to read backup file, %s", err.Error())
+	}
+	if ret := bytes.Compare(bkp, []byte(dump)); ret != 0 {
+		t.Fatalf("Backup Failed: backup bytes are not same")
+	}
+}
+
+func Test_SingleNodeBackupTablesFiltered(t *testing.T) {
+	t.Parallel()
+
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	fooDump := `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE foo (id integer not null primary key, name text);
+INSERT INTO "foo" VALUES(1,'fiona');
+COMMIT;
+`
+	queries := stmtsFromStrings([]string{
+		fooDump,
+		`CREATE TABLE audit (id integer not null primary key, event text)`,
+		`INSERT INTO audit(id, event) VALUES(1, "login")`,
+		`CREATE INDEX audit_event ON audit(event)`,
+	})
+	if _, err := s.Execute(&ExecuteRequest{Stmts: queries}); err != nil {
+		t.Fatalf("failed to load tables: %s", err.Error())
+	}
+
+	for _, opts := range []*BackupOptions{
+		{IncludeTables: []string{"foo"}},
+		{ExcludeTables: []string{"audit"}},
+	} {
+		var buf bytes.Buffer
+		if err := s.BackupWithOptions(true, BackupSQL, &buf, opts); err != nil {
+			t.Fatalf("Backup failed %s", err.Error())
+		}
+		if exp, got := fooDump, buf.String(); exp != got {
+			t.Fatalf("unexpected SQL backup for %+v\nexp: %s\ngot: %s", opts, exp, got)
+		}
+
+		buf.Reset()
+		if err := s.BackupWithOptions(true, BackupJSONL, &buf, opts); err != nil {
+			t.Fatalf("Backup failed %s", err.Error())
+		}
+		exp := `{"table":"foo","columns":["id","name"],"types":["integer","text"]}
+{"id":1,"name":"fiona"}
+`
+		if got := buf.String(); exp != got {
+			t.Fatalf("unexpected JSONL backup for %+v\nexp: %s\ngot: %s", opts, exp, got)
+		}
+	}
+
+	err := s.BackupWithOptions(true, BackupBinary, ioutil.Discard, &BackupOptions{IncludeTables: []string{"foo"}})
+	if err != ErrBackupFilterUnsupported {
+		t.Fatalf("expected ErrBackupFilterUnsupported for binary backup, got %v", err)
+	}
+}
+
+func Test_SingleNodeBackupInsertMode(t *testing.T) {
+	t.Parallel()
+
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	dump := `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE foo (id integer not null primary key, name text);
+INSERT INTO "foo" VALUES(1,'fiona');
+COMMIT;
+`
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump)}); err != nil {
+		t.Fatalf("failed to load simple dump: %s", err.Error())
+	}
+
+	for mode, insert := range map[InsertMode]string{
+		InsertPlain:     "INSERT",
+		InsertOrReplace: "INSERT OR REPLACE",
+		InsertOrIgnore:  "INSERT OR IGNORE",
+	} {
+		var buf bytes.Buffer
+		if err := s.BackupWithOptions(true, BackupSQL, &buf, &BackupOptions{Insert: mode}); err != nil {
+			t.Fatalf("Backup failed %s", err.Error())
+		}
+		exp := strings.Replace(dump, "INSERT", insert, 1)
+		if got := buf.String(); exp != got {
+			t.Fatalf("unexpected SQL backup for mode %d\nexp: %s\ngot: %s", mode, exp, got)
+		}
+	}
+
+	// Rows in an INSERT OR REPLACE backup can be loaded over themselves.
+	var buf bytes.Buffer
+	if err := s.BackupWithOptions(true, BackupSQL, &buf, &BackupOptions{Insert: InsertOrReplace}); err != nil {
+		t.Fatalf("Backup failed %s", err.Error())
+	}
+	r, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(strings.Replace(buf.String(), "CREATE TABLE", "CREATE TABLE IF NOT EXISTS", 1))})
+	if err != nil {
+		t.Fatalf("failed to load backup: %s", err.Error())
+	}
+	if r[0].Error != "" {
+		t.Fatalf("failed to load backup over existing rows: %s", r[0].Error)
+	}
+}
+
+func Test_SingleNodeBackupCSV(t *testing.T) {
+	t.Parallel()
+
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id integer not null primary key, name text, score real)`,
+		`INSERT INTO foo(id, name, score) VALUES(1, 'fiona', 1.5)`,
+		`INSERT INTO foo(id, name, score) VALUES(2, 'smith, "declan"', NULL)`,
+		`INSERT INTO foo(id, name, score) VALUES(3, 'line one
+line two', 3)`,
+		`INSERT INTO foo(id, name, score) VALUES(4, '', 4)`,
+		`INSERT INTO foo(id, name, score) VALUES(5, NULL, 5)`,
+		`CREATE TABLE bar (id integer not null primary key)`,
+	})})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	var buf bytes.Buffer
+	if err := s.BackupWithOptions(true, BackupCSV, &buf, nil); err != ErrBackupTableRequired {
+		t.Fatalf("expected ErrBackupTableRequired, got %v", err)
+	}
+	if err := s.BackupWithOptions(true, BackupCSV, &buf, &BackupOptions{Table: "qux"}); err == nil {
+		t.Fatalf("expected error backing up missing table")
+	}
+	if err := s.BackupWithOptions(true, BackupCSV, &buf, &BackupOptions{Table: "foo"}); err != nil {
+		t.Fatalf("CSV backup failed: %s", err.Error())
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse CSV backup: %s", err.Error())
+	}
+	exp := [][]string{
+		{"id", "name", "score"},
+		{"1", "fiona", "1.5"},
+		{"2", `smith, "declan"`, `\N`},
+		{"3", "line one\nline two", "3"},
+		{"4", "", "4"},
+		{"5", `\N`, "5"},
+	}
+	if got := asJSON(records); asJSON(exp) != got {
+		t.Fatalf("unexpected CSV backup\nexp: %s\ngot: %s", asJSON(exp), got)
+	}
+
+	// NULL may be written as another field.
+	buf.Reset()
+	if err := s.BackupWithOptions(true, BackupCSV, &buf, &BackupOptions{Table: "foo", CSVNull: "NULL"}); err != nil {
+		t.Fatalf("CSV backup failed: %s", err.Error())
+	}
+	records, err = csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse CSV backup: %s", err.Error())
+	}
+	if exp, got := `[["4","","4"],["5","NULL","5"]]`, asJSON(records[4:]); exp != got {
+		t.Fatalf("unexpected CSV backup with NULL marker\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeLoad(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	dump := `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE foo (id integer not null primary key, name text);
+INSERT INTO "foo" VALUES(1,'fiona');
+COMMIT;
+`
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load simple dump: %s", err.Error())
+	}
+
+	// Check that data were loaded correctly.
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: true, Lvl: Strong, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeSingleCommandTrigger(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	dump := `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE foo (id integer primary key asc, name text);
+INSERT INTO "foo" VALUES(1,'bob');
+INSERT INTO "foo" VALUES(2,'alice');
+INSERT INTO "foo" VALUES(3,'eve');
+CREATE TABLE bar (nameid integer, age integer);
+INSERT INTO "bar" VALUES(1,44);
+INSERT INTO "bar" VALUES(2,46);
+INSERT INTO "bar" VALUES(3,8);
+CREATE VIEW foobar as select name as Person, Age as age from foo inner join bar on foo.id == bar.nameid;
+CREATE TRIGGER new_foobar instead of insert on foobar begin insert into foo (name) values (new.Person); insert into bar (nameid, age) values ((select id from foo where name == new.Person), new.Age); end;
+COMMIT;
+`
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load dump with trigger: %s", err.Error())
+	}
+
+	// Check that the VIEW and TRIGGER are OK by using both.
+	r, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString("INSERT INTO foobar VALUES('jason', 16)"), Timings: false, Tx: true})
+	if err != nil {
+		t.Fatalf("failed to insert into view on single node: %s", err.Error())
+	}
+	if exp, got := int64(3), r[0].LastInsertID; exp != got {
+		t.Fatalf("unexpected results for query\nexp: %d\ngot: %d", exp, got)
+	}
+}
+
+func Test_SingleNodeLoadNoStatements(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	dump := `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+COMMIT;
+`
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load dump with no commands: %s", err.Error())
+	}
+}
+
+func Test_SingleNodeLoadEmpty(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	dump := ``
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load empty dump: %s", err.Error())
+	}
+}
+
+func Test_SingleNodeLoadAbortOnError(t *testing.T) {
+	t.Parallel()
+
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	dump := `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT);
+COMMIT;
+`
+	r, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load commands: %s", err.Error())
+	}
+	if r[0].Error != "" {
+		t.Fatalf("error received creating table: %s", r[0].Error)
+	}
+
+	r, err = s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load commands: %s", err.Error())
+	}
+	if r[0].Error != "table foo already exists" {
+		t.Fatalf("received wrong error message: %s", r[0].Error)
+	}
+
+	r, err = s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load commands: %s", err.Error())
+	}
+	if r[0].Error != "cannot start a transaction within a transaction" {
+		t.Fatalf("received wrong error message: %s", r[0].Error)
+	}
+
+	r, err = s.ExecuteOrAbort(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load commands: %s", err.Error())
+	}
+	if r[0].Error != "cannot start a transaction within a transaction" {
+		t.Fatalf("received wrong error message: %s", r[0].Error)
+	}
+
+	r, err = s.Execute(&ExecuteRequest{Stmts: stmtsFromString(dump), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load commands: %s", err.Error())
+	}
+	if r[0].Error != "table foo already exists" {
+		t.Fatalf("received wrong error message: %s", r[0].Error)
+	}
+}
+
+func Test_SingleNodeLoadChinook(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(chinook.DB), Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to load chinook dump: %s", err.Error())
+	}
+
+	// Check that data were loaded correctly.
+
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT count(*) FROM track"), Timings: false, Tx: true, Lvl: Strong, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `["count(*)"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[3503]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	r, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT count(*) FROM album"), Timings: false, Tx: true, Lvl: Strong, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `["count(*)"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[347]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	r, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT count(*) FROM artist"), Timings: false, Tx: true, Lvl: Strong, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `["count(*)"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[275]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+}
+
+func Test_SingleNodeExplainQueryPlanChinook(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(chinook.DB)})
+	if err != nil {
+		t.Fatalf("failed to load chinook dump: %s", err.Error())
+	}
+
+	steps, err := s.ExplainQueryPlan(`SELECT Album.Title FROM Album JOIN Artist ON Album.ArtistId = Artist.ArtistId WHERE Artist.Name = ?`,
+		[]interface{}{"AC/DC"})
+	if err != nil {
+		t.Fatalf("failed to explain query plan: %s", err.Error())
+	}
+	if len(steps) != 2 {
+		t.Fatalf("expected a step for each table of the join, got %s", asJSON(steps))
+	}
+	var indexed bool
+	for _, st := range steps {
+		if !strings.HasPrefix(st.Detail, "SCAN") && !strings.HasPrefix(st.Detail, "SEARCH") {
+			t.Fatalf("plan step neither scans nor searches: %s", asJSON(st))
+		}
+		if strings.Contains(st.Detail, "USING") {
+			indexed = true
+		}
+	}
+	if !indexed {
+		t.Fatalf("expected the join to use an index, got %s", asJSON(steps))
+	}
+
+	if _, err := s.ExplainQueryPlan(`SELECT * FROM nonexistent`, nil); err == nil {
+		t.Fatalf("expected error explaining query of missing table")
+	}
+}
+
+func Test_SingleNodeSchemaChinook(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(chinook.DB)})
+	if err != nil {
+		t.Fatalf("failed to load chinook dump: %s", err.Error())
+	}
+
+	tables, err := s.Schema()
+	if err != nil {
+		t.Fatalf("failed to get schema: %s", err.Error())
+	}
+	if exp, got := 11, len(tables); exp != got {
+		t.Fatalf("wrong number of tables, exp %d, got %d", exp, got)
+	}
+
+	found := make(map[string]TableInfo)
+	for _, ti := range tables {
+		found[strings.ToLower(ti.Name)] = ti
+	}
+	for name, exp := range map[string]string{
+		"album":  `["AlbumId","Title","ArtistId"]`,
+		"artist": `["ArtistId","Name"]`,
+		"track":  `["TrackId","Name","AlbumId","MediaTypeId","GenreId","Composer","Milliseconds","Bytes","UnitPrice"]`,
+	} {
+		ti, ok := found[name]
+		if !ok {
+			t.Fatalf("table %s not found in schema", name)
+		}
+		if !strings.HasPrefix(ti.SQL, "CREATE TABLE") {
+			t.Fatalf("wrong SQL for table %s: %s", name, ti.SQL)
+		}
+		var cols []string
+		for _, c := range ti.Columns {
+			cols = append(cols, c.Name)
+		}
+		if got := asJSON(cols); exp != got {
+			t.Fatalf("wrong columns for table %s\nexp: %s\ngot: %s", name, exp, got)
+		}
+	}
+
+	id := found["track"].Columns[0]
+	if !id.PrimaryKey || !id.NotNull || id.Type != "INTEGER" {
+		t.Fatalf("wrong metadata for track primary key: %+v", id)
+	}
+	if len(found["track"].Indexes) == 0 {
+		t.Fatalf("no indexes found for track")
+	}
+}
+
+func Test_MultiNodeSchemaHash(t *testing.T) {
+	s0 := mustNewStoreWithConfig(true, &StoreConfig{PublishSchemaHash: true})
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	stores := []*Store{s0}
+	for i := 0; i < 2; i++ {
+		s := mustNewStoreWithConfig(true, &StoreConfig{PublishSchemaHash: true})
+		defer os.RemoveAll(s.Path())
+		if err := s.Open(false); err != nil {
+			t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+		}
+		defer s.Close(true)
+		if err := s0.Join(s.ID(), s.Addr(), true, nil); err != nil {
+			t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+		}
+		stores = append(stores, s)
+	}
+
+	// Joining a member again, at the same address, changes nothing.
+	s1 := stores[1]
+	if err := s0.Join(s1.ID(), s1.Addr(), true, map[string]string{"foo": "bar"}); err != nil {
+		t.Fatalf("failed to rejoin node: %s", err.Error())
+	}
+	if v := s0.Metadata(s1.ID(), "foo"); v != "" {
+		t.Fatalf("rejoin of member set metadata, got %q", v)
+	}
+
+	empty := s0.SchemaHash()
+	if _, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`CREATE INDEX foo_name ON foo(name)`,
+	})}); err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	hash := s0.SchemaHash()
+	if hash == "" || hash == empty {
+		t.Fatalf("schema hash not changed by schema change, got %q", hash)
+	}
+
+	// Each node publishes its hash once it has applied the changes, a
+	// follower through the leader.
+	published := func(s *Store, hash string) func() bool {
+		return func() bool {
+			all := s.AllMetadata()
+			for _, n := range stores {
+				if all[n.ID()][SchemaHashKey] != hash {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	testPoll(t, published(s0, hash), 100*time.Millisecond, 10*time.Second)
+	for _, s := range stores {
+		if got := s.SchemaHash(); got != hash {
+			t.Fatalf("schema hash of node %s does not match leader, exp %s, got %s", s.ID(), hash, got)
+		}
+	}
+	testPoll(t, published(s1, hash), 100*time.Millisecond, 10*time.Second)
+	if !s1.SchemaConsistent() {
+		t.Fatalf("schema not consistent across nodes")
+	}
+
+	// A change made to one database outside of the Raft log is detected,
+	// once the follower publishes its hash.
+	s2 := stores[2]
+	if _, err := s2.db.ExecuteStringStmt(`CREATE TABLE drift (id INTEGER)`); err != nil {
+		t.Fatalf("failed to change schema of follower: %s", err.Error())
+	}
+	if err := s2.PublishSchemaHash(); err != nil {
+		t.Fatalf("failed to publish schema hash on follower: %s", err.Error())
+	}
+	if s0.SchemaConsistent() {
+		t.Fatalf("schema drift not detected")
+	}
+}
+
+func Test_SingleNodeQueryAssociativeChinook(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(chinook.DB)})
+	if err != nil {
+		t.Fatalf("failed to load chinook dump: %s", err.Error())
+	}
+
+	q := `SELECT * FROM album INNER JOIN artist ON album.ArtistId = artist.ArtistId ORDER BY AlbumId LIMIT 2`
+	for _, lvl := range []ConsistencyLevel{None, Strong} {
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(q), Lvl: lvl, Associative: true})
+		if err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+		if exp, got := `["AlbumId","Title","ArtistId","ArtistId","Name"]`, asJSON(r[0].Columns); exp != got {
+			t.Fatalf("unexpected columns for query\nexp: %s\ngot: %s", exp, got)
+		}
+		if r[0].Values != nil {
+			t.Fatalf("values set for associative query")
+		}
+		if exp, got := `[{"AlbumId":1,"ArtistId":1,"ArtistId:1":1,"Name":"AC/DC","Title":"For Those About To Rock We Salute You"},{"AlbumId":2,"ArtistId":2,"ArtistId:1":2,"Name":"Accept","Title":"Balls to the Wall"}]`, asJSON(r[0].Maps); exp != got {
+			t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+		}
+	}
+}
+
+func Test_MultiNodeJoinRemove(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	// Get sorted list of cluster nodes.
+	storeNodes := []string{s0.ID(), s1.ID()}
+	sort.StringSlice(storeNodes).Sort()
+
+	// Join the second node to the first.
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+
+	s1.WaitForLeader(10 * time.Second)
+
+	// Check leader state on follower.
+	if got, exp := s1.LeaderAddr(), s0.Addr(); got != exp {
+		t.Fatalf("wrong leader address returned, got: %s, exp %s", got, exp)
+	}
+	id, err := s1.LeaderID()
+	if err != nil {
+		t.Fatalf("failed to retrieve leader ID: %s", err.Error())
+	}
+	if got, exp := id, s0.raftID; got != exp {
+		t.Fatalf("wrong leader ID returned, got: %s, exp %s", got, exp)
+	}
+
+	nodes, err := s0.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err.Error())
+	}
+
+	if len(nodes) != len(storeNodes) {
+		t.Fatalf("size of cluster is not correct")
+	}
+	if storeNodes[0] != nodes[0].ID || storeNodes[1] != nodes[1].ID {
+		t.Fatalf("cluster does not have correct nodes")
+	}
+
+	// Remove a node.
+	if err := s0.Remove(s1.ID()); err != nil {
+		t.Fatalf("failed to remove %s from cluster: %s", s1.ID(), err.Error())
+	}
+
+	nodes, err = s0.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes post remove: %s", err.Error())
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("size of cluster is not correct post remove")
+	}
+	if s0.ID() != nodes[0].ID {
+		t.Fatalf("cluster does not have correct nodes post remove")
+	}
+}
+
+// Test_MultiNodeTrailingLogs checks that a follower which was briefly down
+// catches up from the leader's log, without the transfer of a snapshot, if
+// the leader keeps enough trailing logs after snapshotting.
+func Test_MultiNodeTrailingLogs(t *testing.T) {
+	for _, tt := range []struct {
+		trailingLogs uint64
+		expSnapshot  bool
+	}{
+		{trailingLogs: 1, expSnapshot: true},
+		{trailingLogs: 1000, expSnapshot: false},
+	} {
+		s0 := mustNewStoreWithConfig(true, &StoreConfig{TrailingLogs: tt.trailingLogs})
+		defer os.RemoveAll(s0.Path())
+		if err := s0.Open(true); err != nil {
+			t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+		}
+		defer s0.Close(true)
+		s0.WaitForLeader(10 * time.Second)
+
+		s1 := mustNewStoreWithConfig(false, &StoreConfig{})
+		defer os.RemoveAll(s1.Path())
+		if err := s1.Open(false); err != nil {
+			t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+		}
+		// The follower is a non-voter, so the leader keeps quorum without it.
+		if err := s0.Join(s1.ID(), s1.Addr(), false, nil); err != nil {
+			t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+		}
+		s1.WaitForLeader(10 * time.Second)
+		if _, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+			t.Fatalf("failed to execute on leader: %s", err.Error())
+		}
+		if err := s1.WaitForBarrier(s0.raft.LastIndex(), 5*time.Second); err != nil {
+			t.Fatalf("follower failed to apply log: %s", err.Error())
+		}
+
+		// Take the follower down, and snapshot the leader while it is.
+		addr := s1.Addr()
+		if err := s1.Close(true); err != nil {
+			t.Fatalf("failed to close follower: %s", err.Error())
+		}
+		s1.ln.Close()
+		for i := 0; i < 20; i++ {
+			if _, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO foo(name) VALUES("fiona")`)}); err != nil {
+				t.Fatalf("failed to execute on leader: %s", err.Error())
+			}
+		}
+		if err := s0.TriggerSnapshot(); err != nil {
+			t.Fatalf("failed to snapshot leader: %s", err.Error())
+		}
+
+		s1 = New(mustMockLister(addr), &StoreConfig{
+			DBConf: NewDBConfig("", false),
+			Dir:    s1.Path(),
+			ID:     s1.ID(),
+		})
+		if err := s1.Open(false); err != nil {
+			t.Fatalf("failed to reopen follower: %s", err.Error())
+		}
+		defer s1.Close(true)
+		if err := s1.WaitForBarrier(s0.raft.LastIndex(), 10*time.Second); err != nil {
+			t.Fatalf("follower failed to catch up: %s", err.Error())
+		}
+		r, err := s1.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM foo`), Lvl: None})
+		if err != nil {
+			t.Fatalf("failed to query follower: %s", err.Error())
+		}
+		if exp, got := `[[20]]`, asJSON(r[0].Values); exp != got {
+			t.Fatalf("unexpected row count on follower\nexp: %s\ngot: %s", exp, got)
+		}
+		if got := s1.raft.Stats()["last_snapshot_index"] != "0"; got != tt.expSnapshot {
+			t.Fatalf("trailing logs %d: snapshot transferred to follower %v, exp %v", tt.trailingLogs, got, tt.expSnapshot)
+		}
+	}
+}
+
+func Test_MultiNodeDeadNodeTimeout(t *testing.T) {
+	s0 := mustNewStoreWithConfig(true, &StoreConfig{DeadNodeTimeout: time.Second})
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	var nonVoters []*Store
+	for i := 0; i < 2; i++ {
+		s := mustNewStore(true)
+		defer os.RemoveAll(s.Path())
+		if err := s.Open(false); err != nil {
+			t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+		}
+		defer s.Close(true)
+		if err := s0.Join(s.ID(), s.Addr(), false, nil); err != nil {
+			t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+		}
+		if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+			t.Fatalf("failed to wait for leader on non-voter: %s", err.Error())
+		}
+		nonVoters = append(nonVoters, s)
+	}
+
+	// Reachable non-voters are kept.
+	time.Sleep(2 * time.Second)
+	nodes, err := s0.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err.Error())
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("reachable node removed, got %d nodes", len(nodes))
+	}
+
+	dead := nonVoters[0]
+	if err := dead.Close(true); err != nil {
+		t.Fatalf("failed to close non-voter: %s", err.Error())
+	}
+	dead.ln.Close()
+	if err := s0.WaitForRemoved(dead.ID(), 10*time.Second); err != nil {
+		t.Fatalf("dead non-voter not removed: %s", err.Error())
+	}
+	nodes, err = s0.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err.Error())
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("size of cluster is not correct post removal, got %d nodes", len(nodes))
+	}
+	for _, n := range nodes {
+		if n.ID == dead.ID() {
+			t.Fatalf("dead non-voter still in cluster")
+		}
+	}
+}
+
+func Test_MultiNodeWaitForRemoved(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	s2 := mustNewStore(true)
+	defer os.RemoveAll(s2.Path())
+	if err := s2.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s2.Close(true)
+	if err := s0.Join(s2.ID(), s2.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s2.WaitForLeader(10 * time.Second)
+
+	if err := s1.WaitForRemoved(s2.ID(), 500*time.Millisecond); err == nil {
+		t.Fatalf("node reported removed while still in cluster")
+	}
+
+	if err := s0.Remove(s2.ID()); err != nil {
+		t.Fatalf("failed to remove %s from cluster: %s", s2.ID(), err.Error())
+	}
+	for _, s := range []*Store{s0, s1} {
+		if err := s.WaitForRemoved(s2.ID(), 5*time.Second); err != nil {
+			t.Fatalf("failed to wait for removal on %s: %s", s.ID(), err.Error())
+		}
+	}
+	nodes, err := s1.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err.Error())
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("size of cluster is not correct post remove, got %d", len(nodes))
+	}
+}
+
+func Test_MultiNodeJoinNonVoterRemove(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	// Get sorted list of cluster nodes.
+	storeNodes := []string{s0.ID(), s1.ID()}
+	sort.StringSlice(storeNodes).Sort()
+
+	// Join the second node to the first.
+	if err := s0.Join(s1.ID(), s1.Addr(), false, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+
+	s1.WaitForLeader(10 * time.Second)
+
+	// Check leader state on follower.
+	if got, exp := s1.LeaderAddr(), s0.Addr(); got != exp {
+		t.Fatalf("wrong leader address returned, got: %s, exp %s", got, exp)
+	}
+	id, err := s1.LeaderID()
+	if err != nil {
+		t.Fatalf("failed to retrieve leader ID: %s", err.Error())
+	}
+	if got, exp := id, s0.raftID; got != exp {
+		t.Fatalf("wrong leader ID returned, got: %s, exp %s", got, exp)
+	}
+
+	nodes, err := s0.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err.Error())
+	}
+
+	if len(nodes) != len(storeNodes) {
+		t.Fatalf("size of cluster is not correct")
+	}
+	if storeNodes[0] != nodes[0].ID || storeNodes[1] != nodes[1].ID {
+		t.Fatalf("cluster does not have correct nodes")
+	}
+
+	// Remove the non-voter.
+	if err := s0.Remove(s1.ID()); err != nil {
+		t.Fatalf("failed to remove %s from cluster: %s", s1.ID(), err.Error())
+	}
+
+	nodes, err = s0.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes post remove: %s", err.Error())
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("size of cluster is not correct post remove")
+	}
+	if s0.ID() != nodes[0].ID {
+		t.Fatalf("cluster does not have correct nodes post remove")
+	}
+}
+
+func Test_MultiNodeJoinIncompatibleVersion(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStoreWithConfig(true, &StoreConfig{FormatVersion: FormatVersion + 1})
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	md := map[string]string{FormatVersionKey: strconv.Itoa(s1.FormatVersion())}
+	if err := s0.Join(s1.ID(), s1.Addr(), true, md); !errors.Is(err, ErrIncompatibleVersion) {
+		t.Fatalf("expected ErrIncompatibleVersion joining mismatched node, got %v", err)
+	}
+	nodes, err := s0.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err.Error())
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("mismatched node added to cluster")
+	}
+
+	md = map[string]string{FormatVersionKey: strconv.Itoa(s0.FormatVersion())}
+	if err := s0.Join(s1.ID(), s1.Addr(), true, md); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+}
+
+func Test_MultiNodeJoinRemoveByAddr(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	if err := s0.RemoveByAddr("127.0.0.1:1"); err != ErrNodeNotFound {
+		t.Fatalf("expected ErrNodeNotFound removing unknown address, got %v", err)
+	}
+
+	if err := s0.RemoveByAddr(s1.Addr()); err != nil {
+		t.Fatalf("failed to remove %s from cluster: %s", s1.Addr(), err.Error())
+	}
+
+	nodes, err := s0.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes post remove: %s", err.Error())
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("size of cluster is not correct post remove")
+	}
+	if s0.ID() != nodes[0].ID {
+		t.Fatalf("cluster does not have correct nodes post remove")
+	}
+}
+
+func Test_SingleNodeBootFromSQLiteFile(t *testing.T) {
+	// Build a plain SQLite file, as another tool would.
+	path := filepath.Join(mustTempDir(), "boot.sqlite")
+	defer os.RemoveAll(filepath.Dir(path))
+	db, err := sql.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open database file: %s", err.Error())
+	}
+	if _, err := db.ExecuteStringStmt(`CREATE TABLE foo (id integer not null primary key, name text)`); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	if _, err := db.ExecuteStringStmt(`INSERT INTO foo(id, name) VALUES(1, "fiona")`); err != nil {
+		t.Fatalf("failed to insert record: %s", err.Error())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database file: %s", err.Error())
+	}
+
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+	if err := s.BootFromSQLiteFile(path); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader booting unopened store, got %v", err)
+	}
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if err := s.BootFromSQLiteFile(filepath.Join(filepath.Dir(path), "missing.sqlite")); err == nil {
+		t.Fatalf("expected error booting from missing file")
+	}
+	if err := s.BootFromSQLiteFile(path); err != nil {
+		t.Fatalf("failed to boot from SQLite file: %s", err.Error())
+	}
+
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM foo`), Lvl: Strong})
+	if err != nil {
+		t.Fatalf("failed to query booted database: %s", err.Error())
+	}
+	if exp, got := `[{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"]]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results after boot\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_MultiNodeReload(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	if _, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id integer not null primary key, name text)`)}); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+
+	// Build the replacement database offline.
+	path := filepath.Join(mustTempDir(), "reload.db")
+	defer os.RemoveAll(filepath.Dir(path))
+	db, err := sql.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open database file: %s", err.Error())
+	}
+	if _, err := db.ExecuteStringStmt(`CREATE TABLE bar (id integer not null primary key, name text)`); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	if _, err := db.ExecuteStringStmt(`INSERT INTO bar(id, name) VALUES(1, "fiona")`); err != nil {
+		t.Fatalf("failed to insert record: %s", err.Error())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database file: %s", err.Error())
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read database file: %s", err.Error())
+	}
+
+	if err := s1.Reload(bytes.NewReader(b)); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader reloading on follower, got %v", err)
+	}
+	if err := s0.Reload(bytes.NewReader([]byte("not a database file"))); err == nil {
+		t.Fatalf("expected error reloading invalid database file")
+	}
+	if err := s0.Reload(bytes.NewReader(b)); err != nil {
+		t.Fatalf("failed to reload database: %s", err.Error())
+	}
+
+	if err := s1.WaitForAppliedIndex(s0.raft.AppliedIndex(), 5*time.Second); err != nil {
+		t.Fatalf("follower failed to apply reload: %s", err.Error())
+	}
+	for _, s := range []*Store{s0, s1} {
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT name FROM sqlite_master WHERE type="table" ORDER BY name`), Lvl: None})
+		if err != nil {
+			t.Fatalf("failed to query tables: %s", err.Error())
+		}
+		if exp, got := `[{"columns":["name"],"types":["text"],"values":[["bar"]]}]`, asJSON(r); exp != got {
+			t.Fatalf("unexpected tables after reload\nexp: %s\ngot: %s", exp, got)
+		}
+		r, err = s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT * FROM bar`), Lvl: None})
+		if err != nil {
+			t.Fatalf("failed to query reloaded table: %s", err.Error())
+		}
+		if exp, got := `[{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"]]}]`, asJSON(r); exp != got {
+			t.Fatalf("unexpected results after reload\nexp: %s\ngot: %s", exp, got)
+		}
+	}
+}
+
+func Test_MultiNodeNodesWithStatus(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	nodes, err := s0.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err.Error())
+	}
+	for _, n := range nodes {
+		if n.Status != nil {
+			t.Fatalf("status set for node %s when not requested", n.ID)
+		}
+	}
+
+	// Wait for the follower to hear from the leader.
+	testPoll(t, func() bool {
+		return !s1.raft.LastContact().IsZero()
+	}, 100*time.Millisecond, 5*time.Second)
+
+	nodes, err = s1.Nodes(true)
+	if err != nil {
+		t.Fatalf("failed to get nodes with status: %s", err.Error())
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("wrong number of nodes, exp 2, got %d", len(nodes))
+	}
+	for _, n := range nodes {
+		switch n.ID {
+		case s0.ID():
+			if !n.Status.Leader || n.Status.Self || !n.Status.Reachable {
+				t.Fatalf("unexpected status for leader: %+v", n.Status)
+			}
+			if time.Since(n.Status.LastContact) > 5*time.Second {
+				t.Fatalf("leader last contact is not recent: %s", n.Status.LastContact)
+			}
+		case s1.ID():
+			if n.Status.Leader || !n.Status.Self || !n.Status.Reachable {
+				t.Fatalf("unexpected status for follower: %+v", n.Status)
+			}
+		default:
+			t.Fatalf("unexpected node %s", n.ID)
+		}
+	}
+
+	nodes, err = s0.Nodes(true)
+	if err != nil {
+		t.Fatalf("failed to get nodes with status: %s", err.Error())
+	}
+	for _, n := range nodes {
+		switch n.ID {
+		case s0.ID():
+			if !n.Status.Leader || !n.Status.Self || !n.Status.Reachable {
+				t.Fatalf("unexpected status for leader reported by itself: %+v", n.Status)
+			}
+		case s1.ID():
+			if n.Status.Leader || n.Status.Self || !n.Status.Reachable {
+				t.Fatalf("unexpected status for follower reported by leader: %+v", n.Status)
+			}
+			if time.Since(n.Status.LastContact) > 5*time.Second {
+				t.Fatalf("follower last contact is not recent: %s", n.Status.LastContact)
+			}
+		default:
+			t.Fatalf("unexpected node %s", n.ID)
+		}
+	}
+}
+
+func Test_MultiNodeQueryNotLeaderError(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	for _, lvl := range []ConsistencyLevel{Weak, Strong} {
+		_, err := s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM sqlite_master"), Lvl: lvl})
+		if !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("expected error matching ErrNotLeader for level %v, got %v", lvl, err)
+		}
+		var nle *NotLeaderError
+		if !errors.As(err, &nle) {
+			t.Fatalf("expected *NotLeaderError for level %v, got %T", lvl, err)
+		}
+		if exp, got := s0.Addr(), nle.LeaderAddr; exp != got {
+			t.Fatalf("wrong leader address for level %v, exp %s, got %s", lvl, exp, got)
+		}
+	}
+}
+
+func Test_MultiNodeLeaderChange(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	s0Ch := s0.RegisterLeaderChange()
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	s0.WaitForLeader(10 * time.Second)
+
+	select {
+	case isLeader := <-s0Ch:
+		if !isLeader {
+			t.Fatalf("first node notified of leadership loss, not gain")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for leadership notification on first node")
+	}
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	s1Ch := s1.RegisterLeaderChange()
+
+	s2 := mustNewStore(true)
+	defer os.RemoveAll(s2.Path())
+	if err := s2.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s2.Close(true)
+	s2Ch := s2.RegisterLeaderChange()
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if err := s0.Join(s2.ID(), s2.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+	s2.WaitForLeader(10 * time.Second)
+
+	// Kill the leader, and check one of the remaining nodes is notified
+	// that it is now the leader.
+	if err := s0.Close(true); err != nil {
+		t.Fatalf("failed to close leader: %s", err.Error())
+	}
+
+	select {
+	case isLeader := <-s1Ch:
+		if !isLeader || !s1.IsLeader() {
+			t.Fatalf("second node received incorrect leadership notification")
+		}
+	case isLeader := <-s2Ch:
+		if !isLeader || !s2.IsLeader() {
+			t.Fatalf("third node received incorrect leadership notification")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("timed out waiting for leadership notification on new leader")
+	}
+}
+
+func Test_MultiNodeStepdown(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	if err := s0.Stepdown(true); err != ErrNoEligibleVoters {
+		t.Fatalf("expected ErrNoEligibleVoters for single node, got %v", err)
+	}
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	s2 := mustNewStore(true)
+	defer os.RemoveAll(s2.Path())
+	if err := s2.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s2.Close(true)
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if err := s0.Join(s2.ID(), s2.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if _, err := s1.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("failed to wait for leader on follower: %s", err.Error())
+	}
+
+	if err := s1.Stepdown(true); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader for follower, got %v", err)
+	}
+
+	if err := s0.Stepdown(true); err != nil {
+		t.Fatalf("failed to step down: %s", err.Error())
+	}
+	id, _, err := s0.Leader()
+	if err != nil {
+		t.Fatalf("failed to get leader: %s", err.Error())
+	}
+	if id == s0.ID() || (id != s1.ID() && id != s2.ID()) {
+		t.Fatalf("leadership not transferred, leader is %s", id)
+	}
+}
+
+func Test_MultiNodeRemoveLeader(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	if err := s0.Remove(s0.ID()); !errors.Is(err, ErrNoEligibleVoters) {
+		t.Fatalf("expected ErrNoEligibleVoters removing single node, got %v", err)
+	}
+	if s0.Metadata(s0.ID(), removePendingKey) == "true" {
+		t.Fatalf("failed removal left node marked for removal")
+	}
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	s2 := mustNewStore(true)
+	defer os.RemoveAll(s2.Path())
+	if err := s2.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s2.Close(true)
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if err := s0.Join(s2.ID(), s2.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if _, err := s1.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("failed to wait for leader on follower: %s", err.Error())
+	}
+
+	if err := s0.Remove(s0.ID()); err != nil {
+		t.Fatalf("failed to remove leader: %s", err.Error())
+	}
+
+	var leader *Store
+	for _, s := range []*Store{s1, s2} {
+		id, err := s.WaitForLeader(10 * time.Second)
+		if err != nil {
+			t.Fatalf("failed to wait for new leader: %s", err.Error())
+		}
+		if id == s0.Addr() {
+			t.Fatalf("removed node is still leader")
+		}
+		if s.IsLeader() {
+			leader = s
+		}
+	}
+	if leader == nil {
+		t.Fatalf("no new leader elected")
+	}
+
+	nodes, err := leader.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err.Error())
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("wrong number of nodes after removing leader, got %d", len(nodes))
+	}
+	for _, n := range nodes {
+		if n.ID == s0.ID() {
+			t.Fatalf("removed leader still in cluster")
+		}
+	}
+	if md := leader.AllMetadata(); md[s0.ID()] != nil {
+		t.Fatalf("removed leader still has metadata: %v", md[s0.ID()])
+	}
+}
+
+func Test_MultiNodeReady(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if s0.Live() {
+		t.Fatalf("unopened store reports live")
+	}
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+	if !s0.Live() || !s0.Ready() {
+		t.Fatalf("leader not live and ready, live %v, ready %v", s0.Live(), s0.Ready())
+	}
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if s1.Ready() {
+		t.Fatalf("follower with no leader reports ready")
+	}
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	waitFor := func(ready bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for s1.Ready() != ready {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for follower ready to be %v", ready)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(true)
+
+	// Stall the follower's FSM, so it falls behind the commit index.
+	s1.dbMu.Lock()
+	for i := 0; i < 5; i++ {
+		if _, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE IF NOT EXISTS foo (id INTEGER NOT NULL PRIMARY KEY)`)}); err != nil {
+			s1.dbMu.Unlock()
+			t.Fatalf("failed to execute on leader: %s", err.Error())
+		}
+	}
+	waitFor(false)
+	s1.dbMu.Unlock()
+	waitFor(true)
+
+	s1.Close(true)
+	if s1.Live() {
+		t.Fatalf("closed store reports live")
+	}
+}
+
+func Test_MultiNodeBootstrapExpect(t *testing.T) {
+	stores := make([]*Store, 3)
+	for i := range stores {
+		stores[i] = mustNewStoreWithConfig(true, &StoreConfig{BootstrapExpect: 3})
+		defer os.RemoveAll(stores[i].Path())
+	}
+	for _, s := range stores {
+		for _, p := range stores {
+			if p != s {
+				s.bootstrapPeers = append(s.bootstrapPeers, &Server{ID: p.ID(), Addr: p.ln.Addr().String()})
+			}
+		}
+	}
+
+	// No node bootstraps until every node is reachable.
+	if err := stores[0].Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer stores[0].Close(true)
+	addr := stores[1].ln.Addr().String()
+	stores[1].ln.Close()
+	time.Sleep(3 * bootstrapDialDelay)
+	if _, err := stores[0].WaitForLeader(time.Second); err == nil {
+		t.Fatalf("cluster bootstrapped before all nodes were reachable")
+	}
+	stores[1].ln = mustMockLister(addr)
+
+	for _, s := range stores[1:] {
+		if err := s.Open(false); err != nil {
+			t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+		}
+		defer s.Close(true)
+	}
+
+	var leader string
+	for _, s := range stores {
+		l, err := s.WaitForLeader(10 * time.Second)
+		if err != nil {
+			t.Fatalf("failed to wait for leader on node %s: %s", s.ID(), err.Error())
+		}
+		if leader != "" && l != leader {
+			t.Fatalf("nodes disagree on leader, %s and %s", leader, l)
+		}
+		leader = l
+	}
+	nodes, err := stores[0].Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err.Error())
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("expected a cluster of 3 nodes, got %d", len(nodes))
+	}
+
+	s := mustNewStoreWithConfig(true, &StoreConfig{BootstrapExpect: 2})
+	defer os.RemoveAll(s.Path())
+	if err := s.Open(false); err != ErrInvalidBootstrap {
+		t.Fatalf("expected ErrInvalidBootstrap, got %v", err)
+	}
+	if s.db != nil {
+		t.Fatalf("database left open after invalid bootstrap")
+	}
+}
+
+func Test_MultiNodeExecuteApplyRetries(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	s0.WaitForLeader(10 * time.Second)
+
+	followers := make([]*Store, 2)
+	for i := range followers {
+		s := mustNewStoreWithConfig(true, &StoreConfig{ApplyRetries: 6})
+		defer os.RemoveAll(s.Path())
+		if err := s.Open(false); err != nil {
+			t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+		}
+		defer s.Close(true)
+		if err := s0.Join(s.ID(), s.Addr(), true, nil); err != nil {
+			t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+		}
+		s.WaitForLeader(10 * time.Second)
+		followers[i] = s
+	}
+
+	// A follower retries while it is not the leader, and gives up.
+	start := time.Now()
+	if _, err := followers[0].Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY)`)}); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader from follower, got %v", err)
+	}
+	if time.Since(start) < applyRetryDelay {
+		t.Fatalf("follower did not retry before giving up")
+	}
+
+	// Kill the leader. Whichever follower wins the election makes the change.
+	if err := s0.Close(true); err != nil {
+		t.Fatalf("failed to close leader: %s", err.Error())
+	}
+	errCh := make(chan error, len(followers))
+	for _, s := range followers {
+		go func(s *Store) {
+			_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY)`)})
+			errCh <- err
+		}(s)
+	}
+	var succeeded int
+	for range followers {
+		if err := <-errCh; err == nil {
+			succeeded++
+		} else if err != ErrNotLeader {
+			t.Fatalf("unexpected error executing after leader loss: %s", err.Error())
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expected one retrying execute to succeed, %d succeeded", succeeded)
+	}
+
+	// SQL errors are returned without retrying.
+	leader := followers[0]
+	if !leader.IsLeader() {
+		leader = followers[1]
+	}
+	start = time.Now()
+	r, err := leader.Execute(&ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO bar(id) VALUES(1)`)})
+	if err != nil {
+		t.Fatalf("failed to execute on new leader: %s", err.Error())
+	}
+	if r[0].Error == "" {
+		t.Fatalf("expected insert into missing table to fail")
+	}
+	if time.Since(start) >= applyRetryDelay {
+		t.Fatalf("SQL error was retried")
+	}
+}
+
+func Test_MultiNodeJoinWithPromotion(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	queries := []string{`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`}
+	for i := 0; i < 100; i++ {
+		queries = append(queries, `INSERT INTO foo(name) VALUES("fiona")`)
+	}
+	for _, q := range queries {
+		if _, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(q)}); err != nil {
+			t.Fatalf("failed to execute on leader: %s", err.Error())
+		}
+	}
+
+	suffrage := func(id string) raft.ServerSuffrage {
+		cf := s0.raft.GetConfiguration()
+		if err := cf.Error(); err != nil {
+			t.Fatalf("failed to get configuration: %s", err.Error())
+		}
+		for _, srv := range cf.Configuration().Servers {
+			if srv.ID == raft.ServerID(id) {
+				return srv.Suffrage
+			}
+		}
+		t.Fatalf("node %s not in configuration", id)
+		return raft.Nonvoter
+	}
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.JoinWithPromotion(s1.ID(), s1.Addr(), nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for suffrage(s1.ID()) != raft.Voter {
+		if time.Now().After(deadline) {
+			t.Fatalf("joined node not promoted to voter")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if s1.raft.LastIndex() < uint64(len(queries)) {
+		t.Fatalf("node promoted before catching up, last index %d", s1.raft.LastIndex())
+	}
+
+	// Explicit promotion.
+	s2 := mustNewStore(true)
+	defer os.RemoveAll(s2.Path())
+	if err := s2.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s2.Close(true)
+	if err := s0.Join(s2.ID(), s2.Addr(), false, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if suffrage(s2.ID()) != raft.Nonvoter {
+		t.Fatalf("node joined as non-voter is a voter")
+	}
+	if err := s0.Promote(s2.ID()); err != nil {
+		t.Fatalf("failed to promote node: %s", err.Error())
+	}
+	if suffrage(s2.ID()) != raft.Voter {
+		t.Fatalf("promoted node is not a voter")
+	}
+	if err := s0.Promote("nonsense"); err != ErrNodeNotFound {
+		t.Fatalf("expected ErrNodeNotFound, got %v", err)
+	}
+}
+
+// Test_MultiNodePromotionTimeout checks that a non-voter which never
+// responds is not promoted, and that promotion is given up in time.
+func Test_MultiNodePromotionTimeout(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	since := time.Now()
+	if err := s0.Join(s1.ID(), s1.Addr(), false, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if err := s0.promoteWhenCaughtUp(s1.ID(), s0.raft.LastIndex(), since, 10*time.Second); err != nil {
+		t.Fatalf("failed to promote node: %s", err.Error())
+	}
+	if c, ok := s0.contacts.Contact(raft.ServerID(s1.ID())); !ok || c.Time.Before(since) {
+		t.Fatalf("no contact recorded with caught up node")
+	}
+
+	// A node which is not running never catches up.
+	if err := s0.Join("dead", "127.0.0.1:1", false, nil); err != nil {
+		t.Fatalf("failed to join dead node: %s", err.Error())
+	}
+	start := time.Now()
+	if err := s0.promoteWhenCaughtUp("dead", s0.raft.LastIndex(), start, time.Second); err == nil {
+		t.Fatalf("dead node promoted")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("promotion took %s to time out", d)
+	}
+	nodes, err := s0.Nodes(false)
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err.Error())
+	}
+	for _, n := range nodes {
+		if n.ID == "dead" && n.Suffrage != raft.Nonvoter.String() {
+			t.Fatalf("dead node has wrong suffrage %s", n.Suffrage)
+		}
+	}
+}
+
+func Test_MultiNodeJoinLearner(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	queries := []string{`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`}
+	for i := 0; i < 100; i++ {
+		queries = append(queries, `INSERT INTO foo(name) VALUES("fiona")`)
+	}
+	for _, q := range queries {
+		if _, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(q)}); err != nil {
+			t.Fatalf("failed to execute on leader: %s", err.Error())
+		}
+	}
+
+	suffrage := func(id string) raft.ServerSuffrage {
+		cf := s0.raft.GetConfiguration()
+		if err := cf.Error(); err != nil {
+			t.Fatalf("failed to get configuration: %s", err.Error())
+		}
+		for _, srv := range cf.Configuration().Servers {
+			if srv.ID == raft.ServerID(id) {
+				return srv.Suffrage
+			}
+		}
+		t.Fatalf("node %s not in configuration", id)
+		return raft.Nonvoter
+	}
+
+	s1 := mustNewStoreWithConfig(true, &StoreConfig{Learner: true})
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if !s1.Learner() {
+		t.Fatalf("store configured as learner is not a learner")
+	}
+	md := map[string]string{LearnerKey: "true"}
+	if err := s0.JoinWithPromotion(s1.ID(), s1.Addr(), md); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if err := s1.WaitForBarrier(s0.raft.LastIndex(), 5*time.Second); err != nil {
+		t.Fatalf("learner failed to catch up: %s", err.Error())
+	}
+
+	// Wait long enough for any promotion to have happened.
+	time.Sleep(5 * promoteCheckDelay)
+	if suffrage(s1.ID()) != raft.Nonvoter {
+		t.Fatalf("learner promoted to voter after catching up")
+	}
+	if err := s0.Promote(s1.ID()); err != ErrLearner {
+		t.Fatalf("expected ErrLearner promoting learner, got %v", err)
+	}
+
+	// Rejoining as a voter, without the learner metadata, does not make it
+	// a voter either.
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to rejoin learner: %s", err.Error())
+	}
+	if suffrage(s1.ID()) != raft.Nonvoter {
+		t.Fatalf("learner made a voter by rejoin")
+	}
+}
+
+func Test_MultiNodeNodesSuffrage(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+
+	s2 := mustNewStore(true)
+	defer os.RemoveAll(s2.Path())
+	if err := s2.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s2.Close(true)
+	if err := s0.Join(s2.ID(), s2.Addr(), false, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s2.WaitForLeader(10 * time.Second)
+
+	exp := map[string]string{s0.ID(): "Voter", s1.ID(): "Voter", s2.ID(): "Nonvoter"}
+	for _, s := range []*Store{s0, s2} {
+		nodes, err := s.Nodes(false)
+		if err != nil {
+			t.Fatalf("failed to get nodes: %s", err.Error())
+		}
+		if len(nodes) != 3 {
+			t.Fatalf("wrong number of nodes, got %d", len(nodes))
+		}
+		if !sort.IsSorted(Servers(nodes)) {
+			t.Fatalf("nodes not sorted by ID: %s", asJSON(nodes))
+		}
+		for _, n := range nodes {
+			if n.Suffrage != exp[n.ID] {
+				t.Fatalf("wrong suffrage for node %s, exp %s, got %s", n.ID, exp[n.ID], n.Suffrage)
+			}
+		}
+	}
+}
+
+func Test_MultiNodeFunctions(t *testing.T) {
+	// A domain-specific, but deterministic, hash.
+	hash := func(s string) int64 {
+		var h int64 = 17
+		for _, c := range s {
+			h = h*31 + int64(c)
+		}
+		return h
+	}
+	newStore := func() *Store {
+		dbConf := NewDBConfig("", true)
+		dbConf.Functions = []Function{{Name: "domain_hash", Impl: hash, Deterministic: true}}
+		return mustNewStoreWithConfig(true, &StoreConfig{DBConf: dbConf})
+	}
+
+	s0 := newStore()
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := newStore()
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	results, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT, hash INTEGER)`,
+		`INSERT INTO foo(id, name, hash) VALUES(1, "fiona", domain_hash("fiona"))`,
+	})})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if results[1].Error != "" {
+		t.Fatalf("failed to insert using function: %s", results[1].Error)
+	}
+	if err := s1.WaitForAppliedIndex(results[1].RaftIndex, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s", err.Error())
+	}
+
+	exp := fmt.Sprintf(`[[%d,%d]]`, hash("fiona"), hash("aoife"))
+	for _, s := range []*Store{s0, s1} {
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT hash, domain_hash("aoife") FROM foo`), Lvl: None})
+		if err != nil {
+			t.Fatalf("failed to query node: %s", err.Error())
+		}
+		if got := asJSON(r[0].Values); exp != got {
+			t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+		}
+	}
+}
+
+func Test_MultiNodeBarrier(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	if _, err := s1.Barrier(time.Second); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader for barrier on follower, got %v", err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		stmts := stmtsFromString(fmt.Sprintf(`INSERT INTO foo(id, name) VALUES(%d, "fiona")`, i))
+		if i == 1 {
+			stmts = append(stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`), stmts...)
+		}
+		if _, err := s0.Execute(&ExecuteRequest{Stmts: stmts}); err != nil {
+			t.Fatalf("failed to execute on leader: %s", err.Error())
+		}
+
+		// Read our own write on the follower.
+		idx, err := s0.Barrier(5 * time.Second)
+		if err != nil {
+			t.Fatalf("failed to write barrier on leader: %s", err.Error())
+		}
+		if err := s1.WaitForBarrier(idx, 5*time.Second); err != nil {
+			t.Fatalf("failed to wait for barrier on follower: %s", err.Error())
+		}
+		r, err := s1.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM foo`), Lvl: None})
+		if err != nil {
+			t.Fatalf("failed to query follower: %s", err.Error())
+		}
+		if exp, got := fmt.Sprintf(`[[%d]]`, i), asJSON(r[0].Values); exp != got {
+			t.Fatalf("follower missed write after barrier\nexp: %s\ngot: %s", exp, got)
+		}
+	}
+
+	if err := s1.WaitForBarrier(s1.raft.LastIndex()+100, 200*time.Millisecond); err == nil {
+		t.Fatalf("expected timeout waiting for unreached barrier")
+	}
+}
+
+func Test_MultiNodeQueryStaleFor(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	results, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if err := s1.WaitForAppliedIndex(results[1].RaftIndex, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s", err.Error())
+	}
+
+	qr := &QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Lvl: None}
+	r, err := s0.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query leader: %s", err.Error())
+	}
+	if r[0].StaleFor != 0 {
+		t.Fatalf("leader read is stale for %s", r[0].StaleFor)
+	}
+
+	r, err = s1.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query follower: %s", err.Error())
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if d := r[0].StaleFor; d < 0 || d > 5*time.Second {
+		t.Fatalf("unexpected staleness of follower read: %s", d)
+	}
+
+	// A follower which loses the leader grows staler.
+	s0.Close(true)
+	time.Sleep(500 * time.Millisecond)
+	r, err = s1.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query follower: %s", err.Error())
+	}
+	if d := r[0].StaleFor; d < 500*time.Millisecond {
+		t.Fatalf("follower read without leader is stale for only %s", d)
+	}
+}
+
+func Test_MultiNodeQueryServedByLeader(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	results, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if err := s1.WaitForAppliedIndex(results[1].RaftIndex, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s", err.Error())
+	}
+
+	served := func(s *Store, lvl ConsistencyLevel) bool {
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromStrings([]string{"SELECT * FROM foo", "SELECT 1"}), Lvl: lvl})
+		if err != nil {
+			t.Fatalf("failed to query node: %s", err.Error())
+		}
+		if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+			t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+		}
+		if r[0].ServedByLeader != r[1].ServedByLeader {
+			t.Fatalf("statements of the same read disagree on whether served by leader")
+		}
+		return r[0].ServedByLeader
+	}
+	for _, lvl := range []ConsistencyLevel{None, Weak, Strong} {
+		if !served(s0, lvl) {
+			t.Fatalf("read at level %v on leader not served by leader", lvl)
+		}
+	}
+	if served(s1, None) {
+		t.Fatalf("None read on follower served by leader")
+	}
+
+	// Once the follower is leader, its reads are served by the leader.
+	if err := s0.Stepdown(true); err != nil {
+		t.Fatalf("failed to step down leader: %s", err.Error())
+	}
+	if s1.raft.State() != raft.Leader {
+		t.Fatalf("follower not leader after stepdown")
+	}
+	if !served(s1, None) {
+		t.Fatalf("None read on new leader not served by leader")
+	}
+	if served(s0, None) {
+		t.Fatalf("None read on former leader served by leader")
+	}
+}
+
+func Test_MultiNodeQueryChecksum(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	results, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT, score REAL, data BLOB)`,
+		`INSERT INTO foo VALUES(1, "fiona", 1.5, x'0102')`,
+		`INSERT INTO foo VALUES(2, NULL, NULL, NULL)`,
+		`INSERT INTO foo VALUES(3, "1", 3, x'')`,
+	})})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if err := s1.WaitForAppliedIndex(results[3].RaftIndex, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s", err.Error())
+	}
+
+	qr := &QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo ORDER BY id"), Lvl: None, Checksum: true}
+	checksum := func(s *Store, qr *QueryRequest) string {
+		r, err := s.Query(qr)
+		if err != nil {
+			t.Fatalf("failed to query node: %s", err.Error())
+		}
+		if r[0].Error != "" {
+			t.Fatalf("query returned error: %s", r[0].Error)
+		}
+		if len(r[0].Checksum) != 16 {
+			t.Fatalf("unexpected checksum %q", r[0].Checksum)
+		}
+		return r[0].Checksum
+	}
+	sum := checksum(s0, qr)
+	if got := checksum(s1, qr); got != sum {
+		t.Fatalf("checksums of identical data differ, leader %s, follower %s", sum, got)
+	}
+	aqr := *qr
+	aqr.Associative = true
+	if got := checksum(s1, &aqr); got != sum {
+		t.Fatalf("checksum of associative rows differs, exp %s, got %s", sum, got)
+	}
+
+	// Values which print alike, but are of different types, differ.
+	if checksum(s0, &QueryRequest{Stmts: stmtsFromString("SELECT 1"), Lvl: None, Checksum: true}) ==
+		checksum(s0, &QueryRequest{Stmts: stmtsFromString("SELECT '1'"), Lvl: None, Checksum: true}) {
+		t.Fatalf("checksum of integer and text are the same")
+	}
+
+	// A change made to one node alone is detected.
+	if _, err := s1.db.ExecuteStringStmt(`UPDATE foo SET name = "declan" WHERE id = 1`); err != nil {
+		t.Fatalf("failed to change follower: %s", err.Error())
+	}
+	if got := checksum(s1, qr); got == sum {
+		t.Fatalf("checksum unchanged by change to data")
+	}
+
+	r, err := s0.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query leader: %s", err.Error())
+	}
+	if r[0].Checksum != "" {
+		t.Fatalf("checksum set without being requested")
+	}
+}
+
+func Test_MultiNodeExecuteIdempotencyKey(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	_, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+
+	er := &ExecuteRequest{
+		Stmts:          stmtsFromString(`INSERT INTO foo(name) VALUES("fiona")`),
+		IdempotencyKey: "insert-fiona",
+	}
+	first, err := s0.Execute(er)
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	second, err := s0.Execute(er)
+	if err != nil {
+		t.Fatalf("failed to retry execute on leader: %s", err.Error())
+	}
+	if exp, got := asJSON(first), asJSON(second); exp != got {
+		t.Fatalf("retry did not return original results\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// A different key is applied.
+	third, err := s0.Execute(&ExecuteRequest{
+		Stmts:          stmtsFromString(`INSERT INTO foo(name) VALUES("fiona")`),
+		IdempotencyKey: "insert-fiona-again",
+	})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if err := s1.WaitForAppliedIndex(third[0].RaftIndex, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s", err.Error())
+	}
+
+	for _, s := range []*Store{s0, s1} {
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM foo`), Lvl: None})
+		if err != nil {
+			t.Fatalf("failed to query node: %s", err.Error())
+		}
+		if exp, got := `[[2]]`, asJSON(r[0].Values); exp != got {
+			t.Fatalf("unexpected row count\nexp: %s\ngot: %s", exp, got)
+		}
+	}
+
+	// Keys survive a snapshot and restore.
+	f, err := s0.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+	snapDir := mustTempDir()
+	defer os.RemoveAll(snapDir)
+	snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+	if err := f.Persist(&mockSnapshotSink{snapFile}); err != nil {
+		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	}
+	snapFile, err = os.Open(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to open snapshot file: %s", err.Error())
+	}
+	s0.restoreIdempotency(nil)
+	if err := s0.Restore(snapFile); err != nil {
+		t.Fatalf("failed to restore snapshot from disk: %s", err.Error())
+	}
+	if _, err := s0.Execute(er); err != nil {
+		t.Fatalf("failed to retry execute on leader: %s", err.Error())
+	}
+	r, err := s0.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM foo`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query node: %s", err.Error())
+	}
+	if exp, got := `[[2]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected row count after restore\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_MultiNodeQuiesce(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	er := &ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO foo(name) VALUES("fiona")`)}
+	if _, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if _, err := s0.Execute(er); err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+
+	if err := s1.Quiesce(true); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader quiescing on follower, got %v", err)
+	}
+	if err := s0.Quiesce(true); err != nil {
+		t.Fatalf("failed to quiesce cluster: %s", err.Error())
+	}
+	if err := s1.WaitForBarrier(s0.raft.LastIndex(), 5*time.Second); err != nil {
+		t.Fatalf("follower failed to apply log: %s", err.Error())
+	}
+	for _, s := range []*Store{s0, s1} {
+		if !s.Quiesced() {
+			t.Fatalf("node %s not quiesced", s.ID())
+		}
+		if _, err := s.Execute(er); err != ErrQuiesced {
+			t.Fatalf("expected ErrQuiesced executing on node %s, got %v", s.ID(), err)
+		}
+		if _, err := s.ExecuteBatch(&BatchExecuteRequest{Stmt: er.Stmts[0].Query, Parameters: [][]Value{nil}}); err != ErrQuiesced {
+			t.Fatalf("expected ErrQuiesced executing batch on node %s, got %v", s.ID(), err)
+		}
+		r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM foo`), Lvl: None})
+		if err != nil {
+			t.Fatalf("failed to query quiesced node %s: %s", s.ID(), err.Error())
+		}
+		if exp, got := `[[1]]`, asJSON(r[0].Values); exp != got {
+			t.Fatalf("unexpected row count\nexp: %s\ngot: %s", exp, got)
+		}
+	}
+
+	// A change already on its way through the log when the cluster is
+	// quiesced is refused by every node.
+	c, err := newCommand(execute, er.command())
+	if err != nil {
+		t.Fatalf("failed to create command: %s", err.Error())
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %s", err.Error())
+	}
+	f := s0.raft.Apply(b, 5*time.Second)
+	if err := f.Error(); err != nil {
+		t.Fatalf("failed to apply command: %s", err.Error())
+	}
+	if err := f.Response().(*fsmExecuteResponse).error; err != ErrQuiesced {
+		t.Fatalf("expected ErrQuiesced applying change, got %v", err)
+	}
+
+	// Nor may the database be replaced or rebuilt.
+	database, err := s0.Database(true)
+	if err != nil {
+		t.Fatalf("failed to read database: %s", err.Error())
+	}
+	if err := s0.Reload(bytes.NewReader(database)); err != ErrQuiesced {
+		t.Fatalf("expected ErrQuiesced reloading, got %v", err)
+	}
+	if err := s0.Vacuum(); err != ErrQuiesced {
+		t.Fatalf("expected ErrQuiesced vacuuming, got %v", err)
+	}
+	if err := s0.Reindex(""); err != ErrQuiesced {
+		t.Fatalf("expected ErrQuiesced reindexing, got %v", err)
+	}
+	for _, cmd := range []struct {
+		typ commandType
+		sub interface{}
+	}{{load, &loadSub{DB: database}}, {vacuum, nil}, {reindex, ""}} {
+		c, err := newCommand(cmd.typ, cmd.sub)
+		if err != nil {
+			t.Fatalf("failed to create command: %s", err.Error())
+		}
+		b, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err.Error())
+		}
+		f := s0.raft.Apply(b, 5*time.Second)
+		if err := f.Error(); err != nil {
+			t.Fatalf("failed to apply command: %s", err.Error())
+		}
+		if err := f.Response().(*fsmGenericResponse).error; err != ErrQuiesced {
+			t.Fatalf("expected ErrQuiesced applying command %v, got %v", cmd.typ, err)
+		}
+	}
+
+	// Quiescence survives a snapshot and restore.
+	snap, err := s0.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+	snapDir := mustTempDir()
+	defer os.RemoveAll(snapDir)
+	snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+	if err := snap.Persist(&mockSnapshotSink{snapFile}); err != nil {
+		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	}
+	snapFile, err = os.Open(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to open snapshot file: %s", err.Error())
+	}
+	s0.setQuiesced(false)
+	if err := s0.Restore(snapFile); err != nil {
+		t.Fatalf("failed to restore snapshot from disk: %s", err.Error())
+	}
+	if !s0.Quiesced() {
+		t.Fatalf("node not quiesced after restore")
+	}
+
+	if err := s0.Quiesce(false); err != nil {
+		t.Fatalf("failed to unquiesce cluster: %s", err.Error())
+	}
+	if err := s1.WaitForBarrier(s0.raft.LastIndex(), 5*time.Second); err != nil {
+		t.Fatalf("follower failed to apply log: %s", err.Error())
+	}
+	if s1.Quiesced() {
+		t.Fatalf("follower still quiesced")
+	}
+	if _, err := s0.Execute(er); err != nil {
+		t.Fatalf("failed to execute on unquiesced leader: %s", err.Error())
+	}
+}
+
+func Test_MultiNodeOnApplyError(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	type applyErr struct {
+		index uint64
+		err   error
+	}
+	errCh := make(chan applyErr, 10)
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	s1.OnApplyError = func(index uint64, err error) {
+		errCh <- applyErr{index, err}
+	}
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	results, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO bar(id, name) VALUES(1, "fiona")`,
+	})})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if results[1].Error == "" {
+		t.Fatalf("expected insert into missing table to fail")
+	}
+
+	select {
+	case ae := <-errCh:
+		if ae.index != results[1].RaftIndex {
+			t.Fatalf("wrong index for apply error, exp %d, got %d", results[1].RaftIndex, ae.index)
+		}
+		var e *ApplyError
+		if !errors.As(ae.err, &e) {
+			t.Fatalf("expected *ApplyError, got %T", ae.err)
+		}
+		if exp, got := `INSERT INTO bar(id, name) VALUES(1, "fiona")`, e.Statement; exp != got {
+			t.Fatalf("wrong statement for apply error, exp %s, got %s", exp, got)
+		}
+		if exp, got := "no such table: bar", e.Err.Error(); exp != got {
+			t.Fatalf("wrong apply error, exp %s, got %s", exp, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for apply error on follower")
+	}
+
+	// Successful statements are not reported.
+	results, err = s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO foo(id, name) VALUES(1, "fiona")`)})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if err := s1.WaitForAppliedIndex(results[0].RaftIndex, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s", err.Error())
+	}
+	select {
+	case ae := <-errCh:
+		t.Fatalf("unexpected apply error at index %d: %v", ae.index, ae.err)
+	default:
+	}
+}
+
+func Test_MultiNodeQueryMixedLevels(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+
+	results, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if err := s1.WaitForAppliedIndex(results[1].RaftIndex, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s", err.Error())
+	}
+
+	strong := Strong
+	mixed := func() []Statement {
+		stmts := stmtsFromStrings([]string{`SELECT name FROM foo`, `SELECT COUNT(*) FROM foo`, `SELECT id FROM foo`})
+		stmts[1].Lvl = &strong
+		return stmts
+	}
+
+	// Only the overridden statement is read through the log.
+	idx := s0.raft.AppliedIndex()
+	r, err := s0.Query(&QueryRequest{Stmts: mixed(), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query leader with mixed levels: %s", err.Error())
+	}
+	if exp, got := `[{"columns":["name"],"types":["text"],"values":[["fiona"]]},{"columns":["COUNT(*)"],"types":[""],"values":[[1]]},{"columns":["id"],"types":["integer"],"values":[[1]]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for mixed query\nexp: %s\ngot: %s", exp, got)
+	}
+	if got := s0.raft.AppliedIndex(); got != idx+1 {
+		t.Fatalf("expected one log entry for mixed query, applied index went from %d to %d", idx, got)
+	}
+
+	// A statement requiring Strong fails the request on a follower.
+	if _, err := s1.Query(&QueryRequest{Stmts: mixed(), Lvl: None}); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader for mixed query on follower, got %v", err)
+	}
+
+	// Statements overridden to None may be read on a follower.
+	none := None
+	stmts := stmtsFromStrings([]string{`SELECT name FROM foo`})
+	stmts[0].Lvl = &none
+	r, err = s1.Query(&QueryRequest{Stmts: stmts, Lvl: Strong})
+	if err != nil {
+		t.Fatalf("failed to query follower with None override: %s", err.Error())
+	}
+	if exp, got := `[{"columns":["name"],"types":["text"],"values":[["fiona"]]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for None override\nexp: %s\ngot: %s", exp, got)
+	}
+
+	if _, err := s0.Query(&QueryRequest{Stmts: mixed(), Lvl: None, Tx: true}); err != ErrMixedLevelTx {
+		t.Fatalf("expected ErrMixedLevelTx, got %v", err)
+	}
+}
+
+// Test_SingleNodeLeaderLease checks that a lease is only held once an entry
+// of the current term has been applied, and is lost on any change of state.
+func Test_SingleNodeLeaderLease(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	// Verifying leadership alone does not show that entries of earlier
+	// terms have been applied.
+	s.observeState(&raft.Observation{Data: raft.Leader})
+	if !s.confirmLeadership(0) {
+		t.Fatalf("failed to confirm leadership")
+	}
+	if s.leaseValid() {
+		t.Fatalf("lease valid before any entry of the term applied")
+	}
+
+	epoch := s.leaderEpoch()
+	if err := s.readBarrier(context.Background()); err != nil {
+		t.Fatalf("failed to commit barrier: %s", err.Error())
+	}
+	if !s.leaseValid() {
+		t.Fatalf("lease not valid after barrier applied")
+	}
+
+	// A change of state discards the lease, and any confirmation begun
+	// before the change.
+	s.observeState(&raft.Observation{Data: raft.Follower})
+	if s.leaseValid() {
+		t.Fatalf("lease valid after change of state")
+	}
+	s.setLeaderConfirmed(epoch, time.Now(), true)
+	if s.leaseValid() {
+		t.Fatalf("lease valid from confirmation of earlier epoch")
+	}
+}
+
+func Test_MultiNodeQueryLinearizableLease(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if _, err := s1.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("failed to wait for leader on follower: %s", err.Error())
+	}
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	if _, err := s0.Execute(&ExecuteRequest{Stmts: queries}); err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+
+	query := func(lvl ConsistencyLevel) {
+		r, err := s0.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Lvl: lvl})
+		if err != nil {
+			t.Fatalf("failed to query leader at level %d: %s", lvl, err.Error())
+		}
+		if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+			t.Fatalf("unexpected results for query at level %d\nexp: %s\ngot: %s", lvl, exp, got)
+		}
+	}
+
+	// The write just confirmed leadership, so the lease is valid, and the
+	// read is served locally, like a Weak read, without a Raft round trip.
+	idx := s0.raft.LastIndex()
+	query(LinearizableLease)
+	if exp, got := idx, s0.raft.LastIndex(); exp != got {
+		t.Fatalf("lease read went through the log, exp last index %d, got %d", exp, got)
+	}
+
+	// A Strong read always goes through the log.
+	query(Strong)
+	if exp, got := idx+1, s0.raft.LastIndex(); exp != got {
+		t.Fatalf("strong read did not go through the log, exp last index %d, got %d", exp, got)
+	}
+
+	// Once the lease has expired, the read falls back to a Strong read.
+	time.Sleep(raft.DefaultConfig().LeaderLeaseTimeout + 100*time.Millisecond)
+	query(LinearizableLease)
+	if exp, got := idx+2, s0.raft.LastIndex(); exp != got {
+		t.Fatalf("expired lease read did not go through the log, exp last index %d, got %d", exp, got)
+	}
+
+	_, err := s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Lvl: LinearizableLease})
+	if !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader from follower, got %v", err)
+	}
+}
+
+func Test_MultiNodeQueryLinearizable(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	stores := []*Store{s0}
+	for i := 0; i < 2; i++ {
+		s := mustNewStore(true)
+		defer os.RemoveAll(s.Path())
+		if err := s.Open(false); err != nil {
+			t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+		}
+		defer s.Close(true)
+		if err := s0.Join(s.ID(), s.Addr(), true, nil); err != nil {
+			t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+		}
+		if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+			t.Fatalf("failed to wait for leader on follower: %s", err.Error())
+		}
+		stores = append(stores, s)
+	}
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	if _, err := s0.Execute(&ExecuteRequest{Stmts: queries}); err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+
+	// Read from the new leader as soon as it is elected, before it has
+	// necessarily applied the write.
+	if err := s0.Stepdown(true); err != nil {
+		t.Fatalf("failed to step down leader: %s", err.Error())
+	}
+	var leader *Store
+	for leader == nil {
+		for _, s := range stores[1:] {
+			if s.IsLeader() {
+				leader = s
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	idx := leader.raft.LastIndex()
+	r, err := leader.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Lvl: Linearizable})
+	if err != nil {
+		t.Fatalf("failed to query new leader: %s", err.Error())
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Only the barrier, not the read, is written to the log.
+	if exp, got := idx+1, leader.raft.LastIndex(); exp != got {
+		t.Fatalf("unexpected last index after read, exp %d, got %d", exp, got)
+	}
+	var l raft.Log
+	if err := leader.raftLog.GetLog(leader.raft.LastIndex(), &l); err != nil {
+		t.Fatalf("failed to get last log entry: %s", err.Error())
+	}
+	if l.Type != raft.LogBarrier {
+		t.Fatalf("unexpected type of last log entry, exp %d, got %d", raft.LogBarrier, l.Type)
+	}
+
+	_, err = s0.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Lvl: Linearizable})
+	if !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader from follower, got %v", err)
+	}
+}
+
+func Test_MultiNodeExecuteRaftIndex(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	results, err := s0.Execute(&ExecuteRequest{Stmts: queries})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	idx := results[1].RaftIndex
+	if idx == 0 {
+		t.Fatalf("execute result has zero raft index")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s1.WaitForAppliedIndexContext(ctx, idx); err != nil {
+		t.Fatalf("error waiting for follower to apply index %d: %s", idx, err.Error())
+	}
+	r, err := s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query follower node: %s", err.Error())
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// A failed execute returns no results, and so no index.
+	results, err = s1.Execute(&ExecuteRequest{Stmts: queries})
+	if err == nil {
+		t.Fatalf("successfully executed on follower")
+	}
+	if results != nil {
+		t.Fatalf("failed execute returned results: %s", asJSON(results))
+	}
+}
+
+func Test_MultiNodeExecuteQuery(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	s2 := mustNewStore(true)
+	defer os.RemoveAll(s2.Path())
+	if err := s2.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s2.Close(true)
+
+	// Join the second node to the first as a voting node.
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+
+	// Join the third node to the first as a non-voting node.
+	if err := s0.Join(s2.ID(), s2.Addr(), false, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	_, err := s0.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	r, err := s0.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query leader node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Wait until the 3 log entries have been applied to the voting follower,
+	// and then query.
+	if err := s1.WaitForAppliedIndex(3, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+	}
+	r, err = s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: Weak, Freshness: 0})
+	if err == nil {
+		t.Fatalf("successfully queried non-leader node")
+	}
+	r, err = s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: Strong, Freshness: 0})
+	if err == nil {
+		t.Fatalf("successfully queried non-leader node")
+	}
+	r, err = s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query follower node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Wait until the 3 log entries have been applied to the non-voting follower,
+	// and then query.
+	if err := s2.WaitForAppliedIndex(3, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+	}
+	r, err = s2.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: Weak, Freshness: 0})
+	if err == nil {
+		t.Fatalf("successfully queried non-voting node with Weak")
+	}
+	r, err = s2.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: Strong, Freshness: 0})
+	if err == nil {
+		t.Fatalf("successfully queried non-voting node with Strong")
+	}
+	r, err = s2.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query non-voting node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_MultiNodeQueryWeakFreshness(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	var followers []*Store
+	for i := 0; i < 2; i++ {
+		s := mustNewStore(true)
+		defer os.RemoveAll(s.Path())
+		if err := s.Open(false); err != nil {
+			t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+		}
+		defer s.Close(true)
+		if err := s0.Join(s.ID(), s.Addr(), true, nil); err != nil {
+			t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+		}
+		s.WaitForLeader(10 * time.Second)
+		followers = append(followers, s)
+	}
+
+	if _, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+
+	qr := &QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Lvl: Weak, Freshness: 100 * time.Millisecond}
+	if _, err := s0.Query(qr); err != nil {
+		t.Fatalf("failed to perform fresh Weak read on connected leader: %s", err.Error())
+	}
+
+	// Partition the leader from the rest of the cluster.
+	for _, s := range followers {
+		if err := s.Close(true); err != nil {
+			t.Fatalf("failed to close follower: %s", err.Error())
+		}
+	}
+	time.Sleep(2 * qr.Freshness)
+
+	_, err := s0.Query(qr)
+	if err != ErrStaleRead && !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected fresh Weak read on partitioned leader to fail, got %v", err)
+	}
+
+	// Without a freshness bound, a Weak read is still served while the
+	// node believes it is the leader.
+	if s0.raft.State() == raft.Leader {
+		qr.Freshness = 0
+		if _, err := s0.Query(qr); err != nil && !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("unexpected error for Weak read without freshness: %s", err.Error())
+		}
+	}
+}
+
+func Test_MultiNodeExecuteQueryFreshness(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	// Join the second node to the first.
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	_, err := s0.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	r, err := s0.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query leader node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Wait until the 3 log entries have been applied to the follower,
+	// and then query.
+	if err := s1.WaitForAppliedIndex(3, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+	}
+
+	// "Weak" consistency queries with 1 nanosecond freshness should pass, because the
+	// leader verifies its leadership with the reachable follower.
+	r, err = s0.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: Weak, Freshness: mustParseDuration("1ns")})
+	if err != nil {
+		t.Fatalf("Failed to verify leadership for freshness if level is Weak: %s", err.Error())
+	}
+	// "Strong" consistency queries with 1 nanosecond freshness should pass, because freshness
+	// is ignored in this case.
+	r, err = s0.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: Strong, Freshness: mustParseDuration("1ns")})
+	if err != nil {
+		t.Fatalf("Failed to ignore freshness if level is Strong: %s", err.Error())
+	}
+
+	// Kill leader.
+	s0.Close(true)
+
+	// "None" consistency queries should still work.
+	r, err = s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query follower node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Wait for the freshness interval to pass.
+	time.Sleep(mustParseDuration("1s"))
+
+	// "None" consistency queries with 1 nanosecond freshness should fail, because at least
+	// one nanosecond *should* have passed since leader died (surely!).
+	r, err = s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: mustParseDuration("1ns")})
+	if err == nil {
+		t.Fatalf("freshness violating query didn't return an error")
+	}
+	if err != ErrStaleRead {
+		t.Fatalf("freshness violating query didn't returned wrong error: %s", err.Error())
+	}
+
+	// Freshness of 0 is ignored.
+	r, err = s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query follower node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// "None" consistency queries with 1 hour freshness should pass, because it should
+	// not be that long since the leader died.
+	r, err = s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: mustParseDuration("1h")})
+	if err != nil {
+		t.Fatalf("failed to query follower node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_StoreLogTruncationMultinode(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	s0.SnapshotThreshold = 4
+	s0.SnapshotInterval = 100 * time.Millisecond
+
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+	nSnaps := stats.Get(numSnaphots).String()
+
+	// Write more than s.SnapshotThreshold statements.
+	queries := []string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+		`INSERT INTO foo(id, name) VALUES(2, "fiona")`,
+		`INSERT INTO foo(id, name) VALUES(3, "fiona")`,
+		`INSERT INTO foo(id, name) VALUES(4, "fiona")`,
+		`INSERT INTO foo(id, name) VALUES(5, "fiona")`,
+	}
+	for i := range queries {
+		_, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(queries[i]), Timings: false, Tx: false})
+		if err != nil {
+			t.Fatalf("failed to execute on single node: %s", err.Error())
+		}
+	}
+
+	// Wait for the snapshot to happen and log to be truncated.
 	f := func() bool {
 		return stats.Get(numSnaphots).String() != nSnaps
 	}
-	testPoll(t, f, 100*time.Millisecond, 2*time.Second)
+	testPoll(t, f, 100*time.Millisecond, 2*time.Second)
+
+	// Fire up new node and ensure it picks up all changes. This will
+	// involve getting a snapshot and truncated log.
+	s1 := mustNewStore(true)
+	if err := s1.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	// Join the second node to the first.
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+	// Wait until the log entries have been applied to the follower,
+	// and then query.
+	if err := s1.WaitForAppliedIndex(8, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+	}
+	r, err := s1.Query(&QueryRequest{Stmts: stmtsFromString("SELECT count(*) FROM foo"), Timings: false, Tx: true, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `["count(*)"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[5]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeSnapshotThresholdRuntime(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	s.SetSnapshotThreshold(4)
+	s.SetSnapshotInterval(100 * time.Millisecond)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	for i := 0; i < 10; i++ {
+		_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO foo(name) VALUES("fiona")`)})
+		if err != nil {
+			t.Fatalf("failed to execute on single node: %s", err.Error())
+		}
+	}
+
+	// The original snapshot interval is 2 minutes, so any snapshot within the
+	// poll period must be due to the new settings.
+	testPoll(t, func() bool {
+		st, err := s.Stats()
+		if err != nil {
+			return false
+		}
+		return st["num_snapshots"].(int64) > 0
+	}, 100*time.Millisecond, 10*time.Second)
+}
+
+func Test_SingleNodeRestoreInvalid(t *testing.T) {
+	for _, inmem := range []bool{true, false} {
+		func() {
+			s := mustNewStore(inmem)
+			defer os.RemoveAll(s.Path())
+
+			if err := s.Open(true); err != nil {
+				t.Fatalf("failed to open single-node store: %s", err.Error())
+			}
+			defer s.Close(true)
+			s.WaitForLeader(10 * time.Second)
+
+			queries := stmtsFromStrings([]string{
+				`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+				`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+			})
+			if _, err := s.Execute(&ExecuteRequest{Stmts: queries}); err != nil {
+				t.Fatalf("failed to execute on single node: %s", err.Error())
+			}
+
+			f, err := s.Snapshot()
+			if err != nil {
+				t.Fatalf("failed to snapshot node: %s", err.Error())
+			}
+			snapDir := mustTempDir()
+			defer os.RemoveAll(snapDir)
+			snapPath := filepath.Join(snapDir, "snapshot")
+			snapFile, err := os.Create(snapPath)
+			if err != nil {
+				t.Fatalf("failed to create snapshot file: %s", err.Error())
+			}
+			if err := f.Persist(&mockSnapshotSink{snapFile}); err != nil {
+				t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+			}
+			snap, err := ioutil.ReadFile(snapPath)
+			if err != nil {
+				t.Fatalf("failed to read snapshot file: %s", err.Error())
+			}
+
+			// Corrupt the database, keeping the snapshot the same length.
+			corrupt := make([]byte, len(snap))
+			copy(corrupt, snap)
+			for i := 8 + 1024; i < len(corrupt)-64; i++ {
+				corrupt[i] = 0xff
+			}
+
+			for name, b := range map[string][]byte{
+				"truncated": snap[:len(snap)/2],
+				"corrupt":   corrupt,
+			} {
+				if err := s.Restore(ioutil.NopCloser(bytes.NewReader(b))); err == nil {
+					t.Fatalf("restored from %s snapshot (in-memory %v)", name, inmem)
+				}
+				r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Lvl: None})
+				if err != nil {
+					t.Fatalf("failed to query single node: %s", err.Error())
+				}
+				if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+					t.Fatalf("unexpected results after %s restore (in-memory %v)\nexp: %s\ngot: %s", name, inmem, exp, got)
+				}
+			}
+
+			// The store is still writable.
+			if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`INSERT INTO foo(id, name) VALUES(2, "declan")`)}); err != nil {
+				t.Fatalf("failed to insert after failed restores: %s", err.Error())
+			}
+		}()
+	}
+}
+
+func Test_SingleNodeSnapshotOnDisk(t *testing.T) {
+	s := mustNewStore(false)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	_, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	_, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+
+	// Snap the node and write to disk.
+	f, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+
+	snapDir := mustTempDir()
+	defer os.RemoveAll(snapDir)
+	snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+	sink := &mockSnapshotSink{snapFile}
+	if err := f.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	}
+
+	// Check restoration.
+	snapFile, err = os.Open(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to open snapshot file: %s", err.Error())
+	}
+	if err := s.Restore(snapFile); err != nil {
+		t.Fatalf("failed to restore snapshot from disk: %s", err.Error())
+	}
+
+	// Ensure database is back in the correct state.
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeSnapshotInMem(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	_, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	_, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+
+	// Snap the node and write to disk.
+	f, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+
+	snapDir := mustTempDir()
+	defer os.RemoveAll(snapDir)
+	snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+	sink := &mockSnapshotSink{snapFile}
+	if err := f.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	}
+
+	// Check restoration.
+	snapFile, err = os.Open(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to open snapshot file: %s", err.Error())
+	}
+	if err := s.Restore(snapFile); err != nil {
+		t.Fatalf("failed to restore snapshot from disk: %s", err.Error())
+	}
+
+	// Ensure database is back in the correct state.
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Timings: false, Tx: false, Lvl: None, Freshness: 0})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeCancelSnapshot(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if s.CancelSnapshot() {
+		t.Fatal("cancelled snapshot when none in progress")
+	}
+
+	// Make the database bigger than a single write to the sink.
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, data BLOB)`,
+		`WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c WHERE x < 4096) INSERT INTO foo(data) SELECT randomblob(1024) FROM c`,
+	})
+	if _, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	f, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+	snapDir := mustTempDir()
+	defer os.RemoveAll(snapDir)
+	snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+
+	var inProgress bool
+	sink := &cancellingSnapshotSink{
+		mockSnapshotSink: mockSnapshotSink{snapFile},
+		onWrite:          func() { inProgress = s.CancelSnapshot() },
+	}
+	if err := f.Persist(sink); err != ErrSnapshotCancelled {
+		t.Fatalf("expected snapshot to be cancelled, got: %v", err)
+	}
+	if !inProgress {
+		t.Fatal("snapshot not reported as in progress")
+	}
+	if !sink.cancelled || sink.closed {
+		t.Fatalf("partial snapshot not discarded, cancelled: %v, closed: %v", sink.cancelled, sink.closed)
+	}
+	if s.CancelSnapshot() {
+		t.Fatal("cancelled snapshot after persist returned")
+	}
+
+	// A later snapshot is unaffected.
+	snapFile, err = os.Create(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+	if err := f.Persist(&mockSnapshotSink{snapFile}); err != nil {
+		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	}
+}
+
+func Test_SingleNodeSnapshotExclude(t *testing.T) {
+	s := mustNewStoreWithConfig(true, &StoreConfig{SnapshotExclude: []string{"cache_"}})
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+		`CREATE TABLE cache_foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`CREATE INDEX cache_foo_name ON cache_foo(name)`,
+		`INSERT INTO cache_foo(id, name) VALUES(1, "fiona")`,
+	})
+	_, err := s.Execute(&ExecuteRequest{Stmts: queries, Timings: false, Tx: false})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	f, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+	snapDir := mustTempDir()
+	defer os.RemoveAll(snapDir)
+	snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+	sink := &mockSnapshotSink{snapFile}
+	if err := f.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	}
+
+	// The live database still holds the excluded table.
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM cache_foo"), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	snapFile, err = os.Open(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to open snapshot file: %s", err.Error())
+	}
+	if err := s.Restore(snapFile); err != nil {
+		t.Fatalf("failed to restore snapshot from disk: %s", err.Error())
+	}
+
+	r, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM foo"), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	r, err = s.Query(&QueryRequest{Stmts: stmtsFromString("SELECT * FROM cache_foo"), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := "no such table: cache_foo", r[0].Error; exp != got {
+		t.Fatalf("excluded table restored\nexp: %s\ngot: %s", exp, got)
+	}
+	r, err = s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM sqlite_master WHERE name LIKE 'cache_%'`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[0]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("excluded schema restored\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeAttachedDatabases(t *testing.T) {
+	for _, inmem := range []bool{true, false} {
+		func() {
+			dbConf := NewDBConfig("", inmem)
+			dbConf.Attach = []AttachedDB{{Name: "archive", Memory: inmem}, {Name: "extra", Memory: true}}
+			s := mustNewStoreWithConfig(inmem, &StoreConfig{DBConf: dbConf})
+			defer os.RemoveAll(s.Path())
+			if err := s.Open(true); err != nil {
+				t.Fatalf("failed to open single-node store: %s", err.Error())
+			}
+			defer s.Close(true)
+			s.WaitForLeader(10 * time.Second)
+
+			_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+				`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+				`CREATE TABLE archive.foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+				`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+				`INSERT INTO archive.foo(id, name) VALUES(2, "declan")`,
+			})})
+			if err != nil {
+				t.Fatalf("failed to execute on single node: %s", err.Error())
+			}
+
+			query := `SELECT * FROM main.foo UNION ALL SELECT * FROM archive.foo ORDER BY id`
+			exp := `[{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"],[2,"declan"]]}]`
+			r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(query), Lvl: None})
+			if err != nil {
+				t.Fatalf("failed to query single node: %s", err.Error())
+			}
+			if got := asJSON(r); exp != got {
+				t.Fatalf("unexpected results across databases, in-memory %t\nexp: %s\ngot: %s", inmem, exp, got)
+			}
+
+			// The attached databases are included in snapshots.
+			f, err := s.Snapshot()
+			if err != nil {
+				t.Fatalf("failed to snapshot node: %s", err.Error())
+			}
+			snapDir := mustTempDir()
+			defer os.RemoveAll(snapDir)
+			snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
+			if err != nil {
+				t.Fatalf("failed to create snapshot file: %s", err.Error())
+			}
+			if err := f.Persist(&mockSnapshotSink{snapFile}); err != nil {
+				t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+			}
+			if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`DELETE FROM archive.foo`)}); err != nil {
+				t.Fatalf("failed to delete archived rows: %s", err.Error())
+			}
+			snapFile, err = os.Open(filepath.Join(snapDir, "snapshot"))
+			if err != nil {
+				t.Fatalf("failed to open snapshot file: %s", err.Error())
+			}
+			if err := s.Restore(snapFile); err != nil {
+				t.Fatalf("failed to restore snapshot from disk: %s", err.Error())
+			}
+			r, err = s.Query(&QueryRequest{Stmts: stmtsFromString(query), Lvl: None})
+			if err != nil {
+				t.Fatalf("failed to query single node: %s", err.Error())
+			}
+			if got := asJSON(r); exp != got {
+				t.Fatalf("unexpected results after restore, in-memory %t\nexp: %s\ngot: %s", inmem, exp, got)
+			}
+
+			// Backups cover only the main database.
+			var buf bytes.Buffer
+			if err := s.Backup(true, BackupSQL, &buf); err != nil {
+				t.Fatalf("failed to back up: %s", err.Error())
+			}
+			if strings.Contains(buf.String(), "declan") {
+				t.Fatalf("backup includes attached database: %s", buf.String())
+			}
+		}()
+	}
+
+	dbConf := NewDBConfig("", true)
+	dbConf.Attach = []AttachedDB{{Name: "main", Memory: true}}
+	s := mustNewStoreWithConfig(true, &StoreConfig{DBConf: dbConf})
+	defer os.RemoveAll(s.Path())
+	if err := s.Open(true); !errors.Is(err, ErrInvalidAttachment) {
+		t.Fatalf("expected ErrInvalidAttachment, got %v", err)
+	}
+}
+
+func Test_SingleNodeRestoreAttachedMismatch(t *testing.T) {
+	dbConf := NewDBConfig("", true)
+	dbConf.Attach = []AttachedDB{{Name: "archive", Memory: true}}
+	s := mustNewStoreWithConfig(true, &StoreConfig{DBConf: dbConf})
+	defer os.RemoveAll(s.Path())
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	_, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+		`CREATE TABLE archive.foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO archive.foo(id, name) VALUES(1, "fiona")`,
+	})})
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	f, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+	snapDir := mustTempDir()
+	defer os.RemoveAll(snapDir)
+	snapPath := filepath.Join(snapDir, "snapshot")
+	snapFile, err := os.Create(snapPath)
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+	if err := f.Persist(&mockSnapshotSink{snapFile}); err != nil {
+		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	}
+	snap, err := ioutil.ReadFile(snapPath)
+	if err != nil {
+		t.Fatalf("failed to read snapshot file: %s", err.Error())
+	}
+
+	// Nodes attaching other databases, or none, refuse the snapshot.
+	for _, attach := range [][]AttachedDB{nil, {{Name: "other", Memory: true}}} {
+		func() {
+			dbConf := NewDBConfig("", true)
+			dbConf.Attach = attach
+			s := mustNewStoreWithConfig(true, &StoreConfig{DBConf: dbConf})
+			defer os.RemoveAll(s.Path())
+			if err := s.Open(true); err != nil {
+				t.Fatalf("failed to open single-node store: %s", err.Error())
+			}
+			defer s.Close(true)
+			s.WaitForLeader(10 * time.Second)
+
+			err := s.Restore(ioutil.NopCloser(bytes.NewReader(snap)))
+			if err != ErrSnapshotAttachments {
+				t.Fatalf("expected ErrSnapshotAttachments for %v, got %v", attach, err)
+			}
+		}()
+	}
+
+	// A corrupt attached database size fails, rather than allocating it.
+	corrupt := append([]byte(nil), snap...)
+	sz := binary.LittleEndian.Uint64(corrupt)
+	off := 8 + int(sz) + 1 + 8
+	off += 8 + int(binary.LittleEndian.Uint64(corrupt[off:]))
+	binary.LittleEndian.PutUint64(corrupt[off:], math.MaxInt64)
+	if err := s.Restore(ioutil.NopCloser(bytes.NewReader(corrupt))); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF for corrupt size, got %v", err)
+	}
+
+	// The snapshot itself still restores.
+	if err := s.Restore(ioutil.NopCloser(bytes.NewReader(snap))); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err.Error())
+	}
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM archive.foo`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[{"columns":["COUNT(*)"],"types":[""],"values":[[1]]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results after restore\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_MetadataMultinode(t *testing.T) {
+	s0 := mustNewStore(true)
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+	s1 := mustNewStore(true)
+	if err := s1.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s1.Close(true)
+	s1.WaitForLeader(10 * time.Second)
+
+	if s0.Metadata(s0.raftID, "foo") != "" {
+		t.Fatal("nonexistent metadata foo found")
+	}
+	if s0.Metadata("nonsense", "foo") != "" {
+		t.Fatal("nonexistent metadata foo found for nonexistent node")
+	}
+
+	if err := s0.SetMetadata(map[string]string{"foo": "bar"}); err != nil {
+		t.Fatalf("failed to set metadata: %s", err.Error())
+	}
+	if s0.Metadata(s0.raftID, "foo") != "bar" {
+		t.Fatal("key foo not found")
+	}
+	if s0.Metadata("nonsense", "foo") != "" {
+		t.Fatal("nonexistent metadata foo found for nonexistent node")
+	}
+
+	// Join the second node to the first.
+	meta := map[string]string{"baz": "qux"}
+	if err := s0.Join(s1.ID(), s1.Addr(), true, meta); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	s1.WaitForLeader(10 * time.Second)
+	// Wait until the log entries have been applied to the follower,
+	// and then query.
+	if err := s1.WaitForAppliedIndex(5, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+	}
+
+	if s1.Metadata(s0.raftID, "foo") != "bar" {
+		t.Fatal("key foo not found for s0")
+	}
+	if s0.Metadata(s1.raftID, "baz") != "qux" {
+		t.Fatal("key baz not found for s1")
+	}
+
+	// Remove a node.
+	if err := s0.Remove(s1.ID()); err != nil {
+		t.Fatalf("failed to remove %s from cluster: %s", s1.ID(), err.Error())
+	}
+	if s1.Metadata(s0.raftID, "foo") != "bar" {
+		t.Fatal("key foo not found for s0")
+	}
+	if s0.Metadata(s1.raftID, "baz") != "" {
+		t.Fatal("key baz found for removed node s1")
+	}
+}
+
+// Test_MultiNodeWatchMetadata checks that changes to metadata, made through
+// the leader, are reported to a subscriber on a follower.
+func Test_MultiNodeWatchMetadata(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	ch, cancel := s1.WatchMetadata()
+	defer cancel()
+
+	s2 := mustNewStore(true)
+	defer os.RemoveAll(s2.Path())
+	if err := s2.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s2.Close(true)
+
+	// expect waits for the next event for the given node, skipping events
+	// for any other node.
+	expect := func(typ MetadataEventType, id string, data map[string]string) {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case ev := <-ch:
+				if ev.ID != id {
+					continue
+				}
+				if ev.Type != typ || fmt.Sprint(ev.Data) != fmt.Sprint(data) {
+					t.Fatalf("wrong event for %s, exp %s %v, got %s %v", id, typ, data, ev.Type, ev.Data)
+				}
+				return
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s event for %s", typ, id)
+			}
+		}
+	}
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, map[string]string{"baz": "qux"}); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if _, err := s1.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("error waiting for leader: %s", err)
+	}
+	expect(MetadataNodeAdded, s1.ID(), map[string]string{"baz": "qux"})
+
+	if err := s0.SetMetadata(map[string]string{"foo": "bar"}); err != nil {
+		t.Fatalf("failed to set metadata: %s", err.Error())
+	}
+	expect(MetadataNodeAdded, s0.ID(), map[string]string{"foo": "bar"})
+
+	if err := s0.SetMetadata(map[string]string{"foo": "bar", "qux": "quux"}); err != nil {
+		t.Fatalf("failed to set metadata: %s", err.Error())
+	}
+	expect(MetadataKeysSet, s0.ID(), map[string]string{"qux": "quux"})
+
+	if err := s0.Join(s2.ID(), s2.Addr(), false, map[string]string{"a": "b"}); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	expect(MetadataNodeAdded, s2.ID(), map[string]string{"a": "b"})
+
+	if err := s0.Remove(s2.ID()); err != nil {
+		t.Fatalf("failed to remove %s from cluster: %s", s2.ID(), err.Error())
+	}
+	expect(MetadataNodeRemoved, s2.ID(), map[string]string{"a": "b"})
+
+	// A cancelled subscription's channel is closed, and gets no more events.
+	cancelled, cancel2 := s1.WatchMetadata()
+	cancel2()
+	cancel2()
+	if err := s0.SetMetadata(map[string]string{"foo": "baz"}); err != nil {
+		t.Fatalf("failed to set metadata: %s", err.Error())
+	}
+	expect(MetadataKeysSet, s0.ID(), map[string]string{"foo": "baz"})
+	if _, ok := <-cancelled; ok {
+		t.Fatalf("cancelled subscription received event")
+	}
+
+	// Closing the store closes every channel.
+	if err := s1.Close(true); err != nil {
+		t.Fatalf("failed to close node: %s", err.Error())
+	}
+	for range ch {
+	}
+	if closed, _ := s1.WatchMetadata(); !isClosed(closed) {
+		t.Fatalf("subscription to closed store not closed")
+	}
+}
+
+// isClosed returns whether ch is closed, and has no events left.
+func isClosed(ch <-chan MetadataEvent) bool {
+	select {
+	case _, ok := <-ch:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func Test_MultiNodeAllMetadata(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
 
-	// Fire up new node and ensure it picks up all changes. This will
-	// involve getting a snapshot and truncated log.
 	s1 := mustNewStore(true)
-	if err := s1.Open(true); err != nil {
-		t.Fatalf("failed to open single-node store: %s", err.Error())
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
 	}
 	defer s1.Close(true)
 
-	// Join the second node to the first.
-	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
-		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	if exp, got := "{}", asJSON(s0.AllMetadata()); exp != got {
+		t.Fatalf("unexpected metadata before any set\nexp: %s\ngot: %s", exp, got)
 	}
-	s1.WaitForLeader(10 * time.Second)
-	// Wait until the log entries have been applied to the follower,
-	// and then query.
-	if err := s1.WaitForAppliedIndex(8, 5*time.Second); err != nil {
-		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+
+	if err := s0.SetMetadata(map[string]string{"foo": "bar"}); err != nil {
+		t.Fatalf("failed to set metadata: %s", err.Error())
 	}
-	r, err := s1.Query(&QueryRequest{stmtsFromString("SELECT count(*) FROM foo"), false, true, None, 0})
-	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
+	if err := s0.Join(s1.ID(), s1.Addr(), true, map[string]string{"baz": "qux"}); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
 	}
-	if exp, got := `["count(*)"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if err := s1.WaitForAppliedIndex(s0.AppliedIndex(), 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s", err.Error())
 	}
-	if exp, got := `[[5]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+
+	for _, s := range []*Store{s0, s1} {
+		md := s.AllMetadata()
+		if len(md) != 2 {
+			t.Fatalf("wrong number of nodes in metadata, exp 2, got %d: %s", len(md), asJSON(md))
+		}
+		if exp, got := `{"foo":"bar"}`, asJSON(md[s0.ID()]); exp != got {
+			t.Fatalf("unexpected metadata for s0\nexp: %s\ngot: %s", exp, got)
+		}
+		if exp, got := `{"baz":"qux"}`, asJSON(md[s1.ID()]); exp != got {
+			t.Fatalf("unexpected metadata for s1\nexp: %s\ngot: %s", exp, got)
+		}
+
+		// The returned maps are copies.
+		md[s0.ID()]["foo"] = "changed"
+		if s.Metadata(s0.ID(), "foo") != "bar" {
+			t.Fatal("metadata changed through AllMetadata result")
+		}
 	}
 }
 
-func Test_SingleNodeSnapshotOnDisk(t *testing.T) {
-	s := mustNewStore(false)
+func Test_SingleNodeTriggerSnapshot(t *testing.T) {
+	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
 
 	if err := s.Open(true); err != nil {
@@ -921,55 +6345,86 @@ func Test_SingleNodeSnapshotOnDisk(t *testing.T) {
 		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
 		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
 	})
-	_, err := s.Execute(&ExecuteRequest{queries, false, false})
-	if err != nil {
-		t.Fatalf("failed to execute on single node: %s", err.Error())
+	for _, q := range queries {
+		if _, err := s.Execute(&ExecuteRequest{Stmts: []Statement{q}}); err != nil {
+			t.Fatalf("failed to execute on single node: %s", err.Error())
+		}
 	}
-	_, err = s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
-	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
+
+	n := atomic.LoadInt64(&s.numSnapshots)
+	if err := s.TriggerSnapshot(); err != nil {
+		t.Fatalf("failed to trigger snapshot: %s", err.Error())
+	}
+	if exp, got := n+1, atomic.LoadInt64(&s.numSnapshots); exp != got {
+		t.Fatalf("wrong number of snapshots, exp %d, got %d", exp, got)
+	}
+	if exp, got := strconv.FormatUint(s.raft.LastIndex(), 10), s.raft.Stats()["last_snapshot_index"]; exp != got {
+		t.Fatalf("wrong last snapshot index, exp %s, got %s", exp, got)
 	}
 
-	// Snap the node and write to disk.
-	f, err := s.Snapshot()
-	if err != nil {
-		t.Fatalf("failed to snapshot node: %s", err.Error())
+	// Nothing new to snapshot is not an error.
+	if err := s.TriggerSnapshot(); err != nil {
+		t.Fatalf("failed to trigger snapshot with nothing new: %s", err.Error())
 	}
+}
 
-	snapDir := mustTempDir()
-	defer os.RemoveAll(snapDir)
-	snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
+func Test_SingleNodeLastSnapshot(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	index, _, _, at, err := s.LastSnapshot()
 	if err != nil {
-		t.Fatalf("failed to create snapshot file: %s", err.Error())
+		t.Fatalf("failed to get last snapshot: %s", err.Error())
 	}
-	sink := &mockSnapshotSink{snapFile}
-	if err := f.Persist(sink); err != nil {
-		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	if index != 0 || !at.IsZero() {
+		t.Fatalf("unexpected last snapshot before any snapshot, index %d, time %s", index, at)
 	}
-
-	// Check restoration.
-	snapFile, err = os.Open(filepath.Join(snapDir, "snapshot"))
+	stats, err := s.Stats()
 	if err != nil {
-		t.Fatalf("failed to open snapshot file: %s", err.Error())
+		t.Fatalf("failed to get stats: %s", err.Error())
 	}
-	if err := s.Restore(snapFile); err != nil {
-		t.Fatalf("failed to restore snapshot from disk: %s", err.Error())
+	if _, ok := stats["last_snapshot"]; ok {
+		t.Fatalf("last snapshot in stats before any snapshot")
 	}
 
-	// Ensure database is back in the correct state.
-	r, err := s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	before := time.Now()
+	if err := s.TriggerSnapshot(); err != nil {
+		t.Fatalf("failed to trigger snapshot: %s", err.Error())
+	}
+	index, term, size, at, err := s.LastSnapshot()
 	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
+		t.Fatalf("failed to get last snapshot: %s", err.Error())
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if exp := s.raft.LastIndex(); index != exp {
+		t.Fatalf("wrong last snapshot index, exp %d, got %d", exp, index)
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	if term == 0 || size == 0 {
+		t.Fatalf("unexpected last snapshot term %d, size %d", term, size)
+	}
+	if at.Before(before.Truncate(time.Millisecond)) || at.After(time.Now()) {
+		t.Fatalf("last snapshot time %s not recent", at)
+	}
+
+	stats, err = s.Stats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %s", err.Error())
+	}
+	ls := stats["last_snapshot"].(map[string]interface{})
+	if ls["index"] != index || ls["size"] != size || ls["time"] != at {
+		t.Fatalf("unexpected last snapshot in stats: %v", ls)
 	}
 }
 
-func Test_SingleNodeSnapshotInMem(t *testing.T) {
+func Test_SingleNodeAppliedIndex(t *testing.T) {
 	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
 
@@ -979,117 +6434,213 @@ func Test_SingleNodeSnapshotInMem(t *testing.T) {
 	defer s.Close(true)
 	s.WaitForLeader(10 * time.Second)
 
-	queries := stmtsFromStrings([]string{
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
 		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
-		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
-	})
-	_, err := s.Execute(&ExecuteRequest{queries, false, false})
-	if err != nil {
-		t.Fatalf("failed to execute on single node: %s", err.Error())
-	}
-	_, err = s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
-	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
+	})}); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
 	}
 
-	// Snap the node and write to disk.
-	f, err := s.Snapshot()
-	if err != nil {
-		t.Fatalf("failed to snapshot node: %s", err.Error())
-	}
+	var last uint64
+	for i := 0; i < 5; i++ {
+		results, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings([]string{
+			`INSERT INTO foo(name) VALUES("fiona")`,
+		})})
+		if err != nil {
+			t.Fatalf("failed to insert record: %s", err.Error())
+		}
+		idx := results[0].RaftIndex
+		if idx <= last {
+			t.Fatalf("raft index did not increase, last %d, got %d", last, idx)
+		}
+		last = idx
 
-	snapDir := mustTempDir()
-	defer os.RemoveAll(snapDir)
-	snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
-	if err != nil {
-		t.Fatalf("failed to create snapshot file: %s", err.Error())
-	}
-	sink := &mockSnapshotSink{snapFile}
-	if err := f.Persist(sink); err != nil {
-		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+		if err := s.WaitForAppliedIndexContext(context.Background(), idx); err != nil {
+			t.Fatalf("failed to wait for applied index: %s", err.Error())
+		}
+		if got := s.AppliedIndex(); got < idx {
+			t.Fatalf("applied index behind write, exp at least %d, got %d", idx, got)
+		}
 	}
+}
 
-	// Check restoration.
-	snapFile, err = os.Open(filepath.Join(snapDir, "snapshot"))
-	if err != nil {
-		t.Fatalf("failed to open snapshot file: %s", err.Error())
+func Test_SingleNodeRaftTimeouts(t *testing.T) {
+	s := mustNewStoreWithConfig(true, &StoreConfig{
+		HeartbeatTimeout:   2 * time.Second,
+		ElectionTimeout:    3 * time.Second,
+		LeaderLeaseTimeout: time.Second,
+	})
+	defer os.RemoveAll(s.Path())
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	if err := s.Restore(snapFile); err != nil {
-		t.Fatalf("failed to restore snapshot from disk: %s", err.Error())
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("failed to wait for leader: %s", err.Error())
 	}
 
-	// Ensure database is back in the correct state.
-	r, err := s.Query(&QueryRequest{stmtsFromString("SELECT * FROM foo"), false, false, None, 0})
-	if err != nil {
-		t.Fatalf("failed to query single node: %s", err.Error())
+	c := s.raftConfig()
+	if c.HeartbeatTimeout != 2*time.Second || c.ElectionTimeout != 3*time.Second || c.LeaderLeaseTimeout != time.Second {
+		t.Fatalf("custom timeouts not in Raft config, heartbeat %s, election %s, lease %s",
+			c.HeartbeatTimeout, c.ElectionTimeout, c.LeaderLeaseTimeout)
 	}
-	if exp, got := `["id","name"]`, asJSON(r[0].Columns); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %s", err.Error())
+	}
+	for k, exp := range map[string]string{
+		"heartbeat_timeout":    "2s",
+		"election_timeout":     "3s",
+		"leader_lease_timeout": "1s",
+	} {
+		if got := stats[k]; got != exp {
+			t.Fatalf("wrong %s in stats, exp %s, got %v", k, exp, got)
+		}
 	}
-	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
-		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+
+	// The lease may not outlast the heartbeat timeout.
+	s1 := mustNewStoreWithConfig(true, &StoreConfig{
+		HeartbeatTimeout:   100 * time.Millisecond,
+		LeaderLeaseTimeout: time.Second,
+	})
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(true); err != ErrInvalidRaftTimeouts {
+		t.Fatalf("expected ErrInvalidRaftTimeouts, got %v", err)
 	}
 }
 
-func Test_MetadataMultinode(t *testing.T) {
-	s0 := mustNewStore(true)
-	if err := s0.Open(true); err != nil {
-		t.Fatalf("failed to open single-node store: %s", err.Error())
+func Test_SingleNodeDBSize(t *testing.T) {
+	for _, inmem := range []bool{true, false} {
+		func() {
+			s := mustNewStore(inmem)
+			defer os.RemoveAll(s.Path())
+			if err := s.Open(true); err != nil {
+				t.Fatalf("failed to open single-node store: %s", err.Error())
+			}
+			defer s.Close(true)
+			s.WaitForLeader(10 * time.Second)
+
+			if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+				t.Fatalf("failed to create table: %s", err.Error())
+			}
+			baseline, err := s.DBSize()
+			if err != nil {
+				t.Fatalf("failed to get database size: %s", err.Error())
+			}
+			if baseline == 0 {
+				t.Fatalf("database size not set, in-memory %t", inmem)
+			}
+
+			params := make([][]Value, 500)
+			for i := range params {
+				params[i] = []Value{strings.Repeat("fiona", 20)}
+			}
+			if _, err := s.ExecuteBatch(&BatchExecuteRequest{Stmt: `INSERT INTO foo(name) VALUES(?)`, Parameters: params}); err != nil {
+				t.Fatalf("failed to insert rows: %s", err.Error())
+			}
+			size, err := s.DBSize()
+			if err != nil {
+				t.Fatalf("failed to get database size: %s", err.Error())
+			}
+			if size <= baseline {
+				t.Fatalf("database size did not grow, in-memory %t, baseline %d, now %d", inmem, baseline, size)
+			}
+
+			st, err := s.Stats()
+			if err != nil {
+				t.Fatalf("failed to get stats: %s", err.Error())
+			}
+			if got := st["db_size"].(int64); got != size {
+				t.Fatalf("wrong database size in stats, exp %d, got %d", size, got)
+			}
+		}()
 	}
-	defer s0.Close(true)
-	s0.WaitForLeader(10 * time.Second)
-	s1 := mustNewStore(true)
-	if err := s1.Open(true); err != nil {
+}
+
+func Test_SingleNodeStats(t *testing.T) {
+	s := mustNewStore(false)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
 		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	defer s1.Close(true)
-	s1.WaitForLeader(10 * time.Second)
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
 
-	if s0.Metadata(s0.raftID, "foo") != "" {
-		t.Fatal("nonexistent metadata foo found")
+	queries := stmtsFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	})
+	if _, err := s.Execute(&ExecuteRequest{Stmts: queries}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
 	}
-	if s0.Metadata("nonsense", "foo") != "" {
-		t.Fatal("nonexistent metadata foo found for nonexistent node")
+	if _, err := s.Snapshot(); err != nil {
+		t.Fatalf("failed to snapshot single node: %s", err.Error())
 	}
 
-	if err := s0.SetMetadata(map[string]string{"foo": "bar"}); err != nil {
-		t.Fatalf("failed to set metadata: %s", err.Error())
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %s", err.Error())
 	}
-	if s0.Metadata(s0.raftID, "foo") != "bar" {
-		t.Fatal("key foo not found")
+	for _, k := range []string{"num_snapshots", "applied_index", "last_log_index",
+		"fsm_apply_duration", "num_nodes", "leader", "db_size"} {
+		if _, ok := st[k]; !ok {
+			t.Fatalf("stats missing key %s", k)
+		}
 	}
-	if s0.Metadata("nonsense", "foo") != "" {
-		t.Fatal("nonexistent metadata foo found for nonexistent node")
+	if got, exp := st["num_snapshots"].(int64), int64(1); got != exp {
+		t.Fatalf("wrong number of snapshots, got %d, exp %d", got, exp)
 	}
-
-	// Join the second node to the first.
-	meta := map[string]string{"baz": "qux"}
-	if err := s0.Join(s1.ID(), s1.Addr(), true, meta); err != nil {
-		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	if got, exp := st["num_nodes"].(int), 1; got != exp {
+		t.Fatalf("wrong number of nodes, got %d, exp %d", got, exp)
 	}
-	s1.WaitForLeader(10 * time.Second)
-	// Wait until the log entries have been applied to the follower,
-	// and then query.
-	if err := s1.WaitForAppliedIndex(5, 5*time.Second); err != nil {
-		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+	if st["applied_index"].(uint64) == 0 || st["last_log_index"].(uint64) == 0 {
+		t.Fatalf("applied or last log index not set")
+	}
+	if st["db_size"].(int64) == 0 {
+		t.Fatalf("database size not set")
 	}
+	if got, exp := st["leader"].(map[string]string)["addr"], s.Addr(); got != exp {
+		t.Fatalf("wrong leader address, got %s, exp %s", got, exp)
+	}
+}
 
-	if s1.Metadata(s0.raftID, "foo") != "bar" {
-		t.Fatal("key foo not found for s0")
+func Test_SingleNodeTableRowCounts(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
 	}
-	if s0.Metadata(s1.raftID, "baz") != "qux" {
-		t.Fatal("key baz not found for s1")
+	defer s.Close(true)
+	s.WaitForLeader(10 * time.Second)
+
+	if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)}); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if exp, got := `{"foo":0}`, asJSON(s.TableRowCounts()); exp != got {
+		t.Fatalf("unexpected table row counts\nexp: %s\ngot: %s", exp, got)
 	}
 
-	// Remove a node.
-	if err := s0.Remove(s1.ID()); err != nil {
-		t.Fatalf("failed to remove %s from cluster: %s", s1.ID(), err.Error())
+	for i := 0; i < 10; i++ {
+		stmts := []string{`INSERT INTO foo(name) VALUES("fiona")`, `INSERT INTO foo(name) VALUES("declan")`}
+		if i%3 == 0 {
+			stmts = append(stmts, `DELETE FROM foo WHERE id = (SELECT MIN(id) FROM foo)`)
+		}
+		if _, err := s.Execute(&ExecuteRequest{Stmts: stmtsFromStrings(stmts)}); err != nil {
+			t.Fatalf("failed to execute on single node: %s", err.Error())
+		}
 	}
-	if s1.Metadata(s0.raftID, "foo") != "bar" {
-		t.Fatal("key foo not found for s0")
+
+	r, err := s.Query(&QueryRequest{Stmts: stmtsFromString(`SELECT COUNT(*) FROM foo`), Lvl: None})
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
 	}
-	if s0.Metadata(s1.raftID, "baz") != "" {
-		t.Fatal("key baz found for removed node s1")
+	actual := r[0].Values[0][0].(int64)
+	if actual != 16 {
+		t.Fatalf("unexpected row count, exp 16, got %d", actual)
+	}
+	if got := s.TableRowCounts()["foo"]; got < actual-1 || got > actual+1 {
+		t.Fatalf("table row count %d does not track actual row count %d", got, actual)
 	}
 }
 
@@ -1125,25 +6676,91 @@ func Test_State(t *testing.T) {
 }
 
 func mustNewStore(inmem bool) *Store {
+	return mustNewStoreWithConfig(inmem, &StoreConfig{})
+}
+
+// mustNewStoreWithConfig returns a Store created with the given config. The
+// directory and ID are always set, as is the DBConfig, unless already set.
+func mustNewStoreWithConfig(inmem bool, c *StoreConfig) *Store {
 	path := mustTempDir()
 	defer os.RemoveAll(path)
 
-	cfg := NewDBConfig("", inmem)
-	s := New(mustMockLister("localhost:0"), &StoreConfig{
-		DBConf: cfg,
-		Dir:    path,
-		ID:     path, // Could be any unique string.
-	})
+	if c.DBConf == nil {
+		c.DBConf = NewDBConfig("", inmem)
+	}
+	c.Dir = path
+	c.ID = path // Could be any unique string.
+	s := New(mustMockLister("localhost:0"), c)
 	if s == nil {
 		panic("failed to create new store")
 	}
 	return s
 }
 
+// mockLogger is a Logger which records every event logged.
+type mockLogger struct {
+	mu  sync.Mutex
+	evs []string
+}
+
+func (m *mockLogger) Debug(msg string, kv ...interface{}) { m.log("DEBUG", msg, kv) }
+func (m *mockLogger) Info(msg string, kv ...interface{})  { m.log("INFO", msg, kv) }
+func (m *mockLogger) Warn(msg string, kv ...interface{})  { m.log("WARN", msg, kv) }
+func (m *mockLogger) Error(msg string, kv ...interface{}) { m.log("ERROR", msg, kv) }
+
+func (m *mockLogger) log(level, msg string, kv []interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.evs = append(m.evs, fmt.Sprint(append([]interface{}{level, msg}, kv...)))
+}
+
+func (m *mockLogger) logged(level, msg string, kv ...interface{}) bool {
+	ev := fmt.Sprint(append([]interface{}{level, msg}, kv...))
+	for _, e := range m.events() {
+		if e == ev {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mockLogger) events() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.evs...)
+}
+
 type mockSnapshotSink struct {
 	*os.File
 }
 
+// cancellingSnapshotSink calls onWrite just before its first write, and
+// records whether it was closed or cancelled.
+type cancellingSnapshotSink struct {
+	mockSnapshotSink
+	onWrite   func()
+	closed    bool
+	cancelled bool
+}
+
+func (c *cancellingSnapshotSink) Write(p []byte) (int, error) {
+	if c.onWrite != nil {
+		c.onWrite()
+		c.onWrite = nil
+	}
+	return c.mockSnapshotSink.Write(p)
+}
+
+func (c *cancellingSnapshotSink) Close() error {
+	c.closed = true
+	return c.mockSnapshotSink.Close()
+}
+
+func (c *cancellingSnapshotSink) Cancel() error {
+	c.cancelled = true
+	return c.mockSnapshotSink.File.Close()
+}
+
 func (m *mockSnapshotSink) ID() string {
 	return "1"
 }
@@ -1203,7 +6820,7 @@ func stmtsFromString(s string) []Statement {
 func stmtsFromStrings(s []string) []Statement {
 	stmts := make([]Statement, len(s))
 	for i, ss := range s {
-		stmts[i] = Statement{ss, nil}
+		stmts[i] = Statement{Query: ss}
 	}
 	return stmts
 }
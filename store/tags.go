@@ -0,0 +1,97 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxStatsTags is the maximum number of distinct tags for which stats
+	// are recorded, so that clients cannot grow the stats without bound.
+	maxStatsTags = 64
+
+	// otherStatsTag is the tag under which the stats of requests are
+	// recorded once maxStatsTags distinct tags have been seen.
+	otherStatsTag = "_other"
+)
+
+// tagStat holds the stats recorded for one tag.
+type tagStat struct {
+	queries  *histogram // Time taken by tagged Queries, end to end.
+	executes *histogram // Time taken by tagged Executes, end to end.
+	errors   uint64     // Tagged requests which returned an error.
+}
+
+// tagStats holds the stats of tagged requests, by tag. The zero value is
+// ready for use. It is safe for concurrent use.
+type tagStats struct {
+	mu   sync.Mutex
+	tags map[string]*tagStat
+}
+
+// observeQuery records a query with the given tag, which took the time
+// since start, and returned err.
+func (t *tagStats) observeQuery(tag string, start time.Time, err error) {
+	t.observe(tag, start, err, true)
+}
+
+// observeExecute records an execute with the given tag, which took the time
+// since start, and returned err.
+func (t *tagStats) observeExecute(tag string, start time.Time, err error) {
+	t.observe(tag, start, err, false)
+}
+
+func (t *tagStats) observe(tag string, start time.Time, err error, query bool) {
+	ts := t.stat(tag)
+	if query {
+		ts.queries.Since(start)
+	} else {
+		ts.executes.Since(start)
+	}
+	if err != nil {
+		t.mu.Lock()
+		ts.errors++
+		t.mu.Unlock()
+	}
+}
+
+// stat returns the stats of tag, created if need be, or those of
+// otherStatsTag if there are already maxStatsTags distinct tags.
+func (t *tagStats) stat(tag string) *tagStat {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tags == nil {
+		t.tags = make(map[string]*tagStat)
+	}
+	if ts, ok := t.tags[tag]; ok {
+		return ts
+	}
+	if len(t.tags) >= maxStatsTags {
+		tag = otherStatsTag
+		if ts, ok := t.tags[tag]; ok {
+			return ts
+		}
+	}
+	ts := &tagStat{queries: newHistogram(), executes: newHistogram()}
+	t.tags[tag] = ts
+	return ts
+}
+
+// Stats returns the stats of each tag, keyed by tag, or nil if no tagged
+// request has been recorded.
+func (t *tagStats) Stats() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.tags) == 0 {
+		return nil
+	}
+	stats := make(map[string]interface{}, len(t.tags))
+	for tag, ts := range t.tags {
+		stats[tag] = map[string]interface{}{
+			"query":   ts.queries.Stats(),
+			"execute": ts.executes.Stats(),
+			"errors":  ts.errors,
+		}
+	}
+	return stats
+}
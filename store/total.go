@@ -0,0 +1,105 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	sql "github.com/rqlite/rqlite/db"
+)
+
+// withTotals returns a copy of qr in which each statement is followed by a
+// statement counting the rows it would return without any LIMIT, so that
+// both are read at the same consistency level, and within any transaction
+// of qr. A statement whose LIMIT cannot be removed is counted with a query
+// returning no rows, so that results stay paired.
+func withTotals(qr *QueryRequest) *QueryRequest {
+	tqr := *qr
+	tqr.Stmts = make([]Statement, 0, 2*len(qr.Stmts))
+	for _, stmt := range qr.Stmts {
+		tqr.Stmts = append(tqr.Stmts, stmt, totalStatement(stmt))
+	}
+	return &tqr
+}
+
+// foldTotals sets the Total field of the rows of each statement from the
+// rows of the count which follows it, and returns the rows of the statements
+// alone.
+func foldTotals(rows []*sql.Rows) []*sql.Rows {
+	folded := make([]*sql.Rows, 0, len(rows)/2)
+	for i := 0; i+1 < len(rows); i += 2 {
+		r, c := rows[i], rows[i+1]
+		if r.Error == "" && c.Error == "" && len(c.Values) == 1 && len(c.Values[0]) == 1 {
+			if n, ok := c.Values[0][0].(int64); ok {
+				r.Total = &n
+			}
+		}
+		folded = append(folded, r)
+	}
+	return folded
+}
+
+// totalStatement returns the statement counting the rows stmt would return
+// without any LIMIT. A blank statement is counted by a blank statement, as
+// neither returns any rows.
+func totalStatement(stmt Statement) Statement {
+	if stmt.Query == "" {
+		return stmt
+	}
+	inner, params, ok := stripLimit(stmt.Query, stmt.Parameters)
+	if !ok {
+		return Statement{Query: `SELECT NULL WHERE 0`, Lvl: stmt.Lvl}
+	}
+	return Statement{
+		Query:      fmt.Sprintf(`SELECT COUNT(*) FROM (%s)`, inner),
+		Parameters: params,
+		Lvl:        stmt.Lvl,
+	}
+}
+
+// stripLimit returns query without any LIMIT clause of its outermost SELECT,
+// and params without the parameters bound to that clause. It returns false
+// if query is not a single statement, or the clause binds parameters other
+// than by plain positional "?" placeholders, as then it cannot tell which
+// parameters belong to the clause.
+func stripLimit(query string, params []Value) (string, []Value, bool) {
+	q := strings.TrimRight(strings.TrimSpace(query), "; \t\r\n")
+	limit := -1
+	var placeholders []int // Positions of "?" outside strings.
+	single := true
+	scanSQL(q, func(i, depth int) bool {
+		switch {
+		case q[i] == ';':
+			single = false
+			return false
+		case q[i] == '?':
+			placeholders = append(placeholders, i)
+		case depth == 0 && isKeywordAt(q, i, "LIMIT"):
+			limit = i
+		}
+		return true
+	})
+	if !single {
+		return "", nil, false
+	}
+	if limit < 0 {
+		return q, params, true
+	}
+
+	tail := q[limit:]
+	if strings.ContainsAny(tail, ":@$") {
+		return "", nil, false
+	}
+	n := 0
+	for _, p := range placeholders {
+		if p > limit {
+			if p+1 < len(q) && q[p+1] >= '0' && q[p+1] <= '9' {
+				return "", nil, false
+			}
+			n++
+		}
+	}
+	if n > len(params) {
+		return "", nil, false
+	}
+	return strings.TrimSpace(q[:limit]), params[:len(params)-n], true
+}
@@ -1,7 +1,11 @@
 package store
 
 import (
+	"bufio"
+	"crypto/tls"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
@@ -44,3 +48,267 @@ func (t *Transport) Close() error {
 func (t *Transport) Addr() net.Addr {
 	return t.ln.Addr()
 }
+
+// TLSListener is a Listener which encrypts all connections made through
+// another Listener. Connections accepted by it act as the server side of
+// the TLS session, and connections dialed by it as the client side, each
+// using the same config. Peers may therefore be authenticated by setting
+// ClientAuth and ClientCAs, along with Certificates and RootCAs.
+type TLSListener struct {
+	Listener
+	config *tls.Config
+}
+
+// NewTLSListener returns a TLSListener which wraps ln, and uses config for
+// all connections.
+func NewTLSListener(ln Listener, config *tls.Config) *TLSListener {
+	return &TLSListener{
+		Listener: ln,
+		config:   config,
+	}
+}
+
+// Accept waits for the next connection. The TLS handshake is performed when
+// the connection is first read from or written to.
+func (l *TLSListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.config), nil
+}
+
+// Dial creates a new network connection, and completes the TLS handshake
+// with the remote node, all within timeout.
+func (l *TLSListener) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	start := time.Now()
+	conn, err := l.Listener.Dial(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	config := l.config
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if timeout > 0 {
+		tlsConn.SetDeadline(start.Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// throttledTransport is a Raft transport which limits the rate at which
+// snapshots are sent to other nodes. All other traffic is unaffected.
+type throttledTransport struct {
+	*raft.NetworkTransport
+	rate int64 // Bytes per second.
+}
+
+// InstallSnapshot sends a snapshot to target, reading data no faster than
+// the rate of the transport.
+func (t *throttledTransport) InstallSnapshot(id raft.ServerID, target raft.ServerAddress,
+	args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
+	return t.NetworkTransport.InstallSnapshot(id, target, args, resp, newThrottledReader(data, t.rate))
+}
+
+// throttledReader is a Reader which returns data from another Reader no
+// faster than a given rate.
+type throttledReader struct {
+	r     io.Reader
+	rate  int64 // Bytes per second.
+	start time.Time
+	n     int64 // Bytes read since start.
+}
+
+// newThrottledReader returns a Reader which reads from r at most rate bytes
+// per second.
+func newThrottledReader(r io.Reader, rate int64) *throttledReader {
+	return &throttledReader{r: r, rate: rate}
+}
+
+// Read reads at most one second's worth of data, and then waits until the
+// data read so far is no more than the rate allows.
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+	return n, err
+}
+
+// peerContact is what this node last learnt of another node from Raft's own
+// traffic with it.
+type peerContact struct {
+	Time    time.Time // When the node last responded.
+	LastLog uint64    // Index of the last entry in the node's log, as it last reported.
+}
+
+// contactTransport is a Raft transport which records the responses of other
+// nodes to the AppendEntries RPCs Raft sends them, which include the regular
+// heartbeats of a leader to every other node, voter or not. No RPCs are sent
+// by the transport itself.
+type contactTransport struct {
+	raft.Transport
+
+	mu       sync.Mutex
+	contacts map[raft.ServerID]peerContact
+}
+
+// newContactTransport returns a contactTransport which wraps trans.
+func newContactTransport(trans raft.Transport) *contactTransport {
+	return &contactTransport{
+		Transport: trans,
+		contacts:  make(map[raft.ServerID]peerContact),
+	}
+}
+
+// AppendEntries sends the RPC to target, and records the response, if any.
+func (t *contactTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress,
+	args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	if err := t.Transport.AppendEntries(id, target, args, resp); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.contacts[id] = peerContact{Time: time.Now(), LastLog: resp.LastLog}
+	return nil
+}
+
+// Contact returns what was last learnt of the node with the given ID, if
+// it has ever responded.
+func (t *contactTransport) Contact(id raft.ServerID) (peerContact, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.contacts[id]
+	return c, ok
+}
+
+// Forget discards what was learnt of the node with the given ID.
+func (t *contactTransport) Forget(id raft.ServerID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.contacts, id)
+}
+
+// Close closes the wrapped transport, if it may be closed.
+func (t *contactTransport) Close() error {
+	if c, ok := t.Transport.(raft.WithClose); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// rpcSetMetadata begins a connection by which a node asks the leader to set
+// its metadata. Connections made by Raft begin with one of Raft's own RPC
+// types, all of which are lower.
+const rpcSetMetadata byte = 0xff
+
+// rpcListener is a Listener which serves the Store's own RPCs, made on
+// connections to the Raft address, and passes every other connection on to
+// Raft. The first byte of each connection decides which it is.
+type rpcListener struct {
+	Listener
+	serve func(net.Conn) // Serves a connection carrying rpcSetMetadata.
+
+	once  sync.Once
+	conns chan net.Conn
+	done  chan struct{} // Closed once the wrapped Listener fails.
+	err   error         // Why the wrapped Listener failed, set before done is closed.
+}
+
+// newRPCListener returns an rpcListener which wraps ln, and passes each
+// connection carrying rpcSetMetadata to serve, once the byte is read.
+func newRPCListener(ln Listener, serve func(net.Conn)) *rpcListener {
+	return &rpcListener{
+		Listener: ln,
+		serve:    serve,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+// Accept waits for the next connection for Raft.
+func (l *rpcListener) Accept() (net.Conn, error) {
+	l.once.Do(func() { go l.accept() })
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// accept accepts connections from the wrapped Listener until it fails,
+// routing each from its own goroutine, so a slow client delays no other.
+func (l *rpcListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+// route reads the first byte of conn, and passes conn to serve, or on to
+// Raft with the byte still to be read.
+func (l *rpcListener) route(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(connectionTimeout))
+	b, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if b[0] == rpcSetMetadata {
+		br.Discard(1)
+		l.serve(&bufferedConn{Conn: conn, r: br})
+		return
+	}
+	select {
+	case l.conns <- &bufferedConn{Conn: conn, r: br}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// bufferedConn is a connection whose reads are served by r, which holds
+// any data already read from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads data from the connection.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -1,7 +1,17 @@
 package store
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
 	"testing"
+	"time"
 )
 
 func Test_NewTransport(t *testing.T) {
@@ -9,3 +19,210 @@ func Test_NewTransport(t *testing.T) {
 		t.Fatal("failed to create new Transport")
 	}
 }
+
+func Test_MultiNodeJoinTLS(t *testing.T) {
+	config := mustTLSConfig()
+
+	s0 := mustNewStoreWithConfig(true, &StoreConfig{TLSConfig: config})
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	s1 := mustNewStoreWithConfig(true, &StoreConfig{TLSConfig: config})
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if _, err := s1.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("failed to wait for leader on joined node: %s", err.Error())
+	}
+
+	results, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)})
+	if err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if err := s1.WaitForAppliedIndex(results[0].RaftIndex, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s", err.Error())
+	}
+}
+
+func Test_MultiNodeJoinSnapshotTransferRate(t *testing.T) {
+	const rate = 32 * 1024
+	s0 := mustNewStoreWithConfig(true, &StoreConfig{SnapshotTransferRate: rate, TrailingLogs: 1})
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	s0.WaitForLeader(10 * time.Second)
+
+	stmts := []string{`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, data BLOB)`}
+	for i := 0; i < 64; i++ {
+		stmts = append(stmts, `INSERT INTO foo(data) VALUES(randomblob(1024))`)
+	}
+	if _, err := s0.Execute(&ExecuteRequest{Stmts: stmtsFromStrings(stmts)}); err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	if err := s0.TriggerSnapshot(); err != nil {
+		t.Fatalf("failed to snapshot leader: %s", err.Error())
+	}
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	start := time.Now()
+	if err := s0.Join(s1.ID(), s1.Addr(), true, nil); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+	if err := s1.WaitForBarrier(s0.raft.LastIndex(), 20*time.Second); err != nil {
+		t.Fatalf("joined node failed to catch up: %s", err.Error())
+	}
+	if s1.raft.Stats()["last_snapshot_index"] == "0" {
+		t.Fatalf("snapshot not transferred to joined node")
+	}
+
+	// The snapshot holds at least the 64KB inserted, so takes 2 seconds to send.
+	if d := time.Since(start); d < 2*time.Second {
+		t.Fatalf("snapshot transferred in %s, faster than rate allows", d)
+	}
+
+	qr := &QueryRequest{Stmts: stmtsFromString(`SELECT id, hex(data) FROM foo ORDER BY id`), Lvl: None}
+	exp, err := s0.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query leader: %s", err.Error())
+	}
+	got, err := s1.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query joined node: %s", err.Error())
+	}
+	if len(got[0].Values) != 64 || asJSON(exp) != asJSON(got) {
+		t.Fatalf("data on joined node does not match leader")
+	}
+}
+
+func Test_TLSListenerRejectsPlaintext(t *testing.T) {
+	ln := NewTLSListener(mustMockLister("localhost:0"), mustTLSConfig())
+	defer ln.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		errCh <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial TLS listener: %s", err.Error())
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("plaintext raft traffic\n")); err != nil {
+		t.Fatalf("failed to write to TLS listener: %s", err.Error())
+	}
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("TLS handshake succeeded with plaintext connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for TLS handshake")
+	}
+}
+
+func Test_TLSListenerRequiresClientCert(t *testing.T) {
+	config := mustTLSConfig()
+	ln := NewTLSListener(mustMockLister("localhost:0"), config)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	// A peer trusting the same CA, but with no certificate of its own.
+	noCert := &tls.Config{RootCAs: config.RootCAs}
+	dialer := NewTLSListener(mustMockLister("localhost:0"), noCert)
+	defer dialer.Close()
+	conn, err := dialer.Dial(ln.Addr().String(), time.Second)
+	if err == nil {
+		// TLS 1.3 reports a rejected client certificate on first read.
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatalf("successfully connected without a client certificate")
+	}
+}
+
+// mustTLSConfig returns a config for mutual TLS, presenting and requiring
+// a certificate for 127.0.0.1 signed by a CA created for the test.
+func mustTLSConfig() *tls.Config {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("failed to generate CA key")
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rqlite test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		panic("failed to create CA certificate")
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		panic("failed to parse CA certificate")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("failed to generate node key")
+	}
+	node := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "rqlite test node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	nodeDER, err := x509.CreateCertificate(rand.Reader, node, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		panic("failed to create node certificate")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{nodeDER}, PrivateKey: key}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
@@ -176,7 +176,7 @@ func Test_SingleParameterizedNode(t *testing.T) {
 }
 
 // Test_SingleNodeSQLInjection demonstrates that using the non-parameterized API is vulnerable to
-// SQL injection attacks.
+// SQL injection attacks, though statements injected into a query cannot modify the database.
 func Test_SingleNodeSQLInjection(t *testing.T) {
 	node := mustNewLeaderNode()
 	defer node.Deprovision()
@@ -198,12 +198,12 @@ func Test_SingleNodeSQLInjection(t *testing.T) {
 		},
 		{
 			stmt:     fmt.Sprintf(`SELECT * FROM foo WHERE name=%s`, `"baz";DROP TABLE FOO`),
-			expected: `{"results":[{}]}`,
+			expected: `{"results":[{"error":"attempt to write a readonly database"}]}`,
 			execute:  false,
 		},
 		{
 			stmt:     `SELECT * FROM foo`,
-			expected: `{"results":[{"error":"no such table: foo"}]}`,
+			expected: `{"results":[{"columns":["id","name"],"types":["integer","text"]}]}`,
 			execute:  false,
 		},
 	}